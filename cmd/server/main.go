@@ -1,15 +1,316 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
 	"x-swap/internal/service"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+const (
+	mainnetChainID  = 1
+	arbitrumChainID = 42161
+	baseChainID     = 8453
 )
 
 func main() {
-	blockchainService := service.NewBlockchainService(
-		"https://eth.llamarpc.com",
-		common.HexToAddress("0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48"),
+	checkpointDir := flag.String("checkpoint-dir", ".", "directory storing the last indexed block of every chain")
+	backfillChain := flag.Uint64("backfill-chain", mainnetChainID, "chain to re-scan for missed deposits")
+	backfillFrom := flag.Uint64("backfill-from", 0, "first block to re-scan for missed deposits")
+	backfillTo := flag.Uint64("backfill-to", 0, "last block to re-scan for missed deposits")
+	depositXpub := flag.String("deposit-xpub", "", "account xpub (m/44'/60'/0') deposit addresses are derived from")
+	depositAddressFile := flag.String("deposit-addresses", "deposit-addresses.json", "file storing the deposit addresses handed out and the next derivation index")
+	wsURL := flag.String("ws-url", "", "mainnet WebSocket RPC endpoint, enables subscriptions instead of polling")
+	traceInternal := flag.Bool("trace-internal", false, "detect internal ETH transfers on mainnet with debug_traceBlockByHash")
+	settlementContract := flag.String("settlement-contract", "", "mainnet settlement contract address, enables on-chain settlement of fills")
+	exchangeWallets := flag.String("exchange-wallets", "", "comma separated exchange wallet addresses holding user funds")
+	reconcile := flag.Bool("reconcile", false, "reconcile internal balances with on-chain holdings once after the backfill, print the report and exit, non-zero on discrepancies")
+	reconcileBlocks := flag.String("reconcile-blocks", "", "blocks to pin per chain as chainID=block pairs, e.g. 1=19000000,8453=12000000")
+	reconcileInterval := flag.Duration("reconcile-interval", 0, "reconcile on this schedule while running, 0 disables it")
+	reconcileThresholds := flag.String("reconcile-thresholds", "", "tolerated delta per asset in its smallest unit, e.g. USDC=1000000")
+	flag.Parse()
+
+	chainConfigs := []service.ChainConfig{
+		{
+			Name:          "mainnet",
+			ChainID:       mainnetChainID,
+			RPCURLs:       []string{"https://eth.llamarpc.com", "https://ethereum-rpc.publicnode.com"},
+			WebSocketURL:  *wsURL,
+			Confirmations: 12,
+		},
+		{
+			Name:          "arbitrum",
+			ChainID:       arbitrumChainID,
+			RPCURLs:       []string{"https://arb1.arbitrum.io/rpc", "https://arbitrum-one-rpc.publicnode.com"},
+			Confirmations: 20,
+		},
+		{
+			Name:          "base",
+			ChainID:       baseChainID,
+			RPCURLs:       []string{"https://mainnet.base.org", "https://base-rpc.publicnode.com"},
+			Confirmations: 20,
+		},
+	}
+
+	tokenRegistry := service.NewTokenRegistry()
+	tokens := []struct {
+		symbol   string
+		chainID  uint64
+		address  common.Address
+		decimals int
+	}{
+		{"USDC", mainnetChainID, common.HexToAddress("0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48"), 6},
+		{"USDC", arbitrumChainID, common.HexToAddress("0xaf88d065e77c8cC2239327C5EDb3A432268e5831"), 6},
+		{"USDC", baseChainID, common.HexToAddress("0x833589fCD6eDb6E08f4c7C32D4a71E413bCbBf02"), 6},
+		{"ETH", mainnetChainID, service.NativeTokenAddress, 18},
+		{"ETH", arbitrumChainID, service.NativeTokenAddress, 18},
+		{"ETH", baseChainID, service.NativeTokenAddress, 18},
+	}
+	for _, token := range tokens {
+		if _, err := tokenRegistry.RegisterToken(token.symbol, token.chainID, token.address, token.decimals); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	marketService := service.NewMarketService()
+	userService := service.NewUserService()
+	orderService := service.NewOrderService()
+	chainSupervisor := service.NewChainSupervisor()
+	for _, config := range chainConfigs {
+		config.CheckpointPath = filepath.Join(*checkpointDir, fmt.Sprintf("checkpoint-%d.json", config.ChainID))
+		blockchainService, err := service.NewChainBlockchainService(config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := chainSupervisor.AddChain(blockchainService); err != nil {
+			log.Fatal(err)
+		}
+	}
+	mainnetService, err := chainSupervisor.GetChain(mainnetChainID)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	serviceRegistry := service.NewServiceRegistry(
+		marketService,
+		userService,
+		orderService,
+		mainnetService,
 	)
-	blockchainService.Start()
+	serviceRegistry.SetTokenRegistry(tokenRegistry)
+	serviceRegistry.SetChainSupervisor(chainSupervisor)
+	reservesService := service.NewReservesService()
+	reservesService.SetServiceRegistry(serviceRegistry)
+	serviceRegistry.SetReservesService(reservesService)
+	marketService.SetServiceRegistry(serviceRegistry)
+	userService.SetServiceRegistry(serviceRegistry)
+	orderService.SetServiceRegistry(serviceRegistry)
+	chainSupervisor.SetServiceRegistry(serviceRegistry)
+	// orders are signed for the settlement contract they can be settled by
+	userService.SetOrderDomain(service.OrderDomain{
+		Name:              "x-swap",
+		Version:           "1",
+		ChainID:           mainnetChainID,
+		VerifyingContract: common.HexToAddress(*settlementContract),
+	})
+	if *depositXpub != "" {
+		depositWallet, err := service.NewHDWallet(*depositXpub)
+		if err != nil {
+			log.Fatal(err)
+		}
+		userService.SetDepositWallet(depositWallet)
+	}
+	if err := userService.SetDepositAddressStore(service.NewFileDepositAddressStore(*depositAddressFile)); err != nil {
+		log.Fatal(err)
+	}
+	if *traceInternal {
+		rpcClient, err := rpc.Dial(chainConfigs[0].RPCURLs[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		mainnetService.SetCallTracer(service.NewRPCCallTracer(rpcClient))
+	}
+
+	// the hot wallet key is read from the environment, never from flags
+	if hotWalletKey := os.Getenv("HOT_WALLET_KEY"); hotWalletKey != "" {
+		key, err := crypto.HexToECDSA(hotWalletKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pool, err := service.DialRPCPool(context.Background(), chainConfigs[0].RPCURLs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go pool.Run(15 * time.Second)
+		withdrawalService := service.NewWithdrawalService(pool, key)
+		withdrawalService.SetServiceRegistry(serviceRegistry)
+		serviceRegistry.SetWithdrawalService(withdrawalService)
+		go withdrawalService.Start()
+	}
+
+	// the key encrypting the api key secrets is read from the environment, never from flags
+	if apiKeySecretKey := os.Getenv("API_KEY_SECRET_KEY"); apiKeySecretKey != "" {
+		secretKey, err := hex.DecodeString(apiKeySecretKey)
+		if err != nil {
+			log.Fatalf("API_KEY_SECRET_KEY: %v", err)
+		}
+		apiKeyService, err := service.NewAPIKeyService(secretKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		apiKeyService.SetServiceRegistry(serviceRegistry)
+		serviceRegistry.SetAPIKeyService(apiKeyService)
+	}
+
+	// the settlement operator key is read from the environment, never from flags
+	if *settlementContract != "" {
+		if !common.IsHexAddress(*settlementContract) {
+			log.Fatalf("invalid settlement contract address %q", *settlementContract)
+		}
+		key, err := crypto.HexToECDSA(os.Getenv("SETTLEMENT_OPERATOR_KEY"))
+		if err != nil {
+			log.Fatalf("SETTLEMENT_OPERATOR_KEY: %v", err)
+		}
+		client, err := ethclient.Dial(chainConfigs[0].RPCURLs[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		settlementService, err := service.NewSettlementService(client, common.HexToAddress(*settlementContract), key)
+		if err != nil {
+			log.Fatal(err)
+		}
+		settlementService.SetServiceRegistry(serviceRegistry)
+		serviceRegistry.SetSettlementService(settlementService)
+		orderService.SubscribeFills(settlementService.QueueFill)
+		go settlementService.Start()
+	}
+
+	wallets, err := parseAddresses(*exchangeWallets)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if withdrawalService, err := serviceRegistry.GetWithdrawalService(); err == nil {
+		wallets = append(wallets, withdrawalService.HotWalletAddress())
+	}
+	reconciliationService := service.NewReconciliationService(wallets)
+	reconciliationService.SetServiceRegistry(serviceRegistry)
+	thresholds, err := parseThresholds(*reconcileThresholds)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for asset, threshold := range thresholds {
+		reconciliationService.SetThreshold(asset, threshold)
+	}
+
+	// deposits are matched against the deposit addresses restored above
+	if *backfillTo > 0 {
+		backfillService, err := chainSupervisor.GetChain(*backfillChain)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := backfillService.WatchRegisteredTokens(); err != nil {
+			log.Fatal(err)
+		}
+		if err := backfillService.Backfill(*backfillFrom, *backfillTo); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// balances only exist once deposits are credited, so the one-shot run
+	// reconciles what the backfill credited, pinned to its last block
+	if *reconcile {
+		blocks, err := parseChainBlocks(*reconcileBlocks)
+		if err != nil {
+			log.Fatal(err)
+		}
+		report, err := reconciliationService.Reconcile(blocks)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Print(report)
+		if len(report.Discrepancies()) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	if *reconcileInterval > 0 {
+		reconciliationService.SetInterval(*reconcileInterval)
+		go reconciliationService.Start()
+	}
+
+	go userService.SweepExpiredOrders(time.Minute)
+	chainSupervisor.Start()
+}
+
+func parseAddresses(value string) ([]common.Address, error) {
+	addresses := []common.Address{}
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !common.IsHexAddress(field) {
+			return nil, fmt.Errorf("invalid address %q", field)
+		}
+		addresses = append(addresses, common.HexToAddress(field))
+	}
+	return addresses, nil
+}
+
+// parseChainBlocks parses chainID=block pairs.
+func parseChainBlocks(value string) (map[uint64]uint64, error) {
+	blocks := make(map[uint64]uint64)
+	for _, field := range strings.Split(value, ",") {
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+		chainID, block, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid chain block %q, expected chainID=block", field)
+		}
+		parsedChainID, err := strconv.ParseUint(chainID, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chain ID in %q: %w", field, err)
+		}
+		parsedBlock, err := strconv.ParseUint(block, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid block in %q: %w", field, err)
+		}
+		blocks[parsedChainID] = parsedBlock
+	}
+	return blocks, nil
+}
+
+// parseThresholds parses asset=amount pairs.
+func parseThresholds(value string) (map[string]*big.Int, error) {
+	thresholds := make(map[string]*big.Int)
+	for _, field := range strings.Split(value, ",") {
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+		asset, amount, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid threshold %q, expected asset=amount", field)
+		}
+		threshold, ok := new(big.Int).SetString(amount, 10)
+		if !ok {
+			return nil, fmt.Errorf("invalid amount in threshold %q", field)
+		}
+		thresholds[asset] = threshold
+	}
+	return thresholds, nil
 }
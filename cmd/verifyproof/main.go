@@ -0,0 +1,57 @@
+// Command verifyproof checks a proof of reserves inclusion proof against the
+// root published by the exchange.
+//
+//	verifyproof -root 0x... proof.json
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"x-swap/internal/service"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+func main() {
+	root := flag.String("root", "", "published liabilities root the proof must lead to (required)")
+	flag.Parse()
+	// the proof carries its own root, only the published one makes it
+	// worth checking
+	if !isHash(*root) {
+		log.Fatal("-root must be the published liabilities root, a 32 byte hex hash")
+	}
+
+	input := io.Reader(os.Stdin)
+	if flag.NArg() > 0 {
+		file, err := os.Open(flag.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer file.Close()
+		input = file
+	}
+
+	var proof service.InclusionProof
+	if err := json.NewDecoder(input).Decode(&proof); err != nil {
+		log.Fatalf("reading proof: %v", err)
+	}
+	if common.HexToHash(*root) != proof.Root {
+		log.Fatalf("proof is for root %s, not the published root %s", proof.Root.Hex(), *root)
+	}
+	if err := service.VerifyInclusionProof(proof); err != nil {
+		log.Fatalf("invalid proof: %v", err)
+	}
+	fmt.Printf("%s balance of %s %s is included in root %s with total liabilities %s\n",
+		proof.User.Hex(), proof.Balance, proof.Asset, proof.Root.Hex(), proof.Total)
+}
+
+func isHash(value string) bool {
+	data, err := hexutil.Decode(value)
+	return err == nil && len(data) == common.HashLength
+}
@@ -0,0 +1,6 @@
+// Package settlement contains the Go bindings of the exchange settlement
+// contract, which transfers the tokens of a batch of matched fills between
+// makers and takers.
+package settlement
+
+//go:generate go run github.com/ethereum/go-ethereum/cmd/abigen --abi Settlement.abi --pkg settlement --type Settlement --out settlement.go
@@ -0,0 +1,389 @@
+// Code generated - DO NOT EDIT.
+// This file is a generated binding and any manual changes will be lost.
+
+package settlement
+
+import (
+	"errors"
+	"math/big"
+	"strings"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/event"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var (
+	_ = errors.New
+	_ = big.NewInt
+	_ = strings.NewReader
+	_ = ethereum.NotFound
+	_ = bind.Bind
+	_ = common.Big1
+	_ = types.BloomLookup
+	_ = event.NewSubscription
+	_ = abi.ConvertType
+)
+
+// SettlementFill is an auto generated low-level Go binding around an user-defined struct.
+type SettlementFill struct {
+	Maker       common.Address
+	Taker       common.Address
+	BaseToken   common.Address
+	QuoteToken  common.Address
+	BaseAmount  *big.Int
+	QuoteAmount *big.Int
+	TakerBuys   bool
+}
+
+// SettlementMetaData contains all meta data concerning the Settlement contract.
+var SettlementMetaData = &bind.MetaData{
+	ABI: "[{\"type\":\"function\",\"name\":\"settleBatch\",\"stateMutability\":\"nonpayable\",\"inputs\":[{\"name\":\"batchId\",\"type\":\"bytes32\",\"internalType\":\"bytes32\"},{\"name\":\"fills\",\"type\":\"tuple[]\",\"internalType\":\"structSettlement.Fill[]\",\"components\":[{\"name\":\"maker\",\"type\":\"address\",\"internalType\":\"address\"},{\"name\":\"taker\",\"type\":\"address\",\"internalType\":\"address\"},{\"name\":\"baseToken\",\"type\":\"address\",\"internalType\":\"address\"},{\"name\":\"quoteToken\",\"type\":\"address\",\"internalType\":\"address\"},{\"name\":\"baseAmount\",\"type\":\"uint256\",\"internalType\":\"uint256\"},{\"name\":\"quoteAmount\",\"type\":\"uint256\",\"internalType\":\"uint256\"},{\"name\":\"takerBuys\",\"type\":\"bool\",\"internalType\":\"bool\"}]}],\"outputs\":[]},{\"type\":\"function\",\"name\":\"isSettled\",\"stateMutability\":\"view\",\"inputs\":[{\"name\":\"batchId\",\"type\":\"bytes32\",\"internalType\":\"bytes32\"}],\"outputs\":[{\"name\":\"\",\"type\":\"bool\",\"internalType\":\"bool\"}]},{\"type\":\"event\",\"name\":\"BatchSettled\",\"anonymous\":false,\"inputs\":[{\"name\":\"batchId\",\"type\":\"bytes32\",\"indexed\":true,\"internalType\":\"bytes32\"},{\"name\":\"fillCount\",\"type\":\"uint256\",\"indexed\":false,\"internalType\":\"uint256\"}]}]",
+}
+
+// SettlementABI is the input ABI used to generate the binding from.
+// Deprecated: Use SettlementMetaData.ABI instead.
+var SettlementABI = SettlementMetaData.ABI
+
+// Settlement is an auto generated Go binding around an Ethereum contract.
+type Settlement struct {
+	SettlementCaller     // Read-only binding to the contract
+	SettlementTransactor // Write-only binding to the contract
+	SettlementFilterer   // Log filterer for contract events
+}
+
+// SettlementCaller is an auto generated read-only Go binding around an Ethereum contract.
+type SettlementCaller struct {
+	contract *bind.BoundContract // Generic contract wrapper for the low level calls
+}
+
+// SettlementTransactor is an auto generated write-only Go binding around an Ethereum contract.
+type SettlementTransactor struct {
+	contract *bind.BoundContract // Generic contract wrapper for the low level calls
+}
+
+// SettlementFilterer is an auto generated log filtering Go binding around an Ethereum contract events.
+type SettlementFilterer struct {
+	contract *bind.BoundContract // Generic contract wrapper for the low level calls
+}
+
+// SettlementSession is an auto generated Go binding around an Ethereum contract,
+// with pre-set call and transact options.
+type SettlementSession struct {
+	Contract     *Settlement       // Generic contract binding to set the session for
+	CallOpts     bind.CallOpts     // Call options to use throughout this session
+	TransactOpts bind.TransactOpts // Transaction auth options to use throughout this session
+}
+
+// SettlementCallerSession is an auto generated read-only Go binding around an Ethereum contract,
+// with pre-set call options.
+type SettlementCallerSession struct {
+	Contract *SettlementCaller // Generic contract caller binding to set the session for
+	CallOpts bind.CallOpts     // Call options to use throughout this session
+}
+
+// SettlementTransactorSession is an auto generated write-only Go binding around an Ethereum contract,
+// with pre-set transact options.
+type SettlementTransactorSession struct {
+	Contract     *SettlementTransactor // Generic contract transactor binding to set the session for
+	TransactOpts bind.TransactOpts     // Transaction auth options to use throughout this session
+}
+
+// SettlementRaw is an auto generated low-level Go binding around an Ethereum contract.
+type SettlementRaw struct {
+	Contract *Settlement // Generic contract binding to access the raw methods on
+}
+
+// SettlementCallerRaw is an auto generated low-level read-only Go binding around an Ethereum contract.
+type SettlementCallerRaw struct {
+	Contract *SettlementCaller // Generic read-only contract binding to access the raw methods on
+}
+
+// SettlementTransactorRaw is an auto generated low-level write-only Go binding around an Ethereum contract.
+type SettlementTransactorRaw struct {
+	Contract *SettlementTransactor // Generic write-only contract binding to access the raw methods on
+}
+
+// NewSettlement creates a new instance of Settlement, bound to a specific deployed contract.
+func NewSettlement(address common.Address, backend bind.ContractBackend) (*Settlement, error) {
+	contract, err := bindSettlement(address, backend, backend, backend)
+	if err != nil {
+		return nil, err
+	}
+	return &Settlement{SettlementCaller: SettlementCaller{contract: contract}, SettlementTransactor: SettlementTransactor{contract: contract}, SettlementFilterer: SettlementFilterer{contract: contract}}, nil
+}
+
+// NewSettlementCaller creates a new read-only instance of Settlement, bound to a specific deployed contract.
+func NewSettlementCaller(address common.Address, caller bind.ContractCaller) (*SettlementCaller, error) {
+	contract, err := bindSettlement(address, caller, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &SettlementCaller{contract: contract}, nil
+}
+
+// NewSettlementTransactor creates a new write-only instance of Settlement, bound to a specific deployed contract.
+func NewSettlementTransactor(address common.Address, transactor bind.ContractTransactor) (*SettlementTransactor, error) {
+	contract, err := bindSettlement(address, nil, transactor, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &SettlementTransactor{contract: contract}, nil
+}
+
+// NewSettlementFilterer creates a new log filterer instance of Settlement, bound to a specific deployed contract.
+func NewSettlementFilterer(address common.Address, filterer bind.ContractFilterer) (*SettlementFilterer, error) {
+	contract, err := bindSettlement(address, nil, nil, filterer)
+	if err != nil {
+		return nil, err
+	}
+	return &SettlementFilterer{contract: contract}, nil
+}
+
+// bindSettlement binds a generic wrapper to an already deployed contract.
+func bindSettlement(address common.Address, caller bind.ContractCaller, transactor bind.ContractTransactor, filterer bind.ContractFilterer) (*bind.BoundContract, error) {
+	parsed, err := SettlementMetaData.GetAbi()
+	if err != nil {
+		return nil, err
+	}
+	return bind.NewBoundContract(address, *parsed, caller, transactor, filterer), nil
+}
+
+// Call invokes the (constant) contract method with params as input values and
+// sets the output to result. The result type might be a single field for simple
+// returns, a slice of interfaces for anonymous returns and a struct for named
+// returns.
+func (_Settlement *SettlementRaw) Call(opts *bind.CallOpts, result *[]interface{}, method string, params ...interface{}) error {
+	return _Settlement.Contract.SettlementCaller.contract.Call(opts, result, method, params...)
+}
+
+// Transfer initiates a plain transaction to move funds to the contract, calling
+// its default method if one is available.
+func (_Settlement *SettlementRaw) Transfer(opts *bind.TransactOpts) (*types.Transaction, error) {
+	return _Settlement.Contract.SettlementTransactor.contract.Transfer(opts)
+}
+
+// Transact invokes the (paid) contract method with params as input values.
+func (_Settlement *SettlementRaw) Transact(opts *bind.TransactOpts, method string, params ...interface{}) (*types.Transaction, error) {
+	return _Settlement.Contract.SettlementTransactor.contract.Transact(opts, method, params...)
+}
+
+// Call invokes the (constant) contract method with params as input values and
+// sets the output to result. The result type might be a single field for simple
+// returns, a slice of interfaces for anonymous returns and a struct for named
+// returns.
+func (_Settlement *SettlementCallerRaw) Call(opts *bind.CallOpts, result *[]interface{}, method string, params ...interface{}) error {
+	return _Settlement.Contract.contract.Call(opts, result, method, params...)
+}
+
+// Transfer initiates a plain transaction to move funds to the contract, calling
+// its default method if one is available.
+func (_Settlement *SettlementTransactorRaw) Transfer(opts *bind.TransactOpts) (*types.Transaction, error) {
+	return _Settlement.Contract.contract.Transfer(opts)
+}
+
+// Transact invokes the (paid) contract method with params as input values.
+func (_Settlement *SettlementTransactorRaw) Transact(opts *bind.TransactOpts, method string, params ...interface{}) (*types.Transaction, error) {
+	return _Settlement.Contract.contract.Transact(opts, method, params...)
+}
+
+// IsSettled is a free data retrieval call binding the contract method 0xbd07f3c9.
+//
+// Solidity: function isSettled(bytes32 batchId) view returns(bool)
+func (_Settlement *SettlementCaller) IsSettled(opts *bind.CallOpts, batchId [32]byte) (bool, error) {
+	var out []interface{}
+	err := _Settlement.contract.Call(opts, &out, "isSettled", batchId)
+
+	if err != nil {
+		return *new(bool), err
+	}
+
+	out0 := *abi.ConvertType(out[0], new(bool)).(*bool)
+
+	return out0, err
+
+}
+
+// IsSettled is a free data retrieval call binding the contract method 0xbd07f3c9.
+//
+// Solidity: function isSettled(bytes32 batchId) view returns(bool)
+func (_Settlement *SettlementSession) IsSettled(batchId [32]byte) (bool, error) {
+	return _Settlement.Contract.IsSettled(&_Settlement.CallOpts, batchId)
+}
+
+// IsSettled is a free data retrieval call binding the contract method 0xbd07f3c9.
+//
+// Solidity: function isSettled(bytes32 batchId) view returns(bool)
+func (_Settlement *SettlementCallerSession) IsSettled(batchId [32]byte) (bool, error) {
+	return _Settlement.Contract.IsSettled(&_Settlement.CallOpts, batchId)
+}
+
+// SettleBatch is a paid mutator transaction binding the contract method 0x76076dfd.
+//
+// Solidity: function settleBatch(bytes32 batchId, (address,address,address,address,uint256,uint256,bool)[] fills) returns()
+func (_Settlement *SettlementTransactor) SettleBatch(opts *bind.TransactOpts, batchId [32]byte, fills []SettlementFill) (*types.Transaction, error) {
+	return _Settlement.contract.Transact(opts, "settleBatch", batchId, fills)
+}
+
+// SettleBatch is a paid mutator transaction binding the contract method 0x76076dfd.
+//
+// Solidity: function settleBatch(bytes32 batchId, (address,address,address,address,uint256,uint256,bool)[] fills) returns()
+func (_Settlement *SettlementSession) SettleBatch(batchId [32]byte, fills []SettlementFill) (*types.Transaction, error) {
+	return _Settlement.Contract.SettleBatch(&_Settlement.TransactOpts, batchId, fills)
+}
+
+// SettleBatch is a paid mutator transaction binding the contract method 0x76076dfd.
+//
+// Solidity: function settleBatch(bytes32 batchId, (address,address,address,address,uint256,uint256,bool)[] fills) returns()
+func (_Settlement *SettlementTransactorSession) SettleBatch(batchId [32]byte, fills []SettlementFill) (*types.Transaction, error) {
+	return _Settlement.Contract.SettleBatch(&_Settlement.TransactOpts, batchId, fills)
+}
+
+// SettlementBatchSettledIterator is returned from FilterBatchSettled and is used to iterate over the raw logs and unpacked data for BatchSettled events raised by the Settlement contract.
+type SettlementBatchSettledIterator struct {
+	Event *SettlementBatchSettled // Event containing the contract specifics and raw log
+
+	contract *bind.BoundContract // Generic contract to use for unpacking event data
+	event    string              // Event name to use for unpacking event data
+
+	logs chan types.Log        // Log channel receiving the found contract events
+	sub  ethereum.Subscription // Subscription for errors, completion and termination
+	done bool                  // Whether the subscription completed delivering logs
+	fail error                 // Occurred error to stop iteration
+}
+
+// Next advances the iterator to the subsequent event, returning whether there
+// are any more events found. In case of a retrieval or parsing error, false is
+// returned and Error() can be queried for the exact failure.
+func (it *SettlementBatchSettledIterator) Next() bool {
+	// If the iterator failed, stop iterating
+	if it.fail != nil {
+		return false
+	}
+	// If the iterator completed, deliver directly whatever's available
+	if it.done {
+		select {
+		case log := <-it.logs:
+			it.Event = new(SettlementBatchSettled)
+			if err := it.contract.UnpackLog(it.Event, it.event, log); err != nil {
+				it.fail = err
+				return false
+			}
+			it.Event.Raw = log
+			return true
+
+		default:
+			return false
+		}
+	}
+	// Iterator still in progress, wait for either a data or an error event
+	select {
+	case log := <-it.logs:
+		it.Event = new(SettlementBatchSettled)
+		if err := it.contract.UnpackLog(it.Event, it.event, log); err != nil {
+			it.fail = err
+			return false
+		}
+		it.Event.Raw = log
+		return true
+
+	case err := <-it.sub.Err():
+		it.done = true
+		it.fail = err
+		return it.Next()
+	}
+}
+
+// Error returns any retrieval or parsing error occurred during filtering.
+func (it *SettlementBatchSettledIterator) Error() error {
+	return it.fail
+}
+
+// Close terminates the iteration process, releasing any pending underlying
+// resources.
+func (it *SettlementBatchSettledIterator) Close() error {
+	it.sub.Unsubscribe()
+	return nil
+}
+
+// SettlementBatchSettled represents a BatchSettled event raised by the Settlement contract.
+type SettlementBatchSettled struct {
+	BatchId   [32]byte
+	FillCount *big.Int
+	Raw       types.Log // Blockchain specific contextual infos
+}
+
+// FilterBatchSettled is a free log retrieval operation binding the contract event 0x05eeb6582a6ebb84a23d676e06d8a05c09d5a6f8e1be1b93a3d8ca75a8a78347.
+//
+// Solidity: event BatchSettled(bytes32 indexed batchId, uint256 fillCount)
+func (_Settlement *SettlementFilterer) FilterBatchSettled(opts *bind.FilterOpts, batchId [][32]byte) (*SettlementBatchSettledIterator, error) {
+
+	var batchIdRule []interface{}
+	for _, batchIdItem := range batchId {
+		batchIdRule = append(batchIdRule, batchIdItem)
+	}
+
+	logs, sub, err := _Settlement.contract.FilterLogs(opts, "BatchSettled", batchIdRule)
+	if err != nil {
+		return nil, err
+	}
+	return &SettlementBatchSettledIterator{contract: _Settlement.contract, event: "BatchSettled", logs: logs, sub: sub}, nil
+}
+
+// WatchBatchSettled is a free log subscription operation binding the contract event 0x05eeb6582a6ebb84a23d676e06d8a05c09d5a6f8e1be1b93a3d8ca75a8a78347.
+//
+// Solidity: event BatchSettled(bytes32 indexed batchId, uint256 fillCount)
+func (_Settlement *SettlementFilterer) WatchBatchSettled(opts *bind.WatchOpts, sink chan<- *SettlementBatchSettled, batchId [][32]byte) (event.Subscription, error) {
+
+	var batchIdRule []interface{}
+	for _, batchIdItem := range batchId {
+		batchIdRule = append(batchIdRule, batchIdItem)
+	}
+
+	logs, sub, err := _Settlement.contract.WatchLogs(opts, "BatchSettled", batchIdRule)
+	if err != nil {
+		return nil, err
+	}
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		defer sub.Unsubscribe()
+		for {
+			select {
+			case log := <-logs:
+				// New log arrived, parse the event and forward to the user
+				event := new(SettlementBatchSettled)
+				if err := _Settlement.contract.UnpackLog(event, "BatchSettled", log); err != nil {
+					return err
+				}
+				event.Raw = log
+
+				select {
+				case sink <- event:
+				case err := <-sub.Err():
+					return err
+				case <-quit:
+					return nil
+				}
+			case err := <-sub.Err():
+				return err
+			case <-quit:
+				return nil
+			}
+		}
+	}), nil
+}
+
+// ParseBatchSettled is a log parse operation binding the contract event 0x05eeb6582a6ebb84a23d676e06d8a05c09d5a6f8e1be1b93a3d8ca75a8a78347.
+//
+// Solidity: event BatchSettled(bytes32 indexed batchId, uint256 fillCount)
+func (_Settlement *SettlementFilterer) ParseBatchSettled(log types.Log) (*SettlementBatchSettled, error) {
+	event := new(SettlementBatchSettled)
+	if err := _Settlement.contract.UnpackLog(event, "BatchSettled", log); err != nil {
+		return nil, err
+	}
+	event.Raw = log
+	return event, nil
+}
@@ -0,0 +1,488 @@
+package service
+
+import (
+	"container/heap"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+type APIScope string
+
+const (
+	// ScopeRead allows reading the account.
+	ScopeRead APIScope = "read"
+	// ScopeTrade allows placing orders.
+	ScopeTrade APIScope = "trade"
+	// ScopeWithdraw allows requesting withdrawals.
+	ScopeWithdraw APIScope = "withdraw"
+)
+
+// APIKey lets a client act for a user within its scopes without the user's
+// signing key. Its secret is kept encrypted with the service's key.
+type APIKey struct {
+	ID     string
+	User   common.Address
+	Scopes []APIScope
+	// AllowedIPs are the addresses and networks requests may come from, any
+	// address when empty.
+	AllowedIPs []netip.Prefix
+	CreatedAt  time.Time
+	// ExpiresAt is zero for keys that do not expire.
+	ExpiresAt time.Time
+	RevokedAt time.Time
+	// sealedSecret is the HMAC key requests are signed with, encrypted with
+	// the service's key and bound to the key ID, so the stored keys alone
+	// cannot sign requests.
+	sealedSecret []byte
+}
+
+func (key APIKey) HasScope(scope APIScope) bool {
+	return slices.Contains(key.Scopes, scope)
+}
+
+func (key APIKey) clone() APIKey {
+	key.Scopes = slices.Clone(key.Scopes)
+	key.AllowedIPs = slices.Clone(key.AllowedIPs)
+	key.sealedSecret = nil
+	return key
+}
+
+// APIRequest is a request signed with an API key. Signature is the hex
+// HMAC-SHA256 of the decimal Timestamp, in unix milliseconds, followed by the
+// body.
+type APIRequest struct {
+	KeyID     string
+	Timestamp int64
+	Body      []byte
+	Signature string
+	RemoteIP  string
+}
+
+// APIOrderRequest is the body of an order request.
+type APIOrderRequest struct {
+	Market string    `json:"market"`
+	Side   OrderType `json:"side"`
+	Size   *big.Int  `json:"size"`
+	Price  *big.Int  `json:"price"`
+	Fill   bool      `json:"fill"`
+	Nonce  uint64    `json:"nonce"`
+	// Expiry is in unix seconds, zero for orders that do not expire.
+	Expiry int64 `json:"expiry"`
+}
+
+// APIWithdrawalRequest is the body of a withdrawal request.
+type APIWithdrawalRequest struct {
+	Token  string         `json:"token"`
+	To     common.Address `json:"to"`
+	Amount *big.Int       `json:"amount"`
+}
+
+// SignAPIRequest returns the signature of a request made with the secret of
+// an API key.
+func SignAPIRequest(secret string, timestamp int64, body []byte) string {
+	return hex.EncodeToString(apiSignature([]byte(secret), timestamp, body))
+}
+
+func apiSignature(secret []byte, timestamp int64, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// APIKeyService issues API keys and authenticates the requests made with
+// them before passing them on to the user and withdrawal services.
+type APIKeyService struct {
+	keys map[string]*APIKey
+	// secretCipher encrypts the secrets of the keys.
+	secretCipher cipher.AEAD
+	// maxClockSkew is how far the timestamp of a request may be from now.
+	maxClockSkew time.Duration
+	// seenSignatures holds the signatures accepted within the clock skew, so
+	// a captured request cannot be replayed. signatureExpiries orders them by
+	// the time they may be forgotten.
+	seenSignatures    map[seenSignature]bool
+	signatureExpiries signatureExpiries
+	serviceRegistry   *ServiceRegistry
+	mu                sync.Mutex
+}
+
+// NewAPIKeyService takes the 32 byte key the secrets of the API keys are
+// encrypted with.
+func NewAPIKeyService(secretKey []byte) (*APIKeyService, error) {
+	if len(secretKey) != 32 {
+		return nil, fmt.Errorf("api key secret key must be 32 bytes, got %d", len(secretKey))
+	}
+	block, err := aes.NewCipher(secretKey)
+	if err != nil {
+		return nil, err
+	}
+	secretCipher, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &APIKeyService{
+		keys:           make(map[string]*APIKey),
+		secretCipher:   secretCipher,
+		maxClockSkew:   30 * time.Second,
+		seenSignatures: make(map[seenSignature]bool),
+	}, nil
+}
+
+func (service *APIKeyService) SetServiceRegistry(serviceRegistry *ServiceRegistry) {
+	service.serviceRegistry = serviceRegistry
+}
+
+func (service *APIKeyService) GetServiceRegistry() (*ServiceRegistry, error) {
+	if service.serviceRegistry == nil {
+		return nil, errors.New("service registry not set")
+	}
+	return service.serviceRegistry, nil
+}
+
+func (service *APIKeyService) SetMaxClockSkew(maxClockSkew time.Duration) {
+	service.maxClockSkew = maxClockSkew
+}
+
+// CreateKey issues a key for a registered user and returns it with its
+// secret. The secret is not stored and cannot be retrieved later. allowedIPs
+// takes addresses and CIDR networks. A zero expiresAt never expires.
+func (service *APIKeyService) CreateKey(
+	user common.Address,
+	scopes []APIScope,
+	allowedIPs []string,
+	expiresAt time.Time,
+) (APIKey, string, error) {
+	serviceRegistry, err := service.GetServiceRegistry()
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	userService, err := serviceRegistry.GetUserService()
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	if _, err := userService.GetUser(user); err != nil {
+		return APIKey{}, "", err
+	}
+	if len(scopes) == 0 {
+		return APIKey{}, "", errors.New("api key needs at least one scope")
+	}
+	for _, scope := range scopes {
+		if scope != ScopeRead && scope != ScopeTrade && scope != ScopeWithdraw {
+			return APIKey{}, "", fmt.Errorf("unknown api key scope %q", scope)
+		}
+	}
+	prefixes := make([]netip.Prefix, 0, len(allowedIPs))
+	for _, allowedIP := range allowedIPs {
+		prefix, err := parseAllowedIP(allowedIP)
+		if err != nil {
+			return APIKey{}, "", err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	now := time.Now()
+	if !expiresAt.IsZero() && !expiresAt.After(now) {
+		return APIKey{}, "", errors.New("api key expiry must be in the future")
+	}
+
+	id, err := randomHex(16)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	sealedSecret, err := service.sealSecret(id, []byte(secret))
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	key := &APIKey{
+		ID:           id,
+		User:         user,
+		Scopes:       slices.Clone(scopes),
+		AllowedIPs:   prefixes,
+		CreatedAt:    now,
+		ExpiresAt:    expiresAt,
+		sealedSecret: sealedSecret,
+	}
+
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	service.keys[id] = key
+	return key.clone(), secret, nil
+}
+
+// RevokeKey permanently disables a key.
+func (service *APIKeyService) RevokeKey(id string) error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	key, ok := service.keys[id]
+	if !ok {
+		return fmt.Errorf("api key %s not found", id)
+	}
+	if key.RevokedAt.IsZero() {
+		key.RevokedAt = time.Now()
+	}
+	return nil
+}
+
+// GetKeys returns the keys of a user, without their secrets.
+func (service *APIKeyService) GetKeys(user common.Address) []APIKey {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	keys := []APIKey{}
+	for _, key := range service.keys {
+		if key.User == user {
+			keys = append(keys, key.clone())
+		}
+	}
+	slices.SortFunc(keys, func(a, b APIKey) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return keys
+}
+
+// Authenticate checks that a request is signed with a valid key that has the
+// scope, is recent, comes from an allowed address and was not seen before,
+// and returns the key.
+func (service *APIKeyService) Authenticate(request APIRequest, scope APIScope) (APIKey, error) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	key, ok := service.keys[request.KeyID]
+	if !ok {
+		return APIKey{}, errors.New("unknown api key")
+	}
+	now := time.Now()
+	if !key.RevokedAt.IsZero() {
+		return APIKey{}, errors.New("api key revoked")
+	}
+	if !key.ExpiresAt.IsZero() && !now.Before(key.ExpiresAt) {
+		return APIKey{}, errors.New("api key expired")
+	}
+
+	secret, err := service.openSecret(key)
+	if err != nil {
+		return APIKey{}, err
+	}
+	signature, err := hex.DecodeString(request.Signature)
+	if err != nil || !hmac.Equal(signature, apiSignature(secret, request.Timestamp, request.Body)) {
+		return APIKey{}, errors.New("invalid request signature")
+	}
+	timestamp := time.UnixMilli(request.Timestamp)
+	if skew := now.Sub(timestamp).Abs(); skew > service.maxClockSkew {
+		return APIKey{}, fmt.Errorf("request timestamp is %s off, more than %s", skew.Round(time.Millisecond), service.maxClockSkew)
+	}
+	if len(key.AllowedIPs) > 0 {
+		ip, err := netip.ParseAddr(request.RemoteIP)
+		if err != nil {
+			return APIKey{}, fmt.Errorf("invalid remote address %q", request.RemoteIP)
+		}
+		if !slices.ContainsFunc(key.AllowedIPs, func(prefix netip.Prefix) bool { return prefix.Contains(ip.Unmap()) }) {
+			return APIKey{}, fmt.Errorf("requests from %s are not allowed for this api key", ip)
+		}
+	}
+	if !key.HasScope(scope) {
+		return APIKey{}, fmt.Errorf("api key lacks the %s scope", scope)
+	}
+
+	for len(service.signatureExpiries) > 0 && now.After(service.signatureExpiries[0].expiry) {
+		expired := heap.Pop(&service.signatureExpiries).(signatureExpiry)
+		delete(service.seenSignatures, expired.signature)
+	}
+	// the decoded signature is kept, as differently encoded hex is the same request
+	seen := seenSignature{keyID: key.ID, mac: string(signature)}
+	if service.seenSignatures[seen] {
+		return APIKey{}, errors.New("request was already used")
+	}
+	service.seenSignatures[seen] = true
+	heap.Push(&service.signatureExpiries, signatureExpiry{signature: seen, expiry: timestamp.Add(service.maxClockSkew)})
+	return key.clone(), nil
+}
+
+// sealSecret encrypts the secret of a key, bound to the key ID so it cannot
+// be moved to another key.
+func (service *APIKeyService) sealSecret(id string, secret []byte) ([]byte, error) {
+	nonce := make([]byte, service.secretCipher.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return service.secretCipher.Seal(nonce, nonce, secret, []byte(id)), nil
+}
+
+func (service *APIKeyService) openSecret(key *APIKey) ([]byte, error) {
+	nonceSize := service.secretCipher.NonceSize()
+	if len(key.sealedSecret) < nonceSize {
+		return nil, fmt.Errorf("api key %s has no secret", key.ID)
+	}
+	secret, err := service.secretCipher.Open(nil, key.sealedSecret[:nonceSize], key.sealedSecret[nonceSize:], []byte(key.ID))
+	if err != nil {
+		return nil, fmt.Errorf("decrypting the secret of api key %s: %w", key.ID, err)
+	}
+	return secret, nil
+}
+
+// GetAccount returns the account of the key's user.
+func (service *APIKeyService) GetAccount(request APIRequest) (User, error) {
+	key, err := service.Authenticate(request, ScopeRead)
+	if err != nil {
+		return User{}, err
+	}
+	userService, err := service.getUserService()
+	if err != nil {
+		return User{}, err
+	}
+	return userService.GetUser(key.User)
+}
+
+// PlaceOrder places the APIOrderRequest in the body for the key's user. The
+// key stands in for the order signature, the nonce and expiry still apply.
+func (service *APIKeyService) PlaceOrder(request APIRequest) (FillReport, error) {
+	key, err := service.Authenticate(request, ScopeTrade)
+	if err != nil {
+		return FillReport{}, err
+	}
+	var body APIOrderRequest
+	if err := json.Unmarshal(request.Body, &body); err != nil {
+		return FillReport{}, fmt.Errorf("invalid order request: %w", err)
+	}
+	if body.Size == nil || body.Price == nil {
+		return FillReport{}, errors.New("invalid order request: size and price are required")
+	}
+	if body.Side != BuyOrder && body.Side != SellOrder {
+		return FillReport{}, fmt.Errorf("invalid order request: unknown side %q", body.Side)
+	}
+	serviceRegistry, err := service.GetServiceRegistry()
+	if err != nil {
+		return FillReport{}, err
+	}
+	marketService, err := serviceRegistry.GetMarketService()
+	if err != nil {
+		return FillReport{}, err
+	}
+	orderService, err := serviceRegistry.GetOrderService()
+	if err != nil {
+		return FillReport{}, err
+	}
+	userService, err := serviceRegistry.GetUserService()
+	if err != nil {
+		return FillReport{}, err
+	}
+	market, ok := marketService.LookupMarket(body.Market)
+	if !ok {
+		return FillReport{}, fmt.Errorf("market %s not found", body.Market)
+	}
+
+	order := Order{
+		ID:         orderService.GetNextOrderID(),
+		User:       key.User,
+		OrderType:  body.Side,
+		Size:       body.Size,
+		Price:      body.Price,
+		SizeFilled: big.NewInt(0),
+		CreatedAt:  time.Now(),
+		Status:     Open,
+		Market:     market,
+		Nonce:      body.Nonce,
+	}
+	if body.Expiry != 0 {
+		order.Expiry = time.Unix(body.Expiry, 0)
+	}
+	return userService.placeOrder(order, body.Fill, false)
+}
+
+// RequestWithdrawal requests the APIWithdrawalRequest in the body for the
+// key's user.
+func (service *APIKeyService) RequestWithdrawal(request APIRequest) (*Withdrawal, error) {
+	key, err := service.Authenticate(request, ScopeWithdraw)
+	if err != nil {
+		return nil, err
+	}
+	var body APIWithdrawalRequest
+	if err := json.Unmarshal(request.Body, &body); err != nil {
+		return nil, fmt.Errorf("invalid withdrawal request: %w", err)
+	}
+	serviceRegistry, err := service.GetServiceRegistry()
+	if err != nil {
+		return nil, err
+	}
+	withdrawalService, err := serviceRegistry.GetWithdrawalService()
+	if err != nil {
+		return nil, err
+	}
+	return withdrawalService.RequestWithdrawal(key.User, body.Token, body.To, body.Amount)
+}
+
+func (service *APIKeyService) getUserService() (*UserService, error) {
+	serviceRegistry, err := service.GetServiceRegistry()
+	if err != nil {
+		return nil, err
+	}
+	return serviceRegistry.GetUserService()
+}
+
+func parseAllowedIP(allowedIP string) (netip.Prefix, error) {
+	if prefix, err := netip.ParsePrefix(allowedIP); err == nil {
+		return prefix.Masked(), nil
+	}
+	ip, err := netip.ParseAddr(allowedIP)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid allowed address %q", allowedIP)
+	}
+	ip = ip.Unmap()
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
+
+func randomHex(size int) (string, error) {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(data), nil
+}
+
+type seenSignature struct {
+	keyID string
+	mac   string
+}
+
+type signatureExpiry struct {
+	signature seenSignature
+	expiry    time.Time
+}
+
+// signatureExpiries is a min-heap of the seen signatures by expiry.
+type signatureExpiries []signatureExpiry
+
+func (expiries signatureExpiries) Len() int { return len(expiries) }
+
+func (expiries signatureExpiries) Less(i, j int) bool {
+	return expiries[i].expiry.Before(expiries[j].expiry)
+}
+
+func (expiries signatureExpiries) Swap(i, j int) { expiries[i], expiries[j] = expiries[j], expiries[i] }
+
+func (expiries *signatureExpiries) Push(expiry any) {
+	*expiries = append(*expiries, expiry.(signatureExpiry))
+}
+
+func (expiries *signatureExpiries) Pop() any {
+	old := *expiries
+	expiry := old[len(old)-1]
+	*expiries = old[:len(old)-1]
+	return expiry
+}
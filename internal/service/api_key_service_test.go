@@ -0,0 +1,137 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"x-swap/internal/utils"
+)
+
+func setupAPIKeys(t *testing.T) *APIKeyService {
+	secretKey := make([]byte, 32)
+	_, err := rand.Read(secretKey)
+	assert.Nil(t, err)
+	apiKeyService, err := NewAPIKeyService(secretKey)
+	assert.Nil(t, err)
+	apiKeyService.SetServiceRegistry(serviceRegistry)
+	serviceRegistry.SetAPIKeyService(apiKeyService)
+	return apiKeyService
+}
+
+func signedRequest(t *testing.T, key APIKey, secret string, body any, remoteIP string) APIRequest {
+	data, err := json.Marshal(body)
+	assert.Nil(t, err)
+	timestamp := time.Now().UnixMilli()
+	return APIRequest{
+		KeyID:     key.ID,
+		Timestamp: timestamp,
+		Body:      data,
+		Signature: SignAPIRequest(secret, timestamp, data),
+		RemoteIP:  remoteIP,
+	}
+}
+
+// resign moves the timestamp of a request and signs it again.
+func resign(request APIRequest, secret string, shift time.Duration) APIRequest {
+	request.Timestamp += shift.Milliseconds()
+	request.Signature = SignAPIRequest(secret, request.Timestamp, request.Body)
+	return request
+}
+
+func TestAPIKeyAuthenticatesOrders(t *testing.T) {
+	setup()
+	apiKeyService := setupAPIKeys(t)
+	// the key stands in for the order signature
+	userService.SetOrderDomain(testOrderDomain)
+	topup(users[0], big.NewInt(1e8), "BTC")
+
+	_, _, err := apiKeyService.CreateKey(users[0], []APIScope{"admin"}, nil, time.Time{})
+	assert.ErrorContains(t, err, "unknown api key scope")
+	key, secret, err := apiKeyService.CreateKey(users[0], []APIScope{ScopeRead, ScopeTrade}, []string{"10.0.0.0/8"}, time.Time{})
+	assert.Nil(t, err)
+	assert.Equal(t, len(apiKeyService.GetKeys(users[0])), 1)
+
+	order := APIOrderRequest{
+		Market: marketTicker,
+		Side:   SellOrder,
+		Size:   big.NewInt(5e7),
+		Price:  big.NewInt(100_000e6),
+		Nonce:  1,
+	}
+	request := signedRequest(t, key, secret, order, "10.1.2.3")
+	_, err = apiKeyService.PlaceOrder(request)
+	assert.Nil(t, err)
+	assert.Equal(t, orderService.GetOpenOrderCount(marketTicker, users[0]), 1)
+	_, err = apiKeyService.PlaceOrder(request)
+	assert.ErrorContains(t, err, "already used")
+	uppercase := request
+	uppercase.Signature = strings.ToUpper(request.Signature)
+	_, err = apiKeyService.PlaceOrder(uppercase)
+	assert.ErrorContains(t, err, "request was already used")
+
+	// nonces still apply to orders placed with a key
+	_, err = apiKeyService.PlaceOrder(resign(request, secret, time.Millisecond))
+	assert.ErrorContains(t, err, "nonce 1 was already used")
+
+	order.Nonce = 2
+	_, err = apiKeyService.PlaceOrder(signedRequest(t, key, secret, order, "192.168.1.1"))
+	assert.ErrorContains(t, err, "not allowed for this api key")
+
+	tampered := signedRequest(t, key, secret, order, "10.1.2.3")
+	tampered.Body = []byte(`{"market":"BTC/USD","side":"SELL","size":50000000,"price":1,"nonce":2}`)
+	_, err = apiKeyService.PlaceOrder(tampered)
+	assert.ErrorContains(t, err, "invalid request signature")
+
+	// the stored secret does not sign requests without the service's key
+	stolen := signedRequest(t, key, string(apiKeyService.keys[key.ID].sealedSecret), order, "10.1.2.3")
+	_, err = apiKeyService.PlaceOrder(stolen)
+	assert.ErrorContains(t, err, "invalid request signature")
+
+	stale := resign(signedRequest(t, key, secret, order, "10.1.2.3"), secret, -time.Minute)
+	_, err = apiKeyService.PlaceOrder(stale)
+	assert.ErrorContains(t, err, "request timestamp")
+
+	account, err := apiKeyService.GetAccount(signedRequest(t, key, secret, nil, "10.1.2.3"))
+	assert.Nil(t, err)
+	assert.Equal(t, account.BalanceLocked["BTC"], big.NewInt(5e7))
+	_, err = apiKeyService.RequestWithdrawal(signedRequest(t, key, secret, nil, "10.1.2.3"))
+	assert.ErrorContains(t, err, "lacks the withdraw scope")
+
+	apiKeyService.keys[key.ID].ExpiresAt = time.Now().Add(-time.Second)
+	_, err = apiKeyService.PlaceOrder(signedRequest(t, key, secret, order, "10.1.2.3"))
+	assert.ErrorContains(t, err, "api key expired")
+	apiKeyService.keys[key.ID].ExpiresAt = time.Time{}
+
+	assert.Nil(t, apiKeyService.RevokeKey(key.ID))
+	_, err = apiKeyService.PlaceOrder(signedRequest(t, key, secret, order, "10.1.2.3"))
+	assert.ErrorContains(t, err, "api key revoked")
+	assert.Equal(t, orderService.GetOpenOrderCount(marketTicker, users[0]), 1)
+}
+
+func TestAPIKeyWithdrawal(t *testing.T) {
+	_, _, _ = setupWithdrawals(t)
+	apiKeyService := setupAPIKeys(t)
+	topup(users[0], big.NewInt(500e6), "USDC")
+	key, secret, err := apiKeyService.CreateKey(users[0], []APIScope{ScopeWithdraw}, nil, time.Now().Add(time.Hour))
+	assert.Nil(t, err)
+
+	recipient := utils.GenerateRandomAddress()
+	withdrawal, err := apiKeyService.RequestWithdrawal(signedRequest(t, key, secret, APIWithdrawalRequest{
+		Token:  "USDC",
+		To:     recipient,
+		Amount: big.NewInt(200e6),
+	}, "127.0.0.1"))
+	assert.Nil(t, err)
+	assert.Equal(t, withdrawal.User, users[0])
+	assert.Equal(t, withdrawal.To, recipient)
+	assert.Equal(t, userService.GetAssetAmount(users[0], "USDC"), big.NewInt(300e6))
+
+	_, err = apiKeyService.PlaceOrder(signedRequest(t, key, secret, APIOrderRequest{}, "127.0.0.1"))
+	assert.ErrorContains(t, err, "lacks the trade scope")
+}
@@ -3,46 +3,92 @@ package service
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
 	"math/big"
+	"sync"
 	"time"
 
+	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethclient"
 )
 
+const defaultMaxBlockRange = 2000
+
 type BlockchainService struct {
-	client             *ethclient.Client
-	serviceRegistry    *ServiceRegistry
-	ctx                context.Context
-	cancel             context.CancelFunc
-	rpcURL             string
-	pollInterval       time.Duration
-	contractAddress    common.Address
-	lastProcessedBlock uint64
+	client              EthereumClient
+	closer              interface{ Close() }
+	serviceRegistry     *ServiceRegistry
+	ctx                 context.Context
+	cancel              context.CancelFunc
+	name                string
+	rpcURLs             []string
+	expectedChainID     uint64
+	pollInterval        time.Duration
+	contractAddresses   []common.Address
+	blockRange          uint64
+	maxBlockRange       uint64
+	chainID             uint64
+	confirmations       uint64
+	lastProcessedBlock  uint64
+	deposits            map[depositKey]*Deposit
+	depositKeys         []depositKey
+	orphanedDeposits    []Deposit
+	depositsMu          sync.Mutex
+	blockHashes         map[uint64]common.Hash
+	reorgWindow         uint64
+	checkpointStore     CheckpointStore
+	watchNative         bool
+	callTracer          CallTracer
+	dialSubscriber      func(ctx context.Context) (SubscriptionClient, error)
+	minReconnectBackoff time.Duration
+	maxReconnectBackoff time.Duration
+	indexMu             sync.Mutex
 }
 
 type TransferEvent struct {
+	Source DepositSource
 	From   common.Address
 	To     common.Address
-	Amount *big.Int
-	Token  string
-	Block  uint64
-	TxHash string
+	// Amount is converted to the asset's decimals, which may differ from the
+	// token's decimals on this chain.
+	Amount    *big.Int
+	Token     string
+	Contract  common.Address
+	ChainID   uint64
+	Block     uint64
+	BlockHash common.Hash
+	TxHash    common.Hash
+	LogIndex  uint
 }
 
 func NewBlockchainService(rpcURL string, contractAddress common.Address) *BlockchainService {
+	service := newBlockchainService([]string{rpcURL})
+	service.contractAddresses = []common.Address{contractAddress}
+	return service
+}
+
+func newBlockchainService(rpcURLs []string) *BlockchainService {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	return &BlockchainService{
-		rpcURL:             rpcURL,
-		contractAddress:    contractAddress,
-		pollInterval:       5 * time.Second,
-		ctx:                ctx,
-		cancel:             cancel,
-		lastProcessedBlock: 0,
+		rpcURLs:             append([]string{}, rpcURLs...),
+		contractAddresses:   []common.Address{},
+		blockRange:          defaultMaxBlockRange,
+		maxBlockRange:       defaultMaxBlockRange,
+		pollInterval:        5 * time.Second,
+		confirmations:       12,
+		ctx:                 ctx,
+		cancel:              cancel,
+		lastProcessedBlock:  0,
+		deposits:            make(map[depositKey]*Deposit),
+		depositKeys:         []depositKey{},
+		blockHashes:         make(map[uint64]common.Hash),
+		reorgWindow:         defaultReorgWindow,
+		minReconnectBackoff: minReconnectBackoff,
+		maxReconnectBackoff: maxReconnectBackoff,
 	}
 }
 
@@ -59,11 +105,99 @@ func (service *BlockchainService) GetServiceRegistry() (*ServiceRegistry, error)
 
 func (service *BlockchainService) Start() error {
 	log.Println("Starting blockchain service...")
-	client, err := ethclient.Dial(service.rpcURL)
-	if err != nil {
+	if err := service.Connect(); err != nil {
 		return err
 	}
+	if err := service.resume(); err != nil {
+		return err
+	}
+	if service.dialSubscriber != nil {
+		service.subscriptionLoop()
+	} else {
+		service.eventPollingLoop()
+	}
+
+	return nil
+}
+
+// Connect dials the RPC endpoints and reads the chain ID. With several
+// endpoints, calls go through an RPCPool that fails over between them. It is
+// a no-op when the service is already connected.
+func (service *BlockchainService) Connect() error {
+	if service.client != nil {
+		return nil
+	}
+	if len(service.rpcURLs) > 1 {
+		pool, err := DialRPCPool(service.ctx, service.rpcURLs)
+		if err != nil {
+			return err
+		}
+		if err := pool.CheckHealth(service.ctx); err != nil {
+			log.Printf("RPC pool health check: %v", err)
+		}
+		go pool.Run(defaultHealthInterval)
+		service.client = pool
+		service.closer = pool
+	} else {
+		client, err := ethclient.Dial(service.rpcURLs[0])
+		if err != nil {
+			return err
+		}
+		service.client = client
+		service.closer = client
+	}
+
+	if err := service.loadChainID(); err != nil {
+		service.closer.Close()
+		service.client = nil
+		service.closer = nil
+		return err
+	}
+	return nil
+}
+
+// SetClient makes the service use the given client instead of dialing an RPC
+// endpoint. It waits for a running indexing pass to finish.
+func (service *BlockchainService) SetClient(client EthereumClient) error {
+	service.indexMu.Lock()
+	defer service.indexMu.Unlock()
 	service.client = client
+	return service.loadChainID()
+}
+
+func (service *BlockchainService) loadChainID() error {
+	chainID, err := service.client.ChainID(service.ctx)
+	if err != nil {
+		return err
+	}
+	if service.expectedChainID != 0 && chainID.Uint64() != service.expectedChainID {
+		return fmt.Errorf("endpoint serves chain %d, expected chain %d", chainID.Uint64(), service.expectedChainID)
+	}
+	service.chainID = chainID.Uint64()
+	return nil
+}
+
+// resume continues from the saved checkpoint. Without a checkpoint, indexing
+// starts 10 blocks behind the chain head.
+func (service *BlockchainService) resume() error {
+	if service.checkpointStore != nil {
+		checkpoint, err := service.checkpointStore.LoadCheckpoint()
+		if err != nil {
+			return err
+		}
+		if checkpoint != nil {
+			if checkpoint.ChainID != service.chainID {
+				return fmt.Errorf(
+					"checkpoint is for chain %d, connected to chain %d",
+					checkpoint.ChainID, service.chainID,
+				)
+			}
+			log.Printf("Resuming from checkpoint at block %d", checkpoint.BlockNumber)
+			service.lastProcessedBlock = checkpoint.BlockNumber
+			service.blockHashes[checkpoint.BlockNumber] = checkpoint.BlockHash
+			return nil
+		}
+	}
 
 	latestBlock, err := service.client.BlockNumber(service.ctx)
 	if err != nil {
@@ -75,16 +209,14 @@ func (service *BlockchainService) Start() error {
 	} else {
 		service.lastProcessedBlock = 0
 	}
-	service.eventPollingLoop()
-
 	return nil
 }
 
 func (service *BlockchainService) Stop() {
 	log.Println("Stopping blockchain service...")
 	service.cancel()
-	if service.client != nil {
-		service.client.Close()
+	if service.closer != nil {
+		service.closer.Close()
 	}
 }
 
@@ -106,6 +238,9 @@ func (service *BlockchainService) eventPollingLoop() {
 }
 
 func (service *BlockchainService) processNewBlocks() error {
+	service.indexMu.Lock()
+	defer service.indexMu.Unlock()
+
 	latestBlock, err := service.client.BlockNumber(service.ctx)
 	if err != nil {
 		return err
@@ -115,105 +250,242 @@ func (service *BlockchainService) processNewBlocks() error {
 		return nil
 	}
 
+	if err := service.checkReorg(latestBlock); err != nil {
+		return err
+	}
+
 	log.Printf("Processing blocks %d to %d", service.lastProcessedBlock+1, latestBlock)
-	for blockNum := service.lastProcessedBlock + 1; blockNum <= latestBlock; blockNum++ {
-		if err := service.processBlock(blockNum); err != nil {
-			log.Printf("Error processing block %d: %v", blockNum, err)
-			continue
-		}
+	if err := service.processRange(service.lastProcessedBlock+1, latestBlock); err != nil {
+		return err
 	}
+	if err := service.creditConfirmedDeposits(latestBlock); err != nil {
+		return err
+	}
+	// credited deposits no longer hold the checkpoint back
+	return service.saveCheckpoint()
+}
+
+// processRange indexes the blocks between fromBlock and toBlock, inclusive,
+// advancing and persisting the checkpoint after every chunk.
+func (service *BlockchainService) processRange(fromBlock uint64, toBlock uint64) error {
+	for fromBlock <= toBlock {
+		chunkEnd, err := service.indexChunk(fromBlock, toBlock)
+		if err != nil {
+			return err
+		}
 
-	service.lastProcessedBlock = latestBlock
+		service.lastProcessedBlock = chunkEnd
+		if err := service.recordBlockHashes(fromBlock, chunkEnd, toBlock); err != nil {
+			return err
+		}
+		if service.lastProcessedBlock != chunkEnd {
+			// rolled back, the next run indexes the canonical chain
+			return nil
+		}
+		if err := service.saveCheckpoint(); err != nil {
+			return err
+		}
+		fromBlock = chunkEnd + 1
+	}
 	return nil
 }
 
-func (service *BlockchainService) processBlock(blockNumber uint64) error {
-	block, err := service.client.BlockByNumber(service.ctx, big.NewInt(int64(blockNumber)))
-	if err != nil {
-		return err
-	}
+// indexChunk records the Transfer logs of the watched contracts, and native
+// transfers when enabled, for one chunk starting at fromBlock and returns the
+// last block of the chunk. The chunk size adapts to the provider: it is halved
+// when a query fails (e.g. too many results) and doubled after a successful
+// query, up to maxBlockRange.
+func (service *BlockchainService) indexChunk(fromBlock uint64, toBlock uint64) (uint64, error) {
+	for {
+		chunkEnd := fromBlock + service.blockRange - 1
+		if chunkEnd > toBlock {
+			chunkEnd = toBlock
+		}
 
-	for _, tx := range block.Transactions() {
-		if service.isRelevantTransaction(tx) {
-			transferEvent, err := service.parseTransferEvent(tx, blockNumber)
+		var logs []types.Log
+		var err error
+		// without addresses the query would match the transfers of every token
+		if len(service.contractAddresses) > 0 {
+			logs, err = service.client.FilterLogs(service.ctx, ethereum.FilterQuery{
+				FromBlock: new(big.Int).SetUint64(fromBlock),
+				ToBlock:   new(big.Int).SetUint64(chunkEnd),
+				Addresses: service.contractAddresses,
+				Topics:    [][]common.Hash{{transferEventSigHash}},
+			})
+		}
+		if err != nil {
+			if service.blockRange > 1 {
+				service.blockRange /= 2
+				log.Printf("Error fetching logs for blocks %d to %d, reducing range to %d: %v",
+					fromBlock, chunkEnd, service.blockRange, err)
+				continue
+			}
+			return 0, err
+		}
+
+		for _, vLog := range logs {
+			if vLog.Removed {
+				continue
+			}
+			transferEvent, err := service.parseTransferLog(vLog)
 			if err != nil {
 				log.Printf("Error parsing transfer event: %v", err)
 				continue
 			}
+			if err := service.updateUserBalance(transferEvent); err != nil {
+				log.Printf("Error updating user balance: %v", err)
+			}
+		}
 
-			if transferEvent != nil {
-				if err := service.updateUserBalance(transferEvent); err != nil {
-					log.Printf("Error updating user balance: %v", err)
-				}
+		if service.watchNative {
+			if err := service.indexNativeTransfers(fromBlock, chunkEnd); err != nil {
+				return 0, err
 			}
 		}
-	}
 
-	return nil
+		if service.blockRange < service.maxBlockRange {
+			service.blockRange = min(service.blockRange*2, service.maxBlockRange)
+		}
+		return chunkEnd, nil
+	}
 }
 
-func (service *BlockchainService) isRelevantTransaction(tx *types.Transaction) bool {
-	// to is valid token address
+// Backfill re-scans a block range for deposits that were missed, e.g. while
+// the service was down. Deposits are keyed by transaction hash and log index,
+// so running it over already indexed blocks never credits twice. It does not
+// move the checkpoint.
+func (service *BlockchainService) Backfill(fromBlock uint64, toBlock uint64) error {
+	if fromBlock > toBlock {
+		return fmt.Errorf("invalid backfill range %d to %d", fromBlock, toBlock)
+	}
+	if err := service.Connect(); err != nil {
+		return err
+	}
+
+	service.indexMu.Lock()
+	defer service.indexMu.Unlock()
 
-	if tx.To() != nil && *tx.To() == service.contractAddress {
-		return true
+	log.Printf("Backfilling blocks %d to %d", fromBlock, toBlock)
+	for fromBlock <= toBlock {
+		chunkEnd, err := service.indexChunk(fromBlock, toBlock)
+		if err != nil {
+			return err
+		}
+		fromBlock = chunkEnd + 1
+	}
+
+	latestBlock, err := service.client.BlockNumber(service.ctx)
+	if err != nil {
+		return err
 	}
-	return false
+	return service.creditConfirmedDeposits(latestBlock)
 }
 
-func (service *BlockchainService) parseTransferEvent(
-	tx *types.Transaction,
-	blockNumber uint64,
-) (*TransferEvent, error) {
-	transferEventSignature := []byte("Transfer(address,address,uint256)")
-	transferEventSigHash := common.BytesToHash(
-		crypto.Keccak256(transferEventSignature),
-	)
+func (service *BlockchainService) saveCheckpoint() error {
+	if service.checkpointStore == nil {
+		return nil
+	}
+	blockNumber := service.checkpointBlock()
+	blockHash, ok := service.blockHashes[blockNumber]
+	if !ok {
+		header, err := service.client.HeaderByNumber(
+			service.ctx,
+			new(big.Int).SetUint64(blockNumber),
+		)
+		if err != nil {
+			return err
+		}
+		blockHash = header.Hash()
+	}
+	return service.checkpointStore.SaveCheckpoint(Checkpoint{
+		ChainID:     service.chainID,
+		BlockNumber: blockNumber,
+		BlockHash:   blockHash,
+		UpdatedAt:   time.Now(),
+	})
+}
+
+// checkpointBlock returns the block indexing resumes after on a restart.
+// Pending deposits are only kept in memory, so the checkpoint stays below the
+// oldest one and a restart indexes and credits it again.
+func (service *BlockchainService) checkpointBlock() uint64 {
+	service.depositsMu.Lock()
+	defer service.depositsMu.Unlock()
+	blockNumber := service.lastProcessedBlock
+	for _, key := range service.depositKeys {
+		deposit := service.deposits[key]
+		if deposit.Status == DepositPending && deposit.Block <= blockNumber {
+			blockNumber = max(deposit.Block, 1) - 1
+		}
+	}
+	return blockNumber
+}
 
-	receipt, err := service.client.TransactionReceipt(service.ctx, tx.Hash())
+// parseTransferLog decodes an ERC-20 Transfer log. Logs are matched by the
+// emitting contract, so transfers made through routers or other contracts are
+// picked up as well.
+func (service *BlockchainService) parseTransferLog(vLog types.Log) (*TransferEvent, error) {
+	if len(vLog.Topics) != 3 || vLog.Topics[0] != transferEventSigHash || len(vLog.Data) != 32 {
+		return nil, fmt.Errorf("log %s:%d is not an ERC-20 transfer", vLog.TxHash.Hex(), vLog.Index)
+	}
+	token, err := service.resolveToken(vLog.Address)
+	if err != nil {
+		return nil, err
+	}
+	amount, err := service.toAssetAmount(token, new(big.Int).SetBytes(vLog.Data))
 	if err != nil {
 		return nil, err
 	}
 
-	for _, vLog := range receipt.Logs {
-		if len(vLog.Topics) == 0 || vLog.Topics[0] != transferEventSigHash {
-			continue
-		}
-		from := common.BytesToAddress(vLog.Topics[1].Bytes())
-		to := common.BytesToAddress(vLog.Topics[2].Bytes())
-		amount := new(big.Int).SetBytes(vLog.Data)
+	return &TransferEvent{
+		From:      common.BytesToAddress(vLog.Topics[1].Bytes()),
+		To:        common.BytesToAddress(vLog.Topics[2].Bytes()),
+		Amount:    amount,
+		Token:     token.Symbol,
+		Contract:  vLog.Address,
+		ChainID:   service.chainID,
+		Block:     vLog.BlockNumber,
+		BlockHash: vLog.BlockHash,
+		Source:    LogDeposit,
+		TxHash:    vLog.TxHash,
+		LogIndex:  vLog.Index,
+	}, nil
+}
 
-		return &TransferEvent{
-			From:   from,
-			To:     to,
-			Amount: amount,
-			Token:  tx.To().Hex(),
-			Block:  blockNumber,
-			TxHash: tx.Hash().Hex(),
-		}, nil
+// resolveToken looks up the registered token for a contract on this chain.
+func (service *BlockchainService) resolveToken(contract common.Address) (Token, error) {
+	serviceRegistry, err := service.GetServiceRegistry()
+	if err != nil {
+		return Token{}, err
 	}
+	tokenRegistry, err := serviceRegistry.GetTokenRegistry()
+	if err != nil {
+		return Token{}, err
+	}
+	return tokenRegistry.GetTokenByContract(service.chainID, contract)
+}
 
-	return nil, nil
+// toAssetAmount converts an on-chain amount of a token to the decimals the
+// asset's balances are kept in.
+func (service *BlockchainService) toAssetAmount(token Token, amount *big.Int) (*big.Int, error) {
+	serviceRegistry, err := service.GetServiceRegistry()
+	if err != nil {
+		return nil, err
+	}
+	tokenRegistry, err := serviceRegistry.GetTokenRegistry()
+	if err != nil {
+		return nil, err
+	}
+	return tokenRegistry.ToAssetAmount(token, amount), nil
 }
 
-// updateUserBalance updates user balances based on transfer events
+// updateUserBalance records a transfer to a user deposit address. The user is
+// credited by creditConfirmedDeposits once the deposit is confirmed.
 func (service *BlockchainService) updateUserBalance(event *TransferEvent) error {
-	// serviceRegistry, err := service.GetServiceRegistry()
-	// if err != nil {
-	// 	return err
-	// }
-
-	// userService, err := serviceRegistry.GetUserService()
-	// if err != nil {
-	// 	return err
-	// }
-
 	log.Printf("Processing transfer: %s -> %s, Amount: %s %s",
 		event.From.Hex(), event.To.Hex(), event.Amount.String(), event.Token)
 
-	// Add balance to recipient
-	// userService.AddBalance(event.To, event.Token, event.Amount)
-	return nil
+	return service.recordDeposit(event)
 }
 
 // GetLastProcessedBlock returns the last processed block number
@@ -221,6 +493,33 @@ func (service *BlockchainService) GetLastProcessedBlock() uint64 {
 	return service.lastProcessedBlock
 }
 
+// SetCheckpointStore sets where the last processed block is persisted
+func (service *BlockchainService) SetCheckpointStore(checkpointStore CheckpointStore) {
+	service.checkpointStore = checkpointStore
+}
+
+// WatchContract adds a token contract whose Transfer logs are indexed
+func (service *BlockchainService) WatchContract(contractAddress common.Address) {
+	for _, address := range service.contractAddresses {
+		if address == contractAddress {
+			return
+		}
+	}
+	service.contractAddresses = append(service.contractAddresses, contractAddress)
+}
+
+// SetMaxBlockRange sets the largest block range queried in one eth_getLogs call
+func (service *BlockchainService) SetMaxBlockRange(maxBlockRange uint64) {
+	service.maxBlockRange = max(maxBlockRange, 1)
+	service.blockRange = service.maxBlockRange
+}
+
+// SetConfirmations sets how many confirmations a deposit needs before it is
+// credited
+func (service *BlockchainService) SetConfirmations(confirmations uint64) {
+	service.confirmations = confirmations
+}
+
 // SetPollInterval allows changing the polling interval
 func (service *BlockchainService) SetPollInterval(interval time.Duration) {
 	service.pollInterval = interval
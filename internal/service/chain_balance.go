@@ -0,0 +1,74 @@
+package service
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// AddBalanceFromChain credits an asset that arrived from the given chain. The
+// balance itself is unified across chains, the chain is kept as provenance.
+func (service *UserService) AddBalanceFromChain(
+	user common.Address,
+	chainID uint64,
+	asset string,
+	amount *big.Int,
+	reason EntryReason,
+	reference string,
+) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	service.post(reason, reference, transfer(externalAccount(chainID), availableAccount(user), asset, amount)...)
+	chainBalance := service.chainBalance(user, asset, chainID)
+	chainBalance.Add(chainBalance, amount)
+}
+
+// SubBalanceToChain debits an asset that leaves through the given chain. It
+// fails when the user's available balance does not cover the amount.
+func (service *UserService) SubBalanceToChain(
+	user common.Address,
+	chainID uint64,
+	asset string,
+	amount *big.Int,
+	reason EntryReason,
+	reference string,
+) error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	if available := service.assetAmountAvailable(user, asset); available.Cmp(amount) < 0 {
+		return fmt.Errorf("insufficient %s balance: have %s, need %s", asset, available, amount)
+	}
+	service.post(reason, reference, transfer(availableAccount(user), externalAccount(chainID), asset, amount)...)
+	chainBalance := service.chainBalance(user, asset, chainID)
+	chainBalance.Sub(chainBalance, amount)
+	return nil
+}
+
+// GetBalanceProvenance returns the net amount of an asset a user moved in
+// through each chain. It is negative for a chain the user withdrew more on
+// than deposited.
+func (service *UserService) GetBalanceProvenance(user common.Address, asset string) map[uint64]*big.Int {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	provenance := map[uint64]*big.Int{}
+	for chainID, amount := range service.ChainBalances[user][asset] {
+		provenance[chainID] = new(big.Int).Set(amount)
+	}
+	return provenance
+}
+
+func (service *UserService) chainBalance(user common.Address, asset string, chainID uint64) *big.Int {
+	if service.ChainBalances[user] == nil {
+		service.ChainBalances[user] = make(map[string]map[uint64]*big.Int)
+	}
+	if service.ChainBalances[user][asset] == nil {
+		service.ChainBalances[user][asset] = make(map[uint64]*big.Int)
+	}
+	if service.ChainBalances[user][asset][chainID] == nil {
+		service.ChainBalances[user][asset][chainID] = big.NewInt(0)
+	}
+	return service.ChainBalances[user][asset][chainID]
+}
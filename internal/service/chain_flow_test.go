@@ -0,0 +1,104 @@
+package service
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+
+	"x-swap/internal/utils"
+)
+
+func TestDepositAndWithdrawalOnSimulatedChain(t *testing.T) {
+	chain, withdrawalService, token := setupWithdrawals(t)
+	blockchainService := NewBlockchainService("", token.Address)
+	blockchainService.SetServiceRegistry(serviceRegistry)
+	blockchainService.SetConfirmations(3)
+	assert.Nil(t, blockchainService.SetClient(chain.client))
+	assert.Nil(t, blockchainService.resume())
+
+	depositAddress := utils.GenerateRandomAddress()
+	assert.Nil(t, userService.SetDepositAddress(users[0], depositAddress))
+
+	// the user sends 250 USDC from an external wallet to the deposit address
+	chain.mint(t, token.Address, chain.address, big.NewInt(250e6))
+	data, err := erc20TestABI.Pack("transfer", depositAddress, big.NewInt(250e6))
+	assert.Nil(t, err)
+	receipt := chain.send(t, &token.Address, data)
+	assert.Equal(t, receipt.Status, types.ReceiptStatusSuccessful)
+
+	assert.Nil(t, blockchainService.processNewBlocks())
+	deposit, err := blockchainService.GetDeposit(receipt.TxHash, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, deposit.Status, DepositPending)
+	assert.Equal(t, userService.GetAssetAmount(users[0], "USDC").String(), "0")
+
+	chain.backend.Commit()
+	chain.backend.Commit()
+	assert.Nil(t, blockchainService.processNewBlocks())
+	deposit, err = blockchainService.GetDeposit(receipt.TxHash, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, deposit.Status, DepositCredited)
+	assert.Equal(t, userService.GetAssetAmount(users[0], "USDC"), big.NewInt(250e6))
+
+	recipient := utils.GenerateRandomAddress()
+	withdrawal, err := withdrawalService.RequestWithdrawal(users[0], "USDC", recipient, big.NewInt(100e6))
+	assert.Nil(t, err)
+	assert.Nil(t, withdrawalService.ProcessWithdrawals())
+	chain.backend.Commit()
+	chain.backend.Commit()
+	assert.Nil(t, withdrawalService.ProcessWithdrawals())
+	assert.Nil(t, blockchainService.processNewBlocks())
+
+	confirmed, err := withdrawalService.GetWithdrawal(withdrawal.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, confirmed.Status, WithdrawalConfirmed)
+	assert.Equal(t, chain.tokenBalance(t, token.Address, recipient), big.NewInt(100e6))
+	assert.Equal(t, userService.GetAssetAmount(users[0], "USDC"), big.NewInt(150e6))
+	// the payout is not mistaken for a deposit
+	assert.Equal(t, len(blockchainService.GetDeposits()), 1)
+}
+
+func TestReorgOnSimulatedChainRollsBackDeposit(t *testing.T) {
+	chain, _, token := setupWithdrawals(t)
+	blockchainService := NewBlockchainService("", token.Address)
+	blockchainService.SetServiceRegistry(serviceRegistry)
+	blockchainService.SetConfirmations(2)
+	assert.Nil(t, blockchainService.SetClient(chain.client))
+	assert.Nil(t, blockchainService.resume())
+
+	depositAddress := utils.GenerateRandomAddress()
+	assert.Nil(t, userService.SetDepositAddress(users[0], depositAddress))
+	ancestor, err := chain.client.HeaderByNumber(context.Background(), nil)
+	assert.Nil(t, err)
+
+	chain.mint(t, token.Address, depositAddress, big.NewInt(250e6))
+	chain.backend.Commit()
+	assert.Nil(t, blockchainService.processNewBlocks())
+	deposits := blockchainService.GetDeposits()
+	assert.Equal(t, len(deposits), 1)
+	assert.Equal(t, deposits[0].Status, DepositCredited)
+	assert.Equal(t, userService.GetAssetAmount(users[0], "USDC"), big.NewInt(250e6))
+
+	// the blocks after the ancestor are replaced by a longer fork
+	assert.Nil(t, chain.backend.Fork(ancestor.Hash()))
+	for i := 0; i < 3; i++ {
+		chain.backend.Commit()
+	}
+	commonAncestor, err := blockchainService.findCommonAncestor()
+	assert.Nil(t, err)
+	assert.Equal(t, commonAncestor, ancestor.Number.Uint64())
+
+	latestBlock, err := chain.client.BlockNumber(context.Background())
+	assert.Nil(t, err)
+	assert.Nil(t, blockchainService.checkReorg(latestBlock))
+	assert.Equal(t, blockchainService.GetLastProcessedBlock(), ancestor.Number.Uint64())
+	assert.Equal(t, userService.GetAssetAmount(users[0], "USDC").String(), "0")
+	orphaned := blockchainService.GetOrphanedDeposits()
+	assert.Equal(t, len(orphaned), 1)
+	assert.Equal(t, orphaned[0].Status, DepositRolledBack)
+	assert.Equal(t, orphaned[0].TxHash, deposits[0].TxHash)
+	assert.Nil(t, userService.VerifyBalances())
+}
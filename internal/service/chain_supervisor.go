@@ -0,0 +1,174 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// ChainConfig describes one chain watched for deposits.
+type ChainConfig struct {
+	Name         string
+	ChainID      uint64
+	RPCURLs      []string
+	WebSocketURL string
+	// Confirmations defaults to 12 when zero.
+	Confirmations  uint64
+	CheckpointPath string
+	PollInterval   time.Duration
+}
+
+func (config ChainConfig) Validate() error {
+	if config.ChainID == 0 {
+		return fmt.Errorf("chain %s has no chain ID", config.Name)
+	}
+	if len(config.RPCURLs) == 0 {
+		return fmt.Errorf("chain %s has no RPC endpoints", config.Name)
+	}
+	return nil
+}
+
+// NewChainBlockchainService creates a BlockchainService for one chain. The
+// watched contracts are the registry's tokens on that chain, see
+// WatchRegisteredTokens.
+func NewChainBlockchainService(config ChainConfig) (*BlockchainService, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	service := newBlockchainService(config.RPCURLs)
+	service.name = config.Name
+	service.expectedChainID = config.ChainID
+	if config.Confirmations > 0 {
+		service.SetConfirmations(config.Confirmations)
+	}
+	if config.PollInterval > 0 {
+		service.SetPollInterval(config.PollInterval)
+	}
+	if config.WebSocketURL != "" {
+		service.SetWebSocketURL(config.WebSocketURL)
+	}
+	if config.CheckpointPath != "" {
+		service.SetCheckpointStore(NewFileCheckpointStore(config.CheckpointPath))
+	}
+	return service, nil
+}
+
+// GetChainID returns the configured chain ID, or the connected one for
+// services created without a chain configuration.
+func (service *BlockchainService) GetChainID() uint64 {
+	if service.expectedChainID != 0 {
+		return service.expectedChainID
+	}
+	return service.chainID
+}
+
+// ChainSupervisor runs one BlockchainService per chain and restarts the ones
+// that fail, e.g. because their RPC endpoints are unreachable at startup.
+type ChainSupervisor struct {
+	services        []*BlockchainService
+	serviceRegistry *ServiceRegistry
+	restartDelay    time.Duration
+	ctx             context.Context
+	cancel          context.CancelFunc
+	wg              sync.WaitGroup
+}
+
+func NewChainSupervisor() *ChainSupervisor {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &ChainSupervisor{
+		services:     []*BlockchainService{},
+		restartDelay: 10 * time.Second,
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+}
+
+func (supervisor *ChainSupervisor) SetServiceRegistry(serviceRegistry *ServiceRegistry) {
+	supervisor.serviceRegistry = serviceRegistry
+	for _, service := range supervisor.services {
+		service.SetServiceRegistry(serviceRegistry)
+	}
+}
+
+func (supervisor *ChainSupervisor) SetRestartDelay(restartDelay time.Duration) {
+	supervisor.restartDelay = restartDelay
+}
+
+// AddChain puts a chain's service under supervision.
+func (supervisor *ChainSupervisor) AddChain(service *BlockchainService) error {
+	chainID := service.GetChainID()
+	if chainID == 0 {
+		return errors.New("chain service has no chain ID")
+	}
+	if _, err := supervisor.GetChain(chainID); err == nil {
+		return fmt.Errorf("chain %d already supervised", chainID)
+	}
+	if supervisor.serviceRegistry != nil {
+		service.SetServiceRegistry(supervisor.serviceRegistry)
+	}
+	supervisor.services = append(supervisor.services, service)
+	return nil
+}
+
+func (supervisor *ChainSupervisor) GetChain(chainID uint64) (*BlockchainService, error) {
+	for _, service := range supervisor.services {
+		if service.GetChainID() == chainID {
+			return service, nil
+		}
+	}
+	return nil, fmt.Errorf("chain %d not supervised", chainID)
+}
+
+func (supervisor *ChainSupervisor) GetChains() []*BlockchainService {
+	return append([]*BlockchainService{}, supervisor.services...)
+}
+
+// GetDeposits returns the deposits of all chains.
+func (supervisor *ChainSupervisor) GetDeposits() []Deposit {
+	deposits := []Deposit{}
+	for _, service := range supervisor.services {
+		deposits = append(deposits, service.GetDeposits()...)
+	}
+	return deposits
+}
+
+// Start runs every chain and blocks until Stop is called.
+func (supervisor *ChainSupervisor) Start() {
+	for _, service := range supervisor.services {
+		supervisor.wg.Add(1)
+		go supervisor.supervise(service)
+	}
+	supervisor.wg.Wait()
+}
+
+func (supervisor *ChainSupervisor) Stop() {
+	supervisor.cancel()
+	for _, service := range supervisor.services {
+		service.Stop()
+	}
+}
+
+func (supervisor *ChainSupervisor) supervise(service *BlockchainService) {
+	defer supervisor.wg.Done()
+	for {
+		err := service.WatchRegisteredTokens()
+		if err == nil {
+			err = service.Start()
+		}
+		if supervisor.ctx.Err() != nil {
+			return
+		}
+		log.Printf("Chain %s (%d) stopped, restarting in %s: %v",
+			service.name, service.GetChainID(), supervisor.restartDelay, err)
+
+		select {
+		case <-supervisor.ctx.Done():
+			return
+		case <-time.After(supervisor.restartDelay):
+		}
+	}
+}
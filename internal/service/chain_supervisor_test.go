@@ -0,0 +1,65 @@
+package service
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"x-swap/internal/utils"
+)
+
+func TestSupervisedChainsCreditUnifiedBalances(t *testing.T) {
+	setup()
+	tokenRegistry := NewTokenRegistry()
+	serviceRegistry.SetTokenRegistry(tokenRegistry)
+	supervisor := NewChainSupervisor()
+	supervisor.SetServiceRegistry(serviceRegistry)
+
+	depositAddress := utils.GenerateRandomAddress()
+	assert.Nil(t, userService.SetDepositAddress(users[0], depositAddress))
+
+	// USDC has 6 decimals on the first chain and 18 on the second one
+	chains := []*testChain{newTestChainWithID(t, 1), newTestChainWithID(t, 8453)}
+	decimals := []uint8{6, 18}
+	for i, chain := range chains {
+		chainID := []uint64{1, 8453}[i]
+		tokenAddress := chain.deployToken(t, decimals[i])
+		_, err := tokenRegistry.RegisterToken("USDC", chainID, tokenAddress, int(decimals[i]))
+		assert.Nil(t, err)
+
+		blockchainService, err := NewChainBlockchainService(ChainConfig{
+			ChainID:       chainID,
+			RPCURLs:       []string{"http://localhost:8545"},
+			Confirmations: 1,
+			PollInterval:  10 * time.Millisecond,
+		})
+		assert.Nil(t, err)
+		assert.Nil(t, blockchainService.SetClient(chain.client))
+		assert.Nil(t, supervisor.AddChain(blockchainService))
+		chain.mint(t, tokenAddress, depositAddress, new(big.Int).Mul(big.NewInt(int64(10*(i+1))),
+			new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals[i])), nil)))
+	}
+
+	duplicate, err := NewChainBlockchainService(ChainConfig{ChainID: 1, RPCURLs: []string{"http://localhost:8545"}})
+	assert.Nil(t, err)
+	assert.ErrorContains(t, supervisor.AddChain(duplicate), "already supervised")
+	wrongChain, err := NewChainBlockchainService(ChainConfig{ChainID: 10, RPCURLs: []string{"http://localhost:8545"}})
+	assert.Nil(t, err)
+	assert.ErrorContains(t, wrongChain.SetClient(chains[0].client), "expected chain 10")
+
+	go supervisor.Start()
+	defer supervisor.Stop()
+
+	assert.Eventually(t, func() bool {
+		return len(supervisor.GetDeposits()) == 2
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return userService.GetAssetAmount(users[0], "USDC").Cmp(big.NewInt(30e6)) == 0
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, userService.GetBalanceProvenance(users[0], "USDC"), map[uint64]*big.Int{
+		1:    big.NewInt(10e6),
+		8453: big.NewInt(20e6),
+	})
+}
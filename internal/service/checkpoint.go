@@ -0,0 +1,81 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Checkpoint is the last block fully indexed by a BlockchainService.
+type Checkpoint struct {
+	ChainID     uint64      `json:"chainId"`
+	BlockNumber uint64      `json:"blockNumber"`
+	BlockHash   common.Hash `json:"blockHash"`
+	UpdatedAt   time.Time   `json:"updatedAt"`
+}
+
+// CheckpointStore persists the indexer checkpoint across restarts. Load
+// returns nil when no checkpoint was saved yet.
+type CheckpointStore interface {
+	LoadCheckpoint() (*Checkpoint, error)
+	SaveCheckpoint(checkpoint Checkpoint) error
+}
+
+// FileCheckpointStore keeps the checkpoint in a JSON file.
+type FileCheckpointStore struct {
+	path string
+}
+
+func NewFileCheckpointStore(path string) *FileCheckpointStore {
+	return &FileCheckpointStore{path: path}
+}
+
+func (store *FileCheckpointStore) LoadCheckpoint() (*Checkpoint, error) {
+	data, err := os.ReadFile(store.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var checkpoint Checkpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return nil, fmt.Errorf("checkpoint %s: %w", store.path, err)
+	}
+	return &checkpoint, nil
+}
+
+func (store *FileCheckpointStore) SaveCheckpoint(checkpoint Checkpoint) error {
+	data, err := json.MarshalIndent(checkpoint, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(store.path, data)
+}
+
+// writeFileAtomic writes to a temporary file first and renames it so a crash
+// never leaves a partially written file behind.
+func writeFileAtomic(path string, data []byte) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), path)
+}
@@ -0,0 +1,106 @@
+package service
+
+import (
+	"context"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+
+	"x-swap/internal/utils"
+)
+
+func TestFileCheckpointStore(t *testing.T) {
+	store := NewFileCheckpointStore(filepath.Join(t.TempDir(), "checkpoint.json"))
+
+	checkpoint, err := store.LoadCheckpoint()
+	assert.Nil(t, err)
+	assert.Nil(t, checkpoint)
+
+	saved := Checkpoint{
+		ChainID:     1,
+		BlockNumber: 19_000_000,
+		BlockHash:   common.HexToHash("0x01"),
+		UpdatedAt:   time.Now().UTC().Truncate(time.Second),
+	}
+	assert.Nil(t, store.SaveCheckpoint(saved))
+	saved.BlockNumber++
+	assert.Nil(t, store.SaveCheckpoint(saved))
+
+	checkpoint, err = store.LoadCheckpoint()
+	assert.Nil(t, err)
+	assert.Equal(t, *checkpoint, saved)
+}
+
+func TestResumeFromCheckpointBelowPendingDeposit(t *testing.T) {
+	chain, _, token := setupWithdrawals(t)
+	store := NewFileCheckpointStore(filepath.Join(t.TempDir(), "checkpoint.json"))
+	newIndexer := func() *BlockchainService {
+		blockchainService := NewBlockchainService("", token.Address)
+		blockchainService.SetServiceRegistry(serviceRegistry)
+		blockchainService.SetConfirmations(3)
+		blockchainService.SetCheckpointStore(store)
+		assert.Nil(t, blockchainService.SetClient(chain.client))
+		assert.Nil(t, blockchainService.resume())
+		return blockchainService
+	}
+	depositAddress := utils.GenerateRandomAddress()
+	assert.Nil(t, userService.SetDepositAddress(users[0], depositAddress))
+
+	blockchainService := newIndexer()
+	chain.mint(t, token.Address, depositAddress, big.NewInt(250e6))
+	depositBlock, err := chain.client.BlockNumber(context.Background())
+	assert.Nil(t, err)
+	chain.backend.Commit()
+	assert.Nil(t, blockchainService.processNewBlocks())
+	assert.Equal(t, blockchainService.GetLastProcessedBlock(), depositBlock+1)
+	deposits := blockchainService.GetDeposits()
+	assert.Equal(t, len(deposits), 1)
+	assert.Equal(t, deposits[0].Status, DepositPending)
+
+	// the pending deposit is lost on a restart, so it is indexed again
+	checkpoint, err := store.LoadCheckpoint()
+	assert.Nil(t, err)
+	assert.Equal(t, checkpoint.BlockNumber, depositBlock-1)
+	restarted := newIndexer()
+	assert.Equal(t, restarted.GetLastProcessedBlock(), depositBlock-1)
+
+	chain.backend.Commit()
+	assert.Nil(t, restarted.processNewBlocks())
+	deposit, err := restarted.GetDeposit(deposits[0].TxHash, deposits[0].LogIndex)
+	assert.Nil(t, err)
+	assert.Equal(t, deposit.Status, DepositCredited)
+	assert.Equal(t, userService.GetAssetAmount(users[0], "USDC"), big.NewInt(250e6))
+	checkpoint, err = store.LoadCheckpoint()
+	assert.Nil(t, err)
+	assert.Equal(t, checkpoint.BlockNumber, depositBlock+2)
+}
+
+func TestBackfillCreditsMissedDeposit(t *testing.T) {
+	chain, _, token := setupWithdrawals(t)
+	depositAddress := utils.GenerateRandomAddress()
+	assert.Nil(t, userService.SetDepositAddress(users[0], depositAddress))
+	chain.mint(t, token.Address, depositAddress, big.NewInt(250e6))
+	depositBlock, err := chain.client.BlockNumber(context.Background())
+	assert.Nil(t, err)
+	chain.backend.Commit()
+	chain.backend.Commit()
+
+	blockchainService := NewBlockchainService("", token.Address)
+	blockchainService.SetServiceRegistry(serviceRegistry)
+	blockchainService.SetConfirmations(3)
+	assert.Nil(t, blockchainService.SetClient(chain.client))
+	assert.Nil(t, blockchainService.Backfill(depositBlock, depositBlock))
+
+	deposits := blockchainService.GetDeposits()
+	assert.Equal(t, len(deposits), 1)
+	assert.Equal(t, deposits[0].Status, DepositCredited)
+	assert.Equal(t, deposits[0].Block, depositBlock)
+	assert.Equal(t, userService.GetAssetAmount(users[0], "USDC"), big.NewInt(250e6))
+	// re-scanning the range does not credit the deposit twice
+	assert.Nil(t, blockchainService.Backfill(depositBlock-1, depositBlock+2))
+	assert.Equal(t, userService.GetAssetAmount(users[0], "USDC"), big.NewInt(250e6))
+}
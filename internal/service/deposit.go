@@ -0,0 +1,192 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+type DepositStatus string
+
+const (
+	// DepositPending deposits are waiting for enough confirmations.
+	DepositPending  DepositStatus = "PENDING"
+	DepositCredited DepositStatus = "CREDITED"
+	// DepositOrphaned deposits were in a block removed by a reorg before they
+	// were credited.
+	DepositOrphaned DepositStatus = "ORPHANED"
+	// DepositRolledBack deposits were credited and debited again after a reorg.
+	DepositRolledBack DepositStatus = "ROLLED_BACK"
+	// DepositFlagged deposits were orphaned after the credited funds had been
+	// used, they need manual review unless the transfer is mined again.
+	DepositFlagged DepositStatus = "FLAGGED"
+)
+
+// DepositSource tells how a deposit was transferred.
+type DepositSource string
+
+const (
+	// LogDeposit is an ERC-20 Transfer event.
+	LogDeposit DepositSource = "LOG"
+	// NativeDeposit is a transaction sending ETH to the deposit address.
+	NativeDeposit DepositSource = "NATIVE"
+	// InternalDeposit is ETH sent by a contract call, found in trace data.
+	InternalDeposit DepositSource = "INTERNAL"
+)
+
+// Deposit is a transfer to an exchange deposit address. It is identified by
+// its source, the transaction hash and the log index, or the call index for
+// internal transfers, so the same transfer is never credited twice.
+type Deposit struct {
+	Source    DepositSource
+	TxHash    common.Hash
+	LogIndex  uint
+	From      common.Address
+	User      common.Address
+	Token     string
+	Contract  common.Address
+	ChainID   uint64
+	Amount    *big.Int
+	Block     uint64
+	BlockHash common.Hash
+	Status    DepositStatus
+}
+
+type depositKey struct {
+	source   DepositSource
+	txHash   common.Hash
+	logIndex uint
+}
+
+func (deposit Deposit) key() depositKey {
+	return depositKey{source: deposit.Source, txHash: deposit.TxHash, logIndex: deposit.LogIndex}
+}
+
+// reference is the journal reference of the entries of a deposit.
+func (deposit Deposit) reference() string {
+	return fmt.Sprintf("deposit:%d:%s:%s:%d", deposit.ChainID, deposit.Source, deposit.TxHash.Hex(), deposit.LogIndex)
+}
+
+// recordDeposit stores a transfer to a user deposit address as a pending
+// deposit. Transfers to other addresses and already known events are ignored.
+func (service *BlockchainService) recordDeposit(event *TransferEvent) error {
+	serviceRegistry, err := service.GetServiceRegistry()
+	if err != nil {
+		return err
+	}
+	userService, err := serviceRegistry.GetUserService()
+	if err != nil {
+		return err
+	}
+
+	user, ok := userService.GetUserByDepositAddress(event.To)
+	if !ok {
+		return nil
+	}
+
+	source := event.Source
+	if source == "" {
+		source = LogDeposit
+	}
+	deposit := Deposit{
+		Source:    source,
+		TxHash:    event.TxHash,
+		LogIndex:  event.LogIndex,
+		From:      event.From,
+		User:      user,
+		Token:     event.Token,
+		Contract:  event.Contract,
+		ChainID:   event.ChainID,
+		Amount:    new(big.Int).Set(event.Amount),
+		Block:     event.Block,
+		BlockHash: event.BlockHash,
+		Status:    DepositPending,
+	}
+
+	service.depositsMu.Lock()
+	defer service.depositsMu.Unlock()
+	if existing, ok := service.deposits[deposit.key()]; ok {
+		if existing.Status == DepositFlagged {
+			// the orphaned transfer was mined again on the canonical chain
+			existing.Block = deposit.Block
+			existing.BlockHash = deposit.BlockHash
+			existing.Status = DepositCredited
+			log.Printf("Flagged deposit %s:%d is included in canonical block %d",
+				existing.TxHash.Hex(), existing.LogIndex, existing.Block)
+		}
+		return nil
+	}
+	service.deposits[deposit.key()] = &deposit
+	service.depositKeys = append(service.depositKeys, deposit.key())
+	log.Printf("Recorded deposit %s:%d of %s %s for %s",
+		deposit.TxHash.Hex(), deposit.LogIndex, deposit.Amount, deposit.Token, user.Hex())
+	return nil
+}
+
+// creditConfirmedDeposits credits every pending deposit that has reached the
+// required number of confirmations at latestBlock.
+func (service *BlockchainService) creditConfirmedDeposits(latestBlock uint64) error {
+	serviceRegistry, err := service.GetServiceRegistry()
+	if err != nil {
+		return err
+	}
+	userService, err := serviceRegistry.GetUserService()
+	if err != nil {
+		return err
+	}
+
+	service.depositsMu.Lock()
+	defer service.depositsMu.Unlock()
+	for _, key := range service.depositKeys {
+		deposit := service.deposits[key]
+		if deposit.Status != DepositPending || !service.isConfirmed(deposit.Block, latestBlock) {
+			continue
+		}
+		userService.AddBalanceFromChain(deposit.User, deposit.ChainID, deposit.Token, deposit.Amount, EntryDeposit, deposit.reference())
+		deposit.Status = DepositCredited
+		log.Printf("Credited deposit %s:%d of %s %s to %s",
+			deposit.TxHash.Hex(), deposit.LogIndex, deposit.Amount, deposit.Token, deposit.User.Hex())
+	}
+	return nil
+}
+
+// isConfirmed reports whether a block has at least the configured number of
+// confirmations; the block itself counts as the first one.
+func (service *BlockchainService) isConfirmed(blockNumber uint64, latestBlock uint64) bool {
+	if blockNumber > latestBlock {
+		return false
+	}
+	return latestBlock-blockNumber+1 >= service.confirmations
+}
+
+// GetDeposit returns the ERC-20 deposit made by a Transfer log.
+func (service *BlockchainService) GetDeposit(txHash common.Hash, logIndex uint) (Deposit, error) {
+	return service.GetDepositBySource(LogDeposit, txHash, logIndex)
+}
+
+func (service *BlockchainService) GetDepositBySource(
+	source DepositSource,
+	txHash common.Hash,
+	index uint,
+) (Deposit, error) {
+	service.depositsMu.Lock()
+	defer service.depositsMu.Unlock()
+	deposit, ok := service.deposits[depositKey{source: source, txHash: txHash, logIndex: index}]
+	if !ok {
+		return Deposit{}, fmt.Errorf("%s deposit %s:%d not found", source, txHash.Hex(), index)
+	}
+	return *deposit, nil
+}
+
+// GetDeposits returns all known deposits in the order they were seen.
+func (service *BlockchainService) GetDeposits() []Deposit {
+	service.depositsMu.Lock()
+	defer service.depositsMu.Unlock()
+	deposits := make([]Deposit, 0, len(service.depositKeys))
+	for _, key := range service.depositKeys {
+		deposits = append(deposits, *service.deposits[key])
+	}
+	return deposits
+}
@@ -0,0 +1,65 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// DepositAssignment links a deposit address to its user. Index is the HD
+// derivation index of derived addresses and nil for addresses set directly.
+type DepositAssignment struct {
+	User    common.Address `json:"user"`
+	Address common.Address `json:"address"`
+	Index   *uint32        `json:"index,omitempty"`
+}
+
+// DepositAddresses is the persisted state of the deposit addresses handed
+// out. NextIndex is the next HD index to derive, indexes below it are never
+// handed out again even when they were skipped.
+type DepositAddresses struct {
+	NextIndex   uint32              `json:"nextIndex"`
+	Assignments []DepositAssignment `json:"assignments"`
+}
+
+// DepositAddressStore persists the deposit addresses across restarts. Load
+// returns nil when nothing was saved yet.
+type DepositAddressStore interface {
+	LoadDepositAddresses() (*DepositAddresses, error)
+	SaveDepositAddresses(depositAddresses DepositAddresses) error
+}
+
+// FileDepositAddressStore keeps the deposit addresses in a JSON file.
+type FileDepositAddressStore struct {
+	path string
+}
+
+func NewFileDepositAddressStore(path string) *FileDepositAddressStore {
+	return &FileDepositAddressStore{path: path}
+}
+
+func (store *FileDepositAddressStore) LoadDepositAddresses() (*DepositAddresses, error) {
+	data, err := os.ReadFile(store.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var depositAddresses DepositAddresses
+	if err := json.Unmarshal(data, &depositAddresses); err != nil {
+		return nil, fmt.Errorf("deposit addresses %s: %w", store.path, err)
+	}
+	return &depositAddresses, nil
+}
+
+func (store *FileDepositAddressStore) SaveDepositAddresses(depositAddresses DepositAddresses) error {
+	data, err := json.MarshalIndent(depositAddresses, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(store.path, data)
+}
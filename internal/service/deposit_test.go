@@ -0,0 +1,146 @@
+package service
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+
+	"x-swap/internal/utils"
+)
+
+func TestDepositCreditedOnceAfterConfirmations(t *testing.T) {
+	setup()
+	usdcAddress := utils.GenerateRandomAddress()
+	blockchainService := NewBlockchainService("", usdcAddress)
+	blockchainService.SetServiceRegistry(serviceRegistry)
+	blockchainService.SetConfirmations(3)
+
+	depositAddress := utils.GenerateRandomAddress()
+	assert.Nil(t, userService.SetDepositAddress(users[0], depositAddress))
+
+	event := &TransferEvent{
+		From:     utils.GenerateRandomAddress(),
+		To:       depositAddress,
+		Amount:   big.NewInt(250e6),
+		Token:    "USD",
+		Contract: usdcAddress,
+		ChainID:  1,
+		Block:    100,
+		TxHash:   common.HexToHash("0x01"),
+		LogIndex: 4,
+	}
+	assert.Nil(t, blockchainService.updateUserBalance(event))
+	// the same log seen again, e.g. when a range is re-scanned
+	assert.Nil(t, blockchainService.updateUserBalance(event))
+	// a transfer to an address that is not a deposit address
+	otherEvent := *event
+	otherEvent.To = utils.GenerateRandomAddress()
+	otherEvent.LogIndex = 5
+	assert.Nil(t, blockchainService.updateUserBalance(&otherEvent))
+
+	assert.Equal(t, len(blockchainService.GetDeposits()), 1)
+
+	assert.Nil(t, blockchainService.creditConfirmedDeposits(101))
+	assert.Equal(t, userService.GetAssetAmount(users[0], "USD").String(), "0")
+
+	assert.Nil(t, blockchainService.creditConfirmedDeposits(102))
+	assert.Nil(t, blockchainService.creditConfirmedDeposits(103))
+	assert.Equal(t, userService.GetAssetAmount(users[0], "USD"), big.NewInt(250e6))
+
+	deposit, err := blockchainService.GetDeposit(common.HexToHash("0x01"), 4)
+	assert.Nil(t, err)
+	assert.Equal(t, deposit.Status, DepositCredited)
+	assert.Equal(t, deposit.User, users[0])
+}
+
+func TestParseTransferLog(t *testing.T) {
+	setup()
+	tokenRegistry := NewTokenRegistry()
+	serviceRegistry.SetTokenRegistry(tokenRegistry)
+	usdcAddress := utils.GenerateRandomAddress()
+	_, err := tokenRegistry.RegisterToken("USDC", 0, usdcAddress, 6)
+	assert.Nil(t, err)
+
+	blockchainService := NewBlockchainService("", usdcAddress)
+	blockchainService.SetServiceRegistry(serviceRegistry)
+
+	from := utils.GenerateRandomAddress()
+	to := utils.GenerateRandomAddress()
+	vLog := types.Log{
+		Address: usdcAddress,
+		Topics: []common.Hash{
+			transferEventSigHash,
+			common.BytesToHash(from.Bytes()),
+			common.BytesToHash(to.Bytes()),
+		},
+		Data:        common.LeftPadBytes(big.NewInt(42e6).Bytes(), 32),
+		BlockNumber: 7,
+		TxHash:      common.HexToHash("0x02"),
+		Index:       3,
+	}
+	event, err := blockchainService.parseTransferLog(vLog)
+	assert.Nil(t, err)
+	assert.Equal(t, event.From, from)
+	assert.Equal(t, event.To, to)
+	assert.Equal(t, event.Amount, big.NewInt(42e6))
+	assert.Equal(t, event.Token, "USDC")
+	assert.Equal(t, event.LogIndex, uint(3))
+
+	vLog.Address = utils.GenerateRandomAddress()
+	_, err = blockchainService.parseTransferLog(vLog)
+	assert.ErrorContains(t, err, "not registered")
+}
+
+func TestRollbackOrphanedDeposits(t *testing.T) {
+	setup()
+	blockchainService := NewBlockchainService("", utils.GenerateRandomAddress())
+	blockchainService.SetServiceRegistry(serviceRegistry)
+	blockchainService.SetConfirmations(1)
+
+	depositAddresses := []common.Address{utils.GenerateRandomAddress(), utils.GenerateRandomAddress()}
+	assert.Nil(t, userService.SetDepositAddress(users[0], depositAddresses[0]))
+	assert.Nil(t, userService.SetDepositAddress(users[1], depositAddresses[1]))
+
+	for i, block := range []uint64{10, 11, 12} {
+		assert.Nil(t, blockchainService.recordDeposit(&TransferEvent{
+			To:       depositAddresses[i%2],
+			Amount:   big.NewInt(100e6),
+			Token:    "USD",
+			Block:    block,
+			TxHash:   common.BigToHash(big.NewInt(int64(i + 1))),
+			LogIndex: 0,
+		}))
+	}
+	assert.Nil(t, blockchainService.creditConfirmedDeposits(11))
+	// users[1] trades away the deposit from block 11
+	assert.Nil(t, userService.SubBalance(users[1], "USD", big.NewInt(60e6)))
+
+	assert.Nil(t, blockchainService.rollbackTo(10))
+	assert.Equal(t, blockchainService.GetLastProcessedBlock(), uint64(10))
+	assert.Equal(t, userService.GetAssetAmount(users[0], "USD"), big.NewInt(100e6))
+	assert.Equal(t, userService.GetAssetAmount(users[1], "USD"), big.NewInt(40e6))
+
+	statuses := map[uint64]DepositStatus{}
+	for _, deposit := range blockchainService.GetDeposits() {
+		statuses[deposit.Block] = deposit.Status
+	}
+	assert.Equal(t, statuses, map[uint64]DepositStatus{10: DepositCredited, 11: DepositFlagged})
+
+	orphaned := blockchainService.GetOrphanedDeposits()
+	assert.Equal(t, len(orphaned), 1)
+	assert.Equal(t, orphaned[0].Status, DepositOrphaned)
+
+	// the block 12 transfer is mined again on the canonical chain
+	assert.Nil(t, blockchainService.recordDeposit(&TransferEvent{
+		To:     depositAddresses[0],
+		Amount: big.NewInt(100e6),
+		Token:  "USD",
+		Block:  13,
+		TxHash: common.BigToHash(big.NewInt(3)),
+	}))
+	assert.Nil(t, blockchainService.creditConfirmedDeposits(13))
+	assert.Equal(t, userService.GetAssetAmount(users[0], "USD"), big.NewInt(200e6))
+}
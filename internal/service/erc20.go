@@ -0,0 +1,79 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const erc20ABIJSON = `[
+	{"type":"function","name":"decimals","stateMutability":"view","inputs":[],"outputs":[{"name":"","type":"uint8"}]},
+	{"type":"function","name":"balanceOf","stateMutability":"view","inputs":[{"name":"owner","type":"address"}],"outputs":[{"name":"","type":"uint256"}]},
+	{"type":"function","name":"transfer","stateMutability":"nonpayable","inputs":[{"name":"to","type":"address"},{"name":"amount","type":"uint256"}],"outputs":[{"name":"","type":"bool"}]},
+	{"type":"event","name":"Transfer","anonymous":false,"inputs":[{"name":"from","type":"address","indexed":true},{"name":"to","type":"address","indexed":true},{"name":"value","type":"uint256","indexed":false}]}
+]`
+
+var erc20ABI = mustParseABI(erc20ABIJSON)
+
+var transferEventSigHash = common.BytesToHash(
+	crypto.Keccak256([]byte("Transfer(address,address,uint256)")),
+)
+
+func mustParseABI(definition string) abi.ABI {
+	parsed, err := abi.JSON(strings.NewReader(definition))
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}
+
+// ReadTokenDecimals calls decimals() on an ERC-20 contract.
+func ReadTokenDecimals(
+	ctx context.Context,
+	caller ethereum.ContractCaller,
+	token common.Address,
+) (int, error) {
+	data, err := erc20ABI.Pack("decimals")
+	if err != nil {
+		return 0, err
+	}
+	output, err := caller.CallContract(ctx, ethereum.CallMsg{To: &token, Data: data}, nil)
+	if err != nil {
+		return 0, err
+	}
+	values, err := erc20ABI.Unpack("decimals", output)
+	if err != nil {
+		return 0, fmt.Errorf("token %s decimals: %w", token.Hex(), err)
+	}
+	return int(values[0].(uint8)), nil
+}
+
+// ReadTokenBalance calls balanceOf(owner) on an ERC-20 contract at the given
+// block, or at the latest block when blockNumber is nil.
+func ReadTokenBalance(
+	ctx context.Context,
+	caller ethereum.ContractCaller,
+	token common.Address,
+	owner common.Address,
+	blockNumber *big.Int,
+) (*big.Int, error) {
+	data, err := erc20ABI.Pack("balanceOf", owner)
+	if err != nil {
+		return nil, err
+	}
+	output, err := caller.CallContract(ctx, ethereum.CallMsg{To: &token, Data: data}, blockNumber)
+	if err != nil {
+		return nil, err
+	}
+	values, err := erc20ABI.Unpack("balanceOf", output)
+	if err != nil {
+		return nil, fmt.Errorf("token %s balanceOf: %w", token.Hex(), err)
+	}
+	return values[0].(*big.Int), nil
+}
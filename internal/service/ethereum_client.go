@@ -0,0 +1,53 @@
+package service
+
+import (
+	"context"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// EthereumClient is the subset of the Ethereum JSON-RPC API the services rely
+// on. It is satisfied by *ethclient.Client and by go-ethereum's simulated
+// backend client, so chain interactions can be tested offline.
+type EthereumClient interface {
+	ChainID(ctx context.Context) (*big.Int, error)
+	BlockNumber(ctx context.Context) (uint64, error)
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+	BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error)
+	FilterLogs(ctx context.Context, query ethereum.FilterQuery) ([]types.Log, error)
+	TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error)
+	SendTransaction(ctx context.Context, tx *types.Transaction) error
+	CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error)
+	BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (*big.Int, error)
+}
+
+// transactionSender is what sendTransaction needs of a client.
+type transactionSender interface {
+	SendTransaction(ctx context.Context, tx *types.Transaction) error
+	TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error)
+}
+
+// sendTransaction sends tx and treats the rejections a resend gets as a
+// success: the node already has tx, because an earlier send reached it
+// although its answer was lost, or its nonce is used because tx itself was
+// mined.
+func sendTransaction(ctx context.Context, client transactionSender, tx *types.Transaction) error {
+	err := client.SendTransaction(ctx, tx)
+	if err == nil {
+		return nil
+	}
+	message := strings.ToLower(err.Error())
+	if strings.Contains(message, "already known") || strings.Contains(message, "known transaction") {
+		return nil
+	}
+	if strings.Contains(message, "nonce too low") {
+		if _, receiptErr := client.TransactionReceipt(ctx, tx.Hash()); receiptErr == nil {
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,80 @@
+package service
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Fill is a match between a taker order and a resting maker order. Amounts
+// are in the decimals of the market's tokens. Trades against a liquidity pool
+// are not fills, the pool is settled with its own reserves.
+type Fill struct {
+	ID           int64
+	MarketTicker string
+	BaseToken    string
+	QuoteToken   string
+	MakerOrderID int64
+	TakerOrderID int64
+	Maker        common.Address
+	Taker        common.Address
+	TakerSide    OrderType
+	BaseAmount   *big.Int
+	QuoteAmount  *big.Int
+	Price        *big.Int
+	CreatedAt    time.Time
+}
+
+// SubscribeFills registers a listener that is called synchronously for every
+// fill recorded after the call.
+func (service *OrderService) SubscribeFills(listener func(Fill)) {
+	service.fillListeners = append(service.fillListeners, listener)
+}
+
+// GetFills returns the fills of a market in execution order.
+func (service *OrderService) GetFills(marketTicker string) []Fill {
+	fills := []Fill{}
+	for _, fill := range service.Fills {
+		if fill.MarketTicker == marketTicker {
+			fills = append(fills, fill)
+		}
+	}
+	return fills
+}
+
+func (service *OrderService) recordFill(
+	taker Order,
+	maker Order,
+	marketTicker string,
+	baseAmount *big.Int,
+	quoteAmount *big.Int,
+) Fill {
+	service.fillID++
+	fill := Fill{
+		ID:           service.fillID,
+		MarketTicker: marketTicker,
+		BaseToken:    taker.Market.BaseToken,
+		QuoteToken:   taker.Market.QuoteToken,
+		MakerOrderID: maker.ID,
+		TakerOrderID: taker.ID,
+		Maker:        maker.User,
+		Taker:        taker.User,
+		TakerSide:    taker.OrderType,
+		BaseAmount:   new(big.Int).Set(baseAmount),
+		QuoteAmount:  new(big.Int).Set(quoteAmount),
+		Price:        new(big.Int).Set(maker.Price),
+		CreatedAt:    time.Now(),
+	}
+	service.Fills = append(service.Fills, fill)
+	for _, listener := range service.fillListeners {
+		listener(fill)
+	}
+	return fill
+}
+
+// reference is the journal reference of the trade entry of a fill.
+func (fill Fill) reference() string {
+	return fmt.Sprintf("fill:%d", fill.ID)
+}
@@ -0,0 +1,79 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const externalChainBranch = uint32(0)
+
+// HDWallet hands out deposit addresses m/44'/60'/0'/0/i below the account
+// extended public key, one index per user.
+type HDWallet struct {
+	account   *hdkeychain.ExtendedKey
+	external  *hdkeychain.ExtendedKey
+	nextIndex uint32
+}
+
+// NewHDWallet takes the account level xpub (m/44'/60'/account'), which the
+// wallet owner exports so no private key is needed to derive addresses. Only
+// non-hardened children can be derived from it.
+func NewHDWallet(accountXpub string) (*HDWallet, error) {
+	account, err := hdkeychain.NewKeyFromString(accountXpub)
+	if err != nil {
+		return nil, fmt.Errorf("invalid extended key: %w", err)
+	}
+	if account.IsPrivate() {
+		return nil, errors.New("deposit wallet expects an extended public key, not a private one")
+	}
+	external, err := account.Derive(externalChainBranch)
+	if err != nil {
+		return nil, err
+	}
+	return &HDWallet{account: account, external: external}, nil
+}
+
+// DeriveAddress returns the deposit address at the given index.
+func (wallet *HDWallet) DeriveAddress(index uint32) (common.Address, error) {
+	if index >= hdkeychain.HardenedKeyStart {
+		return common.Address{}, errors.New("cannot derive a hardened child from a public key")
+	}
+	child, err := wallet.external.Derive(index)
+	if err != nil {
+		return common.Address{}, err
+	}
+	publicKey, err := child.ECPubKey()
+	if err != nil {
+		return common.Address{}, err
+	}
+	return crypto.PubkeyToAddress(*publicKey.ToECDSA()), nil
+}
+
+// NextAddress derives the address at the next unused index.
+func (wallet *HDWallet) NextAddress() (common.Address, uint32, error) {
+	for {
+		index := wallet.nextIndex
+		if index >= hdkeychain.HardenedKeyStart {
+			return common.Address{}, 0, errors.New("deposit address indexes exhausted")
+		}
+		wallet.nextIndex++
+		address, err := wallet.DeriveAddress(index)
+		if errors.Is(err, hdkeychain.ErrInvalidChild) {
+			// skip the rare invalid index, as BIP-32 prescribes
+			continue
+		}
+		if err != nil {
+			return common.Address{}, 0, err
+		}
+		return address, index, nil
+	}
+}
+
+// NextIndex returns the index the next deposit address is derived at.
+func (wallet *HDWallet) NextIndex() uint32 {
+	return wallet.nextIndex
+}
@@ -0,0 +1,107 @@
+package service
+
+import (
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+// BIP-32 test vector 1, chain m/0H
+const testVectorXpub = "xpub68Gmy5EdvgibQVfPdqkBBCHxA5htiqg55crXYuXoQRKfDBFA1WEjWgP6LHhwBZeNK1VTsfTFUHCdrfp1bgwQ9xv5ski8PX9rL2dZXvgGDnw"
+
+// seed of the BIP-39 mnemonic "abandon abandon ... about" without passphrase
+const testMnemonicSeed = "5eb00bbddcf069084889a8ab9155568165f5c453ccb85e70811aaed6f6da5fc19a5ac40b389cd370d086206dec8aa6c43daea6690f20ad3d8d48b2d2ce9e38e4"
+
+func TestHDWalletDerivesEthereumAddresses(t *testing.T) {
+	seed, err := hex.DecodeString(testMnemonicSeed)
+	assert.Nil(t, err)
+	key, err := hdkeychain.NewMaster(seed, &chaincfg.MainNetParams)
+	assert.Nil(t, err)
+	for _, index := range []uint32{44, 60, 0} {
+		key, err = key.Derive(hdkeychain.HardenedKeyStart + index)
+		assert.Nil(t, err)
+	}
+	_, err = NewHDWallet(key.String())
+	assert.ErrorContains(t, err, "not a private one")
+	accountXpub, err := key.Neuter()
+	assert.Nil(t, err)
+
+	wallet, err := NewHDWallet(accountXpub.String())
+	assert.Nil(t, err)
+	address, err := wallet.DeriveAddress(0)
+	assert.Nil(t, err)
+	assert.Equal(t, address, common.HexToAddress("0x9858EfFD232B4033E47d90003D41EC34EcaEda94"))
+
+	_, err = wallet.DeriveAddress(hdkeychain.HardenedKeyStart)
+	assert.ErrorContains(t, err, "hardened")
+	_, err = NewHDWallet(testVectorXpub[:len(testVectorXpub)-1] + "x")
+	assert.ErrorContains(t, err, "checksum")
+}
+
+func TestAssignDepositAddress(t *testing.T) {
+	setup()
+	wallet, err := NewHDWallet(testVectorXpub)
+	assert.Nil(t, err)
+	userService.SetDepositWallet(wallet)
+
+	first, err := userService.AssignDepositAddress(users[0])
+	assert.Nil(t, err)
+	second, err := userService.AssignDepositAddress(users[1])
+	assert.Nil(t, err)
+	assert.NotEqual(t, first, second)
+
+	again, err := userService.AssignDepositAddress(users[0])
+	assert.Nil(t, err)
+	assert.Equal(t, again, first)
+
+	expected, err := wallet.DeriveAddress(1)
+	assert.Nil(t, err)
+	assert.Equal(t, second, expected)
+	assert.Equal(t, userService.DepositIndexes[second], uint32(1))
+
+	owner, ok := userService.GetUserByDepositAddress(second)
+	assert.True(t, ok)
+	assert.Equal(t, owner, users[1])
+}
+
+func TestDepositAddressesSurviveRestart(t *testing.T) {
+	setup()
+	path := filepath.Join(t.TempDir(), "deposit-addresses.json")
+	wallet, err := NewHDWallet(testVectorXpub)
+	assert.Nil(t, err)
+	userService.SetDepositWallet(wallet)
+	assert.Nil(t, userService.SetDepositAddressStore(NewFileDepositAddressStore(path)))
+	first, err := userService.AssignDepositAddress(users[0])
+	assert.Nil(t, err)
+	manual := common.HexToAddress("0x1234")
+	assert.Nil(t, userService.SetDepositAddress(users[1], manual))
+
+	// a restarted service hands out the same addresses and continues the indexes
+	restarted := NewUserService()
+	wallet, err = NewHDWallet(testVectorXpub)
+	assert.Nil(t, err)
+	restarted.SetDepositWallet(wallet)
+	assert.Nil(t, restarted.SetDepositAddressStore(NewFileDepositAddressStore(path)))
+	again, err := restarted.AssignDepositAddress(users[0])
+	assert.Nil(t, err)
+	assert.Equal(t, again, first)
+	owner, ok := restarted.GetUserByDepositAddress(manual)
+	assert.True(t, ok)
+	assert.Equal(t, owner, users[1])
+	second, err := restarted.AssignDepositAddress(users[2])
+	assert.Nil(t, err)
+	assert.Equal(t, restarted.DepositIndexes[second], uint32(1))
+
+	// the saved addresses must come from the configured wallet
+	otherWallet, err := NewHDWallet("xpub6ASuArnXKPbfEwhqN6e3mwBcDTgzisQN1wXN9BJcM47sSikHjJf3UFHKkNAWbWMiGj7Wf5uMash7SyYq527Hqck2AxYysAA7xmALppuCkwQ")
+	assert.Nil(t, err)
+	mismatched := NewUserService()
+	mismatched.SetDepositWallet(otherWallet)
+	err = mismatched.SetDepositAddressStore(NewFileDepositAddressStore(path))
+	assert.ErrorContains(t, err, "is not derived at index 0")
+}
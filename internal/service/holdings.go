@@ -0,0 +1,107 @@
+package service
+
+import (
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// LatestBlock returns the current head of the chain.
+func (service *BlockchainService) LatestBlock() (uint64, error) {
+	if err := service.Connect(); err != nil {
+		return 0, err
+	}
+	return service.client.BlockNumber(service.ctx)
+}
+
+// ReadHoldings returns the total balance of a token held by the given
+// addresses at a block, in the token's decimals on this chain. The native
+// token is read with eth_getBalance, ERC-20 tokens with balanceOf.
+func (service *BlockchainService) ReadHoldings(
+	token Token,
+	holders []common.Address,
+	blockNumber uint64,
+) (*big.Int, error) {
+	if err := service.Connect(); err != nil {
+		return nil, err
+	}
+
+	block := new(big.Int).SetUint64(blockNumber)
+	total := big.NewInt(0)
+	seen := make(map[common.Address]bool, len(holders))
+	for _, holder := range holders {
+		if seen[holder] {
+			continue
+		}
+		seen[holder] = true
+
+		var balance *big.Int
+		var err error
+		if token.Address == NativeTokenAddress {
+			balance, err = service.client.BalanceAt(service.ctx, holder, block)
+		} else {
+			balance, err = ReadTokenBalance(service.ctx, service.client, token.Address, holder, block)
+		}
+		if err != nil {
+			return nil, err
+		}
+		total.Add(total, balance)
+	}
+	return total, nil
+}
+
+// assetHoldings is what the exchange holds of an asset across its chains.
+type assetHoldings struct {
+	total  *big.Int
+	chains map[uint64]*big.Int
+	blocks map[uint64]uint64
+}
+
+// readAssetHoldings sums the holdings of an asset on every chain it is
+// deployed on, converted to the asset's decimals. blocks pins the block read
+// on each chain; chains without an entry are read at their latest block.
+func readAssetHoldings(
+	tokenRegistry *TokenRegistry,
+	chainSupervisor *ChainSupervisor,
+	asset string,
+	holders []common.Address,
+	blocks map[uint64]uint64,
+) (assetHoldings, error) {
+	holdings := assetHoldings{
+		total:  big.NewInt(0),
+		chains: make(map[uint64]*big.Int),
+		blocks: make(map[uint64]uint64),
+	}
+	for _, chainID := range tokenRegistry.GetChains(asset) {
+		token, err := tokenRegistry.GetTokenOnChain(asset, chainID)
+		if err != nil {
+			return assetHoldings{}, err
+		}
+		blockchainService, err := chainSupervisor.GetChain(chainID)
+		if err != nil {
+			return assetHoldings{}, err
+		}
+		blockNumber, pinned := blocks[chainID]
+		if !pinned {
+			if blockNumber, err = blockchainService.LatestBlock(); err != nil {
+				return assetHoldings{}, err
+			}
+		}
+		amount, err := blockchainService.ReadHoldings(token, holders, blockNumber)
+		if err != nil {
+			return assetHoldings{}, err
+		}
+		amount = tokenRegistry.ToAssetAmount(token, amount)
+		holdings.chains[chainID] = amount
+		holdings.blocks[chainID] = blockNumber
+		holdings.total.Add(holdings.total, amount)
+	}
+	return holdings, nil
+}
+
+// exchangeHolders returns the exchange wallets followed by all user deposit
+// addresses.
+func exchangeHolders(userService *UserService, wallets []common.Address) []common.Address {
+	holders := append([]common.Address{}, wallets...)
+	return append(holders, userService.GetDepositAddresses()...)
+}
@@ -0,0 +1,357 @@
+package service
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// EntryReason is why a journal entry moved funds.
+type EntryReason string
+
+const (
+	EntryDeposit          EntryReason = "DEPOSIT"
+	EntryDepositRollback  EntryReason = "DEPOSIT_ROLLBACK"
+	EntryWithdrawal       EntryReason = "WITHDRAWAL"
+	EntryWithdrawalRefund EntryReason = "WITHDRAWAL_REFUND"
+	EntryTrade            EntryReason = "TRADE"
+	EntryPoolTrade        EntryReason = "POOL_TRADE"
+	EntryLock             EntryReason = "LOCK"
+	EntryUnlock           EntryReason = "UNLOCK"
+	EntryAddLiquidity     EntryReason = "ADD_LIQUIDITY"
+	EntryRemoveLiquidity  EntryReason = "REMOVE_LIQUIDITY"
+	EntryTransfer         EntryReason = "TRANSFER"
+	EntryAdjustment       EntryReason = "ADJUSTMENT"
+)
+
+// AccountKind is the kind of a ledger account.
+type AccountKind string
+
+const (
+	// AccountAvailable holds the funds a user can trade or withdraw.
+	AccountAvailable AccountKind = "AVAILABLE"
+	// AccountLocked holds the funds a user has reserved for resting orders.
+	AccountLocked AccountKind = "LOCKED"
+	// AccountExternal is the counterparty of funds entering or leaving the
+	// exchange on a chain.
+	AccountExternal AccountKind = "EXTERNAL"
+	// AccountPool holds the reserves of a market's liquidity pool.
+	AccountPool AccountKind = "POOL"
+	// AccountEquity is the exchange's own account, the counterparty of manual
+	// adjustments.
+	AccountEquity AccountKind = "EQUITY"
+)
+
+// LedgerAccount identifies an account of the journal. Owner is set for user
+// accounts, ID for external (chain ID) and pool (market ticker) accounts.
+type LedgerAccount struct {
+	Kind  AccountKind
+	Owner common.Address
+	ID    string
+}
+
+func (account LedgerAccount) String() string {
+	switch account.Kind {
+	case AccountAvailable, AccountLocked:
+		return fmt.Sprintf("%s:%s", account.Kind, account.Owner.Hex())
+	case AccountExternal, AccountPool:
+		return fmt.Sprintf("%s:%s", account.Kind, account.ID)
+	default:
+		return string(account.Kind)
+	}
+}
+
+func availableAccount(user common.Address) LedgerAccount {
+	return LedgerAccount{Kind: AccountAvailable, Owner: user}
+}
+
+func lockedAccount(user common.Address) LedgerAccount {
+	return LedgerAccount{Kind: AccountLocked, Owner: user}
+}
+
+func externalAccount(chainID uint64) LedgerAccount {
+	return LedgerAccount{Kind: AccountExternal, ID: strconv.FormatUint(chainID, 10)}
+}
+
+func poolAccount(marketTicker string) LedgerAccount {
+	return LedgerAccount{Kind: AccountPool, ID: marketTicker}
+}
+
+func equityAccount() LedgerAccount {
+	return LedgerAccount{Kind: AccountEquity}
+}
+
+// Posting changes the balance of one account by Amount, positive amounts
+// credit the account and negative amounts debit it.
+type Posting struct {
+	Account LedgerAccount
+	Asset   string
+	Amount  *big.Int
+}
+
+// transfer returns the postings that move amount of an asset between two
+// accounts.
+func transfer(from LedgerAccount, to LedgerAccount, asset string, amount *big.Int) []Posting {
+	return []Posting{
+		{Account: from, Asset: asset, Amount: new(big.Int).Neg(amount)},
+		{Account: to, Asset: asset, Amount: new(big.Int).Set(amount)},
+	}
+}
+
+// JournalEntry is one balanced movement of funds: the postings of every asset
+// sum to zero.
+type JournalEntry struct {
+	ID        int64
+	Reason    EntryReason
+	Reference string
+	Postings  []Posting
+	CreatedAt time.Time
+}
+
+func (entry JournalEntry) clone() JournalEntry {
+	postings := make([]Posting, len(entry.Postings))
+	for i, posting := range entry.Postings {
+		postings[i] = Posting{
+			Account: posting.Account,
+			Asset:   posting.Asset,
+			Amount:  new(big.Int).Set(posting.Amount),
+		}
+	}
+	entry.Postings = postings
+	return entry
+}
+
+// checkBalanced returns an error unless the postings of every asset sum to
+// zero.
+func (entry JournalEntry) checkBalanced() error {
+	sums := make(map[string]*big.Int)
+	for _, posting := range entry.Postings {
+		if posting.Amount == nil {
+			return fmt.Errorf("posting to %s has no amount", posting.Account)
+		}
+		if sums[posting.Asset] == nil {
+			sums[posting.Asset] = big.NewInt(0)
+		}
+		sums[posting.Asset].Add(sums[posting.Asset], posting.Amount)
+	}
+	assets := make([]string, 0, len(sums))
+	for asset := range sums {
+		assets = append(assets, asset)
+	}
+	sort.Strings(assets)
+	for _, asset := range assets {
+		if sums[asset].Sign() != 0 {
+			return fmt.Errorf("%s entry %q is unbalanced by %s %s", entry.Reason, entry.Reference, sums[asset], asset)
+		}
+	}
+	return nil
+}
+
+// Journal is an append-only double-entry journal. The balance of every
+// account is derived from its entries and cached.
+type Journal struct {
+	entries  []JournalEntry
+	balances map[LedgerAccount]map[string]*big.Int
+	nextID   int64
+	mu       sync.Mutex
+}
+
+func NewJournal() *Journal {
+	return &Journal{
+		entries:  []JournalEntry{},
+		balances: make(map[LedgerAccount]map[string]*big.Int),
+		nextID:   1,
+	}
+}
+
+// Post appends a balanced entry and applies it to the cached balances. Zero
+// postings are dropped and an entry without postings is not recorded. The
+// amounts are copied, so the caller may reuse them.
+func (journal *Journal) Post(reason EntryReason, reference string, postings ...Posting) (JournalEntry, error) {
+	entry := JournalEntry{Reason: reason, Reference: reference}
+	for _, posting := range postings {
+		if posting.Amount != nil && posting.Amount.Sign() == 0 {
+			continue
+		}
+		entry.Postings = append(entry.Postings, posting)
+	}
+	if err := entry.checkBalanced(); err != nil {
+		return JournalEntry{}, err
+	}
+	if len(entry.Postings) == 0 {
+		return JournalEntry{}, nil
+	}
+	entry = entry.clone()
+
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+	entry.ID = journal.nextID
+	entry.CreatedAt = time.Now()
+	journal.nextID++
+	journal.entries = append(journal.entries, entry)
+	applyPostings(journal.balances, entry.Postings)
+	return entry.clone(), nil
+}
+
+func applyPostings(balances map[LedgerAccount]map[string]*big.Int, postings []Posting) {
+	for _, posting := range postings {
+		if balances[posting.Account] == nil {
+			balances[posting.Account] = make(map[string]*big.Int)
+		}
+		balance := balances[posting.Account][posting.Asset]
+		if balance == nil {
+			balance = big.NewInt(0)
+		}
+		// a fresh value, so balances handed out earlier never change
+		balances[posting.Account][posting.Asset] = new(big.Int).Add(balance, posting.Amount)
+	}
+}
+
+// Balance returns the cached balance of an account.
+func (journal *Journal) Balance(account LedgerAccount, asset string) *big.Int {
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+	if balance := journal.balances[account][asset]; balance != nil {
+		return new(big.Int).Set(balance)
+	}
+	return big.NewInt(0)
+}
+
+// Totals returns the sum of the balances of all accounts of each kind per
+// asset.
+func (journal *Journal) Totals() map[AccountKind]map[string]*big.Int {
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+	totals := make(map[AccountKind]map[string]*big.Int)
+	for account, balances := range journal.balances {
+		if totals[account.Kind] == nil {
+			totals[account.Kind] = make(map[string]*big.Int)
+		}
+		for asset, balance := range balances {
+			addAmount(totals[account.Kind], asset, balance)
+		}
+	}
+	return totals
+}
+
+// Entries returns a copy of all entries in the order they were posted.
+func (journal *Journal) Entries() []JournalEntry {
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+	entries := make([]JournalEntry, len(journal.entries))
+	for i, entry := range journal.entries {
+		entries[i] = entry.clone()
+	}
+	return entries
+}
+
+// GetEntriesByReference returns the entries posted with a reference.
+func (journal *Journal) GetEntriesByReference(reference string) []JournalEntry {
+	entries := []JournalEntry{}
+	for _, entry := range journal.Entries() {
+		if entry.Reference == reference {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// Verify replays the journal from the first entry and checks that every entry
+// is balanced and the cached balances match the replayed ones.
+func (journal *Journal) Verify() error {
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+
+	replayed := make(map[LedgerAccount]map[string]*big.Int)
+	for _, entry := range journal.entries {
+		if err := entry.checkBalanced(); err != nil {
+			return fmt.Errorf("entry %d: %w", entry.ID, err)
+		}
+		applyPostings(replayed, entry.Postings)
+	}
+	for account, assets := range journal.balances {
+		for asset, balance := range assets {
+			expected := replayed[account][asset]
+			if expected == nil {
+				expected = big.NewInt(0)
+			}
+			if balance.Cmp(expected) != 0 {
+				return fmt.Errorf("cached %s balance of %s is %s, journal gives %s", asset, account, balance, expected)
+			}
+		}
+	}
+	for account, assets := range replayed {
+		for asset, expected := range assets {
+			if expected.Sign() != 0 && journal.balances[account][asset] == nil {
+				return fmt.Errorf("%s balance of %s is missing from the cache", asset, account)
+			}
+		}
+	}
+	return nil
+}
+
+// GetJournal returns the journal all balance changes are posted to.
+func (service *UserService) GetJournal() *Journal {
+	return service.journal
+}
+
+// post records an entry built by the service itself and refreshes the cached
+// balances of the users it touches. The postings are balanced by
+// construction, so an error is a bug.
+func (service *UserService) post(reason EntryReason, reference string, postings ...Posting) JournalEntry {
+	if err := service.checkInvariants(postings); err != nil {
+		panic(fmt.Errorf("%s entry %q: %w", reason, reference, err))
+	}
+	entry, err := service.journal.Post(reason, reference, postings...)
+	if err != nil {
+		panic(err)
+	}
+	for _, posting := range entry.Postings {
+		if posting.Account.Kind == AccountAvailable || posting.Account.Kind == AccountLocked {
+			service.refreshBalance(posting.Account.Owner, posting.Asset)
+		}
+	}
+	return entry
+}
+
+// refreshBalance derives the cached Balance and BalanceLocked of a user from
+// the journal. Balance is the total of the available and locked accounts.
+func (service *UserService) refreshBalance(user common.Address, asset string) {
+	locked := service.journal.Balance(lockedAccount(user), asset)
+	balance := service.journal.Balance(availableAccount(user), asset)
+	balance.Add(balance, locked)
+	account := service.ensureUser(user)
+	account.Balance[asset] = balance
+	account.BalanceLocked[asset] = locked
+}
+
+// VerifyBalances checks the journal and that the cached balances of every
+// user match the ones derived from it.
+func (service *UserService) VerifyBalances() error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	if err := service.journal.Verify(); err != nil {
+		return err
+	}
+	for address, user := range service.Users {
+		for asset, balance := range user.Balance {
+			expected := service.journal.Balance(availableAccount(address), asset)
+			expected.Add(expected, service.journal.Balance(lockedAccount(address), asset))
+			if balance.Cmp(expected) != 0 {
+				return fmt.Errorf("%s balance of %s is %s, journal gives %s", asset, address.Hex(), balance, expected)
+			}
+		}
+		for asset, locked := range user.BalanceLocked {
+			if expected := service.journal.Balance(lockedAccount(address), asset); locked.Cmp(expected) != 0 {
+				return fmt.Errorf("locked %s of %s is %s, journal gives %s", asset, address.Hex(), locked, expected)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJournalRejectsUnbalancedEntries(t *testing.T) {
+	setup()
+	journal := NewJournal()
+	_, err := journal.Post(EntryAdjustment, "",
+		Posting{Account: equityAccount(), Asset: "USD", Amount: big.NewInt(-100)},
+		Posting{Account: availableAccount(users[0]), Asset: "USD", Amount: big.NewInt(90)},
+	)
+	assert.ErrorContains(t, err, "unbalanced by -10 USD")
+	// the same amount of another asset does not balance it
+	_, err = journal.Post(EntryAdjustment, "",
+		Posting{Account: equityAccount(), Asset: "USD", Amount: big.NewInt(-100)},
+		Posting{Account: availableAccount(users[0]), Asset: "BTC", Amount: big.NewInt(100)},
+	)
+	assert.ErrorContains(t, err, "unbalanced")
+	assert.Equal(t, len(journal.Entries()), 0)
+
+	entry, err := journal.Post(EntryAdjustment, "", transfer(equityAccount(), availableAccount(users[0]), "USD", big.NewInt(100))...)
+	assert.Nil(t, err)
+	assert.Equal(t, entry.ID, int64(1))
+	assert.Equal(t, journal.Balance(availableAccount(users[0]), "USD"), big.NewInt(100))
+	assert.Equal(t, journal.Balance(equityAccount(), "USD"), big.NewInt(-100))
+	assert.Nil(t, journal.Verify())
+}
+
+func TestAddBalanceCopiesAmount(t *testing.T) {
+	setup()
+	amount := big.NewInt(100e6)
+	userService.AddBalance(users[0], "USD", amount)
+	amount.SetInt64(1)
+	assert.Equal(t, userService.GetAssetAmount(users[0], "USD"), big.NewInt(100e6))
+
+	userService.GetAssetAmount(users[0], "USD").SetInt64(2)
+	assert.Equal(t, userService.GetAssetAmount(users[0], "USD"), big.NewInt(100e6))
+	assert.Nil(t, userService.VerifyBalances())
+}
+
+func TestOrdersPostToJournal(t *testing.T) {
+	setup()
+	topup(users[0], big.NewInt(2e8), "BTC")
+	topup(users[1], big.NewInt(200_000e6), "USD")
+
+	maker := Order{
+		ID:         orderService.GetNextOrderID(),
+		User:       users[0],
+		OrderType:  SellOrder,
+		Size:       big.NewInt(1e8),
+		Price:      big.NewInt(100_000e6),
+		SizeFilled: big.NewInt(0),
+		CreatedAt:  time.Now(),
+		Status:     Open,
+		Market:     market,
+	}
+	_, err := userService.PlaceOrder(maker, false)
+	assert.Nil(t, err)
+	taker := maker
+	taker.ID = orderService.GetNextOrderID()
+	taker.User = users[1]
+	taker.OrderType = BuyOrder
+	taker.Size = big.NewInt(5e7)
+	taker.SizeFilled = big.NewInt(0)
+	_, err = userService.PlaceOrder(taker, true)
+	assert.Nil(t, err)
+
+	journal := userService.GetJournal()
+	reasons := []EntryReason{}
+	for _, entry := range journal.Entries() {
+		reasons = append(reasons, entry.Reason)
+	}
+	assert.Equal(t, reasons, []EntryReason{EntryAdjustment, EntryAdjustment, EntryLock, EntryTrade})
+
+	lock := journal.GetEntriesByReference(orderReference(marketTicker, maker.ID))
+	assert.Equal(t, len(lock), 1)
+	assert.Equal(t, lock[0].Postings[1].Account, lockedAccount(users[0]))
+	assert.Equal(t, lock[0].Postings[1].Amount, big.NewInt(1e8))
+
+	trade := journal.GetEntriesByReference("fill:1")
+	assert.Equal(t, len(trade), 1)
+	assert.Equal(t, len(trade[0].Postings), 4)
+	assert.Equal(t, journal.Balance(availableAccount(users[1]), "BTC"), big.NewInt(5e7))
+	assert.Equal(t, journal.Balance(availableAccount(users[0]), "USD"), big.NewInt(50_000e6))
+	assert.Equal(t, userService.GetAssetAmount(users[1], "USD"), big.NewInt(150_000e6))
+	assert.Nil(t, userService.VerifyBalances())
+
+	// a balance changed behind the journal's back is caught
+	userService.Users[users[1]].Balance["USD"] = big.NewInt(1)
+	assert.ErrorContains(t, userService.VerifyBalances(), "journal gives 150000000000")
+}
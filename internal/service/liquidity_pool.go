@@ -0,0 +1,243 @@
+package service
+
+import (
+	"errors"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const feeDenominator = 10_000
+
+// LiquidityPool is a constant-product (x * y = k) pool that sits alongside the
+// order book of a market. Prices are expressed the same way as order prices:
+// quote token units per 10^BaseTokenDecimals base token units.
+type LiquidityPool struct {
+	ReserveBase  *big.Int
+	ReserveQuote *big.Int
+	TotalShares  *big.Int
+	Shares       map[common.Address]*big.Int
+	FeeBps       int64
+}
+
+func NewLiquidityPool(feeBps int64) *LiquidityPool {
+	return &LiquidityPool{
+		ReserveBase:  big.NewInt(0),
+		ReserveQuote: big.NewInt(0),
+		TotalShares:  big.NewInt(0),
+		Shares:       make(map[common.Address]*big.Int),
+		FeeBps:       feeBps,
+	}
+}
+
+func (pool *LiquidityPool) Clone() *LiquidityPool {
+	shares := make(map[common.Address]*big.Int, len(pool.Shares))
+	for user, amount := range pool.Shares {
+		shares[user] = new(big.Int).Set(amount)
+	}
+	return &LiquidityPool{
+		ReserveBase:  new(big.Int).Set(pool.ReserveBase),
+		ReserveQuote: new(big.Int).Set(pool.ReserveQuote),
+		TotalShares:  new(big.Int).Set(pool.TotalShares),
+		Shares:       shares,
+		FeeBps:       pool.FeeBps,
+	}
+}
+
+func (pool *LiquidityPool) HasLiquidity() bool {
+	return pool.ReserveBase.Sign() > 0 && pool.ReserveQuote.Sign() > 0
+}
+
+// Price returns the spot price of the pool.
+func (pool *LiquidityPool) Price(baseMultiplier *big.Int) *big.Int {
+	if !pool.HasLiquidity() {
+		return big.NewInt(0)
+	}
+	price := new(big.Int).Mul(pool.ReserveQuote, baseMultiplier)
+	return price.Div(price, pool.ReserveBase)
+}
+
+func (pool *LiquidityPool) GetShares(user common.Address) *big.Int {
+	if pool.Shares[user] == nil {
+		return big.NewInt(0)
+	}
+	return new(big.Int).Set(pool.Shares[user])
+}
+
+// Deposit adds liquidity at the current pool ratio and mints LP shares. The
+// first deposit sets the ratio; later deposits only use the proportional part of
+// the supplied amounts. It returns the shares minted and the amounts used.
+func (pool *LiquidityPool) Deposit(
+	user common.Address,
+	baseAmount *big.Int,
+	quoteAmount *big.Int,
+) (*big.Int, *big.Int, *big.Int, error) {
+	if baseAmount.Sign() <= 0 || quoteAmount.Sign() <= 0 {
+		return nil, nil, nil, errors.New("liquidity amounts must be positive")
+	}
+
+	baseUsed := new(big.Int).Set(baseAmount)
+	quoteUsed := new(big.Int).Set(quoteAmount)
+	var shares *big.Int
+	if pool.TotalShares.Sign() == 0 {
+		shares = new(big.Int).Sqrt(new(big.Int).Mul(baseAmount, quoteAmount))
+	} else {
+		quoteUsed = new(big.Int).Mul(baseAmount, pool.ReserveQuote)
+		quoteUsed.Div(quoteUsed, pool.ReserveBase)
+		if quoteUsed.Cmp(quoteAmount) > 0 {
+			quoteUsed.Set(quoteAmount)
+			baseUsed = new(big.Int).Mul(quoteAmount, pool.ReserveBase)
+			baseUsed.Div(baseUsed, pool.ReserveQuote)
+		}
+		shares = new(big.Int).Mul(baseUsed, pool.TotalShares)
+		shares.Div(shares, pool.ReserveBase)
+	}
+	if shares.Sign() <= 0 {
+		return nil, nil, nil, errors.New("liquidity deposit too small")
+	}
+
+	pool.ReserveBase.Add(pool.ReserveBase, baseUsed)
+	pool.ReserveQuote.Add(pool.ReserveQuote, quoteUsed)
+	pool.TotalShares.Add(pool.TotalShares, shares)
+	if pool.Shares[user] == nil {
+		pool.Shares[user] = big.NewInt(0)
+	}
+	pool.Shares[user].Add(pool.Shares[user], shares)
+
+	return shares, baseUsed, quoteUsed, nil
+}
+
+// Withdraw burns LP shares and returns the pro-rata base and quote reserves.
+func (pool *LiquidityPool) Withdraw(
+	user common.Address,
+	shares *big.Int,
+) (*big.Int, *big.Int, error) {
+	if shares.Sign() <= 0 {
+		return nil, nil, errors.New("shares must be positive")
+	}
+	if pool.GetShares(user).Cmp(shares) < 0 {
+		return nil, nil, errors.New("insufficient liquidity shares")
+	}
+
+	baseAmount := new(big.Int).Mul(shares, pool.ReserveBase)
+	baseAmount.Div(baseAmount, pool.TotalShares)
+	quoteAmount := new(big.Int).Mul(shares, pool.ReserveQuote)
+	quoteAmount.Div(quoteAmount, pool.TotalShares)
+
+	pool.ReserveBase.Sub(pool.ReserveBase, baseAmount)
+	pool.ReserveQuote.Sub(pool.ReserveQuote, quoteAmount)
+	pool.TotalShares.Sub(pool.TotalShares, shares)
+	pool.Shares[user].Sub(pool.Shares[user], shares)
+	if pool.Shares[user].Sign() == 0 {
+		delete(pool.Shares, user)
+	}
+
+	return baseAmount, quoteAmount, nil
+}
+
+// FillBuy sells base tokens from the pool to a buyer until the marginal price
+// including the fee reaches limitPrice, maxBase is bought or maxQuote is spent.
+// It returns the base amount bought and the quote amount paid.
+func (pool *LiquidityPool) FillBuy(
+	limitPrice *big.Int,
+	maxBase *big.Int,
+	maxQuote *big.Int,
+	baseMultiplier *big.Int,
+) (*big.Int, *big.Int) {
+	if !pool.HasLiquidity() || limitPrice.Sign() <= 0 {
+		return big.NewInt(0), big.NewInt(0)
+	}
+
+	// spot price at which the marginal price after fee equals limitPrice
+	targetPrice := new(big.Int).Mul(limitPrice, big.NewInt(feeDenominator-pool.FeeBps))
+	targetPrice.Div(targetPrice, big.NewInt(feeDenominator))
+	if targetPrice.Sign() <= 0 {
+		return big.NewInt(0), big.NewInt(0)
+	}
+	targetReserveBase := new(big.Int).Mul(pool.ReserveBase, pool.ReserveQuote)
+	targetReserveBase.Mul(targetReserveBase, baseMultiplier)
+	targetReserveBase.Div(targetReserveBase, targetPrice)
+	targetReserveBase.Sqrt(targetReserveBase)
+
+	baseOut := new(big.Int).Sub(pool.ReserveBase, targetReserveBase)
+	if baseOut.Sign() <= 0 {
+		return big.NewInt(0), big.NewInt(0)
+	}
+	if baseOut.Cmp(maxBase) > 0 {
+		baseOut.Set(maxBase)
+	}
+	if baseOut.Cmp(pool.ReserveBase) >= 0 {
+		baseOut.Sub(pool.ReserveBase, big.NewInt(1))
+	}
+
+	quoteIn := pool.getAmountIn(baseOut, pool.ReserveQuote, pool.ReserveBase)
+	if quoteIn.Cmp(maxQuote) > 0 {
+		quoteIn = new(big.Int).Set(maxQuote)
+		baseOut = pool.getAmountOut(quoteIn, pool.ReserveQuote, pool.ReserveBase)
+	}
+	if baseOut.Sign() <= 0 {
+		return big.NewInt(0), big.NewInt(0)
+	}
+
+	pool.ReserveBase.Sub(pool.ReserveBase, baseOut)
+	pool.ReserveQuote.Add(pool.ReserveQuote, quoteIn)
+	return baseOut, quoteIn
+}
+
+// FillSell buys base tokens from a seller until the marginal price after fee
+// drops to limitPrice or maxBase is sold. It returns the base amount sold and
+// the quote amount received.
+func (pool *LiquidityPool) FillSell(
+	limitPrice *big.Int,
+	maxBase *big.Int,
+	baseMultiplier *big.Int,
+) (*big.Int, *big.Int) {
+	if !pool.HasLiquidity() || limitPrice.Sign() <= 0 {
+		return big.NewInt(0), big.NewInt(0)
+	}
+
+	// spot price at which the marginal price after fee equals limitPrice
+	targetPrice := new(big.Int).Mul(limitPrice, big.NewInt(feeDenominator))
+	targetPrice.Div(targetPrice, big.NewInt(feeDenominator-pool.FeeBps))
+	targetReserveBase := new(big.Int).Mul(pool.ReserveBase, pool.ReserveQuote)
+	targetReserveBase.Mul(targetReserveBase, baseMultiplier)
+	targetReserveBase.Div(targetReserveBase, targetPrice)
+	targetReserveBase.Sqrt(targetReserveBase)
+
+	baseIn := new(big.Int).Sub(targetReserveBase, pool.ReserveBase)
+	if baseIn.Sign() <= 0 {
+		return big.NewInt(0), big.NewInt(0)
+	}
+	// gross up so that the amount left after the fee moves the reserves to target
+	baseIn.Mul(baseIn, big.NewInt(feeDenominator))
+	baseIn.Div(baseIn, big.NewInt(feeDenominator-pool.FeeBps))
+	if baseIn.Cmp(maxBase) > 0 {
+		baseIn.Set(maxBase)
+	}
+
+	quoteOut := pool.getAmountOut(baseIn, pool.ReserveBase, pool.ReserveQuote)
+	if quoteOut.Sign() <= 0 {
+		return big.NewInt(0), big.NewInt(0)
+	}
+
+	pool.ReserveBase.Add(pool.ReserveBase, baseIn)
+	pool.ReserveQuote.Sub(pool.ReserveQuote, quoteOut)
+	return baseIn, quoteOut
+}
+
+func (pool *LiquidityPool) getAmountOut(amountIn, reserveIn, reserveOut *big.Int) *big.Int {
+	amountInWithFee := new(big.Int).Mul(amountIn, big.NewInt(feeDenominator-pool.FeeBps))
+	numerator := new(big.Int).Mul(amountInWithFee, reserveOut)
+	denominator := new(big.Int).Mul(reserveIn, big.NewInt(feeDenominator))
+	denominator.Add(denominator, amountInWithFee)
+	return numerator.Div(numerator, denominator)
+}
+
+func (pool *LiquidityPool) getAmountIn(amountOut, reserveIn, reserveOut *big.Int) *big.Int {
+	numerator := new(big.Int).Mul(reserveIn, amountOut)
+	numerator.Mul(numerator, big.NewInt(feeDenominator))
+	denominator := new(big.Int).Sub(reserveOut, amountOut)
+	denominator.Mul(denominator, big.NewInt(feeDenominator-pool.FeeBps))
+	amountIn := numerator.Div(numerator, denominator)
+	return amountIn.Add(amountIn, big.NewInt(1))
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddAndRemoveLiquidity(t *testing.T) {
+	setup()
+	_, err := marketService.CreatePool(marketTicker, 30)
+	assert.Nil(t, err)
+
+	topup(users[3], big.NewInt(10e8), "BTC")
+	topup(users[3], big.NewInt(1_120_000e6), "USD")
+
+	shares, err := userService.AddLiquidity(users[3], marketTicker, big.NewInt(10e8), big.NewInt(1_120_000e6))
+	assert.Nil(t, err)
+	assert.Equal(t, userService.GetAssetAmount(users[3], "BTC").String(), "0")
+	assert.Equal(t, userService.GetAssetAmount(users[3], "USD").String(), "0")
+
+	pool, _ := marketService.GetPool(marketTicker)
+	assert.Equal(t, pool.Price(big.NewInt(1e8)), big.NewInt(112_000e6))
+
+	baseAmount, quoteAmount, err := userService.RemoveLiquidity(users[3], marketTicker, shares)
+	assert.Nil(t, err)
+	assert.Equal(t, baseAmount, big.NewInt(10e8))
+	assert.Equal(t, quoteAmount, big.NewInt(1_120_000e6))
+	assert.Equal(t, userService.GetAssetAmount(users[3], "BTC"), big.NewInt(10e8))
+	assert.Equal(t, pool.TotalShares.String(), "0")
+}
+
+func TestFillBuyOrderAcrossBookAndPool(t *testing.T) {
+	setup()
+	_, err := marketService.CreatePool(marketTicker, 30)
+	assert.Nil(t, err)
+	topup(users[3], big.NewInt(10e8), "BTC")
+	topup(users[3], big.NewInt(1_120_000e6), "USD")
+	_, err = userService.AddLiquidity(users[3], marketTicker, big.NewInt(10e8), big.NewInt(1_120_000e6))
+	assert.Nil(t, err)
+
+	topup(users[1], big.NewInt(1e8), "BTC")
+	userService.PlaceOrder(Order{
+		ID:         orderService.GetNextOrderID(),
+		User:       users[1],
+		OrderType:  SellOrder,
+		Size:       big.NewInt(1e8),
+		Price:      big.NewInt(113_000e6),
+		SizeFilled: big.NewInt(0),
+		CreatedAt:  time.Now(),
+		Status:     Open,
+		Market:     market,
+	}, false)
+
+	topup(users[2], big.NewInt(500_000e6), "USD")
+	order := Order{
+		ID:         orderService.GetNextOrderID(),
+		User:       users[2],
+		OrderType:  BuyOrder,
+		Size:       big.NewInt(2e8),
+		Price:      big.NewInt(115_000e6),
+		SizeFilled: big.NewInt(0),
+		CreatedAt:  time.Now(),
+		Status:     Open,
+		Market:     market,
+	}
+	amountIn, amountOut, _ := orderService.GetQuote(order.Clone(), marketTicker)
+	report, err := userService.PlaceOrder(order, true)
+	assert.Nil(t, err)
+
+	// the pool is cheaper than the resting order until its price reaches 113k
+	assert.True(t, report.PoolBaseAmount.Sign() > 0)
+	assert.Equal(t, report.BookBaseAmount, big.NewInt(1e8))
+	assert.Equal(t, report.BookQuoteAmount, big.NewInt(113_000e6))
+
+	received := new(big.Int).Add(report.BookBaseAmount, report.PoolBaseAmount)
+	paid := new(big.Int).Add(report.BookQuoteAmount, report.PoolQuoteAmount)
+	assert.Equal(t, received, amountOut)
+	assert.Equal(t, paid, amountIn)
+	assert.Equal(t, userService.GetAssetAmount(users[2], "BTC"), received)
+	assert.Equal(
+		t,
+		userService.GetAssetAmount(users[2], "USD"),
+		new(big.Int).Sub(big.NewInt(500_000e6), paid),
+	)
+	assert.Equal(t, userService.GetAssetAmount(users[1], "USD"), big.NewInt(113_000e6))
+}
+
+func TestGetQuoteFromPoolOnly(t *testing.T) {
+	setup()
+	_, err := marketService.CreatePool(marketTicker, 30)
+	assert.Nil(t, err)
+	topup(users[3], big.NewInt(10e8), "BTC")
+	topup(users[3], big.NewInt(1_120_000e6), "USD")
+	_, err = userService.AddLiquidity(users[3], marketTicker, big.NewInt(10e8), big.NewInt(1_120_000e6))
+	assert.Nil(t, err)
+
+	order := Order{
+		User:       users[2],
+		OrderType:  SellOrder,
+		Size:       big.NewInt(1e8),
+		Price:      big.NewInt(90_000e6),
+		SizeFilled: big.NewInt(0),
+		Market:     market,
+	}
+	amountIn, amountOut, executionPrice := orderService.GetQuote(order, marketTicker)
+	assert.Equal(t, amountIn, big.NewInt(1e8))
+	assert.True(t, amountOut.Sign() > 0)
+	assert.True(t, executionPrice.Cmp(big.NewInt(112_000e6)) < 0)
+	assert.True(t, executionPrice.Cmp(big.NewInt(90_000e6)) > 0)
+}
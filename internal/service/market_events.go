@@ -0,0 +1,57 @@
+package service
+
+import (
+	"math/big"
+	"slices"
+	"time"
+)
+
+type MarketEventType string
+
+const (
+	MarketHaltedEvent        MarketEventType = "MARKET_HALTED"
+	MarketResumedEvent       MarketEventType = "MARKET_RESUMED"
+	MarketStatusChangedEvent MarketEventType = "MARKET_STATUS_CHANGED"
+)
+
+type MarketEvent struct {
+	Type           MarketEventType
+	MarketTicker   string
+	PreviousStatus MarketStatus
+	Status         MarketStatus
+	Reason         string
+	Price          *big.Int
+	Time           time.Time
+}
+
+// Subscribe registers a listener that is called synchronously for every market
+// event emitted after the call.
+func (service *MarketService) Subscribe(listener func(MarketEvent)) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	service.listeners = append(service.listeners, listener)
+}
+
+func (service *MarketService) GetEvents(marketTicker string) []MarketEvent {
+	service.mu.RLock()
+	defer service.mu.RUnlock()
+	events := []MarketEvent{}
+	for _, event := range service.events {
+		if event.MarketTicker == marketTicker {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// emit records an event and calls the listeners. The caller must not hold
+// mu, so listeners can read the markets.
+func (service *MarketService) emit(event MarketEvent) {
+	service.mu.Lock()
+	service.events = append(service.events, event)
+	listeners := slices.Clone(service.listeners)
+	service.mu.Unlock()
+	for _, listener := range listeners {
+		listener(event)
+	}
+}
@@ -0,0 +1,179 @@
+package service
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+)
+
+type MarketStatus string
+
+const (
+	// MarketPreOpen accepts resting orders but no taker orders.
+	MarketPreOpen MarketStatus = "PRE_OPEN"
+	MarketTrading MarketStatus = "TRADING"
+	// MarketCancelOnly rejects new orders but lets users cancel resting ones.
+	MarketCancelOnly MarketStatus = "CANCEL_ONLY"
+	MarketHalted     MarketStatus = "HALTED"
+	// MarketDelisted is terminal: all resting orders are cancelled.
+	MarketDelisted MarketStatus = "DELISTED"
+)
+
+var marketStatusTransitions = map[MarketStatus][]MarketStatus{
+	MarketPreOpen:    {MarketTrading, MarketCancelOnly, MarketHalted, MarketDelisted},
+	MarketTrading:    {MarketCancelOnly, MarketHalted, MarketDelisted},
+	MarketCancelOnly: {MarketPreOpen, MarketTrading, MarketHalted, MarketDelisted},
+	MarketHalted:     {MarketPreOpen, MarketTrading, MarketCancelOnly, MarketDelisted},
+	MarketDelisted:   {},
+}
+
+func canTransition(from MarketStatus, to MarketStatus) bool {
+	for _, status := range marketStatusTransitions[from] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
+// SetMarketStatus is the admin entry point for changing the state of a market.
+// Delisting cancels every resting order and releases the locked balances.
+func (service *MarketService) SetMarketStatus(
+	marketTicker string,
+	status MarketStatus,
+	reason string,
+) error {
+	var orderService *OrderService
+	if status == MarketDelisted {
+		serviceRegistry, err := service.GetServiceRegistry()
+		if err != nil {
+			return err
+		}
+		orderService, err = serviceRegistry.GetOrderService()
+		if err != nil {
+			return err
+		}
+		userService, err := serviceRegistry.GetUserService()
+		if err != nil {
+			return err
+		}
+		// cancelling releases the order locks held by the user service, and
+		// holding its lock keeps new orders out until the market is delisted
+		userService.mu.Lock()
+		defer userService.mu.Unlock()
+	}
+
+	service.mu.RLock()
+	err := service.checkTransition(marketTicker, status)
+	service.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	if status == MarketDelisted {
+		if err := orderService.CancelAllOrders(marketTicker); err != nil {
+			return err
+		}
+	}
+
+	service.mu.Lock()
+	event, err := service.setStatus(marketTicker, status, reason, nil, time.Now())
+	service.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	service.emit(event)
+	return nil
+}
+
+func (service *MarketService) HaltMarket(marketTicker string, reason string) error {
+	return service.SetMarketStatus(marketTicker, MarketHalted, reason)
+}
+
+// ResumeMarket returns a market to trading, lifting a halt before its
+// cool-down has elapsed.
+func (service *MarketService) ResumeMarket(marketTicker string) error {
+	return service.SetMarketStatus(marketTicker, MarketTrading, "resumed manually")
+}
+
+func (service *MarketService) DelistMarket(marketTicker string, reason string) error {
+	return service.SetMarketStatus(marketTicker, MarketDelisted, reason)
+}
+
+// checkTransition returns why a market cannot change to the status. The
+// caller must hold mu.
+func (service *MarketService) checkTransition(marketTicker string, status MarketStatus) error {
+	market, ok := service.markets[marketTicker]
+	if !ok {
+		return fmt.Errorf("market %s not found", marketTicker)
+	}
+	if !canTransition(market.Status, status) {
+		return fmt.Errorf(
+			"market %s cannot change from %s to %s",
+			marketTicker, market.Status, status,
+		)
+	}
+	return nil
+}
+
+// setStatus changes the status of a market and returns the event to emit
+// once the caller released mu, which it must hold.
+func (service *MarketService) setStatus(
+	marketTicker string,
+	status MarketStatus,
+	reason string,
+	price *big.Int,
+	at time.Time,
+) (MarketEvent, error) {
+	if err := service.checkTransition(marketTicker, status); err != nil {
+		return MarketEvent{}, err
+	}
+	market := service.markets[marketTicker]
+	previousStatus := market.Status
+	market.Status = status
+	market.HaltedUntil = time.Time{}
+	service.markets[marketTicker] = market
+
+	eventType := MarketStatusChangedEvent
+	if status == MarketHalted {
+		eventType = MarketHaltedEvent
+	} else if previousStatus == MarketHalted && status == MarketTrading {
+		eventType = MarketResumedEvent
+	}
+	return MarketEvent{
+		Type:           eventType,
+		MarketTicker:   marketTicker,
+		PreviousStatus: previousStatus,
+		Status:         status,
+		Reason:         reason,
+		Price:          price,
+		Time:           at,
+	}, nil
+}
+
+// CheckAcceptsOrder returns why a market in its current state does not accept
+// a new order, or nil if it does.
+func (market Market) CheckAcceptsOrder(fill bool) error {
+	switch market.Status {
+	case MarketTrading:
+		return nil
+	case MarketPreOpen:
+		if fill {
+			return fmt.Errorf("market %s is pre-open and only accepts resting orders", market.MarketTicker)
+		}
+		return nil
+	case MarketHalted:
+		if market.HaltedUntil.IsZero() {
+			return fmt.Errorf("market %s is halted", market.MarketTicker)
+		}
+		return fmt.Errorf(
+			"market %s is halted until %s",
+			market.MarketTicker, market.HaltedUntil.Format(time.RFC3339),
+		)
+	case MarketCancelOnly:
+		return fmt.Errorf("market %s is in cancel-only mode", market.MarketTicker)
+	case MarketDelisted:
+		return fmt.Errorf("market %s is delisted", market.MarketTicker)
+	default:
+		return fmt.Errorf("market %s has unknown status %s", market.MarketTicker, market.Status)
+	}
+}
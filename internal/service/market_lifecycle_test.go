@@ -0,0 +1,83 @@
+package service
+
+import (
+	"math/big"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCancelOnlyRejectsNewOrders(t *testing.T) {
+	setup()
+	topup(users[0], big.NewInt(200_000e6), "USD")
+	order := newLimitOrder(0, BuyOrder, 1e8, 100_000e6)
+	_, err := userService.PlaceOrder(order, false)
+	assert.Nil(t, err)
+
+	assert.Nil(t, marketService.SetMarketStatus(marketTicker, MarketCancelOnly, "maintenance"))
+	_, err = userService.PlaceOrder(newLimitOrder(0, BuyOrder, 1e8, 90_000e6), false)
+	assert.ErrorContains(t, err, "cancel-only")
+
+	assert.Nil(t, userService.CancelOrder(users[0], marketTicker, order.ID))
+	assert.Equal(t, len(orderService.GetActiveOrdersByMarketTicker(marketTicker)), 0)
+	assert.Equal(t, userService.GetAssetAmountLocked(users[0], "USD").String(), "0")
+	assert.Equal(t, orderService.GetInActiveOrdersByMarketTicker(marketTicker)[0].Status, Closed)
+}
+
+func TestDelistCancelsRestingOrders(t *testing.T) {
+	setup()
+	topup(users[0], big.NewInt(200_000e6), "USD")
+	topup(users[1], big.NewInt(2e8), "BTC")
+	_, err := userService.PlaceOrder(newLimitOrder(0, BuyOrder, 1e8, 100_000e6), false)
+	assert.Nil(t, err)
+	_, err = userService.PlaceOrder(newLimitOrder(1, SellOrder, 2e8, 110_000e6), false)
+	assert.Nil(t, err)
+
+	assert.Nil(t, marketService.DelistMarket(marketTicker, "token migration"))
+	assert.Equal(t, len(orderService.GetActiveOrdersByMarketTicker(marketTicker)), 0)
+	assert.Equal(t, userService.GetAssetAmountAvailable(users[0], "USD"), big.NewInt(200_000e6))
+	assert.Equal(t, userService.GetAssetAmountAvailable(users[1], "BTC"), big.NewInt(2e8))
+	assert.Equal(t, marketService.GetMarket(marketTicker).BuyLiquidityInBaseToken.String(), "0")
+	assert.Equal(t, marketService.GetMarket(marketTicker).SellLiquidityInBaseToken.String(), "0")
+
+	_, err = userService.PlaceOrder(newLimitOrder(0, BuyOrder, 1e8, 100_000e6), false)
+	assert.ErrorContains(t, err, "delisted")
+	assert.ErrorContains(t, marketService.ResumeMarket(marketTicker), "cannot change from DELISTED")
+
+	events := marketService.GetEvents(marketTicker)
+	assert.Equal(t, events[len(events)-1].Status, MarketDelisted)
+}
+
+func TestStatusChangesDuringTrading(t *testing.T) {
+	setup()
+	topup(users[0], big.NewInt(2_000_000e6), "USD")
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 20 {
+			assert.Nil(t, marketService.SetMarketStatus(marketTicker, MarketCancelOnly, "maintenance"))
+			assert.Nil(t, marketService.SetMarketStatus(marketTicker, MarketTrading, "maintenance done"))
+		}
+	}()
+	for range 20 {
+		// orders are rejected while the market is cancel-only
+		_, _ = userService.PlaceOrder(newLimitOrder(0, BuyOrder, 1e6, 100_000e6), false)
+	}
+	wg.Wait()
+	assert.Equal(t, marketService.GetMarket(marketTicker).Status, MarketTrading)
+	assert.Equal(t, len(marketService.GetEvents(marketTicker)), 40)
+}
+
+func TestPreOpenOnlyAcceptsRestingOrders(t *testing.T) {
+	setup()
+	assert.Nil(t, marketService.HaltMarket(marketTicker, "incident"))
+	assert.Nil(t, marketService.SetMarketStatus(marketTicker, MarketPreOpen, "reopening"))
+
+	topup(users[0], big.NewInt(200_000e6), "USD")
+	_, err := userService.PlaceOrder(newLimitOrder(0, BuyOrder, 1e8, 100_000e6), true)
+	assert.ErrorContains(t, err, "pre-open")
+	_, err = userService.PlaceOrder(newLimitOrder(0, BuyOrder, 1e8, 100_000e6), false)
+	assert.Nil(t, err)
+}
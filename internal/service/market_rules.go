@@ -0,0 +1,86 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// MarketRules are the per-market trading constraints checked by PlaceOrder. A
+// nil limit (or zero MaxOpenOrders) means the rule is not enforced.
+type MarketRules struct {
+	// TickSize is the price increment, in quote token units.
+	TickSize *big.Int
+	// LotSize is the size increment, in base token units.
+	LotSize *big.Int
+	MinSize *big.Int
+	MaxSize *big.Int
+	// MinNotional is the minimum size * price, in quote token units.
+	MinNotional *big.Int
+	// MaxOpenOrders caps the number of resting orders per user.
+	MaxOpenOrders int
+}
+
+func (rules MarketRules) Validate() error {
+	// checked in a fixed order so the same rules always report the same error
+	for _, rule := range []struct {
+		name  string
+		value *big.Int
+	}{
+		{"tick size", rules.TickSize},
+		{"lot size", rules.LotSize},
+		{"min size", rules.MinSize},
+		{"max size", rules.MaxSize},
+		{"min notional", rules.MinNotional},
+	} {
+		if rule.value != nil && rule.value.Sign() <= 0 {
+			return fmt.Errorf("%s must be positive", rule.name)
+		}
+	}
+	if rules.MinSize != nil && rules.MaxSize != nil && rules.MinSize.Cmp(rules.MaxSize) > 0 {
+		return errors.New("min size is greater than max size")
+	}
+	if rules.MaxOpenOrders < 0 {
+		return errors.New("max open orders must not be negative")
+	}
+	return nil
+}
+
+// CheckOrder validates the price and size of an order against the rules.
+func (rules MarketRules) CheckOrder(order Order, baseMultiplier *big.Int) error {
+	if order.Size == nil || order.Size.Sign() <= 0 {
+		return errors.New("order size must be positive")
+	}
+	if order.Price == nil || order.Price.Sign() <= 0 {
+		return errors.New("order price must be positive")
+	}
+	if rules.TickSize != nil && new(big.Int).Mod(order.Price, rules.TickSize).Sign() != 0 {
+		return fmt.Errorf(
+			"price %s is not a multiple of tick size %s",
+			order.Price, rules.TickSize,
+		)
+	}
+	if rules.LotSize != nil && new(big.Int).Mod(order.Size, rules.LotSize).Sign() != 0 {
+		return fmt.Errorf(
+			"size %s is not a multiple of lot size %s",
+			order.Size, rules.LotSize,
+		)
+	}
+	if rules.MinSize != nil && order.Size.Cmp(rules.MinSize) < 0 {
+		return fmt.Errorf("size %s is below minimum size %s", order.Size, rules.MinSize)
+	}
+	if rules.MaxSize != nil && order.Size.Cmp(rules.MaxSize) > 0 {
+		return fmt.Errorf("size %s is above maximum size %s", order.Size, rules.MaxSize)
+	}
+	if rules.MinNotional != nil {
+		notional := new(big.Int).Mul(order.Size, order.Price)
+		notional.Div(notional, baseMultiplier)
+		if notional.Cmp(rules.MinNotional) < 0 {
+			return fmt.Errorf(
+				"notional %s is below minimum notional %s",
+				notional, rules.MinNotional,
+			)
+		}
+	}
+	return nil
+}
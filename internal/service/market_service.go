@@ -1,13 +1,24 @@
 package service
 
 import (
+	"errors"
 	"fmt"
 	"math/big"
+	"sync"
+	"time"
 )
 
 type MarketService struct {
-	Markets       map[string]Market
-	MarketTickers []string
+	// markets, marketTickers, events, listeners and priceHistory are guarded
+	// by mu, as admin calls change markets while orders are placed. Market
+	// listeners are called without it.
+	markets         map[string]Market
+	marketTickers   []string
+	events          []MarketEvent
+	listeners       []func(MarketEvent)
+	priceHistory    map[string][]pricePoint
+	serviceRegistry *ServiceRegistry
+	mu              sync.RWMutex
 }
 
 type Market struct {
@@ -18,34 +29,62 @@ type Market struct {
 	MarketTicker             string
 	BuyLiquidityInBaseToken  *big.Int
 	SellLiquidityInBaseToken *big.Int
+	Pool                     *LiquidityPool
+	Rules                    MarketRules
+	Protection               PriceProtection
+	Status                   MarketStatus
+	HaltedUntil              time.Time
 }
 
 func NewMarketService() *MarketService {
 	return &MarketService{
-		Markets:       make(map[string]Market),
-		MarketTickers: []string{},
+		markets:       make(map[string]Market),
+		marketTickers: []string{},
+		priceHistory:  make(map[string][]pricePoint),
 	}
 }
 
-func (service *MarketService) CreateMarket(
-	baseToken string,
-	quoteToken string,
-	baseTokenDecimals int,
-	quoteTokenDecimals int,
-) Market {
-	marketTicker := GetMarketTicker(baseToken, quoteToken)
-	service.MarketTickers = append(service.MarketTickers, marketTicker)
-	service.Markets[marketTicker] = Market{
-		BaseToken:                baseToken,
-		QuoteToken:               quoteToken,
-		BaseTokenDecimals:        baseTokenDecimals,
-		QuoteTokenDecimals:       quoteTokenDecimals,
+// CreateMarket opens trading between two assets of the token registry. The
+// decimals of the market are the decimals of the assets.
+func (service *MarketService) CreateMarket(baseToken string, quoteToken string) (Market, error) {
+	serviceRegistry, err := service.GetServiceRegistry()
+	if err != nil {
+		return Market{}, err
+	}
+	tokenRegistry, err := serviceRegistry.GetTokenRegistry()
+	if err != nil {
+		return Market{}, err
+	}
+	base, err := tokenRegistry.GetToken(baseToken)
+	if err != nil {
+		return Market{}, err
+	}
+	quote, err := tokenRegistry.GetToken(quoteToken)
+	if err != nil {
+		return Market{}, err
+	}
+	if base.Symbol == quote.Symbol {
+		return Market{}, fmt.Errorf("market base and quote are both %s", base.Symbol)
+	}
+	marketTicker := GetMarketTicker(base.Symbol, quote.Symbol)
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	if _, ok := service.markets[marketTicker]; ok {
+		return Market{}, fmt.Errorf("market %s already exists", marketTicker)
+	}
+
+	service.marketTickers = append(service.marketTickers, marketTicker)
+	service.markets[marketTicker] = Market{
+		BaseToken:                base.Symbol,
+		QuoteToken:               quote.Symbol,
+		BaseTokenDecimals:        base.Decimals,
+		QuoteTokenDecimals:       quote.Decimals,
 		MarketTicker:             marketTicker,
 		BuyLiquidityInBaseToken:  big.NewInt(0),
 		SellLiquidityInBaseToken: big.NewInt(0),
+		Status:                   MarketTrading,
 	}
-
-	return service.Markets[marketTicker]
+	return service.markets[marketTicker], nil
 }
 
 func (service *MarketService) UpdateLiquidity(
@@ -53,18 +92,99 @@ func (service *MarketService) UpdateLiquidity(
 	buyLiquidityInBaseToken *big.Int,
 	sellLiquidityInBaseToken *big.Int,
 ) {
-	market := service.Markets[marketTicker]
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	market := service.markets[marketTicker]
 	market.BuyLiquidityInBaseToken.Add(market.BuyLiquidityInBaseToken, buyLiquidityInBaseToken)
 	market.SellLiquidityInBaseToken.Add(market.SellLiquidityInBaseToken, sellLiquidityInBaseToken)
-	service.Markets[marketTicker] = market
+	service.markets[marketTicker] = market
+}
+
+func (service *MarketService) SetServiceRegistry(serviceRegistry *ServiceRegistry) {
+	service.serviceRegistry = serviceRegistry
+}
+
+func (service *MarketService) GetServiceRegistry() (*ServiceRegistry, error) {
+	if service.serviceRegistry == nil {
+		return nil, errors.New("service registry not set")
+	}
+	return service.serviceRegistry, nil
+}
+
+// SetMarketRules replaces the trading rules of a market.
+func (service *MarketService) SetMarketRules(marketTicker string, rules MarketRules) error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	market, ok := service.markets[marketTicker]
+	if !ok {
+		return fmt.Errorf("market %s not found", marketTicker)
+	}
+	if err := rules.Validate(); err != nil {
+		return err
+	}
+	market.Rules = rules
+	service.markets[marketTicker] = market
+	return nil
+}
+
+// CreatePool attaches a constant-product liquidity pool to an existing market.
+func (service *MarketService) CreatePool(marketTicker string, feeBps int64) (*LiquidityPool, error) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	market, ok := service.markets[marketTicker]
+	if !ok {
+		return nil, fmt.Errorf("market %s not found", marketTicker)
+	}
+	if market.Pool != nil {
+		return nil, fmt.Errorf("market %s already has a pool", marketTicker)
+	}
+	if feeBps < 0 || feeBps >= feeDenominator {
+		return nil, errors.New("pool fee must be between 0 and 10000 bps")
+	}
+	market.Pool = NewLiquidityPool(feeBps)
+	service.markets[marketTicker] = market
+	return market.Pool, nil
+}
+
+func (service *MarketService) GetPool(marketTicker string) (*LiquidityPool, error) {
+	service.mu.RLock()
+	defer service.mu.RUnlock()
+	pool := service.markets[marketTicker].Pool
+	if pool == nil {
+		return nil, fmt.Errorf("market %s has no pool", marketTicker)
+	}
+	return pool, nil
 }
 
 func (service *MarketService) GetMarket(marketTicker string) Market {
-	return service.Markets[marketTicker]
+	service.mu.RLock()
+	defer service.mu.RUnlock()
+	return service.markets[marketTicker]
+}
+
+// LookupMarket returns a market and whether it exists.
+func (service *MarketService) LookupMarket(marketTicker string) (Market, bool) {
+	service.mu.RLock()
+	defer service.mu.RUnlock()
+	market, ok := service.markets[marketTicker]
+	return market, ok
+}
+
+// GetMarkets returns the markets in the order they were created.
+func (service *MarketService) GetMarkets() []Market {
+	service.mu.RLock()
+	defer service.mu.RUnlock()
+	markets := make([]Market, 0, len(service.marketTickers))
+	for _, marketTicker := range service.marketTickers {
+		markets = append(markets, service.markets[marketTicker])
+	}
+	return markets
 }
 
 func (service *MarketService) PrintMarkets(marketTicker string) {
-	for _, market := range service.Markets {
+	service.mu.RLock()
+	defer service.mu.RUnlock()
+	for _, market := range service.markets {
 		if market.MarketTicker == marketTicker {
 			baseMultiplier := new(
 				big.Int,
@@ -0,0 +1,190 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// SumNode is a node of a Merkle sum tree: a hash committing to the subtree and
+// the sum of the balances below it.
+type SumNode struct {
+	Hash common.Hash `json:"hash"`
+	Sum  *big.Int    `json:"sum"`
+}
+
+// LiabilityTree is a Merkle sum tree over the balances of one asset. Every
+// parent hash commits to both child hashes and both child sums, so a proof
+// cannot hide liabilities by moving them between siblings, and the root sum
+// is the total owed to users.
+type LiabilityTree struct {
+	Asset   string
+	levels  [][]SumNode
+	indexes map[common.Address]int
+	users   []common.Address
+	amounts []*big.Int
+}
+
+// InclusionProof shows that a user balance is included in a published root.
+// Siblings are ordered from the leaf up to the root.
+type InclusionProof struct {
+	Asset    string         `json:"asset"`
+	User     common.Address `json:"user"`
+	Balance  *big.Int       `json:"balance"`
+	Index    int            `json:"index"`
+	Siblings []SumNode      `json:"siblings"`
+	Root     common.Hash    `json:"root"`
+	Total    *big.Int       `json:"total"`
+}
+
+// liabilityLeaf hashes a user balance, keccak256(0x00 || user || balance).
+func liabilityLeaf(user common.Address, balance *big.Int) SumNode {
+	hash := crypto.Keccak256Hash([]byte{0}, user.Bytes(), math.U256Bytes(new(big.Int).Set(balance)))
+	return SumNode{Hash: hash, Sum: new(big.Int).Set(balance)}
+}
+
+// sumParent hashes two children,
+// keccak256(0x01 || left hash || left sum || right hash || right sum).
+func sumParent(left SumNode, right SumNode) SumNode {
+	hash := crypto.Keccak256Hash(
+		[]byte{1},
+		left.Hash.Bytes(), math.U256Bytes(new(big.Int).Set(left.Sum)),
+		right.Hash.Bytes(), math.U256Bytes(new(big.Int).Set(right.Sum)),
+	)
+	return SumNode{Hash: hash, Sum: new(big.Int).Add(left.Sum, right.Sum)}
+}
+
+// emptySumNode pads levels with an odd number of nodes.
+func emptySumNode() SumNode {
+	return SumNode{Sum: big.NewInt(0)}
+}
+
+// BuildLiabilityTree builds the tree of an asset from user balances. Users
+// are ordered by address so the same balances always give the same root;
+// zero balances are left out.
+func BuildLiabilityTree(asset string, balances map[common.Address]*big.Int) (*LiabilityTree, error) {
+	tree := &LiabilityTree{Asset: asset, indexes: make(map[common.Address]int)}
+	for user, balance := range balances {
+		if balance == nil || balance.Sign() == 0 {
+			continue
+		}
+		if balance.Sign() < 0 {
+			return nil, fmt.Errorf("%s balance of %s is negative", asset, user.Hex())
+		}
+		if balance.BitLen() > 256 {
+			return nil, fmt.Errorf("%s balance of %s exceeds 256 bits", asset, user.Hex())
+		}
+		tree.users = append(tree.users, user)
+	}
+	sort.Slice(tree.users, func(i, j int) bool {
+		return bytes.Compare(tree.users[i].Bytes(), tree.users[j].Bytes()) < 0
+	})
+
+	leaves := make([]SumNode, len(tree.users))
+	for i, user := range tree.users {
+		tree.indexes[user] = i
+		tree.amounts = append(tree.amounts, new(big.Int).Set(balances[user]))
+		leaves[i] = liabilityLeaf(user, balances[user])
+	}
+	if len(leaves) == 0 {
+		leaves = []SumNode{emptySumNode()}
+	}
+	tree.levels = [][]SumNode{leaves}
+	for level := leaves; len(level) > 1; {
+		if len(level)%2 == 1 {
+			level = append(level, emptySumNode())
+		}
+		parents := make([]SumNode, 0, len(level)/2)
+		for i := 0; i < len(level); i += 2 {
+			parents = append(parents, sumParent(level[i], level[i+1]))
+		}
+		tree.levels = append(tree.levels, parents)
+		level = parents
+	}
+	return tree, nil
+}
+
+func (tree *LiabilityTree) root() SumNode {
+	return tree.levels[len(tree.levels)-1][0]
+}
+
+// Root returns the hash users check their proofs against.
+func (tree *LiabilityTree) Root() common.Hash {
+	return tree.root().Hash
+}
+
+// Total returns the sum of all balances in the tree.
+func (tree *LiabilityTree) Total() *big.Int {
+	return new(big.Int).Set(tree.root().Sum)
+}
+
+// UserCount returns the number of users with a balance in the tree.
+func (tree *LiabilityTree) UserCount() int {
+	return len(tree.users)
+}
+
+// Proof returns the inclusion proof of a user balance.
+func (tree *LiabilityTree) Proof(user common.Address) (InclusionProof, error) {
+	index, ok := tree.indexes[user]
+	if !ok {
+		return InclusionProof{}, fmt.Errorf("%s has no %s balance in the tree", user.Hex(), tree.Asset)
+	}
+
+	siblings := []SumNode{}
+	position := index
+	for _, level := range tree.levels[:len(tree.levels)-1] {
+		sibling := emptySumNode()
+		if position^1 < len(level) {
+			sibling = level[position^1]
+		}
+		siblings = append(siblings, SumNode{Hash: sibling.Hash, Sum: new(big.Int).Set(sibling.Sum)})
+		position /= 2
+	}
+	return InclusionProof{
+		Asset:    tree.Asset,
+		User:     user,
+		Balance:  new(big.Int).Set(tree.amounts[index]),
+		Index:    index,
+		Siblings: siblings,
+		Root:     tree.Root(),
+		Total:    tree.Total(),
+	}, nil
+}
+
+// VerifyInclusionProof recomputes the root from a proof. It only relies on the
+// proof itself, so users can check it without trusting the exchange.
+func VerifyInclusionProof(proof InclusionProof) error {
+	if proof.Balance == nil || proof.Balance.Sign() < 0 || proof.Balance.BitLen() > 256 {
+		return errors.New("proof balance must be a non-negative 256 bit number")
+	}
+	if proof.Index < 0 || (len(proof.Siblings) < 63 && proof.Index >= 1<<len(proof.Siblings)) {
+		return fmt.Errorf("leaf index %d does not fit a tree of depth %d", proof.Index, len(proof.Siblings))
+	}
+
+	node := liabilityLeaf(proof.User, proof.Balance)
+	position := proof.Index
+	for i, sibling := range proof.Siblings {
+		if sibling.Sum == nil || sibling.Sum.Sign() < 0 || sibling.Sum.BitLen() > 256 {
+			return fmt.Errorf("sibling %d has an invalid sum", i)
+		}
+		if position%2 == 0 {
+			node = sumParent(node, sibling)
+		} else {
+			node = sumParent(sibling, node)
+		}
+		position /= 2
+	}
+	if node.Hash != proof.Root {
+		return fmt.Errorf("proof leads to root %s, not %s", node.Hash.Hex(), proof.Root.Hex())
+	}
+	if proof.Total == nil || node.Sum.Cmp(proof.Total) != 0 {
+		return fmt.Errorf("proof sums to %s, not to the published total %s", node.Sum, proof.Total)
+	}
+	return nil
+}
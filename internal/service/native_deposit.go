@@ -0,0 +1,233 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// NativeTokenAddress is the contract address under which the chain's native
+// asset (ETH) is registered in the token registry.
+var NativeTokenAddress = common.Address{}
+
+// InternalTransfer is ETH moved by a call inside a transaction, e.g. a
+// contract wallet forwarding funds.
+type InternalTransfer struct {
+	TxHash common.Hash
+	// Index is the position of the call in the transaction's call tree.
+	Index uint
+	From  common.Address
+	To    common.Address
+	Value *big.Int
+}
+
+// CallTracer finds internal ETH transfers of a block from trace data.
+type CallTracer interface {
+	TraceInternalTransfers(ctx context.Context, blockHash common.Hash) ([]InternalTransfer, error)
+}
+
+// RPCCallTracer reads internal transfers with debug_traceBlockByHash and the
+// built-in callTracer, which archive and most tracing-enabled nodes support.
+type RPCCallTracer struct {
+	client *rpc.Client
+}
+
+func NewRPCCallTracer(client *rpc.Client) *RPCCallTracer {
+	return &RPCCallTracer{client: client}
+}
+
+type callFrame struct {
+	Type  string         `json:"type"`
+	From  common.Address `json:"from"`
+	To    common.Address `json:"to"`
+	Value *hexutil.Big   `json:"value"`
+	Error string         `json:"error"`
+	Calls []callFrame    `json:"calls"`
+}
+
+type txTrace struct {
+	TxHash common.Hash `json:"txHash"`
+	Result callFrame   `json:"result"`
+}
+
+func (tracer *RPCCallTracer) TraceInternalTransfers(
+	ctx context.Context,
+	blockHash common.Hash,
+) ([]InternalTransfer, error) {
+	var traces []txTrace
+	err := tracer.client.CallContext(ctx, &traces, "debug_traceBlockByHash", blockHash,
+		map[string]string{"tracer": "callTracer"})
+	if err != nil {
+		return nil, err
+	}
+	transfers := []InternalTransfer{}
+	for _, trace := range traces {
+		transfers = append(transfers, internalTransfers(trace.TxHash, trace.Result)...)
+	}
+	return transfers, nil
+}
+
+// internalTransfers flattens the value-carrying calls below the top-level
+// call of a transaction. The top-level transfer is seen in the transaction
+// itself, and calls that reverted, or whose parent reverted, moved nothing.
+func internalTransfers(txHash common.Hash, root callFrame) []InternalTransfer {
+	transfers := []InternalTransfer{}
+	if root.Error != "" {
+		return transfers
+	}
+	index := uint(0)
+	var walk func(frames []callFrame)
+	walk = func(frames []callFrame) {
+		for _, frame := range frames {
+			index++
+			if frame.Error != "" {
+				continue
+			}
+			if (frame.Type == "CALL" || frame.Type == "SELFDESTRUCT") &&
+				frame.Value != nil && frame.Value.ToInt().Sign() > 0 {
+				transfers = append(transfers, InternalTransfer{
+					TxHash: txHash,
+					Index:  index,
+					From:   frame.From,
+					To:     frame.To,
+					Value:  new(big.Int).Set(frame.Value.ToInt()),
+				})
+			}
+			walk(frame.Calls)
+		}
+	}
+	walk(root.Calls)
+	return transfers
+}
+
+// SetCallTracer enables detection of internal ETH transfers.
+func (service *BlockchainService) SetCallTracer(tracer CallTracer) {
+	service.callTracer = tracer
+}
+
+// WatchRegisteredTokens watches every token the registry lists for this
+// chain. ERC-20 contracts are matched by their Transfer logs, and native ETH,
+// registered under NativeTokenAddress, by scanning block transactions.
+func (service *BlockchainService) WatchRegisteredTokens() error {
+	if err := service.Connect(); err != nil {
+		return err
+	}
+	serviceRegistry, err := service.GetServiceRegistry()
+	if err != nil {
+		return err
+	}
+	tokenRegistry, err := serviceRegistry.GetTokenRegistry()
+	if err != nil {
+		return err
+	}
+	for _, token := range tokenRegistry.GetTokensByChain(service.chainID) {
+		if token.Address == NativeTokenAddress {
+			service.watchNative = true
+			continue
+		}
+		service.WatchContract(token.Address)
+	}
+	return nil
+}
+
+// indexNativeTransfers records ETH sent to deposit addresses in the given
+// blocks, directly by transactions and, when a tracer is set, by internal
+// calls.
+func (service *BlockchainService) indexNativeTransfers(fromBlock uint64, toBlock uint64) error {
+	token, err := service.resolveToken(NativeTokenAddress)
+	if err != nil {
+		return err
+	}
+	serviceRegistry, err := service.GetServiceRegistry()
+	if err != nil {
+		return err
+	}
+	userService, err := serviceRegistry.GetUserService()
+	if err != nil {
+		return err
+	}
+	signer := types.LatestSignerForChainID(new(big.Int).SetUint64(service.chainID))
+
+	for blockNumber := fromBlock; blockNumber <= toBlock; blockNumber++ {
+		block, err := service.client.BlockByNumber(service.ctx, new(big.Int).SetUint64(blockNumber))
+		if err != nil {
+			return err
+		}
+
+		for _, tx := range block.Transactions() {
+			if tx.To() == nil || tx.Value().Sign() <= 0 {
+				continue
+			}
+			if _, ok := userService.GetUserByDepositAddress(*tx.To()); !ok {
+				continue
+			}
+			receipt, err := service.client.TransactionReceipt(service.ctx, tx.Hash())
+			if err != nil {
+				return err
+			}
+			if receipt.Status != types.ReceiptStatusSuccessful {
+				continue
+			}
+			from, err := types.Sender(signer, tx)
+			if err != nil {
+				return fmt.Errorf("transaction %s: %w", tx.Hash().Hex(), err)
+			}
+			amount, err := service.toAssetAmount(token, tx.Value())
+			if err != nil {
+				return err
+			}
+			if err := service.updateUserBalance(&TransferEvent{
+				Source:    NativeDeposit,
+				From:      from,
+				To:        *tx.To(),
+				Amount:    amount,
+				Token:     token.Symbol,
+				Contract:  NativeTokenAddress,
+				ChainID:   service.chainID,
+				Block:     blockNumber,
+				BlockHash: block.Hash(),
+				TxHash:    tx.Hash(),
+			}); err != nil {
+				return err
+			}
+		}
+
+		if service.callTracer == nil {
+			continue
+		}
+		transfers, err := service.callTracer.TraceInternalTransfers(service.ctx, block.Hash())
+		if err != nil {
+			return err
+		}
+		for _, transfer := range transfers {
+			if _, ok := userService.GetUserByDepositAddress(transfer.To); !ok {
+				continue
+			}
+			amount, err := service.toAssetAmount(token, transfer.Value)
+			if err != nil {
+				return err
+			}
+			if err := service.updateUserBalance(&TransferEvent{
+				Source:    InternalDeposit,
+				From:      transfer.From,
+				To:        transfer.To,
+				Amount:    amount,
+				Token:     token.Symbol,
+				Contract:  NativeTokenAddress,
+				ChainID:   service.chainID,
+				Block:     blockNumber,
+				BlockHash: block.Hash(),
+				TxHash:    transfer.TxHash,
+				LogIndex:  transfer.Index,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
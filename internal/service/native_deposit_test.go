@@ -0,0 +1,103 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/stretchr/testify/assert"
+
+	"x-swap/internal/utils"
+)
+
+type stubCallTracer map[common.Hash][]InternalTransfer
+
+func (tracer stubCallTracer) TraceInternalTransfers(
+	ctx context.Context,
+	blockHash common.Hash,
+) ([]InternalTransfer, error) {
+	return tracer[blockHash], nil
+}
+
+func TestInternalTransfersFromCallTrace(t *testing.T) {
+	var root callFrame
+	err := json.Unmarshal([]byte(`{
+		"type": "CALL", "from": "0x0000000000000000000000000000000000000001", "to": "0x0000000000000000000000000000000000000002", "value": "0x5",
+		"calls": [
+			{"type": "CALL", "from": "0x0000000000000000000000000000000000000002", "to": "0x0000000000000000000000000000000000000003", "value": "0x2",
+				"calls": [{"type": "CALL", "from": "0x0000000000000000000000000000000000000003", "to": "0x0000000000000000000000000000000000000004", "value": "0x1"}]},
+			{"type": "STATICCALL", "from": "0x0000000000000000000000000000000000000002", "to": "0x0000000000000000000000000000000000000005"},
+			{"type": "CALL", "from": "0x0000000000000000000000000000000000000002", "to": "0x0000000000000000000000000000000000000006", "value": "0x3", "error": "execution reverted",
+				"calls": [{"type": "CALL", "from": "0x0000000000000000000000000000000000000006", "to": "0x0000000000000000000000000000000000000007", "value": "0x3"}]},
+			{"type": "DELEGATECALL", "from": "0x0000000000000000000000000000000000000002", "to": "0x0000000000000000000000000000000000000008", "value": "0x1"}
+		]
+	}`), &root)
+	assert.Nil(t, err)
+
+	txHash := common.HexToHash("0xaa")
+	transfers := internalTransfers(txHash, root)
+	assert.Equal(t, len(transfers), 2)
+	assert.Equal(t, transfers[0].To, common.HexToAddress("0x0000000000000000000000000000000000000003"))
+	assert.Equal(t, transfers[0].Value, big.NewInt(2))
+	assert.Equal(t, transfers[1].To, common.HexToAddress("0x0000000000000000000000000000000000000004"))
+	assert.Equal(t, transfers[1].Index, uint(2))
+
+	root.Error = "out of gas"
+	assert.Equal(t, len(internalTransfers(txHash, root)), 0)
+}
+
+func TestMultiTokenAndNativeDeposits(t *testing.T) {
+	chain, _, usdc := setupWithdrawals(t)
+	tokenRegistry, err := serviceRegistry.GetTokenRegistry()
+	assert.Nil(t, err)
+	daiAddress := chain.deployToken(t, 18)
+	_, err = tokenRegistry.RegisterToken("DAI", usdc.ChainID, daiAddress, 18)
+	assert.Nil(t, err)
+	_, err = tokenRegistry.RegisterToken("ETH", usdc.ChainID, NativeTokenAddress, 18)
+	assert.Nil(t, err)
+
+	blockchainService := NewBlockchainService("", usdc.Address)
+	blockchainService.SetServiceRegistry(serviceRegistry)
+	blockchainService.SetConfirmations(1)
+	assert.Nil(t, blockchainService.SetClient(chain.client))
+	assert.Nil(t, blockchainService.WatchRegisteredTokens())
+	assert.Nil(t, blockchainService.resume())
+
+	depositAddress := utils.GenerateRandomAddress()
+	assert.Nil(t, userService.SetDepositAddress(users[0], depositAddress))
+
+	chain.mint(t, usdc.Address, depositAddress, big.NewInt(10e6))
+	chain.mint(t, daiAddress, depositAddress, big.NewInt(params.Ether))
+	ethReceipt := chain.sendValue(t, &depositAddress, big.NewInt(2*params.Ether), nil)
+	// ETH sent to other addresses is ignored
+	other := utils.GenerateRandomAddress()
+	chain.sendValue(t, &other, big.NewInt(params.Ether), nil)
+
+	// a contract wallet forwarding ETH, as reported by the node's tracer
+	walletReceipt := chain.sendValue(t, &other, big.NewInt(params.Ether), nil)
+	blockchainService.SetCallTracer(stubCallTracer{
+		walletReceipt.BlockHash: {{
+			TxHash: walletReceipt.TxHash,
+			Index:  1,
+			From:   other,
+			To:     depositAddress,
+			Value:  big.NewInt(params.Ether / 2),
+		}},
+	})
+
+	assert.Nil(t, blockchainService.processNewBlocks())
+	assert.Equal(t, userService.GetAssetAmount(users[0], "USDC"), big.NewInt(10e6))
+	assert.Equal(t, userService.GetAssetAmount(users[0], "DAI"), big.NewInt(params.Ether))
+	assert.Equal(t, userService.GetAssetAmount(users[0], "ETH"), big.NewInt(2*params.Ether+params.Ether/2))
+
+	deposit, err := blockchainService.GetDepositBySource(NativeDeposit, ethReceipt.TxHash, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, deposit.From, chain.address)
+	assert.Equal(t, deposit.Status, DepositCredited)
+	deposit, err = blockchainService.GetDepositBySource(InternalDeposit, walletReceipt.TxHash, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, deposit.Token, "ETH")
+}
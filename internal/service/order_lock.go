@@ -0,0 +1,205 @@
+package service
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// orderLock is what is still locked for one resting order.
+type orderLock struct {
+	user   common.Address
+	asset  string
+	amount *big.Int
+}
+
+// LockBalance moves amount of an asset from the user's available to the
+// locked account, reserving it for the order the reference names.
+func (service *UserService) LockBalance(user common.Address, asset string, amount *big.Int, reference string) error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	return service.lockBalance(user, asset, amount, reference)
+}
+
+func (service *UserService) lockBalance(user common.Address, asset string, amount *big.Int, reference string) error {
+	if amount.Sign() < 0 {
+		return fmt.Errorf("cannot lock a negative amount of %s", asset)
+	}
+	if amount.Sign() == 0 {
+		return nil
+	}
+	if available := service.assetAmountAvailable(user, asset); available.Cmp(amount) < 0 {
+		return fmt.Errorf("insufficient %s balance to lock: have %s, need %s", asset, available, amount)
+	}
+	lock, ok := service.orderLocks[reference]
+	if ok && (lock.user != user || lock.asset != asset) {
+		return fmt.Errorf("%s already locks %s of %s", reference, lock.asset, lock.user.Hex())
+	}
+	if !ok {
+		lock = &orderLock{user: user, asset: asset, amount: big.NewInt(0)}
+		service.orderLocks[reference] = lock
+	}
+	service.post(EntryLock, reference, transfer(availableAccount(user), lockedAccount(user), asset, amount)...)
+	lock.amount = new(big.Int).Add(lock.amount, amount)
+	return nil
+}
+
+// UnlockBalance releases amount of what is locked for the order the reference
+// names back to the user's available account.
+func (service *UserService) UnlockBalance(user common.Address, asset string, amount *big.Int, reference string) error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	return service.unlockBalance(user, asset, amount, reference)
+}
+
+func (service *UserService) unlockBalance(user common.Address, asset string, amount *big.Int, reference string) error {
+	lock, err := service.getOrderLock(user, asset, reference, amount)
+	if err != nil {
+		return err
+	}
+	service.post(EntryUnlock, reference, transfer(lockedAccount(user), availableAccount(user), asset, amount)...)
+	service.reduceOrderLock(reference, lock, amount)
+	return nil
+}
+
+// GetOrderLocked returns what is still locked for the order the reference
+// names.
+func (service *UserService) GetOrderLocked(reference string) *big.Int {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	if lock, ok := service.orderLocks[reference]; ok {
+		return new(big.Int).Set(lock.amount)
+	}
+	return big.NewInt(0)
+}
+
+// releaseOrderLock unlocks everything still locked for the order the
+// reference names, once it is cancelled, expired or completely filled. What
+// is left of a filled order is the rounding of its quote amount.
+func (service *UserService) releaseOrderLock(reference string) {
+	lock, ok := service.orderLocks[reference]
+	if !ok {
+		return
+	}
+	if err := service.unlockBalance(lock.user, lock.asset, lock.amount, reference); err != nil {
+		panic(err)
+	}
+}
+
+// spendOrderLock takes amount out of the lock of a maker order for a fill and
+// returns the account to debit. The caller posts the trade.
+func (service *UserService) spendOrderLock(
+	user common.Address,
+	asset string,
+	amount *big.Int,
+	reference string,
+) (LedgerAccount, error) {
+	lock, err := service.getOrderLock(user, asset, reference, amount)
+	if err != nil {
+		return LedgerAccount{}, err
+	}
+	service.reduceOrderLock(reference, lock, amount)
+	return lockedAccount(user), nil
+}
+
+func (service *UserService) getOrderLock(
+	user common.Address,
+	asset string,
+	reference string,
+	amount *big.Int,
+) (*orderLock, error) {
+	lock, ok := service.orderLocks[reference]
+	if !ok || lock.user != user || lock.asset != asset {
+		return nil, fmt.Errorf("%s locks no %s of %s", reference, asset, user.Hex())
+	}
+	if amount.Sign() < 0 || lock.amount.Cmp(amount) < 0 {
+		return nil, fmt.Errorf("cannot take %s %s from %s, it locks %s", amount, asset, reference, lock.amount)
+	}
+	return lock, nil
+}
+
+func (service *UserService) reduceOrderLock(reference string, lock *orderLock, amount *big.Int) {
+	lock.amount = new(big.Int).Sub(lock.amount, amount)
+	if lock.amount.Sign() == 0 {
+		delete(service.orderLocks, reference)
+	}
+}
+
+// CheckBalanceInvariants returns an error if the locked amount of any user
+// asset is negative or exceeds the balance, or differs from the total locked
+// by the user's orders.
+func (service *UserService) CheckBalanceInvariants() error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	orderLocked := make(map[common.Address]map[string]*big.Int)
+	for reference, lock := range service.orderLocks {
+		if lock.amount.Sign() < 0 {
+			return fmt.Errorf("%s locks a negative amount of %s", reference, lock.asset)
+		}
+		if orderLocked[lock.user] == nil {
+			orderLocked[lock.user] = make(map[string]*big.Int)
+		}
+		if orderLocked[lock.user][lock.asset] == nil {
+			orderLocked[lock.user][lock.asset] = big.NewInt(0)
+		}
+		orderLocked[lock.user][lock.asset].Add(orderLocked[lock.user][lock.asset], lock.amount)
+	}
+
+	for address := range service.Users {
+		for asset, locked := range service.Users[address].BalanceLocked {
+			if locked.Sign() < 0 {
+				return fmt.Errorf("locked %s of %s is negative: %s", asset, address.Hex(), locked)
+			}
+			if balance := service.assetAmount(address, asset); locked.Cmp(balance) > 0 {
+				return fmt.Errorf("locked %s of %s exceeds the balance: %s > %s", asset, address.Hex(), locked, balance)
+			}
+			expected := orderLocked[address][asset]
+			if expected == nil {
+				expected = big.NewInt(0)
+			}
+			if locked.Cmp(expected) != 0 {
+				return fmt.Errorf("locked %s of %s is %s, its orders lock %s", asset, address.Hex(), locked, expected)
+			}
+		}
+	}
+	return nil
+}
+
+// checkInvariants returns an error if the postings would leave a user with a
+// negative locked amount, or with more locked than the balance, that is a
+// negative available amount.
+func (service *UserService) checkInvariants(postings []Posting) error {
+	type userAsset struct {
+		user  common.Address
+		asset string
+	}
+	available := make(map[userAsset]*big.Int)
+	locked := make(map[userAsset]*big.Int)
+	for _, posting := range postings {
+		if posting.Account.Kind != AccountAvailable && posting.Account.Kind != AccountLocked {
+			continue
+		}
+		key := userAsset{user: posting.Account.Owner, asset: posting.Asset}
+		if available[key] == nil {
+			available[key] = service.journal.Balance(availableAccount(key.user), key.asset)
+			locked[key] = service.journal.Balance(lockedAccount(key.user), key.asset)
+		}
+		if posting.Account.Kind == AccountAvailable {
+			available[key].Add(available[key], posting.Amount)
+		} else {
+			locked[key].Add(locked[key], posting.Amount)
+		}
+	}
+	for key := range available {
+		if locked[key].Sign() < 0 {
+			return fmt.Errorf("locked %s of %s would be negative: %s", key.asset, key.user.Hex(), locked[key])
+		}
+		if available[key].Sign() < 0 {
+			return fmt.Errorf("%s of %s would be overdrawn by %s",
+				key.asset, key.user.Hex(), new(big.Int).Neg(available[key]))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package service
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func limitOrder(user int, orderType OrderType, size int64, price int64) Order {
+	return Order{
+		ID:         orderService.GetNextOrderID(),
+		User:       users[user],
+		OrderType:  orderType,
+		Size:       big.NewInt(size),
+		Price:      big.NewInt(price),
+		SizeFilled: big.NewInt(0),
+		CreatedAt:  time.Now(),
+		Status:     Open,
+		Market:     market,
+	}
+}
+
+func TestMakerFillsConsumeLock(t *testing.T) {
+	setup()
+	// the quote amount of every partial fill rounds down
+	price := int64(100_000_000_001)
+	topup(users[0], big.NewInt(price), "USD")
+	maker := limitOrder(0, BuyOrder, 1e8, price)
+	_, err := userService.PlaceOrder(maker, false)
+	assert.Nil(t, err)
+	reference := orderReference(marketTicker, maker.ID)
+	assert.Equal(t, userService.GetAssetAmountLocked(users[0], "USD"), big.NewInt(price))
+	assert.Equal(t, userService.GetAssetAmountAvailable(users[0], "USD").String(), "0")
+
+	topup(users[1], big.NewInt(1e8), "BTC")
+	for i, size := range []int64{33_333_333, 33_333_333, 33_333_334} {
+		_, err := userService.PlaceOrder(limitOrder(1, SellOrder, size, price), true)
+		assert.Nil(t, err)
+		assert.Nil(t, userService.CheckBalanceInvariants())
+		if i == 0 {
+			assert.Equal(t, userService.GetOrderLocked(reference), big.NewInt(price-33_333_333_000))
+			assert.Equal(t, userService.GetAssetAmountLocked(users[0], "USD"), big.NewInt(price-33_333_333_000))
+		}
+	}
+
+	// the rounding left over is released with the last fill
+	assert.Equal(t, userService.GetOrderLocked(reference).String(), "0")
+	assert.Equal(t, userService.GetAssetAmountLocked(users[0], "USD").String(), "0")
+	assert.Equal(t, userService.GetAssetAmount(users[0], "USD"), big.NewInt(1))
+	assert.Equal(t, userService.GetAssetAmount(users[0], "BTC"), big.NewInt(1e8))
+	assert.Equal(t, userService.GetAssetAmount(users[1], "USD"), big.NewInt(100_000e6))
+	assert.Nil(t, userService.VerifyBalances())
+}
+
+func TestLockedFundsCannotBeReused(t *testing.T) {
+	setup()
+	topup(users[0], big.NewInt(2e8), "BTC")
+	first := limitOrder(0, SellOrder, 15e7, 100_000e6)
+	_, err := userService.PlaceOrder(first, false)
+	assert.Nil(t, err)
+
+	// the total balance would cover it, the available balance does not
+	_, err = userService.PlaceOrder(limitOrder(0, SellOrder, 1e8, 100_000e6), false)
+	assert.ErrorContains(t, err, "insufficient BTC balance: have 50000000, need 100000000")
+	_, err = userService.PlaceOrder(limitOrder(0, SellOrder, 1e8, 100_000e6), true)
+	assert.ErrorContains(t, err, "insufficient BTC balance")
+	assert.ErrorContains(t, userService.SubBalance(users[0], "BTC", big.NewInt(1e8)), "insufficient BTC balance")
+
+	reference := orderReference(marketTicker, first.ID)
+	assert.ErrorContains(t, userService.UnlockBalance(users[0], "BTC", big.NewInt(2e8), reference), "it locks 150000000")
+	assert.Nil(t, userService.UnlockBalance(users[0], "BTC", big.NewInt(5e7), reference))
+	assert.Equal(t, userService.GetAssetAmountLocked(users[0], "BTC"), big.NewInt(1e8))
+
+	// cancelling releases what is left
+	assert.Nil(t, userService.CancelOrder(users[0], marketTicker, first.ID))
+	assert.Equal(t, userService.GetAssetAmountLocked(users[0], "BTC").String(), "0")
+	assert.Equal(t, userService.GetAssetAmountAvailable(users[0], "BTC"), big.NewInt(2e8))
+	assert.Nil(t, userService.CheckBalanceInvariants())
+
+	// a lock the orders do not account for breaks the invariants
+	userService.Users[users[0]].BalanceLocked["BTC"] = big.NewInt(3e8)
+	assert.ErrorContains(t, userService.CheckBalanceInvariants(), "exceeds the balance")
+}
@@ -1,6 +1,7 @@
 package service
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"math/big"
@@ -20,8 +21,11 @@ type OrderBook struct {
 
 type OrderService struct {
 	OrderBooks      map[string]OrderBook
+	Fills           []Fill
+	fillListeners   []func(Fill)
 	serviceRegistry *ServiceRegistry
 	orderID         int64
+	fillID          int64
 }
 
 type OrderType string
@@ -49,6 +53,34 @@ type Order struct {
 	CreatedAt  time.Time
 	Status     OrderStatus
 	Market     Market
+	// Nonce, Expiry and Signature authenticate the order as EIP-712 typed
+	// data signed by User. A zero Expiry never expires.
+	Nonce     uint64
+	Expiry    time.Time
+	Signature []byte
+}
+
+// IsExpired reports whether the order has an expiry that has passed at now.
+func (order Order) IsExpired(now time.Time) bool {
+	return !order.Expiry.IsZero() && !now.Before(order.Expiry)
+}
+
+// FillReport describes how a taker order was executed across the order book
+// and the market's liquidity pool.
+type FillReport struct {
+	BookBaseAmount  *big.Int
+	BookQuoteAmount *big.Int
+	PoolBaseAmount  *big.Int
+	PoolQuoteAmount *big.Int
+}
+
+func NewFillReport() FillReport {
+	return FillReport{
+		BookBaseAmount:  big.NewInt(0),
+		BookQuoteAmount: big.NewInt(0),
+		PoolBaseAmount:  big.NewInt(0),
+		PoolQuoteAmount: big.NewInt(0),
+	}
 }
 
 func NewOrderService() *OrderService {
@@ -86,16 +118,8 @@ func (service *OrderService) CreateOrder(order Order, marketTicker string) {
 
 	if len(orderBook.Orders) == 1 {
 		orderBook.LastPrice = order.Price
-	} else {
-		if order.OrderType == BuyOrder {
-			orderBook.BuyIndex = orderBook.BuyIndex + 1
-			if orderBook.SellIndex > 0 {
-				orderBook.SellIndex = orderBook.SellIndex + 1
-			}
-		} else if order.OrderType == SellOrder && (insertIdx < orderBook.SellIndex || orderBook.SellIndex <= 0) {
-			orderBook.SellIndex = insertIdx
-		}
 	}
+	orderBook.BuyIndex, orderBook.SellIndex = bookIndexes(orderBook.Orders)
 	service.OrderBooks[marketTicker] = orderBook
 
 	serviceRegistry, err := service.GetServiceRegistry()
@@ -122,12 +146,25 @@ func (service *OrderService) CreateOrder(order Order, marketTicker string) {
 	}
 }
 
-func (service *OrderService) FillOrder(order Order, marketTicker string) {
+// FillOrder executes a taker order against the order book and, if the market
+// has one, the liquidity pool. Before every maker fill the pool is used up to
+// the maker's price so the taker always gets the better of the two sources.
+func (service *OrderService) FillOrder(order Order, marketTicker string) FillReport {
 	serviceRegistry, err := service.GetServiceRegistry()
 	if err != nil {
 		panic(err)
 	}
+	marketService, err := serviceRegistry.GetMarketService()
+	if err != nil {
+		panic(err)
+	}
+	userService, err := serviceRegistry.GetUserService()
+	if err != nil {
+		panic(err)
+	}
 
+	report := NewFillReport()
+	pool := marketService.GetMarket(marketTicker).Pool
 	orderBook := service.OrderBooks[marketTicker]
 	baseMultiplier := new(
 		big.Int,
@@ -143,7 +180,7 @@ func (service *OrderService) FillOrder(order Order, marketTicker string) {
 	}
 
 	for amountRemaining.Cmp(big.NewInt(0)) > 0 {
-		if len(orderBook.Orders) == 0 {
+		if order.OrderType == BuyOrder && takerAmount.Sign() == 0 {
 			break
 		}
 		var makerIndex int
@@ -152,10 +189,61 @@ func (service *OrderService) FillOrder(order Order, marketTicker string) {
 		} else {
 			makerIndex = orderBook.BuyIndex
 		}
+		hasMaker := makerIndex >= 0 && makerIndex < len(orderBook.Orders)
+
+		if pool != nil {
+			limitPrice := order.Price
+			if hasMaker {
+				limitPrice = orderBook.Orders[makerIndex].Price
+			}
+			baseAmount, quoteAmount := fillFromPool(
+				pool,
+				order.OrderType,
+				limitPrice,
+				amountRemaining,
+				takerAmount,
+				baseMultiplier,
+			)
+			if baseAmount.Sign() > 0 {
+				takerAccount, reserves := availableAccount(order.User), poolAccount(marketTicker)
+				if order.OrderType == BuyOrder {
+					postings := transfer(takerAccount, reserves, order.Market.QuoteToken, quoteAmount)
+					postings = append(postings, transfer(reserves, takerAccount, order.Market.BaseToken, baseAmount)...)
+					userService.post(EntryPoolTrade, orderReference(marketTicker, order.ID), postings...)
+					takerAmount.Sub(takerAmount, quoteAmount)
+				} else {
+					postings := transfer(takerAccount, reserves, order.Market.BaseToken, baseAmount)
+					postings = append(postings, transfer(reserves, takerAccount, order.Market.QuoteToken, quoteAmount)...)
+					userService.post(EntryPoolTrade, orderReference(marketTicker, order.ID), postings...)
+					takerAmount.Sub(takerAmount, baseAmount)
+				}
+				amountRemaining.Sub(amountRemaining, baseAmount)
+				order.SizeFilled.Add(order.SizeFilled, baseAmount)
+				report.PoolBaseAmount.Add(report.PoolBaseAmount, baseAmount)
+				report.PoolQuoteAmount.Add(report.PoolQuoteAmount, quoteAmount)
+				orderBook.LastPrice = new(big.Int).Div(
+					new(big.Int).Mul(quoteAmount, baseMultiplier),
+					baseAmount,
+				)
+				if marketService.RecordTrade(marketTicker, orderBook.LastPrice, time.Now()) {
+					break
+				}
+				continue
+			}
+		}
 
-		if makerIndex < 0 || makerIndex >= len(orderBook.Orders) {
+		if !hasMaker {
 			break
 		}
+		if orderBook.Orders[makerIndex].IsExpired(time.Now()) {
+			// expired orders are cancelled instead of matched
+			service.OrderBooks[marketTicker] = orderBook
+			if err := service.CancelOrder(marketTicker, orderBook.Orders[makerIndex].ID); err != nil {
+				panic(err)
+			}
+			orderBook = service.OrderBooks[marketTicker]
+			continue
+		}
 
 		makerOrder := orderBook.Orders[makerIndex]
 		amountAvailable := new(big.Int).Sub(makerOrder.Size, makerOrder.SizeFilled)
@@ -167,11 +255,6 @@ func (service *OrderService) FillOrder(order Order, marketTicker string) {
 		}
 		sizeFilled := new(big.Int).Set(fillableAmount)
 
-		userService, err := serviceRegistry.GetUserService()
-		if err != nil {
-			panic(err)
-		}
-
 		if order.OrderType == BuyOrder {
 			quoteTokenAmountForMaker := new(big.Int).Mul(fillableAmount, makerOrder.Price)
 			quoteTokenAmountForMaker.Div(quoteTokenAmountForMaker, baseMultiplier)
@@ -184,28 +267,31 @@ func (service *OrderService) FillOrder(order Order, marketTicker string) {
 			} else {
 				takerAmount.Sub(takerAmount, quoteTokenAmountForMaker)
 			}
-			// add quote token amount for maker
-			userService.AddBalance(
+			report.BookQuoteAmount.Add(report.BookQuoteAmount, quoteTokenAmountForMaker)
+			fill := service.recordFill(order, makerOrder, marketTicker, sizeFilled, quoteTokenAmountForMaker)
+			// the maker sells the base it locked for the taker's quote
+			makerAccount, err := userService.spendOrderLock(
 				makerOrder.User,
-				order.Market.QuoteToken,
-				quoteTokenAmountForMaker,
-			)
-			// add base token amount (size filled) for taker
-			userService.AddBalance(
-				order.User,
 				order.Market.BaseToken,
 				sizeFilled,
+				orderReference(marketTicker, makerOrder.ID),
 			)
-			userService.SubBalance(
-				makerOrder.User,
+			if err != nil {
+				panic(err)
+			}
+			postings := transfer(
+				makerAccount,
+				availableAccount(order.User),
 				order.Market.BaseToken,
 				sizeFilled,
 			)
-			userService.SubBalance(
-				order.User,
+			postings = append(postings, transfer(
+				availableAccount(order.User),
+				availableAccount(makerOrder.User),
 				order.Market.QuoteToken,
 				quoteTokenAmountForMaker,
-			)
+			)...)
+			userService.post(EntryTrade, fill.reference(), postings...)
 		} else {
 			if fillableAmount.Cmp(takerAmount) > 0 {
 				fillableAmount = takerAmount
@@ -217,86 +303,141 @@ func (service *OrderService) FillOrder(order Order, marketTicker string) {
 
 			quoteTokenAmountForTaker := new(big.Int).Mul(fillableAmount, makerOrder.Price)
 			quoteTokenAmountForTaker.Div(quoteTokenAmountForTaker, baseMultiplier)
+			report.BookQuoteAmount.Add(report.BookQuoteAmount, quoteTokenAmountForTaker)
 
-			// add base token amount (size filled) for maker
-			userService.AddBalance(
+			fill := service.recordFill(order, makerOrder, marketTicker, sizeFilled, quoteTokenAmountForTaker)
+			// the taker sells base for the quote the maker locked
+			makerAccount, err := userService.spendOrderLock(
 				makerOrder.User,
-				order.Market.BaseToken,
-				sizeFilled,
-			)
-			// add quote token amount for taker
-			userService.AddBalance(
-				order.User,
 				order.Market.QuoteToken,
 				quoteTokenAmountForTaker,
+				orderReference(marketTicker, makerOrder.ID),
 			)
-			userService.SubBalance(
-				order.User,
+			if err != nil {
+				panic(err)
+			}
+			postings := transfer(
+				availableAccount(order.User),
+				availableAccount(makerOrder.User),
 				order.Market.BaseToken,
 				sizeFilled,
 			)
-			userService.SubBalance(
-				makerOrder.User,
+			postings = append(postings, transfer(
+				makerAccount,
+				availableAccount(order.User),
 				order.Market.QuoteToken,
 				quoteTokenAmountForTaker,
-			)
+			)...)
+			userService.post(EntryTrade, fill.reference(), postings...)
 		}
 		amountRemaining.Sub(amountRemaining, sizeFilled)
 		order.SizeFilled.Add(order.SizeFilled, sizeFilled)
 		makerOrder.SizeFilled.Add(makerOrder.SizeFilled, sizeFilled)
+		report.BookBaseAmount.Add(report.BookBaseAmount, sizeFilled)
 
 		if makerOrder.SizeFilled.Cmp(makerOrder.Size) == 0 {
 			makerOrder.Status = Filled
+			userService.releaseOrderLock(orderReference(marketTicker, makerOrder.ID))
 			orderBook.InActiveOrders = append(orderBook.InActiveOrders, makerOrder)
 
 			orderBook.Orders = append(
 				orderBook.Orders[:makerIndex],
 				orderBook.Orders[makerIndex+1:]...)
-
-			if order.OrderType == SellOrder {
-				orderBook.SellIndex = orderBook.SellIndex - 1
-				orderBook.BuyIndex = orderBook.BuyIndex - 1
-			}
+			orderBook.BuyIndex, orderBook.SellIndex = bookIndexes(orderBook.Orders)
 		} else {
 			orderBook.Orders[makerIndex] = makerOrder
 		}
 		orderBook.LastPrice = makerOrder.Price
+		if marketService.RecordTrade(marketTicker, makerOrder.Price, time.Now()) {
+			break
+		}
 	}
 	order.Status = Filled
 	orderBook.InActiveOrders = append(orderBook.InActiveOrders, order)
 	service.OrderBooks[marketTicker] = orderBook
 
-	marketService, err := serviceRegistry.GetMarketService()
-	if err != nil {
-		panic(err)
-	}
-
 	if order.OrderType == BuyOrder {
 		marketService.UpdateLiquidity(
 			marketTicker,
 			big.NewInt(0),
-			new(big.Int).Neg(order.SizeFilled),
+			new(big.Int).Neg(report.BookBaseAmount),
 		)
 	} else {
 		marketService.UpdateLiquidity(
 			marketTicker,
-			new(big.Int).Neg(order.SizeFilled),
+			new(big.Int).Neg(report.BookBaseAmount),
 			big.NewInt(0),
 		)
 	}
+	return report
 }
 
+// bookIndexes returns the index of the best (highest) buy order and of the best
+// (lowest) sell order in a price-sorted book. A side without orders gets an
+// index outside the book: -1 for buys and len(orders) for sells.
+func bookIndexes(orders []Order) (int, int) {
+	buyIndex := -1
+	sellIndex := len(orders)
+	for i, order := range orders {
+		if order.OrderType == BuyOrder {
+			buyIndex = i
+		} else if order.OrderType == SellOrder && sellIndex == len(orders) {
+			sellIndex = i
+		}
+	}
+	return buyIndex, sellIndex
+}
+
+// fillFromPool trades against the pool up to limitPrice and returns the base
+// and quote amounts exchanged. For buys takerAmount is the remaining quote
+// budget, for sells it is the remaining base amount.
+func fillFromPool(
+	pool *LiquidityPool,
+	orderType OrderType,
+	limitPrice *big.Int,
+	amountRemaining *big.Int,
+	takerAmount *big.Int,
+	baseMultiplier *big.Int,
+) (*big.Int, *big.Int) {
+	if orderType == BuyOrder {
+		return pool.FillBuy(limitPrice, amountRemaining, takerAmount, baseMultiplier)
+	}
+	maxBase := amountRemaining
+	if takerAmount.Cmp(maxBase) < 0 {
+		maxBase = takerAmount
+	}
+	return pool.FillSell(limitPrice, maxBase, baseMultiplier)
+}
+
+// GetQuote simulates FillOrder without changing any state and returns the
+// amount the taker pays, the amount received and the average execution price.
 func (service *OrderService) GetQuote(
 	order Order,
 	marketTicker string,
 ) (*big.Int, *big.Int, *big.Int) {
+	serviceRegistry, err := service.GetServiceRegistry()
+	if err != nil {
+		panic(err)
+	}
+	marketService, err := serviceRegistry.GetMarketService()
+	if err != nil {
+		panic(err)
+	}
+
+	var pool *LiquidityPool
+	if marketPool := marketService.GetMarket(marketTicker).Pool; marketPool != nil {
+		pool = marketPool.Clone()
+	}
 	orderBook := service.OrderBooks[marketTicker]
-	orders := make([]Order, len(orderBook.Orders))
-	for i, order := range orderBook.Orders {
-		orders[i] = order.Clone()
+	// expired orders would be cancelled instead of matched
+	now := time.Now()
+	orders := make([]Order, 0, len(orderBook.Orders))
+	for _, order := range orderBook.Orders {
+		if !order.IsExpired(now) {
+			orders = append(orders, order.Clone())
+		}
 	}
-	buyIndex := orderBook.BuyIndex
-	sellIndex := orderBook.SellIndex
+	buyIndex, sellIndex := bookIndexes(orders)
 	amountRemaining := new(big.Int).Set(order.Size)
 	amountOut := big.NewInt(0)
 
@@ -314,7 +455,7 @@ func (service *OrderService) GetQuote(
 	_takerAmount := new(big.Int).Set(takerAmount)
 
 	for amountRemaining.Cmp(big.NewInt(0)) > 0 {
-		if len(orderBook.Orders) == 0 {
+		if order.OrderType == BuyOrder && takerAmount.Sign() == 0 {
 			break
 		}
 		var makerIndex int
@@ -323,8 +464,36 @@ func (service *OrderService) GetQuote(
 		} else {
 			makerIndex = buyIndex
 		}
+		hasMaker := makerIndex >= 0 && makerIndex < len(orders)
+
+		if pool != nil {
+			limitPrice := order.Price
+			if hasMaker {
+				limitPrice = orders[makerIndex].Price
+			}
+			baseAmount, quoteAmount := fillFromPool(
+				pool,
+				order.OrderType,
+				limitPrice,
+				amountRemaining,
+				takerAmount,
+				baseMultiplier,
+			)
+			if baseAmount.Sign() > 0 {
+				if order.OrderType == BuyOrder {
+					takerAmount.Sub(takerAmount, quoteAmount)
+					amountOut.Add(amountOut, baseAmount)
+				} else {
+					takerAmount.Sub(takerAmount, baseAmount)
+					amountOut.Add(amountOut, quoteAmount)
+				}
+				amountRemaining.Sub(amountRemaining, baseAmount)
+				order.SizeFilled.Add(order.SizeFilled, baseAmount)
+				continue
+			}
+		}
 
-		if makerIndex < 0 || makerIndex >= len(orders) {
+		if !hasMaker {
 			break
 		}
 
@@ -373,11 +542,7 @@ func (service *OrderService) GetQuote(
 			orders = append(
 				orders[:makerIndex],
 				orders[makerIndex+1:]...)
-
-			if order.OrderType == SellOrder {
-				sellIndex = sellIndex - 1
-				buyIndex = buyIndex - 1
-			}
+			buyIndex, sellIndex = bookIndexes(orders)
 		} else {
 			orders[makerIndex] = makerOrder
 		}
@@ -385,7 +550,9 @@ func (service *OrderService) GetQuote(
 
 	amountIn := new(big.Int).Sub(_takerAmount, takerAmount)
 	var executionPrice *big.Int
-	if order.OrderType == BuyOrder {
+	if amountIn.Sign() == 0 || amountOut.Sign() == 0 {
+		executionPrice = big.NewInt(0)
+	} else if order.OrderType == BuyOrder {
 		executionPrice = new(big.Int).Mul(amountIn, baseMultiplier)
 		executionPrice.Div(executionPrice, amountOut)
 	} else {
@@ -404,6 +571,125 @@ func (service *OrderService) GetInActiveOrdersByMarketTicker(marketTicker string
 	return append([]Order{}, service.OrderBooks[marketTicker].InActiveOrders...)
 }
 
+// CancelOrder removes a resting order from the book and releases the balance
+// locked for its unfilled part.
+func (service *OrderService) CancelOrder(marketTicker string, orderID int64) error {
+	serviceRegistry, err := service.GetServiceRegistry()
+	if err != nil {
+		return err
+	}
+	marketService, err := serviceRegistry.GetMarketService()
+	if err != nil {
+		return err
+	}
+	userService, err := serviceRegistry.GetUserService()
+	if err != nil {
+		return err
+	}
+
+	orderBook := service.OrderBooks[marketTicker]
+	index := -1
+	for i, order := range orderBook.Orders {
+		if order.ID == orderID {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return fmt.Errorf("order %d not found in market %s", orderID, marketTicker)
+	}
+
+	order := orderBook.Orders[index]
+	sizeRemaining := new(big.Int).Sub(order.Size, order.SizeFilled)
+
+	userService.releaseOrderLock(orderReference(marketTicker, order.ID))
+	if order.OrderType == BuyOrder {
+		marketService.UpdateLiquidity(marketTicker, new(big.Int).Neg(sizeRemaining), big.NewInt(0))
+	} else {
+		marketService.UpdateLiquidity(marketTicker, big.NewInt(0), new(big.Int).Neg(sizeRemaining))
+	}
+
+	order.Status = Closed
+	orderBook.Orders = append(orderBook.Orders[:index], orderBook.Orders[index+1:]...)
+	orderBook.BuyIndex, orderBook.SellIndex = bookIndexes(orderBook.Orders)
+	orderBook.InActiveOrders = append(orderBook.InActiveOrders, order)
+	service.OrderBooks[marketTicker] = orderBook
+	return nil
+}
+
+// CancelAllOrders cancels every resting order of a market.
+func (service *OrderService) CancelAllOrders(marketTicker string) error {
+	for _, order := range service.GetActiveOrdersByMarketTicker(marketTicker) {
+		if err := service.CancelOrder(marketTicker, order.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CancelExpiredOrders cancels the resting orders of a market whose expiry
+// passed at now, releasing their locked balances.
+func (service *OrderService) CancelExpiredOrders(marketTicker string, now time.Time) error {
+	for _, order := range service.GetActiveOrdersByMarketTicker(marketTicker) {
+		if !order.IsExpired(now) {
+			continue
+		}
+		if err := service.CancelOrder(marketTicker, order.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (service *OrderService) GetOrder(marketTicker string, orderID int64) (Order, bool) {
+	for _, order := range service.OrderBooks[marketTicker].Orders {
+		if order.ID == orderID {
+			return order, true
+		}
+	}
+	return Order{}, false
+}
+
+// GetBestBidAndAsk returns the highest resting buy price and the lowest resting
+// sell price of a market, nil when that side of the book is empty.
+func (service *OrderService) GetBestBidAndAsk(marketTicker string) (*big.Int, *big.Int) {
+	var bestBid, bestAsk *big.Int
+	for _, order := range service.OrderBooks[marketTicker].Orders {
+		if order.OrderType == BuyOrder && (bestBid == nil || order.Price.Cmp(bestBid) > 0) {
+			bestBid = order.Price
+		}
+		if order.OrderType == SellOrder && (bestAsk == nil || order.Price.Cmp(bestAsk) < 0) {
+			bestAsk = order.Price
+		}
+	}
+	return bestBid, bestAsk
+}
+
+// GetReferencePrice returns the price used by the price band check, nil when
+// no reference is available yet.
+func (service *OrderService) GetReferencePrice(marketTicker string, reference PriceReference) *big.Int {
+	if reference == MidPriceReference {
+		bestBid, bestAsk := service.GetBestBidAndAsk(marketTicker)
+		if bestBid == nil || bestAsk == nil {
+			return nil
+		}
+		mid := new(big.Int).Add(bestBid, bestAsk)
+		return mid.Div(mid, big.NewInt(2))
+	}
+	return service.OrderBooks[marketTicker].LastPrice
+}
+
+// GetOpenOrderCount returns the number of resting orders of a user in a market.
+func (service *OrderService) GetOpenOrderCount(marketTicker string, user common.Address) int {
+	count := 0
+	for _, order := range service.OrderBooks[marketTicker].Orders {
+		if order.User == user {
+			count++
+		}
+	}
+	return count
+}
+
 func (service *OrderService) GetNextOrderID() int64 {
 	service.orderID++
 	return service.orderID
@@ -420,6 +706,9 @@ func (order Order) Clone() Order {
 		CreatedAt:  order.CreatedAt,
 		Status:     order.Status,
 		Market:     order.Market,
+		Nonce:      order.Nonce,
+		Expiry:     order.Expiry,
+		Signature:  bytes.Clone(order.Signature),
 	}
 }
 
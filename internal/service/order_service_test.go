@@ -20,22 +20,23 @@ var serviceRegistry *ServiceRegistry
 var users []common.Address
 
 func setup() {
+	tokenRegistry := NewTokenRegistry()
+	tokenRegistry.RegisterToken("BTC", 1, utils.GenerateRandomAddress(), 8)
+	tokenRegistry.RegisterToken("USD", 1, utils.GenerateRandomAddress(), 6)
 	marketService = NewMarketService()
-	marketService.CreateMarket("BTC", "USD", 8, 6)
-	marketTicker = GetMarketTicker("BTC", "USD")
-	market = marketService.GetMarket(marketTicker)
 	userService = NewUserService()
 	orderService = NewOrderService()
-	serviceRegistry = NewServiceRegistry(marketService, userService, orderService)
+	serviceRegistry = NewServiceRegistry(marketService, userService, orderService, nil)
+	serviceRegistry.SetTokenRegistry(tokenRegistry)
+	marketService.SetServiceRegistry(serviceRegistry)
 	orderService.SetServiceRegistry(serviceRegistry)
 	userService.SetServiceRegistry(serviceRegistry)
+	market, _ = marketService.CreateMarket("BTC", "USD")
+	marketTicker = market.MarketTicker
 
 	for i := 0; i < 10; i++ {
 		users = append(users, utils.GenerateRandomAddress())
-		userService.Users[users[i]] = User{
-			Balance:       make(map[string]*big.Int),
-			BalanceLocked: make(map[string]*big.Int),
-		}
+		userService.RegisterUser(users[i])
 	}
 }
 
@@ -322,3 +323,100 @@ func TestFillSellOrder(t *testing.T) {
 	assert.Equal(t, market.BuyLiquidityInBaseToken.String(), big.NewInt(0).String())
 	assert.Equal(t, market.SellLiquidityInBaseToken, big.NewInt(2e8))
 }
+
+func TestBookIndexesFollowOrderSides(t *testing.T) {
+	setup()
+	topup(users[0], big.NewInt(1e8), "BTC")
+	topup(users[1], big.NewInt(90_000e6), "USD")
+	topup(users[2], big.NewInt(110_000e6), "USD")
+	newOrder := func(user common.Address, orderType OrderType, price int64) Order {
+		return Order{
+			ID:         orderService.GetNextOrderID(),
+			User:       user,
+			OrderType:  orderType,
+			Size:       big.NewInt(1e8),
+			Price:      big.NewInt(price),
+			SizeFilled: big.NewInt(0),
+			CreatedAt:  time.Now(),
+			Status:     Open,
+			Market:     market,
+		}
+	}
+
+	// the buy is inserted in front of the sell that rested first
+	_, err := userService.PlaceOrder(newOrder(users[0], SellOrder, 110_000e6), false)
+	assert.Nil(t, err)
+	_, err = userService.PlaceOrder(newOrder(users[1], BuyOrder, 90_000e6), false)
+	assert.Nil(t, err)
+	orderBook := orderService.OrderBooks[marketTicker]
+	assert.Equal(t, orderBook.BuyIndex, 0)
+	assert.Equal(t, orderBook.SellIndex, 1)
+
+	// a crossing buy takes the sell, not the resting buy
+	_, err = userService.PlaceOrder(newOrder(users[2], BuyOrder, 110_000e6), true)
+	assert.Nil(t, err)
+	assert.Equal(t, userService.GetAssetAmount(users[2], "BTC"), big.NewInt(1e8))
+	activeOrders := orderService.GetActiveOrdersByMarketTicker(marketTicker)
+	assert.Equal(t, len(activeOrders), 1)
+	assert.Equal(t, activeOrders[0].User, users[1])
+	orderBook = orderService.OrderBooks[marketTicker]
+	assert.Equal(t, orderBook.BuyIndex, 0)
+	assert.Equal(t, orderBook.SellIndex, 1)
+}
+
+func TestPlaceOrderMarketRules(t *testing.T) {
+	setup()
+	// the first invalid rule is reported, whatever else is wrong
+	for i := 0; i < 10; i++ {
+		err := marketService.SetMarketRules(marketTicker, MarketRules{
+			TickSize:    big.NewInt(0),
+			LotSize:     big.NewInt(-1),
+			MinNotional: big.NewInt(0),
+		})
+		assert.EqualError(t, err, "tick size must be positive")
+	}
+	err := marketService.SetMarketRules(marketTicker, MarketRules{
+		TickSize:      big.NewInt(1e6),
+		LotSize:       big.NewInt(1e4),
+		MinSize:       big.NewInt(1e5),
+		MaxSize:       big.NewInt(10e8),
+		MinNotional:   big.NewInt(10e6),
+		MaxOpenOrders: 1,
+	})
+	assert.Nil(t, err)
+	market = marketService.GetMarket(marketTicker)
+	topup(users[0], big.NewInt(500_000e6), "USD")
+
+	newOrder := func(size int64, price int64) Order {
+		return Order{
+			ID:         orderService.GetNextOrderID(),
+			User:       users[0],
+			OrderType:  BuyOrder,
+			Size:       big.NewInt(size),
+			Price:      big.NewInt(price),
+			SizeFilled: big.NewInt(0),
+			CreatedAt:  time.Now(),
+			Status:     Open,
+			Market:     market,
+		}
+	}
+
+	_, err = userService.PlaceOrder(newOrder(1e8, 111_000e6+1), false)
+	assert.ErrorContains(t, err, "tick size")
+	_, err = userService.PlaceOrder(newOrder(1e8+1, 111_000e6), false)
+	assert.ErrorContains(t, err, "lot size")
+	_, err = userService.PlaceOrder(newOrder(1e4, 111_000e6), false)
+	assert.ErrorContains(t, err, "below minimum size")
+	_, err = userService.PlaceOrder(newOrder(11e8, 111_000e6), false)
+	assert.ErrorContains(t, err, "above maximum size")
+	_, err = userService.PlaceOrder(newOrder(1e5, 1e6), false)
+	assert.ErrorContains(t, err, "below minimum notional")
+	_, err = userService.PlaceOrder(newOrder(5e8, 111_000e6), false)
+	assert.ErrorContains(t, err, "insufficient USD balance")
+
+	_, err = userService.PlaceOrder(newOrder(1e8, 111_000e6), false)
+	assert.Nil(t, err)
+	_, err = userService.PlaceOrder(newOrder(1e8, 110_000e6), false)
+	assert.ErrorContains(t, err, "maximum of 1 open orders")
+	assert.Equal(t, len(orderService.GetActiveOrdersByMarketTicker(marketTicker)), 1)
+}
@@ -0,0 +1,160 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+type PriceReference string
+
+const (
+	LastTradeReference PriceReference = "LAST_TRADE"
+	MidPriceReference  PriceReference = "MID_PRICE"
+)
+
+// PriceProtection configures the price band and the volatility circuit breaker
+// of a market. Zero values disable the corresponding check.
+type PriceProtection struct {
+	// BandBps rejects orders priced further than this from the reference price.
+	BandBps   int64
+	Reference PriceReference
+	// BreakerBps halts the market when a trade moves the price further than
+	// this from any trade in the last BreakerWindow.
+	BreakerBps    int64
+	BreakerWindow time.Duration
+	// CoolDown is how long a halt triggered by the breaker lasts.
+	CoolDown time.Duration
+}
+
+type pricePoint struct {
+	price *big.Int
+	time  time.Time
+}
+
+func (protection PriceProtection) Validate() error {
+	if protection.BandBps < 0 || protection.BreakerBps < 0 {
+		return errors.New("price protection thresholds must not be negative")
+	}
+	if protection.BreakerBps > 0 && protection.BreakerWindow <= 0 {
+		return errors.New("circuit breaker requires a positive window")
+	}
+	if protection.BreakerBps > 0 && protection.CoolDown <= 0 {
+		return errors.New("circuit breaker requires a positive cool-down")
+	}
+	switch protection.Reference {
+	case "", LastTradeReference, MidPriceReference:
+	default:
+		return fmt.Errorf("unknown price reference %s", protection.Reference)
+	}
+	return nil
+}
+
+// CheckPriceBand rejects an order priced outside the band around the
+// reference price. Orders are accepted when no reference price exists yet.
+func (protection PriceProtection) CheckPriceBand(price *big.Int, referencePrice *big.Int) error {
+	if protection.BandBps == 0 || referencePrice == nil || referencePrice.Sign() <= 0 {
+		return nil
+	}
+	if deviationBps(price, referencePrice).Cmp(big.NewInt(protection.BandBps)) > 0 {
+		return fmt.Errorf(
+			"price %s is more than %d bps away from reference price %s",
+			price, protection.BandBps, referencePrice,
+		)
+	}
+	return nil
+}
+
+// deviationBps returns |price - reference| in basis points of reference.
+func deviationBps(price *big.Int, reference *big.Int) *big.Int {
+	deviation := new(big.Int).Sub(price, reference)
+	deviation.Abs(deviation)
+	deviation.Mul(deviation, big.NewInt(feeDenominator))
+	return deviation.Div(deviation, reference)
+}
+
+// SetPriceProtection replaces the price band and circuit breaker settings of
+// a market.
+func (service *MarketService) SetPriceProtection(marketTicker string, protection PriceProtection) error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	market, ok := service.markets[marketTicker]
+	if !ok {
+		return fmt.Errorf("market %s not found", marketTicker)
+	}
+	if err := protection.Validate(); err != nil {
+		return err
+	}
+	market.Protection = protection
+	service.markets[marketTicker] = market
+	return nil
+}
+
+// RecordTrade feeds a trade price into the circuit breaker and halts the market
+// when the price moved more than BreakerBps within BreakerWindow. It returns
+// true if the market was halted by this trade.
+func (service *MarketService) RecordTrade(marketTicker string, price *big.Int, at time.Time) bool {
+	service.mu.Lock()
+	market, ok := service.markets[marketTicker]
+	if !ok || market.Protection.BreakerBps == 0 || market.Status != MarketTrading {
+		service.mu.Unlock()
+		return false
+	}
+
+	windowStart := at.Add(-market.Protection.BreakerWindow)
+	history := []pricePoint{}
+	for _, point := range service.priceHistory[marketTicker] {
+		if !point.time.Before(windowStart) {
+			history = append(history, point)
+		}
+	}
+
+	for _, point := range history {
+		if deviationBps(price, point.price).Cmp(big.NewInt(market.Protection.BreakerBps)) > 0 {
+			service.priceHistory[marketTicker] = nil
+			event, err := service.setStatus(
+				marketTicker,
+				MarketHalted,
+				fmt.Sprintf(
+					"price moved from %s to %s within %s",
+					point.price, price, market.Protection.BreakerWindow,
+				),
+				price,
+				at,
+			)
+			if err != nil {
+				service.mu.Unlock()
+				return false
+			}
+			market = service.markets[marketTicker]
+			market.HaltedUntil = at.Add(market.Protection.CoolDown)
+			service.markets[marketTicker] = market
+			service.mu.Unlock()
+			service.emit(event)
+			return true
+		}
+	}
+
+	service.priceHistory[marketTicker] = append(history, pricePoint{
+		price: new(big.Int).Set(price),
+		time:  at,
+	})
+	service.mu.Unlock()
+	return false
+}
+
+// refreshStatus resumes a market whose cool-down has elapsed.
+func (service *MarketService) refreshStatus(marketTicker string, now time.Time) {
+	service.mu.Lock()
+	market, ok := service.markets[marketTicker]
+	if !ok || market.Status != MarketHalted || market.HaltedUntil.IsZero() || now.Before(market.HaltedUntil) {
+		service.mu.Unlock()
+		return
+	}
+	event, err := service.setStatus(marketTicker, MarketTrading, "cool-down elapsed", nil, now)
+	service.mu.Unlock()
+	if err == nil {
+		service.emit(event)
+	}
+}
@@ -0,0 +1,86 @@
+package service
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newLimitOrder(user int, orderType OrderType, size int64, price int64) Order {
+	return Order{
+		ID:         orderService.GetNextOrderID(),
+		User:       users[user],
+		OrderType:  orderType,
+		Size:       big.NewInt(size),
+		Price:      big.NewInt(price),
+		SizeFilled: big.NewInt(0),
+		CreatedAt:  time.Now(),
+		Status:     Open,
+		Market:     market,
+	}
+}
+
+func TestPriceBandRejectsFatFingerOrders(t *testing.T) {
+	setup()
+	err := marketService.SetPriceProtection(marketTicker, PriceProtection{
+		BandBps:   500,
+		Reference: MidPriceReference,
+	})
+	assert.Nil(t, err)
+	topup(users[0], big.NewInt(1_000_000e6), "USD")
+	topup(users[1], big.NewInt(5e8), "BTC")
+
+	_, err = userService.PlaceOrder(newLimitOrder(0, BuyOrder, 1e8, 100_000e6), false)
+	assert.Nil(t, err)
+	_, err = userService.PlaceOrder(newLimitOrder(1, SellOrder, 1e8, 102_000e6), false)
+	assert.Nil(t, err)
+
+	// mid price is 101k, 5% band is [95.95k, 106.05k]
+	_, err = userService.PlaceOrder(newLimitOrder(1, SellOrder, 1e8, 10_100e6), false)
+	assert.ErrorContains(t, err, "bps away from reference price")
+	_, err = userService.PlaceOrder(newLimitOrder(0, BuyOrder, 1e8, 106_000e6), false)
+	assert.Nil(t, err)
+}
+
+func TestCircuitBreakerHaltsAndResumesMarket(t *testing.T) {
+	setup()
+	err := marketService.SetPriceProtection(marketTicker, PriceProtection{
+		BreakerBps:    1000,
+		BreakerWindow: time.Minute,
+		CoolDown:      50 * time.Millisecond,
+	})
+	assert.Nil(t, err)
+	events := []MarketEvent{}
+	marketService.Subscribe(func(event MarketEvent) {
+		events = append(events, event)
+	})
+
+	topup(users[0], big.NewInt(100_000e6), "USD")
+	_, err = userService.PlaceOrder(newLimitOrder(0, BuyOrder, 1e8, 90_000e6), false)
+	assert.Nil(t, err)
+	topup(users[1], big.NewInt(5e8), "BTC")
+	_, err = userService.PlaceOrder(newLimitOrder(1, SellOrder, 1e8, 100_000e6), false)
+	assert.Nil(t, err)
+	_, err = userService.PlaceOrder(newLimitOrder(1, SellOrder, 1e8, 120_000e6), false)
+	assert.Nil(t, err)
+
+	topup(users[2], big.NewInt(1_000_000e6), "USD")
+	_, err = userService.PlaceOrder(newLimitOrder(2, BuyOrder, 2e8, 120_000e6), true)
+	assert.Nil(t, err)
+
+	// the second fill moved the price by 20% and halted the market
+	assert.Equal(t, marketService.GetMarket(marketTicker).Status, MarketHalted)
+	assert.Equal(t, len(events), 1)
+	assert.Equal(t, events[0].Type, MarketHaltedEvent)
+
+	_, err = userService.PlaceOrder(newLimitOrder(2, BuyOrder, 1e8, 120_000e6), false)
+	assert.ErrorContains(t, err, "is halted")
+
+	time.Sleep(60 * time.Millisecond)
+	_, err = userService.PlaceOrder(newLimitOrder(2, BuyOrder, 1e8, 110_000e6), false)
+	assert.Nil(t, err)
+	assert.Equal(t, marketService.GetMarket(marketTicker).Status, MarketTrading)
+	assert.Equal(t, events[len(events)-1].Type, MarketResumedEvent)
+}
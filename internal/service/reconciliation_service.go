@@ -0,0 +1,367 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// AssetReconciliation compares the internal ledger of an asset with its
+// on-chain holdings. Amounts are in the asset's decimals.
+type AssetReconciliation struct {
+	Asset string
+	// Balances is the sum of all user balances.
+	Balances *big.Int
+	// Pools is the sum of the liquidity pool reserves.
+	Pools *big.Int
+	// Equity is the exchange's own balance: what it debited from users by
+	// manual adjustments less what it credited to them. Negative equity is not
+	// backed by tokens on chain and is left out of Expected, so it shows in
+	// Delta.
+	Equity *big.Int
+	// PendingWithdrawals were debited from users but had not left the
+	// exchange wallets at the pinned block.
+	PendingWithdrawals *big.Int
+	// UnconfirmedDeposits were credited to users but had not been mined at
+	// the pinned block.
+	UnconfirmedDeposits *big.Int
+	// UncreditedDeposits had been mined at the pinned block but are still
+	// waiting for confirmations.
+	UncreditedDeposits *big.Int
+	// Expected is Balances + Pools + non-negative Equity +
+	// PendingWithdrawals - UnconfirmedDeposits + UncreditedDeposits, what the
+	// exchange should hold on chain.
+	Expected      *big.Int
+	OnChain       *big.Int
+	ChainHoldings map[uint64]*big.Int
+	// Delta is OnChain - Expected.
+	Delta *big.Int
+	// Threshold is the largest tolerated absolute delta.
+	Threshold *big.Int
+	Exceeded  bool
+}
+
+// ReconciliationReport is the result of one reconciliation run.
+type ReconciliationReport struct {
+	Blocks    map[uint64]uint64
+	Assets    []AssetReconciliation
+	CreatedAt time.Time
+}
+
+// Discrepancies returns the assets whose delta exceeds their threshold.
+func (report ReconciliationReport) Discrepancies() []AssetReconciliation {
+	discrepancies := []AssetReconciliation{}
+	for _, asset := range report.Assets {
+		if asset.Exceeded {
+			discrepancies = append(discrepancies, asset)
+		}
+	}
+	return discrepancies
+}
+
+// ReconciliationService periodically checks that the internal balances are
+// backed by the tokens the exchange wallets hold on chain, and alerts when
+// the difference of an asset exceeds its threshold.
+type ReconciliationService struct {
+	wallets         []common.Address
+	thresholds      map[string]*big.Int
+	interval        time.Duration
+	reports         []ReconciliationReport
+	alertListeners  []func(ReconciliationReport)
+	serviceRegistry *ServiceRegistry
+	ctx             context.Context
+	cancel          context.CancelFunc
+	mu              sync.Mutex
+}
+
+func NewReconciliationService(wallets []common.Address) *ReconciliationService {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &ReconciliationService{
+		wallets:    append([]common.Address{}, wallets...),
+		thresholds: make(map[string]*big.Int),
+		interval:   time.Hour,
+		reports:    []ReconciliationReport{},
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+func (service *ReconciliationService) SetServiceRegistry(serviceRegistry *ServiceRegistry) {
+	service.serviceRegistry = serviceRegistry
+}
+
+func (service *ReconciliationService) GetServiceRegistry() (*ServiceRegistry, error) {
+	if service.serviceRegistry == nil {
+		return nil, errors.New("service registry not set")
+	}
+	return service.serviceRegistry, nil
+}
+
+// SetThreshold sets the largest absolute delta of an asset, in the asset's
+// decimals, that does not raise an alert. Assets without one alert on any
+// delta.
+func (service *ReconciliationService) SetThreshold(asset string, threshold *big.Int) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	service.thresholds[asset] = new(big.Int).Abs(threshold)
+}
+
+func (service *ReconciliationService) SetInterval(interval time.Duration) {
+	service.interval = interval
+}
+
+// SubscribeAlerts registers a listener that is called synchronously with
+// every report containing a delta above its threshold.
+func (service *ReconciliationService) SubscribeAlerts(listener func(ReconciliationReport)) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	service.alertListeners = append(service.alertListeners, listener)
+}
+
+// GetReports returns the reports of all runs, oldest first.
+func (service *ReconciliationService) GetReports() []ReconciliationReport {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	return append([]ReconciliationReport{}, service.reports...)
+}
+
+// Start reconciles every interval at the latest block of each chain.
+func (service *ReconciliationService) Start() {
+	log.Println("Starting reconciliation service...")
+	ticker := time.NewTicker(service.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-service.ctx.Done():
+			log.Println("Reconciliation service stopped")
+			return
+		case <-ticker.C:
+			if _, err := service.Reconcile(nil); err != nil {
+				log.Printf("Error reconciling balances: %v", err)
+			}
+		}
+	}
+}
+
+func (service *ReconciliationService) Stop() {
+	service.cancel()
+}
+
+// Reconcile compares the internal ledger of every asset with the on-chain
+// holdings of the exchange wallets and user deposit addresses. blocks pins the
+// block read on each chain; chains without an entry are pinned to their
+// latest block, once for all assets.
+func (service *ReconciliationService) Reconcile(blocks map[uint64]uint64) (ReconciliationReport, error) {
+	serviceRegistry, err := service.GetServiceRegistry()
+	if err != nil {
+		return ReconciliationReport{}, err
+	}
+	userService, err := serviceRegistry.GetUserService()
+	if err != nil {
+		return ReconciliationReport{}, err
+	}
+	tokenRegistry, err := serviceRegistry.GetTokenRegistry()
+	if err != nil {
+		return ReconciliationReport{}, err
+	}
+	chainSupervisor, err := serviceRegistry.GetChainSupervisor()
+	if err != nil {
+		return ReconciliationReport{}, err
+	}
+
+	pinned := make(map[uint64]uint64, len(blocks))
+	for chainID, blockNumber := range blocks {
+		pinned[chainID] = blockNumber
+	}
+	for _, blockchainService := range chainSupervisor.GetChains() {
+		chainID := blockchainService.GetChainID()
+		if _, ok := pinned[chainID]; ok {
+			continue
+		}
+		if pinned[chainID], err = blockchainService.LatestBlock(); err != nil {
+			return ReconciliationReport{}, err
+		}
+	}
+
+	assets := service.ledgerTotals(userService, chainSupervisor, pinned)
+	holders := exchangeHolders(userService, service.wallets)
+	report := ReconciliationReport{Blocks: pinned, CreatedAt: time.Now()}
+	for _, asset := range sortedAssets(assets, tokenRegistry) {
+		reconciliation := assets[asset]
+		if reconciliation == nil {
+			reconciliation = newAssetReconciliation(asset)
+		}
+		holdings, err := readAssetHoldings(tokenRegistry, chainSupervisor, asset, holders, pinned)
+		if err != nil {
+			return ReconciliationReport{}, err
+		}
+		reconciliation.OnChain = holdings.total
+		reconciliation.ChainHoldings = holdings.chains
+		reconciliation.Expected = new(big.Int).Add(reconciliation.Balances, reconciliation.Pools)
+		if reconciliation.Equity.Sign() > 0 {
+			reconciliation.Expected.Add(reconciliation.Expected, reconciliation.Equity)
+		}
+		reconciliation.Expected.Add(reconciliation.Expected, reconciliation.PendingWithdrawals)
+		reconciliation.Expected.Sub(reconciliation.Expected, reconciliation.UnconfirmedDeposits)
+		reconciliation.Expected.Add(reconciliation.Expected, reconciliation.UncreditedDeposits)
+		reconciliation.Delta = new(big.Int).Sub(reconciliation.OnChain, reconciliation.Expected)
+		reconciliation.Threshold = service.threshold(asset)
+		reconciliation.Exceeded = new(big.Int).Abs(reconciliation.Delta).Cmp(reconciliation.Threshold) > 0
+		report.Assets = append(report.Assets, *reconciliation)
+	}
+
+	service.mu.Lock()
+	service.reports = append(service.reports, report)
+	listeners := append([]func(ReconciliationReport){}, service.alertListeners...)
+	service.mu.Unlock()
+
+	discrepancies := report.Discrepancies()
+	for _, discrepancy := range discrepancies {
+		log.Printf("Reconciliation alert: %s on chain %s, expected %s, delta %s exceeds %s",
+			discrepancy.Asset, discrepancy.OnChain, discrepancy.Expected, discrepancy.Delta, discrepancy.Threshold)
+		if discrepancy.Equity.Sign() < 0 {
+			log.Printf("Reconciliation alert: %s equity is %s, credited without on-chain backing",
+				discrepancy.Asset, discrepancy.Equity)
+		}
+	}
+	if len(discrepancies) > 0 {
+		for _, listener := range listeners {
+			listener(report)
+		}
+	}
+	return report, nil
+}
+
+func newAssetReconciliation(asset string) *AssetReconciliation {
+	return &AssetReconciliation{
+		Asset:               asset,
+		Balances:            big.NewInt(0),
+		Pools:               big.NewInt(0),
+		Equity:              big.NewInt(0),
+		PendingWithdrawals:  big.NewInt(0),
+		UnconfirmedDeposits: big.NewInt(0),
+		UncreditedDeposits:  big.NewInt(0),
+	}
+}
+
+// ledgerTotals sums per asset the journal accounts held on chain, that is all
+// but the external ones, and the withdrawals and deposits in flight at the
+// pinned blocks.
+func (service *ReconciliationService) ledgerTotals(
+	userService *UserService,
+	chainSupervisor *ChainSupervisor,
+	pinned map[uint64]uint64,
+) map[string]*AssetReconciliation {
+	assets := make(map[string]*AssetReconciliation)
+	get := func(asset string) *AssetReconciliation {
+		if assets[asset] == nil {
+			assets[asset] = newAssetReconciliation(asset)
+		}
+		return assets[asset]
+	}
+
+	// the journal is read at once, the totals never see half an entry
+	for kind, totals := range userService.GetJournal().Totals() {
+		for asset, total := range totals {
+			switch kind {
+			case AccountAvailable, AccountLocked:
+				get(asset).Balances.Add(get(asset).Balances, total)
+			case AccountPool:
+				get(asset).Pools.Add(get(asset).Pools, total)
+			case AccountEquity:
+				get(asset).Equity.Add(get(asset).Equity, total)
+			}
+		}
+	}
+
+	if serviceRegistry, err := service.GetServiceRegistry(); err == nil {
+		if withdrawalService, err := serviceRegistry.GetWithdrawalService(); err == nil {
+			for _, withdrawal := range withdrawalService.GetAllWithdrawals() {
+				if withdrawal.Status == WithdrawalFailed {
+					continue
+				}
+				if withdrawal.Block != 0 && withdrawal.Block <= pinned[withdrawal.ChainID] {
+					continue
+				}
+				get(withdrawal.Token).PendingWithdrawals.Add(get(withdrawal.Token).PendingWithdrawals, withdrawal.Amount)
+			}
+		}
+	}
+
+	for _, deposit := range chainSupervisor.GetDeposits() {
+		minedAtPin := deposit.Block <= pinned[deposit.ChainID]
+		switch {
+		case deposit.Status == DepositCredited && !minedAtPin:
+			get(deposit.Token).UnconfirmedDeposits.Add(get(deposit.Token).UnconfirmedDeposits, deposit.Amount)
+		case deposit.Status == DepositPending && minedAtPin:
+			get(deposit.Token).UncreditedDeposits.Add(get(deposit.Token).UncreditedDeposits, deposit.Amount)
+		}
+	}
+	return assets
+}
+
+func (service *ReconciliationService) threshold(asset string) *big.Int {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	if threshold, ok := service.thresholds[asset]; ok {
+		return new(big.Int).Set(threshold)
+	}
+	return big.NewInt(0)
+}
+
+// sortedAssets returns the assets with ledger entries and the registered
+// tokens, so tokens held without any user balance are reported too.
+func sortedAssets(assets map[string]*AssetReconciliation, tokenRegistry *TokenRegistry) []string {
+	seen := make(map[string]bool)
+	for asset := range assets {
+		seen[asset] = true
+	}
+	for symbol := range tokenRegistry.Tokens {
+		seen[symbol] = true
+	}
+	sorted := make([]string, 0, len(seen))
+	for asset := range seen {
+		sorted = append(sorted, asset)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// String formats the report as a table, followed by a line for every asset
+// with negative equity.
+func (report ReconciliationReport) String() string {
+	chainIDs := make([]uint64, 0, len(report.Blocks))
+	for chainID := range report.Blocks {
+		chainIDs = append(chainIDs, chainID)
+	}
+	sort.Slice(chainIDs, func(i, j int) bool { return chainIDs[i] < chainIDs[j] })
+
+	output := fmt.Sprintf("Reconciliation at %s\n", report.CreatedAt.Format(time.RFC3339))
+	for _, chainID := range chainIDs {
+		output += fmt.Sprintf("  chain %d pinned at block %d\n", chainID, report.Blocks[chainID])
+	}
+	output += fmt.Sprintf("%-8s %24s %24s %24s %24s  %s\n", "ASSET", "EXPECTED", "ON CHAIN", "DELTA", "THRESHOLD", "STATUS")
+	for _, asset := range report.Assets {
+		status := "OK"
+		if asset.Exceeded {
+			status = "ALERT"
+		}
+		output += fmt.Sprintf("%-8s %24s %24s %24s %24s  %s\n",
+			asset.Asset, asset.Expected, asset.OnChain, asset.Delta, asset.Threshold, status)
+	}
+	for _, asset := range report.Assets {
+		if asset.Equity.Sign() < 0 {
+			output += fmt.Sprintf("%s equity is %s, credited without on-chain backing\n", asset.Asset, asset.Equity)
+		}
+	}
+	return output
+}
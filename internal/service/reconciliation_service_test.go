@@ -0,0 +1,82 @@
+package service
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+
+	"x-swap/internal/utils"
+)
+
+func TestReconcileAtPinnedBlock(t *testing.T) {
+	chain, withdrawalService, token := setupWithdrawals(t)
+	blockchainService := NewBlockchainService("", token.Address)
+	assert.Nil(t, blockchainService.SetClient(chain.client))
+	supervisor := NewChainSupervisor()
+	supervisor.SetServiceRegistry(serviceRegistry)
+	assert.Nil(t, supervisor.AddChain(blockchainService))
+	serviceRegistry.SetChainSupervisor(supervisor)
+
+	reconciliationService := NewReconciliationService([]common.Address{withdrawalService.HotWalletAddress()})
+	reconciliationService.SetServiceRegistry(serviceRegistry)
+	reconciliationService.SetThreshold("USDC", big.NewInt(1e6))
+	alerts := []ReconciliationReport{}
+	reconciliationService.SubscribeAlerts(func(report ReconciliationReport) {
+		alerts = append(alerts, report)
+	})
+
+	// the hot wallet holds the 1,000 USDC users[0] deposited, 300 of which
+	// are being withdrawn
+	userService.AddBalanceFromChain(users[0], token.ChainID, "USDC", big.NewInt(1_000e6), EntryDeposit, "deposit")
+	// a manual credit is paid for out of the exchange's equity, which holds
+	// no tokens for it
+	topup(users[2], big.NewInt(20e6), "USDC")
+	_, err := withdrawalService.RequestWithdrawal(users[0], "USDC", utils.GenerateRandomAddress(), big.NewInt(300e6))
+	assert.Nil(t, err)
+
+	// a deposit that is mined but not yet credited
+	depositAddress := utils.GenerateRandomAddress()
+	assert.Nil(t, userService.SetDepositAddress(users[1], depositAddress))
+	chain.mint(t, token.Address, depositAddress, big.NewInt(50e6))
+	pinnedBlock, err := chain.client.BlockNumber(context.Background())
+	assert.Nil(t, err)
+	assert.Nil(t, blockchainService.recordDeposit(&TransferEvent{
+		To:       depositAddress,
+		Amount:   big.NewInt(50e6),
+		Token:    "USDC",
+		Contract: token.Address,
+		ChainID:  token.ChainID,
+		Block:    pinnedBlock,
+		TxHash:   common.HexToHash("0x01"),
+	}))
+
+	// tokens nobody accounts for arrive after the pinned block
+	chain.mint(t, token.Address, withdrawalService.HotWalletAddress(), big.NewInt(5e6))
+
+	report, err := reconciliationService.Reconcile(map[uint64]uint64{token.ChainID: pinnedBlock})
+	assert.Nil(t, err)
+	assert.Equal(t, len(report.Assets), 1)
+	usdc := report.Assets[0]
+	assert.Equal(t, usdc.Balances, big.NewInt(720e6))
+	assert.Equal(t, usdc.Equity, big.NewInt(-20e6))
+	assert.Equal(t, usdc.PendingWithdrawals, big.NewInt(300e6))
+	assert.Equal(t, usdc.UncreditedDeposits, big.NewInt(50e6))
+	assert.Equal(t, usdc.Expected, big.NewInt(1_070e6))
+	assert.Equal(t, usdc.OnChain, big.NewInt(1_050e6))
+	assert.Equal(t, usdc.Delta, big.NewInt(-20e6))
+	assert.Equal(t, len(report.Discrepancies()), 1)
+	assert.Contains(t, report.String(), "USDC equity is -20000000")
+	assert.Equal(t, len(alerts), 1)
+
+	report, err = reconciliationService.Reconcile(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, report.Blocks[token.ChainID], pinnedBlock+1)
+	assert.Equal(t, report.Assets[0].Delta, big.NewInt(-15e6))
+	assert.Equal(t, report.Assets[0].Exceeded, true)
+	assert.Equal(t, len(alerts), 2)
+	assert.Equal(t, alerts[1].Discrepancies()[0].Asset, "USDC")
+	assert.Equal(t, len(reconciliationService.GetReports()), 2)
+}
@@ -0,0 +1,166 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const defaultReorgWindow = 64
+
+// checkReorg compares the parent hash of the block after lastProcessedBlock
+// with the hash recorded for lastProcessedBlock. On a mismatch it walks back
+// to the last block both chains agree on, rolls back the deposits seen after
+// it and rewinds the indexer so the canonical chain is indexed again.
+func (service *BlockchainService) checkReorg(latestBlock uint64) error {
+	lastHash, ok := service.blockHashes[service.lastProcessedBlock]
+	if !ok || latestBlock <= service.lastProcessedBlock {
+		return nil
+	}
+
+	header, err := service.client.HeaderByNumber(
+		service.ctx,
+		new(big.Int).SetUint64(service.lastProcessedBlock+1),
+	)
+	if err != nil {
+		return err
+	}
+	if header.ParentHash == lastHash {
+		return nil
+	}
+
+	ancestor, err := service.findCommonAncestor()
+	if err != nil {
+		return err
+	}
+	log.Printf("Chain reorganization detected at block %d, rolling back to block %d",
+		service.lastProcessedBlock, ancestor)
+	return service.rollbackTo(ancestor)
+}
+
+// findCommonAncestor returns the highest recorded block whose hash still
+// matches the canonical chain.
+func (service *BlockchainService) findCommonAncestor() (uint64, error) {
+	for blockNumber := service.lastProcessedBlock; ; blockNumber-- {
+		recordedHash, ok := service.blockHashes[blockNumber]
+		if !ok {
+			return 0, fmt.Errorf(
+				"reorg deeper than the %d block window, no common ancestor above block %d",
+				service.reorgWindow, blockNumber,
+			)
+		}
+		header, err := service.client.HeaderByNumber(service.ctx, new(big.Int).SetUint64(blockNumber))
+		if err != nil {
+			return 0, err
+		}
+		if header.Hash() == recordedHash {
+			return blockNumber, nil
+		}
+		if blockNumber == 0 {
+			return 0, nil
+		}
+	}
+}
+
+// rollbackTo undoes every deposit seen after ancestor. Pending deposits are
+// dropped. Credited deposits are debited again, or flagged when the user no
+// longer has the funds available because they were already traded or locked.
+func (service *BlockchainService) rollbackTo(ancestor uint64) error {
+	serviceRegistry, err := service.GetServiceRegistry()
+	if err != nil {
+		return err
+	}
+	userService, err := serviceRegistry.GetUserService()
+	if err != nil {
+		return err
+	}
+
+	service.depositsMu.Lock()
+	keys := []depositKey{}
+	for _, key := range service.depositKeys {
+		deposit := service.deposits[key]
+		if deposit.Block <= ancestor || deposit.Status == DepositFlagged {
+			keys = append(keys, key)
+			continue
+		}
+
+		switch deposit.Status {
+		case DepositPending:
+			deposit.Status = DepositOrphaned
+		case DepositCredited:
+			if err := userService.SubBalanceToChain(
+				deposit.User, deposit.ChainID, deposit.Token, deposit.Amount, EntryDepositRollback, deposit.reference(),
+			); err != nil {
+				deposit.Status = DepositFlagged
+				keys = append(keys, key)
+				log.Printf("Deposit %s:%d of %s %s for %s was orphaned but the funds are no longer available: %v",
+					deposit.TxHash.Hex(), deposit.LogIndex, deposit.Amount, deposit.Token, deposit.User.Hex(), err)
+				continue
+			}
+			deposit.Status = DepositRolledBack
+		}
+		// the same log may be included again on the canonical chain
+		service.orphanedDeposits = append(service.orphanedDeposits, *deposit)
+		delete(service.deposits, key)
+	}
+	service.depositKeys = keys
+	service.depositsMu.Unlock()
+
+	for blockNumber := range service.blockHashes {
+		if blockNumber > ancestor {
+			delete(service.blockHashes, blockNumber)
+		}
+	}
+	service.lastProcessedBlock = ancestor
+	return nil
+}
+
+// recordBlockHashes stores the hashes of the processed blocks that are within
+// the reorg window of tipBlock and drops the ones that left it. A pending
+// deposit whose log names a different block hash than the recorded one was
+// indexed from a fork that got replaced meanwhile, so the range is rolled back
+// to be indexed again.
+func (service *BlockchainService) recordBlockHashes(fromBlock uint64, toBlock uint64, tipBlock uint64) error {
+	if tipBlock+1 > service.reorgWindow && fromBlock < tipBlock+1-service.reorgWindow {
+		fromBlock = tipBlock + 1 - service.reorgWindow
+	}
+	for blockNumber := fromBlock; blockNumber <= toBlock; blockNumber++ {
+		header, err := service.client.HeaderByNumber(service.ctx, new(big.Int).SetUint64(blockNumber))
+		if err != nil {
+			return err
+		}
+		service.blockHashes[blockNumber] = header.Hash()
+	}
+	for blockNumber := range service.blockHashes {
+		if blockNumber+service.reorgWindow <= tipBlock {
+			delete(service.blockHashes, blockNumber)
+		}
+	}
+
+	for _, deposit := range service.GetDeposits() {
+		if deposit.Block < fromBlock || deposit.Block > toBlock {
+			continue
+		}
+		if blockHash, ok := service.blockHashes[deposit.Block]; ok && deposit.BlockHash != blockHash {
+			log.Printf("Deposit %s:%d is from replaced block %s",
+				deposit.TxHash.Hex(), deposit.LogIndex, deposit.BlockHash.Hex())
+			return service.rollbackTo(max(fromBlock, 1) - 1)
+		}
+	}
+	return nil
+}
+
+// GetOrphanedDeposits returns the deposits removed by chain reorganizations.
+func (service *BlockchainService) GetOrphanedDeposits() []Deposit {
+	service.depositsMu.Lock()
+	defer service.depositsMu.Unlock()
+	return append([]Deposit{}, service.orphanedDeposits...)
+}
+
+// GetBlockHash returns the recorded hash of a block inside the reorg window.
+func (service *BlockchainService) GetBlockHash(blockNumber uint64) (common.Hash, bool) {
+	hash, ok := service.blockHashes[blockNumber]
+	return hash, ok
+}
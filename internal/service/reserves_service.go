@@ -0,0 +1,248 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// PublishedRoot is the public commitment to the liabilities of one asset.
+type PublishedRoot struct {
+	Asset     string      `json:"asset"`
+	Root      common.Hash `json:"root"`
+	Total     *big.Int    `json:"total"`
+	Users     int         `json:"users"`
+	CreatedAt time.Time   `json:"createdAt"`
+}
+
+// ReservesReport compares the liabilities of an asset with what the exchange
+// wallets hold on chain. Amounts are in the asset's decimals.
+type ReservesReport struct {
+	Asset       string
+	Liabilities *big.Int
+	Holdings    *big.Int
+	// ChainHoldings and Blocks give the holdings per chain and the block they
+	// were read at.
+	ChainHoldings map[uint64]*big.Int
+	Blocks        map[uint64]uint64
+	Surplus       *big.Int
+	Solvent       bool
+}
+
+// ReservesService publishes proof of reserves: a Merkle sum tree of the user
+// balances of every asset, inclusion proofs for users, and a comparison of
+// the totals with on-chain holdings.
+type ReservesService struct {
+	trees           map[string]*LiabilityTree
+	roots           []PublishedRoot
+	serviceRegistry *ServiceRegistry
+	mu              sync.Mutex
+}
+
+func NewReservesService() *ReservesService {
+	return &ReservesService{
+		trees: make(map[string]*LiabilityTree),
+		roots: []PublishedRoot{},
+	}
+}
+
+func (service *ReservesService) SetServiceRegistry(serviceRegistry *ServiceRegistry) {
+	service.serviceRegistry = serviceRegistry
+}
+
+func (service *ReservesService) GetServiceRegistry() (*ServiceRegistry, error) {
+	if service.serviceRegistry == nil {
+		return nil, errors.New("service registry not set")
+	}
+	return service.serviceRegistry, nil
+}
+
+// PublishSnapshot builds the liability trees of all assets from the current
+// user balances and liquidity pool claims and replaces the published roots
+// with theirs.
+func (service *ReservesService) PublishSnapshot() ([]PublishedRoot, error) {
+	serviceRegistry, err := service.GetServiceRegistry()
+	if err != nil {
+		return nil, err
+	}
+	userService, err := serviceRegistry.GetUserService()
+	if err != nil {
+		return nil, err
+	}
+
+	balances, err := userService.GetLiabilities()
+	if err != nil {
+		return nil, err
+	}
+	assets := make([]string, 0, len(balances))
+	for asset := range balances {
+		assets = append(assets, asset)
+	}
+	sort.Strings(assets)
+
+	now := time.Now()
+	trees := make(map[string]*LiabilityTree, len(assets))
+	roots := make([]PublishedRoot, 0, len(assets))
+	for _, asset := range assets {
+		tree, err := BuildLiabilityTree(asset, balances[asset])
+		if err != nil {
+			return nil, err
+		}
+		trees[asset] = tree
+		roots = append(roots, PublishedRoot{
+			Asset:     asset,
+			Root:      tree.Root(),
+			Total:     tree.Total(),
+			Users:     tree.UserCount(),
+			CreatedAt: now,
+		})
+		log.Printf("Published %s liabilities root %s with total %s over %d users",
+			asset, tree.Root().Hex(), tree.Total(), tree.UserCount())
+	}
+
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	service.trees = trees
+	service.roots = roots
+	return append([]PublishedRoot{}, roots...), nil
+}
+
+// GetPublishedRoots returns the roots of the last snapshot.
+func (service *ReservesService) GetPublishedRoots() []PublishedRoot {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	return append([]PublishedRoot{}, service.roots...)
+}
+
+// WriteRoots writes the roots of the last snapshot as JSON to path.
+func (service *ReservesService) WriteRoots(path string) error {
+	data, err := json.MarshalIndent(service.GetPublishedRoots(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// GetInclusionProof returns the proof that the user balance of an asset is
+// included in the last snapshot.
+func (service *ReservesService) GetInclusionProof(user common.Address, asset string) (InclusionProof, error) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	tree, ok := service.trees[asset]
+	if !ok {
+		return InclusionProof{}, fmt.Errorf("no %s liabilities published", asset)
+	}
+	return tree.Proof(user)
+}
+
+// CompareHoldings compares the published liabilities of every asset with the
+// balances held on chain by the given exchange wallets and all user deposit
+// addresses. blocks pins the block read on each chain; chains without an
+// entry are read at their latest block.
+func (service *ReservesService) CompareHoldings(
+	blocks map[uint64]uint64,
+	wallets []common.Address,
+) ([]ReservesReport, error) {
+	serviceRegistry, err := service.GetServiceRegistry()
+	if err != nil {
+		return nil, err
+	}
+	userService, err := serviceRegistry.GetUserService()
+	if err != nil {
+		return nil, err
+	}
+	tokenRegistry, err := serviceRegistry.GetTokenRegistry()
+	if err != nil {
+		return nil, err
+	}
+	chainSupervisor, err := serviceRegistry.GetChainSupervisor()
+	if err != nil {
+		return nil, err
+	}
+
+	holders := exchangeHolders(userService, wallets)
+	reports := []ReservesReport{}
+	for _, root := range service.GetPublishedRoots() {
+		holdings, err := readAssetHoldings(tokenRegistry, chainSupervisor, root.Asset, holders, blocks)
+		if err != nil {
+			return nil, err
+		}
+		report := ReservesReport{
+			Asset:         root.Asset,
+			Liabilities:   new(big.Int).Set(root.Total),
+			Holdings:      holdings.total,
+			ChainHoldings: holdings.chains,
+			Blocks:        holdings.blocks,
+		}
+		report.Surplus = new(big.Int).Sub(report.Holdings, report.Liabilities)
+		report.Solvent = report.Surplus.Sign() >= 0
+		if !report.Solvent {
+			log.Printf("%s holdings of %s do not cover liabilities of %s",
+				report.Asset, report.Holdings, report.Liabilities)
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// GetLiabilities returns per asset what the exchange owes every user: the
+// balance plus the user's claim on the reserves of each liquidity pool, as
+// given by the user's LP shares. Claims are rounded up, so their total never
+// understates the reserves of a pool.
+func (service *UserService) GetLiabilities() (map[string]map[common.Address]*big.Int, error) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	serviceRegistry, err := service.GetServiceRegistry()
+	if err != nil {
+		return nil, err
+	}
+	marketService, err := serviceRegistry.GetMarketService()
+	if err != nil {
+		return nil, err
+	}
+
+	liabilities := make(map[string]map[common.Address]*big.Int)
+	add := func(asset string, user common.Address, amount *big.Int) {
+		if liabilities[asset] == nil {
+			liabilities[asset] = make(map[common.Address]*big.Int)
+		}
+		if liabilities[asset][user] == nil {
+			liabilities[asset][user] = big.NewInt(0)
+		}
+		liabilities[asset][user].Add(liabilities[asset][user], amount)
+	}
+	for address, user := range service.Users {
+		for asset, balance := range user.Balance {
+			add(asset, address, balance)
+		}
+	}
+	for _, market := range marketService.GetMarkets() {
+		pool := market.Pool
+		if pool == nil || pool.TotalShares.Sign() == 0 {
+			continue
+		}
+		for user, shares := range pool.Shares {
+			add(market.BaseToken, user, poolClaim(shares, pool.ReserveBase, pool.TotalShares))
+			add(market.QuoteToken, user, poolClaim(shares, pool.ReserveQuote, pool.TotalShares))
+		}
+	}
+	return liabilities, nil
+}
+
+// poolClaim returns the part of reserve the shares entitle to, rounded up.
+func poolClaim(shares *big.Int, reserve *big.Int, totalShares *big.Int) *big.Int {
+	claim := new(big.Int).Mul(shares, reserve)
+	claim.Add(claim, totalShares)
+	claim.Sub(claim, big.NewInt(1))
+	return claim.Div(claim, totalShares)
+}
@@ -0,0 +1,153 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+
+	"x-swap/internal/utils"
+)
+
+func TestLiabilityTreeProofs(t *testing.T) {
+	balances := map[common.Address]*big.Int{}
+	total := big.NewInt(0)
+	for i := 1; i <= 5; i++ {
+		balance := big.NewInt(int64(i) * 100e6)
+		balances[utils.GenerateRandomAddress()] = balance
+		total.Add(total, balance)
+	}
+	balances[utils.GenerateRandomAddress()] = big.NewInt(0)
+
+	tree, err := BuildLiabilityTree("USDC", balances)
+	assert.Nil(t, err)
+	assert.Equal(t, tree.Total(), total)
+	assert.Equal(t, tree.UserCount(), 5)
+
+	for user, balance := range balances {
+		proof, err := tree.Proof(user)
+		if balance.Sign() == 0 {
+			assert.ErrorContains(t, err, "has no USDC balance")
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, proof.Balance, balance)
+		assert.Equal(t, len(proof.Siblings), 3)
+		assert.Nil(t, VerifyInclusionProof(proof))
+
+		// the proof survives the trip through JSON to a standalone verifier
+		data, err := json.Marshal(proof)
+		assert.Nil(t, err)
+		var decoded InclusionProof
+		assert.Nil(t, json.Unmarshal(data, &decoded))
+		assert.Nil(t, VerifyInclusionProof(decoded))
+	}
+
+	var user common.Address
+	for candidate, balance := range balances {
+		if balance.Sign() > 0 {
+			user = candidate
+			break
+		}
+	}
+	proof, err := tree.Proof(user)
+	assert.Nil(t, err)
+	understated := proof
+	understated.Balance = new(big.Int).Sub(proof.Balance, big.NewInt(1))
+	assert.ErrorContains(t, VerifyInclusionProof(understated), "proof leads to root")
+
+	// moving liabilities out of a sibling changes the root, the top sibling
+	// is never padding with five users
+	hidden := proof
+	top := len(proof.Siblings) - 1
+	hidden.Siblings = append([]SumNode{}, proof.Siblings...)
+	hidden.Siblings[top] = SumNode{Hash: proof.Siblings[top].Hash, Sum: big.NewInt(0)}
+	assert.ErrorContains(t, VerifyInclusionProof(hidden), "proof leads to root")
+
+	_, err = BuildLiabilityTree("USDC", map[common.Address]*big.Int{user: big.NewInt(-1)})
+	assert.ErrorContains(t, err, "negative")
+}
+
+func TestCompareHoldingsAtBlock(t *testing.T) {
+	setup()
+	chain := newTestChainWithID(t, 1)
+	tokenAddress := chain.deployToken(t, 6)
+	tokenRegistry := NewTokenRegistry()
+	serviceRegistry.SetTokenRegistry(tokenRegistry)
+	_, err := tokenRegistry.RegisterToken("USDC", 1, tokenAddress, 6)
+	assert.Nil(t, err)
+
+	blockchainService := NewBlockchainService("", tokenAddress)
+	assert.Nil(t, blockchainService.SetClient(chain.client))
+	supervisor := NewChainSupervisor()
+	supervisor.SetServiceRegistry(serviceRegistry)
+	assert.Nil(t, supervisor.AddChain(blockchainService))
+	serviceRegistry.SetChainSupervisor(supervisor)
+	reservesService := NewReservesService()
+	reservesService.SetServiceRegistry(serviceRegistry)
+	serviceRegistry.SetReservesService(reservesService)
+
+	topup(users[0], big.NewInt(300e6), "USDC")
+	topup(users[1], big.NewInt(200e6), "USDC")
+	hotWallet := utils.GenerateRandomAddress()
+	depositAddress := utils.GenerateRandomAddress()
+	assert.Nil(t, userService.SetDepositAddress(users[2], depositAddress))
+	chain.mint(t, tokenAddress, hotWallet, big.NewInt(400e6))
+	shortBlock, err := chain.client.BlockNumber(context.Background())
+	assert.Nil(t, err)
+	chain.mint(t, tokenAddress, depositAddress, big.NewInt(150e6))
+	coveredBlock, err := chain.client.BlockNumber(context.Background())
+	assert.Nil(t, err)
+	// moved out after the pinned block
+	chain.mint(t, tokenAddress, hotWallet, big.NewInt(1_000e6))
+
+	roots, err := reservesService.PublishSnapshot()
+	assert.Nil(t, err)
+	assert.Equal(t, len(roots), 1)
+	assert.Equal(t, roots[0].Total, big.NewInt(500e6))
+	proof, err := reservesService.GetInclusionProof(users[1], "USDC")
+	assert.Nil(t, err)
+	assert.Equal(t, proof.Root, roots[0].Root)
+	assert.Nil(t, VerifyInclusionProof(proof))
+
+	reports, err := reservesService.CompareHoldings(map[uint64]uint64{1: coveredBlock}, []common.Address{hotWallet})
+	assert.Nil(t, err)
+	assert.Equal(t, reports[0].Holdings, big.NewInt(550e6))
+	assert.Equal(t, reports[0].Blocks[1], coveredBlock)
+	assert.Equal(t, reports[0].Surplus, big.NewInt(50e6))
+	assert.Equal(t, reports[0].Solvent, true)
+
+	reports, err = reservesService.CompareHoldings(map[uint64]uint64{1: shortBlock}, []common.Address{hotWallet})
+	assert.Nil(t, err)
+	assert.Equal(t, reports[0].Holdings, big.NewInt(400e6))
+	assert.Equal(t, reports[0].Surplus, big.NewInt(-100e6))
+	assert.Equal(t, reports[0].Solvent, false)
+}
+
+func TestSnapshotIncludesPoolLiabilities(t *testing.T) {
+	setup()
+	reservesService := NewReservesService()
+	reservesService.SetServiceRegistry(serviceRegistry)
+	_, err := marketService.CreatePool(marketTicker, 30)
+	assert.Nil(t, err)
+	topup(users[0], big.NewInt(5e8), "BTC")
+	topup(users[3], big.NewInt(10e8), "BTC")
+	topup(users[3], big.NewInt(1_120_000e6), "USD")
+	_, err = userService.AddLiquidity(users[3], marketTicker, big.NewInt(10e8), big.NewInt(1_120_000e6))
+	assert.Nil(t, err)
+
+	// the pool reserves are owed to the liquidity provider
+	roots, err := reservesService.PublishSnapshot()
+	assert.Nil(t, err)
+	assert.Equal(t, len(roots), 2)
+	assert.Equal(t, roots[0].Asset, "BTC")
+	assert.Equal(t, roots[0].Total, big.NewInt(15e8))
+	assert.Equal(t, roots[1].Total, big.NewInt(1_120_000e6))
+	proof, err := reservesService.GetInclusionProof(users[3], "USD")
+	assert.Nil(t, err)
+	assert.Equal(t, proof.Balance, big.NewInt(1_120_000e6))
+	assert.Nil(t, VerifyInclusionProof(proof))
+}
@@ -0,0 +1,517 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+const (
+	defaultMaxHeadLag       = 5
+	defaultMaxFailures      = 3
+	defaultCrossCheckDepth  = 2
+	defaultHealthInterval   = 15 * time.Second
+	headLagPenaltyPerBlock  = 100 * time.Millisecond
+	latencySmoothingWeight  = 8
+	unhealthyFailuresReason = "consecutive failures"
+)
+
+// errEndpointBehind is returned for an endpoint whose head is below the block
+// range of a query, which it would otherwise silently truncate.
+var errEndpointBehind = errors.New("endpoint is behind the requested block")
+
+type rpcEndpoint struct {
+	name     string
+	client   WithdrawalClient
+	latency  time.Duration
+	head     uint64
+	failures int
+	healthy  bool
+	reason   string
+}
+
+// EndpointStatus is a snapshot of the health of a pool endpoint.
+type EndpointStatus struct {
+	Name     string
+	Healthy  bool
+	Reason   string
+	Latency  time.Duration
+	Head     uint64
+	Failures int
+}
+
+// RPCPool spreads calls over several RPC providers of the same chain. Every
+// call goes to the best scored healthy endpoint and fails over to the next
+// one on error. A periodic health check measures latency and head lag, and
+// cross-checks block hashes so that lagging or lying providers are demoted.
+type RPCPool struct {
+	endpoints       []*rpcEndpoint
+	maxHeadLag      uint64
+	maxFailures     int
+	crossCheckDepth uint64
+	mu              sync.Mutex
+	ctx             context.Context
+	cancel          context.CancelFunc
+}
+
+func NewRPCPool() *RPCPool {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &RPCPool{
+		endpoints:       []*rpcEndpoint{},
+		maxHeadLag:      defaultMaxHeadLag,
+		maxFailures:     defaultMaxFailures,
+		crossCheckDepth: defaultCrossCheckDepth,
+		ctx:             ctx,
+		cancel:          cancel,
+	}
+}
+
+// DialRPCPool connects to every URL. Unreachable URLs are skipped, it fails
+// only when none can be dialed.
+func DialRPCPool(ctx context.Context, rpcURLs []string) (*RPCPool, error) {
+	pool := NewRPCPool()
+	errs := []error{}
+	for _, rpcURL := range rpcURLs {
+		client, err := ethclient.DialContext(ctx, rpcURL)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", rpcURL, err))
+			continue
+		}
+		pool.AddEndpoint(rpcURL, client)
+	}
+	if len(pool.endpoints) == 0 {
+		return nil, errors.Join(append([]error{errors.New("no RPC endpoint available")}, errs...)...)
+	}
+	return pool, nil
+}
+
+func (pool *RPCPool) AddEndpoint(name string, client WithdrawalClient) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.endpoints = append(pool.endpoints, &rpcEndpoint{name: name, client: client, healthy: true})
+}
+
+// SetMaxHeadLag sets how many blocks an endpoint may trail the highest head
+// before it is considered unhealthy.
+func (pool *RPCPool) SetMaxHeadLag(maxHeadLag uint64) {
+	pool.maxHeadLag = maxHeadLag
+}
+
+// SetMaxFailures sets after how many consecutive failed calls an endpoint is
+// considered unhealthy until the next health check.
+func (pool *RPCPool) SetMaxFailures(maxFailures int) {
+	pool.maxFailures = max(maxFailures, 1)
+}
+
+func (pool *RPCPool) Status() []EndpointStatus {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	statuses := make([]EndpointStatus, 0, len(pool.endpoints))
+	for _, endpoint := range pool.endpoints {
+		statuses = append(statuses, EndpointStatus{
+			Name:     endpoint.name,
+			Healthy:  endpoint.healthy,
+			Reason:   endpoint.reason,
+			Latency:  endpoint.latency,
+			Head:     endpoint.head,
+			Failures: endpoint.failures,
+		})
+	}
+	return statuses
+}
+
+// Run checks the health of the endpoints every interval until Close.
+func (pool *RPCPool) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-pool.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := pool.CheckHealth(pool.ctx); err != nil {
+				log.Printf("RPC pool health check: %v", err)
+			}
+		}
+	}
+}
+
+// Close stops the health checks and closes the endpoint clients.
+func (pool *RPCPool) Close() {
+	pool.cancel()
+	for _, endpoint := range pool.endpoints {
+		if closer, ok := endpoint.client.(interface{ Close() }); ok {
+			closer.Close()
+		}
+	}
+}
+
+// CheckHealth measures every endpoint's latency and head, marks endpoints
+// trailing the highest head by more than maxHeadLag as lagging, and compares
+// the hash of a block slightly below the lowest head. Endpoints disagreeing
+// with the majority are marked as inconsistent.
+func (pool *RPCPool) CheckHealth(ctx context.Context) error {
+	type probe struct {
+		head    uint64
+		latency time.Duration
+		err     error
+		hash    common.Hash
+	}
+	pool.mu.Lock()
+	endpoints := append([]*rpcEndpoint{}, pool.endpoints...)
+	pool.mu.Unlock()
+
+	probes := make([]probe, len(endpoints))
+	var wg sync.WaitGroup
+	for i, endpoint := range endpoints {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			head, err := endpoint.client.BlockNumber(ctx)
+			probes[i] = probe{head: head, latency: time.Since(start), err: err}
+		}()
+	}
+	wg.Wait()
+
+	maxHead := uint64(0)
+	for _, probe := range probes {
+		if probe.err == nil {
+			maxHead = max(maxHead, probe.head)
+		}
+	}
+	current := []int{}
+	minHead := maxHead
+	for i, probe := range probes {
+		if probe.err == nil && maxHead-probe.head <= pool.maxHeadLag {
+			current = append(current, i)
+			minHead = min(minHead, probe.head)
+		}
+	}
+
+	referenceBlock := uint64(0)
+	if minHead > pool.crossCheckDepth {
+		referenceBlock = minHead - pool.crossCheckDepth
+	}
+	for _, i := range current {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			header, err := endpoints[i].client.HeaderByNumber(ctx, new(big.Int).SetUint64(referenceBlock))
+			if err != nil {
+				probes[i].err = err
+				return
+			}
+			probes[i].hash = header.Hash()
+		}()
+	}
+	wg.Wait()
+
+	votes := map[common.Hash]int{}
+	for _, i := range current {
+		if probes[i].err == nil {
+			votes[probes[i].hash]++
+		}
+	}
+	// ties go to the hash of the best ranked endpoint
+	canonical, majority := common.Hash{}, 0
+	for _, endpoint := range pool.ranked() {
+		for _, i := range current {
+			if endpoints[i] != endpoint || probes[i].err != nil {
+				continue
+			}
+			if count := votes[probes[i].hash]; count > majority {
+				canonical, majority = probes[i].hash, count
+			}
+		}
+	}
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	healthy := 0
+	for i, endpoint := range endpoints {
+		probe := probes[i]
+		endpoint.healthy = false
+		switch {
+		case probe.err != nil:
+			endpoint.reason = probe.err.Error()
+		case maxHead-probe.head > pool.maxHeadLag:
+			endpoint.head = probe.head
+			endpoint.reason = fmt.Sprintf("lagging %d blocks behind", maxHead-probe.head)
+		case len(votes) > 1 && probe.hash != canonical:
+			endpoint.head = probe.head
+			endpoint.reason = fmt.Sprintf(
+				"block %d hash %s disagrees with %d providers",
+				referenceBlock, probe.hash.Hex(), majority,
+			)
+		default:
+			endpoint.head = probe.head
+			endpoint.latency = smoothLatency(endpoint.latency, probe.latency)
+			endpoint.failures = 0
+			endpoint.healthy = true
+			endpoint.reason = ""
+			healthy++
+		}
+	}
+	if healthy == 0 {
+		return errors.New("no healthy RPC endpoint")
+	}
+	return nil
+}
+
+func smoothLatency(previous time.Duration, sample time.Duration) time.Duration {
+	if previous == 0 {
+		return sample
+	}
+	return (previous*(latencySmoothingWeight-1) + sample) / latencySmoothingWeight
+}
+
+// ranked returns the endpoints ordered by preference: healthy before
+// unhealthy ones, then by latency plus a penalty for every block of head lag.
+func (pool *RPCPool) ranked() []*rpcEndpoint {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	maxHead := uint64(0)
+	for _, endpoint := range pool.endpoints {
+		maxHead = max(maxHead, endpoint.head)
+	}
+	score := func(endpoint *rpcEndpoint) time.Duration {
+		return endpoint.latency + time.Duration(maxHead-endpoint.head)*headLagPenaltyPerBlock
+	}
+	endpoints := append([]*rpcEndpoint{}, pool.endpoints...)
+	sort.SliceStable(endpoints, func(i, j int) bool {
+		if endpoints[i].healthy != endpoints[j].healthy {
+			return endpoints[i].healthy
+		}
+		return score(endpoints[i]) < score(endpoints[j])
+	})
+	return endpoints
+}
+
+// call runs fn against the endpoints in ranked order until one succeeds.
+// Results that are answers rather than failures, such as a receipt that does
+// not exist yet, are returned without failing over.
+func (pool *RPCPool) call(ctx context.Context, fn func(endpoint *rpcEndpoint) error) error {
+	errs := []error{}
+	for _, endpoint := range pool.ranked() {
+		start := time.Now()
+		err := fn(endpoint)
+		if err == nil || errors.Is(err, ethereum.NotFound) {
+			pool.recordSuccess(endpoint, time.Since(start))
+			return err
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		if !errors.Is(err, errEndpointBehind) {
+			pool.recordFailure(endpoint, err)
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", endpoint.name, err))
+	}
+	return errors.Join(errs...)
+}
+
+func (pool *RPCPool) recordSuccess(endpoint *rpcEndpoint, latency time.Duration) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	endpoint.latency = smoothLatency(endpoint.latency, latency)
+	endpoint.failures = 0
+	if !endpoint.healthy && endpoint.reason == unhealthyFailuresReason {
+		endpoint.healthy = true
+		endpoint.reason = ""
+	}
+}
+
+func (pool *RPCPool) recordFailure(endpoint *rpcEndpoint, err error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	endpoint.failures++
+	if endpoint.healthy && endpoint.failures >= pool.maxFailures {
+		log.Printf("RPC endpoint %s marked unhealthy: %v", endpoint.name, err)
+		endpoint.healthy = false
+		endpoint.reason = unhealthyFailuresReason
+	}
+}
+
+func (pool *RPCPool) updateHead(endpoint *rpcEndpoint, head uint64) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	endpoint.head = max(endpoint.head, head)
+}
+
+func (pool *RPCPool) ChainID(ctx context.Context) (*big.Int, error) {
+	var chainID *big.Int
+	err := pool.call(ctx, func(endpoint *rpcEndpoint) (err error) {
+		chainID, err = endpoint.client.ChainID(ctx)
+		return err
+	})
+	return chainID, err
+}
+
+func (pool *RPCPool) BlockNumber(ctx context.Context) (uint64, error) {
+	var blockNumber uint64
+	err := pool.call(ctx, func(endpoint *rpcEndpoint) (err error) {
+		blockNumber, err = endpoint.client.BlockNumber(ctx)
+		if err == nil {
+			pool.updateHead(endpoint, blockNumber)
+		}
+		return err
+	})
+	return blockNumber, err
+}
+
+func (pool *RPCPool) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	var header *types.Header
+	err := pool.call(ctx, func(endpoint *rpcEndpoint) (err error) {
+		if err := pool.ensureHead(ctx, endpoint, number); err != nil {
+			return err
+		}
+		header, err = endpoint.client.HeaderByNumber(ctx, number)
+		return err
+	})
+	return header, err
+}
+
+func (pool *RPCPool) BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error) {
+	var block *types.Block
+	err := pool.call(ctx, func(endpoint *rpcEndpoint) (err error) {
+		if err := pool.ensureHead(ctx, endpoint, number); err != nil {
+			return err
+		}
+		block, err = endpoint.client.BlockByNumber(ctx, number)
+		return err
+	})
+	return block, err
+}
+
+// FilterLogs only queries endpoints that have reached the end of the range,
+// since nodes answer ranges beyond their head with the logs they have.
+func (pool *RPCPool) FilterLogs(ctx context.Context, query ethereum.FilterQuery) ([]types.Log, error) {
+	var logs []types.Log
+	err := pool.call(ctx, func(endpoint *rpcEndpoint) (err error) {
+		if err := pool.ensureHead(ctx, endpoint, query.ToBlock); err != nil {
+			return err
+		}
+		logs, err = endpoint.client.FilterLogs(ctx, query)
+		return err
+	})
+	return logs, err
+}
+
+func (pool *RPCPool) TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
+	var receipt *types.Receipt
+	err := pool.call(ctx, func(endpoint *rpcEndpoint) (err error) {
+		receipt, err = endpoint.client.TransactionReceipt(ctx, txHash)
+		return err
+	})
+	return receipt, err
+}
+
+// SendTransaction sends tx through the first endpoint that accepts it. An
+// endpoint that already knows tx, e.g. because the one tried before accepted
+// it but timed out, counts as accepting it.
+func (pool *RPCPool) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	return pool.call(ctx, func(endpoint *rpcEndpoint) error {
+		return sendTransaction(ctx, endpoint.client, tx)
+	})
+}
+
+func (pool *RPCPool) CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	var output []byte
+	err := pool.call(ctx, func(endpoint *rpcEndpoint) (err error) {
+		if err := pool.ensureHead(ctx, endpoint, blockNumber); err != nil {
+			return err
+		}
+		output, err = endpoint.client.CallContract(ctx, call, blockNumber)
+		return err
+	})
+	return output, err
+}
+
+func (pool *RPCPool) BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (*big.Int, error) {
+	var balance *big.Int
+	err := pool.call(ctx, func(endpoint *rpcEndpoint) (err error) {
+		if err := pool.ensureHead(ctx, endpoint, blockNumber); err != nil {
+			return err
+		}
+		balance, err = endpoint.client.BalanceAt(ctx, account, blockNumber)
+		return err
+	})
+	return balance, err
+}
+
+func (pool *RPCPool) PendingNonceAt(ctx context.Context, account common.Address) (uint64, error) {
+	var nonce uint64
+	err := pool.call(ctx, func(endpoint *rpcEndpoint) (err error) {
+		nonce, err = endpoint.client.PendingNonceAt(ctx, account)
+		return err
+	})
+	return nonce, err
+}
+
+func (pool *RPCPool) NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error) {
+	var nonce uint64
+	err := pool.call(ctx, func(endpoint *rpcEndpoint) (err error) {
+		if err := pool.ensureHead(ctx, endpoint, blockNumber); err != nil {
+			return err
+		}
+		nonce, err = endpoint.client.NonceAt(ctx, account, blockNumber)
+		return err
+	})
+	return nonce, err
+}
+
+func (pool *RPCPool) SuggestGasTipCap(ctx context.Context) (*big.Int, error) {
+	var gasTipCap *big.Int
+	err := pool.call(ctx, func(endpoint *rpcEndpoint) (err error) {
+		gasTipCap, err = endpoint.client.SuggestGasTipCap(ctx)
+		return err
+	})
+	return gasTipCap, err
+}
+
+func (pool *RPCPool) EstimateGas(ctx context.Context, call ethereum.CallMsg) (uint64, error) {
+	var gas uint64
+	err := pool.call(ctx, func(endpoint *rpcEndpoint) (err error) {
+		gas, err = endpoint.client.EstimateGas(ctx, call)
+		return err
+	})
+	return gas, err
+}
+
+// ensureHead makes sure the endpoint has reached the given block, refreshing
+// its head if the last known one is lower. Nil means the latest block.
+func (pool *RPCPool) ensureHead(ctx context.Context, endpoint *rpcEndpoint, number *big.Int) error {
+	if number == nil || !number.IsUint64() {
+		return nil
+	}
+	pool.mu.Lock()
+	head := endpoint.head
+	pool.mu.Unlock()
+	if head >= number.Uint64() {
+		return nil
+	}
+	head, err := endpoint.client.BlockNumber(ctx)
+	if err != nil {
+		return err
+	}
+	pool.updateHead(endpoint, head)
+	if head < number.Uint64() {
+		return fmt.Errorf("%w: head %d, requested %d", errEndpointBehind, head, number.Uint64())
+	}
+	return nil
+}
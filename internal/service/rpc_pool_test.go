@@ -0,0 +1,181 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/stretchr/testify/assert"
+
+	"x-swap/internal/utils"
+)
+
+// faultyEndpoint wraps a simulated chain client to act as a provider that is
+// down, lags behind the chain head or serves forged blocks.
+type faultyEndpoint struct {
+	WithdrawalClient
+	down    bool
+	lag     uint64
+	forged  bool
+	timeout bool
+}
+
+func (endpoint *faultyEndpoint) BlockNumber(ctx context.Context) (uint64, error) {
+	if endpoint.down {
+		return 0, errors.New("connection refused")
+	}
+	head, err := endpoint.WithdrawalClient.BlockNumber(ctx)
+	return head - endpoint.lag, err
+}
+
+func (endpoint *faultyEndpoint) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	if endpoint.down {
+		return nil, errors.New("connection refused")
+	}
+	header, err := endpoint.WithdrawalClient.HeaderByNumber(ctx, number)
+	if err != nil || !endpoint.forged {
+		return header, err
+	}
+	forged := types.CopyHeader(header)
+	forged.Extra = []byte("forged")
+	return forged, nil
+}
+
+// FilterLogs truncates the range at the lagging head, as nodes do.
+func (endpoint *faultyEndpoint) FilterLogs(ctx context.Context, query ethereum.FilterQuery) ([]types.Log, error) {
+	if endpoint.down {
+		return nil, errors.New("connection refused")
+	}
+	head, err := endpoint.BlockNumber(ctx)
+	if err != nil {
+		return nil, err
+	}
+	logs, err := endpoint.WithdrawalClient.FilterLogs(ctx, query)
+	truncated := []types.Log{}
+	for _, vLog := range logs {
+		if vLog.BlockNumber <= head {
+			truncated = append(truncated, vLog)
+		}
+	}
+	return truncated, err
+}
+
+// SendTransaction passes the transaction on but loses the answer when the
+// endpoint times out.
+func (endpoint *faultyEndpoint) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	if endpoint.down {
+		return errors.New("connection refused")
+	}
+	if err := endpoint.WithdrawalClient.SendTransaction(ctx, tx); err != nil || !endpoint.timeout {
+		return err
+	}
+	return errors.New("i/o timeout")
+}
+
+func TestRPCPoolFailsOverToHealthyEndpoint(t *testing.T) {
+	chain := newTestChain(t)
+	chain.backend.Commit()
+
+	pool := NewRPCPool()
+	pool.SetMaxFailures(1)
+	pool.AddEndpoint("down", &faultyEndpoint{WithdrawalClient: chain.client, down: true})
+	pool.AddEndpoint("up", &faultyEndpoint{WithdrawalClient: chain.client})
+
+	head, err := pool.BlockNumber(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, head, uint64(1))
+
+	statuses := pool.Status()
+	assert.False(t, statuses[0].Healthy)
+	assert.Equal(t, statuses[0].Reason, unhealthyFailuresReason)
+	assert.True(t, statuses[1].Healthy)
+	// the healthy endpoint is now tried first
+	assert.Equal(t, pool.ranked()[0].name, "up")
+}
+
+func TestRPCPoolDemotesLaggingAndLyingEndpoints(t *testing.T) {
+	chain := newTestChain(t)
+	for i := 0; i < 12; i++ {
+		chain.backend.Commit()
+	}
+
+	pool := NewRPCPool()
+	pool.AddEndpoint("lagging", &faultyEndpoint{WithdrawalClient: chain.client, lag: 10})
+	pool.AddEndpoint("lying", &faultyEndpoint{WithdrawalClient: chain.client, forged: true})
+	pool.AddEndpoint("honest-1", &faultyEndpoint{WithdrawalClient: chain.client})
+	pool.AddEndpoint("honest-2", &faultyEndpoint{WithdrawalClient: chain.client})
+	assert.Nil(t, pool.CheckHealth(context.Background()))
+
+	statuses := pool.Status()
+	assert.False(t, statuses[0].Healthy)
+	assert.Equal(t, statuses[0].Reason, "lagging 10 blocks behind")
+	assert.False(t, statuses[1].Healthy)
+	assert.Contains(t, statuses[1].Reason, "disagrees with 2 providers")
+	assert.True(t, statuses[2].Healthy)
+	assert.True(t, statuses[3].Healthy)
+}
+
+func TestRPCPoolSkipsEndpointsBehindTheQueryRange(t *testing.T) {
+	chain := newTestChain(t)
+	token := chain.deployToken(t, 6)
+	for i := 0; i < 10; i++ {
+		chain.backend.Commit()
+	}
+	chain.mint(t, token, utils.GenerateRandomAddress(), big.NewInt(1e6))
+	head, err := chain.client.BlockNumber(context.Background())
+	assert.Nil(t, err)
+
+	// the lagging endpoint is tried first but would miss the last transfer
+	pool := NewRPCPool()
+	pool.AddEndpoint("lagging", &faultyEndpoint{WithdrawalClient: chain.client, lag: 3})
+	pool.AddEndpoint("synced", &faultyEndpoint{WithdrawalClient: chain.client})
+
+	logs, err := pool.FilterLogs(context.Background(), ethereum.FilterQuery{
+		FromBlock: big.NewInt(0),
+		ToBlock:   new(big.Int).SetUint64(head),
+		Addresses: []common.Address{token},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, len(logs), 1)
+	// being behind is not a failure of the endpoint
+	assert.True(t, pool.Status()[0].Healthy)
+}
+
+func TestRPCPoolTreatsKnownTransactionsAsSent(t *testing.T) {
+	chain := newTestChain(t)
+	ctx := context.Background()
+	chainID, err := chain.client.ChainID(ctx)
+	assert.Nil(t, err)
+	head, err := chain.client.HeaderByNumber(ctx, nil)
+	assert.Nil(t, err)
+	transfer := func(to common.Address) *types.Transaction {
+		tx, err := types.SignNewTx(chain.key, types.LatestSignerForChainID(chainID), &types.DynamicFeeTx{
+			ChainID:   chainID,
+			GasTipCap: big.NewInt(params.GWei),
+			GasFeeCap: new(big.Int).Add(new(big.Int).Mul(head.BaseFee, big.NewInt(2)), big.NewInt(params.GWei)),
+			Gas:       21_000,
+			To:        &to,
+			Value:     big.NewInt(1),
+		})
+		assert.Nil(t, err)
+		return tx
+	}
+
+	// the first endpoint takes the transaction but times out, the next one
+	// already knows it from the network
+	pool := NewRPCPool()
+	pool.AddEndpoint("timeout", &faultyEndpoint{WithdrawalClient: chain.client, timeout: true})
+	pool.AddEndpoint("synced", &faultyEndpoint{WithdrawalClient: chain.client})
+	tx := transfer(utils.GenerateRandomAddress())
+	assert.Nil(t, pool.SendTransaction(ctx, tx))
+
+	// once mined, its nonce is too low but it was sent all the same
+	chain.backend.Commit()
+	assert.Nil(t, pool.SendTransaction(ctx, tx))
+	assert.ErrorContains(t, pool.SendTransaction(ctx, transfer(utils.GenerateRandomAddress())), "nonce too low")
+}
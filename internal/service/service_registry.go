@@ -7,6 +7,12 @@ type ServiceRegistry struct {
 	UserService       *UserService
 	OrderService      *OrderService
 	BlockchainService *BlockchainService
+	TokenRegistry     *TokenRegistry
+	WithdrawalService *WithdrawalService
+	ChainSupervisor   *ChainSupervisor
+	SettlementService *SettlementService
+	ReservesService   *ReservesService
+	APIKeyService     *APIKeyService
 }
 
 func NewServiceRegistry(
@@ -50,3 +56,69 @@ func (registry *ServiceRegistry) GetBlockchainService() (*BlockchainService, err
 	}
 	return registry.BlockchainService, nil
 }
+
+func (registry *ServiceRegistry) SetTokenRegistry(tokenRegistry *TokenRegistry) {
+	registry.TokenRegistry = tokenRegistry
+}
+
+func (registry *ServiceRegistry) GetTokenRegistry() (*TokenRegistry, error) {
+	if registry.TokenRegistry == nil {
+		return nil, errors.New("token registry not set")
+	}
+	return registry.TokenRegistry, nil
+}
+
+func (registry *ServiceRegistry) SetWithdrawalService(withdrawalService *WithdrawalService) {
+	registry.WithdrawalService = withdrawalService
+}
+
+func (registry *ServiceRegistry) GetWithdrawalService() (*WithdrawalService, error) {
+	if registry.WithdrawalService == nil {
+		return nil, errors.New("withdrawal service not set")
+	}
+	return registry.WithdrawalService, nil
+}
+
+func (registry *ServiceRegistry) SetChainSupervisor(chainSupervisor *ChainSupervisor) {
+	registry.ChainSupervisor = chainSupervisor
+}
+
+func (registry *ServiceRegistry) GetChainSupervisor() (*ChainSupervisor, error) {
+	if registry.ChainSupervisor == nil {
+		return nil, errors.New("chain supervisor not set")
+	}
+	return registry.ChainSupervisor, nil
+}
+
+func (registry *ServiceRegistry) SetSettlementService(settlementService *SettlementService) {
+	registry.SettlementService = settlementService
+}
+
+func (registry *ServiceRegistry) GetSettlementService() (*SettlementService, error) {
+	if registry.SettlementService == nil {
+		return nil, errors.New("settlement service not set")
+	}
+	return registry.SettlementService, nil
+}
+
+func (registry *ServiceRegistry) SetReservesService(reservesService *ReservesService) {
+	registry.ReservesService = reservesService
+}
+
+func (registry *ServiceRegistry) GetReservesService() (*ReservesService, error) {
+	if registry.ReservesService == nil {
+		return nil, errors.New("reserves service not set")
+	}
+	return registry.ReservesService, nil
+}
+
+func (registry *ServiceRegistry) SetAPIKeyService(apiKeyService *APIKeyService) {
+	registry.APIKeyService = apiKeyService
+}
+
+func (registry *ServiceRegistry) GetAPIKeyService() (*APIKeyService, error) {
+	if registry.APIKeyService == nil {
+		return nil, errors.New("api key service not set")
+	}
+	return registry.APIKeyService, nil
+}
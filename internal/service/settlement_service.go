@@ -0,0 +1,507 @@
+package service
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rpc"
+
+	"x-swap/internal/contracts/settlement"
+)
+
+type SettlementStatus string
+
+const (
+	// SettlementQueued fills wait to be included in the next batch.
+	SettlementQueued    SettlementStatus = "QUEUED"
+	SettlementSubmitted SettlementStatus = "SUBMITTED"
+	SettlementConfirmed SettlementStatus = "CONFIRMED"
+	// SettlementFailed batches were rejected or reverted, their fills are
+	// queued again. Fills fail once they ran out of attempts or cannot be
+	// expressed on the settlement chain, they need manual review.
+	SettlementFailed SettlementStatus = "FAILED"
+)
+
+const defaultMaxSettlementAttempts = 3
+
+// SettlementBackend is what the settlement contract bindings need to send
+// transactions and what the service needs to follow their receipts.
+type SettlementBackend interface {
+	bind.ContractBackend
+	bind.DeployBackend
+	ChainID(ctx context.Context) (*big.Int, error)
+	BlockNumber(ctx context.Context) (uint64, error)
+	NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error)
+}
+
+// SettlementBatch is one settleBatch transaction of the settlement contract.
+type SettlementBatch struct {
+	ID        common.Hash
+	FillIDs   []int64
+	Nonce     uint64
+	TxHash    common.Hash
+	Block     uint64
+	Status    SettlementStatus
+	Error     string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// tx is the signed transaction, sent again until it is mined
+	tx *types.Transaction
+}
+
+// FillSettlement tracks the on-chain settlement of a fill.
+type FillSettlement struct {
+	Fill     Fill
+	BatchID  common.Hash
+	TxHash   common.Hash
+	Block    uint64
+	Attempts int
+	Status   SettlementStatus
+	Error    string
+}
+
+// SettlementService settles the fills of the order book on chain. Fills are
+// queued as they happen, batched into settleBatch calls of the settlement
+// contract signed by the operator key, and marked settled once the batch
+// transaction has enough confirmations.
+type SettlementService struct {
+	backend         SettlementBackend
+	contract        *settlement.Settlement
+	contractAddress common.Address
+	operator        *ecdsa.PrivateKey
+	operatorAddress common.Address
+	chainID         *big.Int
+	serviceRegistry *ServiceRegistry
+	ctx             context.Context
+	cancel          context.CancelFunc
+	pollInterval    time.Duration
+	confirmations   uint64
+	batchSize       int
+	maxAttempts     int
+	nonce           uint64
+	nonceLoaded     bool
+	fills           map[int64]*FillSettlement
+	queue           []int64
+	batches         map[common.Hash]*SettlementBatch
+	batchIDs        []common.Hash
+	batchCount      uint64
+	mu              sync.Mutex
+}
+
+func NewSettlementService(
+	backend SettlementBackend,
+	contractAddress common.Address,
+	operator *ecdsa.PrivateKey,
+) (*SettlementService, error) {
+	contract, err := settlement.NewSettlement(contractAddress, backend)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &SettlementService{
+		backend:         backend,
+		contract:        contract,
+		contractAddress: contractAddress,
+		operator:        operator,
+		operatorAddress: crypto.PubkeyToAddress(operator.PublicKey),
+		ctx:             ctx,
+		cancel:          cancel,
+		pollInterval:    5 * time.Second,
+		confirmations:   12,
+		batchSize:       50,
+		maxAttempts:     defaultMaxSettlementAttempts,
+		fills:           make(map[int64]*FillSettlement),
+		queue:           []int64{},
+		batches:         make(map[common.Hash]*SettlementBatch),
+		batchIDs:        []common.Hash{},
+	}, nil
+}
+
+func (service *SettlementService) SetServiceRegistry(serviceRegistry *ServiceRegistry) {
+	service.serviceRegistry = serviceRegistry
+}
+
+func (service *SettlementService) GetServiceRegistry() (*ServiceRegistry, error) {
+	if service.serviceRegistry == nil {
+		return nil, errors.New("service registry not set")
+	}
+	return service.serviceRegistry, nil
+}
+
+// SetConfirmations sets how many blocks a batch transaction needs before its
+// fills are considered settled.
+func (service *SettlementService) SetConfirmations(confirmations uint64) {
+	service.confirmations = max(confirmations, 1)
+}
+
+// SetBatchSize sets the maximum number of fills settled by one transaction.
+func (service *SettlementService) SetBatchSize(batchSize int) {
+	service.batchSize = max(batchSize, 1)
+}
+
+func (service *SettlementService) SetPollInterval(pollInterval time.Duration) {
+	service.pollInterval = pollInterval
+}
+
+func (service *SettlementService) OperatorAddress() common.Address {
+	return service.operatorAddress
+}
+
+// QueueFill queues a fill for settlement. It is meant to be subscribed to the
+// order service with SubscribeFills.
+func (service *SettlementService) QueueFill(fill Fill) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	if _, ok := service.fills[fill.ID]; ok {
+		return
+	}
+	service.fills[fill.ID] = &FillSettlement{Fill: fill, Status: SettlementQueued}
+	service.queue = append(service.queue, fill.ID)
+}
+
+func (service *SettlementService) GetFillSettlement(fillID int64) (FillSettlement, error) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	fillSettlement, ok := service.fills[fillID]
+	if !ok {
+		return FillSettlement{}, fmt.Errorf("fill %d is not queued for settlement", fillID)
+	}
+	return *fillSettlement, nil
+}
+
+func (service *SettlementService) GetBatch(batchID common.Hash) (SettlementBatch, error) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	batch, ok := service.batches[batchID]
+	if !ok {
+		return SettlementBatch{}, fmt.Errorf("settlement batch %s not found", batchID.Hex())
+	}
+	return *batch, nil
+}
+
+// GetBatches returns all batches in submission order.
+func (service *SettlementService) GetBatches() []SettlementBatch {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	batches := make([]SettlementBatch, 0, len(service.batchIDs))
+	for _, batchID := range service.batchIDs {
+		batches = append(batches, *service.batches[batchID])
+	}
+	return batches
+}
+
+func (service *SettlementService) Start() {
+	log.Println("Starting settlement service...")
+	ticker := time.NewTicker(service.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-service.ctx.Done():
+			log.Println("Settlement service stopped")
+			return
+		case <-ticker.C:
+			if err := service.ProcessSettlements(); err != nil {
+				log.Printf("Error processing settlements: %v", err)
+			}
+		}
+	}
+}
+
+func (service *SettlementService) Stop() {
+	service.cancel()
+}
+
+// ProcessSettlements submits the queued fills in batches and reconciles the
+// submitted batches with their receipts.
+func (service *SettlementService) ProcessSettlements() error {
+	if err := service.loadChainID(); err != nil {
+		return err
+	}
+
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	// fills of batches failing now are queued again for the next round
+	queued := service.queue
+	service.queue = []int64{}
+	for len(queued) > 0 {
+		count := min(service.batchSize, len(queued))
+		if err := service.submitBatch(queued[:count]); err != nil {
+			for _, fillID := range queued {
+				if service.fills[fillID].Status == SettlementQueued {
+					service.queue = append(service.queue, fillID)
+				}
+			}
+			return err
+		}
+		queued = queued[count:]
+	}
+	return service.reconcile()
+}
+
+// submitBatch sends a settleBatch transaction for the given queued fills.
+// Fills that cannot be expressed on the settlement chain fail without being
+// submitted. Errors reaching the node are returned before the transaction is
+// signed, so the fills stay queued. Once signed, the batch is submitted even
+// if sending reports an error, as the transaction may have reached the
+// network anyway; reconcile settles it from its receipt.
+func (service *SettlementService) submitBatch(queued []int64) error {
+	serviceRegistry, err := service.GetServiceRegistry()
+	if err != nil {
+		return err
+	}
+	tokenRegistry, err := serviceRegistry.GetTokenRegistry()
+	if err != nil {
+		return err
+	}
+	if !service.nonceLoaded {
+		nonce, err := service.backend.PendingNonceAt(service.ctx, service.operatorAddress)
+		if err != nil {
+			return err
+		}
+		service.nonce = nonce
+		service.nonceLoaded = true
+	}
+
+	fillIDs := []int64{}
+	contractFills := []settlement.SettlementFill{}
+	for _, fillID := range queued {
+		fillSettlement := service.fills[fillID]
+		contractFill, err := service.contractFill(tokenRegistry, fillSettlement.Fill)
+		if err != nil {
+			log.Printf("Fill %d cannot be settled: %v", fillSettlement.Fill.ID, err)
+			fillSettlement.Status = SettlementFailed
+			fillSettlement.Error = err.Error()
+			continue
+		}
+		fillIDs = append(fillIDs, fillSettlement.Fill.ID)
+		contractFills = append(contractFills, contractFill)
+	}
+	if len(fillIDs) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	service.batchCount++
+	batchID := service.batchID(now)
+	opts, err := bind.NewKeyedTransactorWithChainID(service.operator, service.chainID)
+	if err != nil {
+		return err
+	}
+	opts.Context = service.ctx
+	opts.Nonce = new(big.Int).SetUint64(service.nonce)
+	opts.NoSend = true
+	tx, err := service.contract.SettleBatch(opts, batchID, contractFills)
+	var rpcErr rpc.Error
+	if err != nil && !errors.As(err, &rpcErr) {
+		return err
+	}
+
+	batch := &SettlementBatch{
+		ID:        batchID,
+		FillIDs:   fillIDs,
+		Nonce:     service.nonce,
+		Status:    SettlementSubmitted,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	service.batches[batch.ID] = batch
+	service.batchIDs = append(service.batchIDs, batch.ID)
+	for _, fillID := range fillIDs {
+		fillSettlement := service.fills[fillID]
+		fillSettlement.BatchID = batch.ID
+		fillSettlement.Attempts++
+		fillSettlement.Status = SettlementSubmitted
+	}
+	if err != nil {
+		// the node rejected the batch, e.g. because it would revert
+		service.failBatch(batch, fmt.Errorf("estimating gas: %w", err))
+		return nil
+	}
+
+	// the nonce belongs to the batch from now on, its fills are only queued
+	// again once the nonce was used by another transaction
+	service.nonce++
+	batch.TxHash = tx.Hash()
+	batch.tx = tx
+	if err := sendTransaction(service.ctx, service.backend, tx); err != nil {
+		log.Printf("Sending settlement batch %s transaction %s: %v", batch.ID.Hex(), batch.TxHash.Hex(), err)
+	}
+	log.Printf("Submitted settlement batch %s with %d fills in transaction %s",
+		batch.ID.Hex(), len(fillIDs), batch.TxHash.Hex())
+	return nil
+}
+
+// batchID derives a unique batch identifier, the settlement contract rejects
+// an identifier that was already settled.
+func (service *SettlementService) batchID(now time.Time) common.Hash {
+	data := make([]byte, 16)
+	binary.BigEndian.PutUint64(data, service.batchCount)
+	binary.BigEndian.PutUint64(data[8:], uint64(now.UnixNano()))
+	return crypto.Keccak256Hash(service.contractAddress.Bytes(), service.operatorAddress.Bytes(), data)
+}
+
+// contractFill converts a fill to token addresses and amounts of the
+// settlement chain.
+func (service *SettlementService) contractFill(tokenRegistry *TokenRegistry, fill Fill) (settlement.SettlementFill, error) {
+	chainID := service.chainID.Uint64()
+	baseToken, err := tokenRegistry.GetTokenOnChain(fill.BaseToken, chainID)
+	if err != nil {
+		return settlement.SettlementFill{}, err
+	}
+	quoteToken, err := tokenRegistry.GetTokenOnChain(fill.QuoteToken, chainID)
+	if err != nil {
+		return settlement.SettlementFill{}, err
+	}
+	baseAmount := tokenRegistry.ToChainAmount(baseToken, fill.BaseAmount)
+	quoteAmount := tokenRegistry.ToChainAmount(quoteToken, fill.QuoteAmount)
+	if tokenRegistry.ToAssetAmount(baseToken, baseAmount).Cmp(fill.BaseAmount) != 0 ||
+		tokenRegistry.ToAssetAmount(quoteToken, quoteAmount).Cmp(fill.QuoteAmount) != 0 {
+		return settlement.SettlementFill{}, fmt.Errorf("fill amounts exceed the token precision on chain %d", chainID)
+	}
+	return settlement.SettlementFill{
+		Maker:       fill.Maker,
+		Taker:       fill.Taker,
+		BaseToken:   baseToken.Address,
+		QuoteToken:  quoteToken.Address,
+		BaseAmount:  baseAmount,
+		QuoteAmount: quoteAmount,
+		TakerBuys:   fill.TakerSide == BuyOrder,
+	}, nil
+}
+
+// reconcile marks the fills of submitted batches as settled once the batch
+// transaction is confirmed and emitted BatchSettled for all of them.
+func (service *SettlementService) reconcile() error {
+	latestBlock, err := service.backend.BlockNumber(service.ctx)
+	if err != nil {
+		return err
+	}
+	for _, batchID := range service.batchIDs {
+		batch := service.batches[batchID]
+		if batch.Status != SettlementSubmitted {
+			continue
+		}
+		receipt, err := service.backend.TransactionReceipt(service.ctx, batch.TxHash)
+		if errors.Is(err, ethereum.NotFound) {
+			if err := service.resend(batch, latestBlock); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		batch.Block = receipt.BlockNumber.Uint64()
+		if latestBlock+1 < batch.Block+service.confirmations {
+			continue
+		}
+		if receipt.Status != types.ReceiptStatusSuccessful {
+			service.failBatch(batch, fmt.Errorf("transaction %s reverted", batch.TxHash.Hex()))
+			continue
+		}
+		if !service.settledInReceipt(batch, receipt) {
+			service.failBatch(batch, fmt.Errorf("transaction %s did not emit BatchSettled", batch.TxHash.Hex()))
+			continue
+		}
+
+		batch.Status = SettlementConfirmed
+		batch.UpdatedAt = time.Now()
+		for _, fillID := range batch.FillIDs {
+			fillSettlement := service.fills[fillID]
+			fillSettlement.TxHash = batch.TxHash
+			fillSettlement.Block = batch.Block
+			fillSettlement.Status = SettlementConfirmed
+		}
+		log.Printf("Settlement batch %s confirmed in block %d", batch.ID.Hex(), batch.Block)
+	}
+	return nil
+}
+
+// resend sends the transaction of a batch without receipt again, the node may
+// have dropped it. If the batch nonce was used by another transaction, the
+// batch can never be mined and its fills are queued again.
+func (service *SettlementService) resend(batch *SettlementBatch, latestBlock uint64) error {
+	if latestBlock+1 >= service.confirmations {
+		confirmedBlock := new(big.Int).SetUint64(latestBlock + 1 - service.confirmations)
+		usedNonce, err := service.backend.NonceAt(service.ctx, service.operatorAddress, confirmedBlock)
+		if err != nil {
+			return err
+		}
+		if usedNonce > batch.Nonce {
+			service.nonceLoaded = false
+			service.failBatch(batch, fmt.Errorf("nonce %d was used by another transaction", batch.Nonce))
+			return nil
+		}
+	}
+	if err := sendTransaction(service.ctx, service.backend, batch.tx); err != nil {
+		log.Printf("Resending settlement batch %s transaction %s: %v", batch.ID.Hex(), batch.TxHash.Hex(), err)
+	}
+	return nil
+}
+
+func (service *SettlementService) settledInReceipt(batch *SettlementBatch, receipt *types.Receipt) bool {
+	for _, vLog := range receipt.Logs {
+		if vLog.Address != service.contractAddress {
+			continue
+		}
+		event, err := service.contract.ParseBatchSettled(*vLog)
+		if err != nil {
+			continue
+		}
+		if event.BatchId == batch.ID && event.FillCount.Cmp(big.NewInt(int64(len(batch.FillIDs)))) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// failBatch marks the batch as failed and queues its fills again unless they
+// ran out of attempts.
+func (service *SettlementService) failBatch(batch *SettlementBatch, reason error) {
+	log.Printf("Settlement batch %s failed: %v", batch.ID.Hex(), reason)
+	batch.Status = SettlementFailed
+	batch.Error = reason.Error()
+	batch.UpdatedAt = time.Now()
+	for _, fillID := range batch.FillIDs {
+		fillSettlement := service.fills[fillID]
+		fillSettlement.Error = reason.Error()
+		if fillSettlement.Attempts >= service.maxAttempts {
+			fillSettlement.Status = SettlementFailed
+			continue
+		}
+		fillSettlement.Status = SettlementQueued
+		service.queue = append(service.queue, fillID)
+	}
+}
+
+func (service *SettlementService) loadChainID() error {
+	if service.chainID != nil {
+		return nil
+	}
+	chainID, err := service.backend.ChainID(service.ctx)
+	if err != nil {
+		return err
+	}
+	service.chainID = chainID
+	return nil
+}
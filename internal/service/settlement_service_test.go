@@ -0,0 +1,220 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+	"github.com/stretchr/testify/assert"
+
+	"x-swap/internal/contracts/settlement"
+	"x-swap/internal/utils"
+)
+
+// testSettlementCode returns the creation code of a settlement contract stub.
+// settleBatch reverts for an empty or already settled batch, otherwise it
+// marks the batch settled and emits BatchSettled(batchId, fills.length);
+// tokens are not moved.
+func testSettlementCode(t *testing.T) []byte {
+	settlementABI, err := settlement.SettlementMetaData.GetAbi()
+	assert.Nil(t, err)
+
+	runtime := newAssembler()
+	runtime.pushInt(0).op(vm.CALLDATALOAD).pushInt(224).op(vm.SHR)
+	for _, method := range []string{"settleBatch", "isSettled"} {
+		runtime.op(vm.DUP1).push(settlementABI.Methods[method].ID).op(vm.EQ).pushLabel(method).op(vm.JUMPI)
+	}
+	runtime.label("revert").pushInt(0).op(vm.DUP1, vm.REVERT)
+
+	runtime.label("isSettled").pushInt(4).op(vm.CALLDATALOAD, vm.SLOAD).pushInt(0).op(vm.MSTORE).
+		pushInt(32).pushInt(0).op(vm.RETURN)
+
+	runtime.label("settleBatch").pushInt(4).op(vm.CALLDATALOAD, vm.DUP1, vm.SLOAD).
+		pushLabel("revert").op(vm.JUMPI).
+		pushInt(36).op(vm.CALLDATALOAD).pushInt(4).op(vm.ADD, vm.CALLDATALOAD, vm.DUP1, vm.ISZERO).
+		pushLabel("revert").op(vm.JUMPI).
+		pushInt(0).op(vm.MSTORE).
+		pushInt(1).op(vm.DUP2, vm.SSTORE).
+		push(settlementABI.Events["BatchSettled"].ID.Bytes()).pushInt(32).pushInt(0).op(vm.LOG2, vm.STOP)
+	return creationCode(runtime.bytes())
+}
+
+func setupSettlement(t *testing.T) (*testChain, *SettlementService, common.Address) {
+	setup()
+	operator, err := crypto.GenerateKey()
+	assert.Nil(t, err)
+	chain := newTestChain(t, crypto.PubkeyToAddress(operator.PublicKey))
+	receipt := chain.send(t, nil, testSettlementCode(t))
+	assert.Equal(t, receipt.Status, types.ReceiptStatusSuccessful)
+
+	settlementService, err := NewSettlementService(chain.client, receipt.ContractAddress, operator)
+	assert.Nil(t, err)
+	settlementService.SetServiceRegistry(serviceRegistry)
+	settlementService.SetConfirmations(2)
+	serviceRegistry.SetSettlementService(settlementService)
+	serviceRegistry.SetTokenRegistry(NewTokenRegistry())
+	orderService.SubscribeFills(settlementService.QueueFill)
+	return chain, settlementService, receipt.ContractAddress
+}
+
+// droppingBackend reports an error for the first transactions sent and drops
+// them, like a node that went away before passing them on.
+type droppingBackend struct {
+	simulated.Client
+	drops int
+}
+
+func (backend *droppingBackend) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	if backend.drops > 0 {
+		backend.drops--
+		return errors.New("i/o timeout")
+	}
+	return backend.Client.SendTransaction(ctx, tx)
+}
+
+// placeTrades rests three sell orders of 0.1 BTC and fills them with one buy.
+func placeTrades(t *testing.T) {
+	for _, maker := range users[1:4] {
+		topup(maker, big.NewInt(1e7), "BTC")
+		_, err := userService.PlaceOrder(Order{
+			ID:         orderService.GetNextOrderID(),
+			User:       maker,
+			OrderType:  SellOrder,
+			Size:       big.NewInt(1e7),
+			Price:      big.NewInt(100_000e6),
+			SizeFilled: big.NewInt(0),
+			CreatedAt:  time.Now(),
+			Status:     Open,
+			Market:     market,
+		}, false)
+		assert.Nil(t, err)
+	}
+	topup(users[0], big.NewInt(30_000e6), "USD")
+	_, err := userService.PlaceOrder(Order{
+		ID:         orderService.GetNextOrderID(),
+		User:       users[0],
+		OrderType:  BuyOrder,
+		Size:       big.NewInt(3e7),
+		Price:      big.NewInt(100_000e6),
+		SizeFilled: big.NewInt(0),
+		CreatedAt:  time.Now(),
+		Status:     Open,
+		Market:     market,
+	}, true)
+	assert.Nil(t, err)
+}
+
+func TestSettleFillsInBatches(t *testing.T) {
+	chain, settlementService, contractAddress := setupSettlement(t)
+	chainID, err := chain.client.ChainID(context.Background())
+	assert.Nil(t, err)
+	tokenRegistry, err := serviceRegistry.GetTokenRegistry()
+	assert.Nil(t, err)
+	_, err = tokenRegistry.RegisterToken("BTC", chainID.Uint64(), utils.GenerateRandomAddress(), 8)
+	assert.Nil(t, err)
+	_, err = tokenRegistry.RegisterToken("USD", chainID.Uint64(), utils.GenerateRandomAddress(), 6)
+	assert.Nil(t, err)
+	settlementService.SetBatchSize(2)
+
+	placeTrades(t)
+	fills := orderService.GetFills(marketTicker)
+	assert.Equal(t, len(fills), 3)
+	assert.Equal(t, fills[0].Maker, users[1])
+	assert.Equal(t, fills[0].Taker, users[0])
+	assert.Equal(t, fills[0].TakerSide, BuyOrder)
+	assert.Equal(t, fills[0].BaseAmount, big.NewInt(1e7))
+	assert.Equal(t, fills[0].QuoteAmount, big.NewInt(10_000e6))
+
+	assert.Nil(t, settlementService.ProcessSettlements())
+	batches := settlementService.GetBatches()
+	assert.Equal(t, len(batches), 2)
+	assert.Equal(t, batches[0].FillIDs, []int64{fills[0].ID, fills[1].ID})
+	assert.Equal(t, batches[1].FillIDs, []int64{fills[2].ID})
+	assert.Equal(t, batches[0].Nonce, uint64(0))
+	assert.Equal(t, batches[1].Nonce, uint64(1))
+
+	chain.backend.Commit()
+	assert.Nil(t, settlementService.ProcessSettlements())
+	fillSettlement, err := settlementService.GetFillSettlement(fills[0].ID)
+	assert.Nil(t, err)
+	assert.Equal(t, fillSettlement.Status, SettlementSubmitted)
+
+	chain.backend.Commit()
+	assert.Nil(t, settlementService.ProcessSettlements())
+	for i, fill := range fills {
+		fillSettlement, err := settlementService.GetFillSettlement(fill.ID)
+		assert.Nil(t, err)
+		assert.Equal(t, fillSettlement.Status, SettlementConfirmed)
+		assert.Equal(t, fillSettlement.TxHash, batches[i/2].TxHash)
+	}
+
+	contract, err := settlement.NewSettlement(contractAddress, chain.client)
+	assert.Nil(t, err)
+	settled, err := contract.IsSettled(&bind.CallOpts{}, batches[1].ID)
+	assert.Nil(t, err)
+	assert.Equal(t, settled, true)
+}
+
+func TestUnsettleableFillFails(t *testing.T) {
+	_, settlementService, _ := setupSettlement(t)
+
+	// neither token is registered on the settlement chain
+	placeTrades(t)
+	assert.Nil(t, settlementService.ProcessSettlements())
+	assert.Equal(t, len(settlementService.GetBatches()), 0)
+	for _, fill := range orderService.GetFills(marketTicker) {
+		fillSettlement, err := settlementService.GetFillSettlement(fill.ID)
+		assert.Nil(t, err)
+		assert.Equal(t, fillSettlement.Status, SettlementFailed)
+		assert.Contains(t, fillSettlement.Error, "BTC")
+	}
+}
+
+func TestSettlementSendErrorKeepsBatchSubmitted(t *testing.T) {
+	chain, settlementService, contractAddress := setupSettlement(t)
+	backend := &droppingBackend{Client: chain.client, drops: 1}
+	contract, err := settlement.NewSettlement(contractAddress, backend)
+	assert.Nil(t, err)
+	settlementService.backend = backend
+	settlementService.contract = contract
+	chainID, err := chain.client.ChainID(context.Background())
+	assert.Nil(t, err)
+	tokenRegistry, err := serviceRegistry.GetTokenRegistry()
+	assert.Nil(t, err)
+	_, err = tokenRegistry.RegisterToken("BTC", chainID.Uint64(), utils.GenerateRandomAddress(), 8)
+	assert.Nil(t, err)
+	_, err = tokenRegistry.RegisterToken("USD", chainID.Uint64(), utils.GenerateRandomAddress(), 6)
+	assert.Nil(t, err)
+
+	// the batch keeps its transaction and fills after the send error
+	placeTrades(t)
+	assert.Nil(t, settlementService.ProcessSettlements())
+	batches := settlementService.GetBatches()
+	assert.Equal(t, len(batches), 1)
+	assert.Equal(t, batches[0].Status, SettlementSubmitted)
+	assert.NotEqual(t, batches[0].TxHash, common.Hash{})
+
+	// it is sent again instead of settling the fills in a new batch
+	chain.backend.Commit()
+	assert.Nil(t, settlementService.ProcessSettlements())
+	chain.backend.Commit()
+	chain.backend.Commit()
+	assert.Nil(t, settlementService.ProcessSettlements())
+	batches = settlementService.GetBatches()
+	assert.Equal(t, len(batches), 1)
+	assert.Equal(t, batches[0].Status, SettlementConfirmed)
+	for _, fill := range orderService.GetFills(marketTicker) {
+		fillSettlement, err := settlementService.GetFillSettlement(fill.ID)
+		assert.Nil(t, err)
+		assert.Equal(t, fillSettlement.Status, SettlementConfirmed)
+		assert.Equal(t, fillSettlement.Attempts, 1)
+	}
+}
@@ -0,0 +1,211 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+)
+
+// OrderDomain is the EIP-712 domain orders are signed for. VerifyingContract
+// is the settlement contract, so signed orders can be settled on chain.
+type OrderDomain struct {
+	Name              string
+	Version           string
+	ChainID           uint64
+	VerifyingContract common.Address
+}
+
+var orderTypes = apitypes.Types{
+	"EIP712Domain": {
+		{Name: "name", Type: "string"},
+		{Name: "version", Type: "string"},
+		{Name: "chainId", Type: "uint256"},
+		{Name: "verifyingContract", Type: "address"},
+	},
+	"Order": {
+		{Name: "market", Type: "string"},
+		{Name: "side", Type: "string"},
+		{Name: "size", Type: "uint256"},
+		{Name: "price", Type: "uint256"},
+		{Name: "nonce", Type: "uint256"},
+		{Name: "expiry", Type: "uint256"},
+	},
+}
+
+// TypedData returns the EIP-712 typed data of an order. The expiry is signed
+// as Unix seconds, zero for orders without one.
+func (domain OrderDomain) TypedData(order Order) apitypes.TypedData {
+	expiry := big.NewInt(0)
+	if !order.Expiry.IsZero() {
+		expiry.SetInt64(order.Expiry.Unix())
+	}
+	return apitypes.TypedData{
+		Types:       orderTypes,
+		PrimaryType: "Order",
+		Domain: apitypes.TypedDataDomain{
+			Name:              domain.Name,
+			Version:           domain.Version,
+			ChainId:           math.NewHexOrDecimal256(int64(domain.ChainID)),
+			VerifyingContract: domain.VerifyingContract.Hex(),
+		},
+		Message: apitypes.TypedDataMessage{
+			"market": order.Market.MarketTicker,
+			"side":   string(order.OrderType),
+			"size":   order.Size,
+			"price":  order.Price,
+			"nonce":  new(big.Int).SetUint64(order.Nonce),
+			"expiry": expiry,
+		},
+	}
+}
+
+// HashOrder returns the EIP-712 digest signed by the order's user.
+func (domain OrderDomain) HashOrder(order Order) (common.Hash, error) {
+	if order.Size == nil || order.Price == nil {
+		return common.Hash{}, errors.New("order size and price must be set")
+	}
+	hash, _, err := apitypes.TypedDataAndHash(domain.TypedData(order))
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return common.BytesToHash(hash), nil
+}
+
+// SignOrder returns the 65 byte [R || S || V] signature of an order, with V
+// being 27 or 28 like eth_signTypedData wallets return it.
+func (domain OrderDomain) SignOrder(order Order, key *ecdsa.PrivateKey) ([]byte, error) {
+	hash, err := domain.HashOrder(order)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := crypto.Sign(hash.Bytes(), key)
+	if err != nil {
+		return nil, err
+	}
+	signature[crypto.RecoveryIDOffset] += 27
+	return signature, nil
+}
+
+// RecoverOrderSigner returns the address that signed an order.
+func (domain OrderDomain) RecoverOrderSigner(order Order) (common.Address, error) {
+	if len(order.Signature) != crypto.SignatureLength {
+		return common.Address{}, fmt.Errorf("order signature must be %d bytes", crypto.SignatureLength)
+	}
+	hash, err := domain.HashOrder(order)
+	if err != nil {
+		return common.Address{}, err
+	}
+	signature := append([]byte{}, order.Signature...)
+	if signature[crypto.RecoveryIDOffset] >= 27 {
+		signature[crypto.RecoveryIDOffset] -= 27
+	}
+	publicKey, err := crypto.SigToPub(hash.Bytes(), signature)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return crypto.PubkeyToAddress(*publicKey), nil
+}
+
+// SetOrderDomain makes PlaceOrder require orders signed for the domain with
+// unused nonces.
+func (service *UserService) SetOrderDomain(domain OrderDomain) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	service.orderDomain = &domain
+}
+
+// GetMinOrderNonce returns the lowest nonce a new order of the user may use.
+func (service *UserService) GetMinOrderNonce(user common.Address) uint64 {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	return service.minOrderNonces[user]
+}
+
+// verifyOrder checks the expiry of an order and, when an order domain is
+// set, that it uses a nonce that was not used before and, if requireSignature
+// is set, that it is signed by its user. Sub-accounts have no key of their
+// own, their orders are signed by their master.
+func (service *UserService) verifyOrder(order Order, now time.Time, requireSignature bool) error {
+	if order.IsExpired(now) {
+		return fmt.Errorf("order expired at %s", order.Expiry.Format(time.RFC3339))
+	}
+	if service.orderDomain == nil {
+		return nil
+	}
+
+	if requireSignature {
+		signer, err := service.orderDomain.RecoverOrderSigner(order)
+		if err != nil {
+			return fmt.Errorf("invalid signature: %w", err)
+		}
+		owner := order.User
+		if user, ok := service.Users[order.User]; ok && user.Master != (common.Address{}) {
+			owner = user.Master
+		}
+		if signer != owner {
+			return fmt.Errorf("order signed by %s, not by %s", signer.Hex(), owner.Hex())
+		}
+	}
+	if minNonce := service.minOrderNonces[order.User]; order.Nonce < minNonce {
+		return fmt.Errorf("order nonce %d is below the minimum nonce %d", order.Nonce, minNonce)
+	}
+	if service.usedOrderNonces[order.User][order.Nonce] {
+		return fmt.Errorf("order nonce %d was already used", order.Nonce)
+	}
+	return nil
+}
+
+func (service *UserService) useOrderNonce(order Order) {
+	if service.orderDomain == nil {
+		return
+	}
+	if service.usedOrderNonces[order.User] == nil {
+		service.usedOrderNonces[order.User] = make(map[uint64]bool)
+	}
+	service.usedOrderNonces[order.User][order.Nonce] = true
+}
+
+// CancelOrdersBelowNonce invalidates every order of the user with a nonce
+// lower than nonce: resting ones are cancelled and signed ones that were not
+// placed yet are rejected. The minimum nonce never decreases.
+func (service *UserService) CancelOrdersBelowNonce(user common.Address, nonce uint64) error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	serviceRegistry, err := service.GetServiceRegistry()
+	if err != nil {
+		return err
+	}
+	orderService, err := serviceRegistry.GetOrderService()
+	if err != nil {
+		return err
+	}
+
+	if nonce <= service.minOrderNonces[user] {
+		return nil
+	}
+	service.minOrderNonces[user] = nonce
+	for marketTicker := range orderService.OrderBooks {
+		for _, order := range orderService.GetActiveOrdersByMarketTicker(marketTicker) {
+			if order.User != user || order.Nonce >= nonce {
+				continue
+			}
+			if err := orderService.CancelOrder(marketTicker, order.ID); err != nil {
+				return err
+			}
+		}
+	}
+	for usedNonce := range service.usedOrderNonces[user] {
+		if usedNonce < nonce {
+			delete(service.usedOrderNonces[user], usedNonce)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+
+	"x-swap/internal/utils"
+)
+
+var testOrderDomain = OrderDomain{
+	Name:              "x-swap",
+	Version:           "1",
+	ChainID:           1,
+	VerifyingContract: common.HexToAddress("0x00000000000000000000000000000000000000aa"),
+}
+
+// newSigningUser registers a user whose orders can be signed with the
+// returned key.
+func newSigningUser(t *testing.T) (common.Address, *ecdsa.PrivateKey) {
+	key, err := crypto.GenerateKey()
+	assert.Nil(t, err)
+	user := crypto.PubkeyToAddress(key.PublicKey)
+	_, err = userService.RegisterUser(user)
+	assert.Nil(t, err)
+	return user, key
+}
+
+func signedBuyOrder(t *testing.T, user common.Address, key *ecdsa.PrivateKey, nonce uint64) Order {
+	order := Order{
+		ID:         orderService.GetNextOrderID(),
+		User:       user,
+		OrderType:  BuyOrder,
+		Size:       big.NewInt(1e7),
+		Price:      big.NewInt(100_000e6),
+		SizeFilled: big.NewInt(0),
+		CreatedAt:  time.Now(),
+		Status:     Open,
+		Market:     market,
+		Nonce:      nonce,
+	}
+	signature, err := testOrderDomain.SignOrder(order, key)
+	assert.Nil(t, err)
+	order.Signature = signature
+	return order
+}
+
+func TestPlaceSignedOrder(t *testing.T) {
+	setup()
+	userService.SetOrderDomain(testOrderDomain)
+	user, key := newSigningUser(t)
+	topup(user, big.NewInt(100_000e6), "USD")
+
+	order := signedBuyOrder(t, user, key, 1)
+	signer, err := testOrderDomain.RecoverOrderSigner(order)
+	assert.Nil(t, err)
+	assert.Equal(t, signer, user)
+	_, err = userService.PlaceOrder(order, false)
+	assert.Nil(t, err)
+
+	// the same signed order submitted again
+	order.ID = orderService.GetNextOrderID()
+	_, err = userService.PlaceOrder(order, false)
+	assert.ErrorContains(t, err, "order nonce 1 was already used")
+
+	// the price was changed after signing
+	tampered := signedBuyOrder(t, user, key, 2)
+	tampered.Price = big.NewInt(90_000e6)
+	_, err = userService.PlaceOrder(tampered, false)
+	assert.ErrorContains(t, err, "not by "+user.Hex())
+
+	// an order for user signed with another key
+	_, otherKey := newSigningUser(t)
+	_, err = userService.PlaceOrder(signedBuyOrder(t, user, otherKey, 3), false)
+	assert.ErrorContains(t, err, "not by "+user.Hex())
+
+	unsigned := signedBuyOrder(t, user, key, 4)
+	unsigned.Signature = nil
+	_, err = userService.PlaceOrder(unsigned, false)
+	assert.ErrorContains(t, err, "invalid signature")
+
+	expired := signedBuyOrder(t, user, key, 5)
+	expired.Expiry = time.Now().Add(-time.Minute)
+	expired.Signature, err = testOrderDomain.SignOrder(expired, key)
+	assert.Nil(t, err)
+	_, err = userService.PlaceOrder(expired, false)
+	assert.ErrorContains(t, err, "order expired")
+
+	assert.Equal(t, len(orderService.GetActiveOrdersByMarketTicker(marketTicker)), 1)
+}
+
+func TestCancelOrdersBelowNonce(t *testing.T) {
+	setup()
+	userService.SetOrderDomain(testOrderDomain)
+	user, key := newSigningUser(t)
+	topup(user, big.NewInt(100_000e6), "USD")
+
+	for nonce := uint64(1); nonce <= 3; nonce++ {
+		_, err := userService.PlaceOrder(signedBuyOrder(t, user, key, nonce), false)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, userService.GetAssetAmountLocked(user, "USD"), big.NewInt(30_000e6))
+
+	assert.Nil(t, userService.CancelOrdersBelowNonce(user, 3))
+	assert.Equal(t, userService.GetMinOrderNonce(user), uint64(3))
+	orders := orderService.GetActiveOrdersByMarketTicker(marketTicker)
+	assert.Equal(t, len(orders), 1)
+	assert.Equal(t, orders[0].Nonce, uint64(3))
+	assert.Equal(t, userService.GetAssetAmountLocked(user, "USD"), big.NewInt(10_000e6))
+
+	_, err := userService.PlaceOrder(signedBuyOrder(t, user, key, 2), false)
+	assert.ErrorContains(t, err, "below the minimum nonce 3")
+	_, err = userService.PlaceOrder(signedBuyOrder(t, user, key, 4), false)
+	assert.Nil(t, err)
+
+	// the minimum nonce never decreases
+	assert.Nil(t, userService.CancelOrdersBelowNonce(user, 1))
+	assert.Equal(t, userService.GetMinOrderNonce(user), uint64(3))
+}
+
+func TestExpiredMakerOrderIsNotMatched(t *testing.T) {
+	setup()
+	maker := users[0]
+	topup(maker, big.NewInt(1e7), "BTC")
+	expiredOrder := Order{
+		ID:         orderService.GetNextOrderID(),
+		User:       maker,
+		OrderType:  SellOrder,
+		Size:       big.NewInt(1e7),
+		Price:      big.NewInt(100_000e6),
+		SizeFilled: big.NewInt(0),
+		CreatedAt:  time.Now(),
+		Status:     Open,
+		Market:     market,
+		Expiry:     time.Now().Add(-time.Second),
+	}
+	assert.Nil(t, userService.LockBalance(maker, "BTC", big.NewInt(1e7), orderReference(marketTicker, expiredOrder.ID)))
+	orderService.CreateOrder(expiredOrder, marketTicker)
+
+	taker := utils.GenerateRandomAddress()
+	_, err := userService.RegisterUser(taker)
+	assert.Nil(t, err)
+	topup(taker, big.NewInt(10_000e6), "USD")
+	report, err := userService.PlaceOrder(Order{
+		ID:         orderService.GetNextOrderID(),
+		User:       taker,
+		OrderType:  BuyOrder,
+		Size:       big.NewInt(1e7),
+		Price:      big.NewInt(100_000e6),
+		SizeFilled: big.NewInt(0),
+		CreatedAt:  time.Now(),
+		Status:     Open,
+		Market:     market,
+	}, true)
+	assert.Nil(t, err)
+	assert.Equal(t, report.BookBaseAmount.String(), "0")
+	assert.Equal(t, len(orderService.GetActiveOrdersByMarketTicker(marketTicker)), 0)
+	assert.Equal(t, userService.GetAssetAmountLocked(maker, "BTC").String(), "0")
+	assert.Equal(t, userService.GetAssetAmount(maker, "BTC"), big.NewInt(1e7))
+}
+
+func TestExpiredOrderBelowTopIsReleased(t *testing.T) {
+	setup()
+	err := marketService.SetMarketRules(marketTicker, MarketRules{
+		TickSize:      big.NewInt(1e6),
+		LotSize:       big.NewInt(1e4),
+		MinSize:       big.NewInt(1e5),
+		MaxSize:       big.NewInt(10e8),
+		MinNotional:   big.NewInt(10e6),
+		MaxOpenOrders: 2,
+	})
+	assert.Nil(t, err)
+	topup(users[0], big.NewInt(300_000e6), "USD")
+	_, err = userService.PlaceOrder(newLimitOrder(0, BuyOrder, 1e8, 100_000e6), false)
+	assert.Nil(t, err)
+	// the expiring order rests below the best bid, so no match reaches it
+	deep := newLimitOrder(0, BuyOrder, 1e8, 90_000e6)
+	deep.Expiry = time.Now().Add(50 * time.Millisecond)
+	_, err = userService.PlaceOrder(deep, false)
+	assert.Nil(t, err)
+	_, err = userService.PlaceOrder(newLimitOrder(0, BuyOrder, 1e8, 80_000e6), false)
+	assert.ErrorContains(t, err, "maximum of 2 open orders")
+
+	time.Sleep(60 * time.Millisecond)
+	next := newLimitOrder(0, BuyOrder, 1e8, 95_000e6)
+	next.Expiry = time.Now().Add(50 * time.Millisecond)
+	_, err = userService.PlaceOrder(next, false)
+	assert.Nil(t, err)
+	assert.Equal(t, userService.GetAssetAmountLocked(users[0], "USD"), big.NewInt(195_000e6))
+	assert.Equal(t, orderService.GetInActiveOrdersByMarketTicker(marketTicker)[0].ID, deep.ID)
+
+	// the sweep releases expired orders without any new order
+	time.Sleep(60 * time.Millisecond)
+	assert.Nil(t, userService.CancelExpiredOrders())
+	assert.Equal(t, orderService.GetOpenOrderCount(marketTicker, users[0]), 1)
+	assert.Equal(t, userService.GetAssetAmountLocked(users[0], "USD"), big.NewInt(100_000e6))
+}
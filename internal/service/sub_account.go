@@ -0,0 +1,209 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// SubAccountAddress returns the address of a master's sub-account. It is
+// derived from the master and the name, so it cannot belong to anyone's key.
+func SubAccountAddress(master common.Address, name string) common.Address {
+	return common.BytesToAddress(crypto.Keccak256(master.Bytes(), []byte(name))[12:])
+}
+
+// CreateSubAccount opens a sub-account under a master account. Sub-accounts
+// have their own balances and orders, and share the status of their master.
+func (service *UserService) CreateSubAccount(master common.Address, name string) (User, error) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	if name == "" {
+		return User{}, errors.New("sub-account name must not be empty")
+	}
+	owner, ok := service.Users[master]
+	if !ok {
+		return User{}, fmt.Errorf("user %s not found", master.Hex())
+	}
+	if owner.Master != (common.Address{}) {
+		return User{}, fmt.Errorf("%s is a sub-account and cannot have sub-accounts", master.Hex())
+	}
+	if err := service.checkUserActive(master); err != nil {
+		return User{}, err
+	}
+	address := SubAccountAddress(master, name)
+	if _, ok := service.Users[address]; ok {
+		return User{}, fmt.Errorf("sub-account %s of %s already exists", name, master.Hex())
+	}
+
+	user := service.ensureUser(address)
+	user.Master = master
+	user.Name = name
+	user.Tier = owner.Tier
+	service.Users[address] = user
+	service.subAccounts[master] = append(service.subAccounts[master], address)
+	return user.clone(), nil
+}
+
+// GetSubAccounts returns the sub-accounts of a master in creation order.
+func (service *UserService) GetSubAccounts(master common.Address) []User {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	subAccounts := []User{}
+	for _, address := range service.subAccounts[master] {
+		subAccounts = append(subAccounts, service.Users[address].clone())
+	}
+	return subAccounts
+}
+
+// Transfer instantly moves available funds between two registered accounts,
+// sub-accounts or not, and returns the journal entry recording it.
+func (service *UserService) Transfer(
+	from common.Address,
+	to common.Address,
+	asset string,
+	amount *big.Int,
+) (JournalEntry, error) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	if amount == nil || amount.Sign() <= 0 {
+		return JournalEntry{}, errors.New("transfer amount must be positive")
+	}
+	if from == to {
+		return JournalEntry{}, errors.New("cannot transfer to the same account")
+	}
+	if err := service.checkUserActive(from); err != nil {
+		return JournalEntry{}, fmt.Errorf("transfer rejected: %w", err)
+	}
+	if err := service.checkUserActive(to); err != nil {
+		return JournalEntry{}, fmt.Errorf("transfer rejected: %w", err)
+	}
+	if available := service.assetAmountAvailable(from, asset); available.Cmp(amount) < 0 {
+		return JournalEntry{}, fmt.Errorf("insufficient %s balance for transfer: have %s, need %s", asset, available, amount)
+	}
+
+	service.transferID++
+	reference := fmt.Sprintf("transfer:%d", service.transferID)
+	return service.post(EntryTransfer, reference, transfer(availableAccount(from), availableAccount(to), asset, amount)...), nil
+}
+
+// GetAggregatedBalances returns the balances and locked amounts of a master
+// account summed with those of all its sub-accounts.
+func (service *UserService) GetAggregatedBalances(master common.Address) (map[string]*big.Int, map[string]*big.Int) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	balances := make(map[string]*big.Int)
+	locked := make(map[string]*big.Int)
+	for _, address := range service.accountGroup(master) {
+		user := service.Users[address]
+		for asset, amount := range user.Balance {
+			addAmount(balances, asset, amount)
+		}
+		for asset, amount := range user.BalanceLocked {
+			addAmount(locked, asset, amount)
+		}
+	}
+	return balances, locked
+}
+
+// PnLReport is the trading result of one or more accounts.
+type PnLReport struct {
+	Accounts []common.Address
+	// Flows is the net amount of every asset gained or given up by trades,
+	// including the pool fees paid in them. Deposits, withdrawals and
+	// transfers are not part of it.
+	Flows map[string]*big.Int
+	// Value is Flows marked to the last price of each asset against Quote, in
+	// the quote asset's decimals.
+	Quote string
+	Value *big.Int
+}
+
+// GetPnL returns the trading result of a single account, marked to the last
+// prices against quote.
+func (service *UserService) GetPnL(account common.Address, quote string) (PnLReport, error) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	return service.pnl([]common.Address{account}, quote)
+}
+
+// GetAggregatedPnL returns the trading result of a master account and all its
+// sub-accounts.
+func (service *UserService) GetAggregatedPnL(master common.Address, quote string) (PnLReport, error) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	return service.pnl(service.accountGroup(master), quote)
+}
+
+func (service *UserService) pnl(accounts []common.Address, quote string) (PnLReport, error) {
+	serviceRegistry, err := service.GetServiceRegistry()
+	if err != nil {
+		return PnLReport{}, err
+	}
+	marketService, err := serviceRegistry.GetMarketService()
+	if err != nil {
+		return PnLReport{}, err
+	}
+	orderService, err := serviceRegistry.GetOrderService()
+	if err != nil {
+		return PnLReport{}, err
+	}
+
+	members := make(map[common.Address]bool, len(accounts))
+	for _, account := range accounts {
+		members[account] = true
+	}
+	report := PnLReport{
+		Accounts: append([]common.Address{}, accounts...),
+		Flows:    make(map[string]*big.Int),
+		Quote:    quote,
+		Value:    big.NewInt(0),
+	}
+	for _, entry := range service.journal.Entries() {
+		if entry.Reason != EntryTrade && entry.Reason != EntryPoolTrade {
+			continue
+		}
+		for _, posting := range entry.Postings {
+			if posting.Account.Kind != AccountAvailable && posting.Account.Kind != AccountLocked {
+				continue
+			}
+			if members[posting.Account.Owner] {
+				addAmount(report.Flows, posting.Asset, posting.Amount)
+			}
+		}
+	}
+
+	for asset, flow := range report.Flows {
+		if asset == quote {
+			report.Value.Add(report.Value, flow)
+			continue
+		}
+		marketTicker := GetMarketTicker(asset, quote)
+		market, ok := marketService.LookupMarket(marketTicker)
+		if !ok {
+			return PnLReport{}, fmt.Errorf("no market %s to value %s", marketTicker, asset)
+		}
+		price := orderService.GetReferencePrice(marketTicker, LastTradeReference)
+		if price == nil {
+			return PnLReport{}, fmt.Errorf("no %s price to value %s", marketTicker, asset)
+		}
+		baseMultiplier := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(market.BaseTokenDecimals)), nil)
+		value := new(big.Int).Mul(flow, price)
+		report.Value.Add(report.Value, value.Quo(value, baseMultiplier))
+	}
+	return report, nil
+}
+
+// accountGroup returns a master account followed by its sub-accounts.
+func (service *UserService) accountGroup(master common.Address) []common.Address {
+	return append([]common.Address{master}, service.subAccounts[master]...)
+}
+
+func addAmount(amounts map[string]*big.Int, asset string, amount *big.Int) {
+	if amounts[asset] == nil {
+		amounts[asset] = big.NewInt(0)
+	}
+	amounts[asset] = new(big.Int).Add(amounts[asset], amount)
+}
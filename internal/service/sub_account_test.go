@@ -0,0 +1,107 @@
+package service
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubAccountsTransfersAndPnL(t *testing.T) {
+	setup()
+	master := users[0]
+	alpha, err := userService.CreateSubAccount(master, "alpha")
+	assert.Nil(t, err)
+	assert.Equal(t, alpha.Master, master)
+	assert.Equal(t, alpha.Address, SubAccountAddress(master, "alpha"))
+	beta, err := userService.CreateSubAccount(master, "beta")
+	assert.Nil(t, err)
+	_, err = userService.CreateSubAccount(master, "alpha")
+	assert.ErrorContains(t, err, "already exists")
+	_, err = userService.CreateSubAccount(alpha.Address, "nested")
+	assert.ErrorContains(t, err, "cannot have sub-accounts")
+	assert.Equal(t, len(userService.GetSubAccounts(master)), 2)
+
+	topup(master, big.NewInt(200_000e6), "USD")
+	entry, err := userService.Transfer(master, alpha.Address, "USD", big.NewInt(100_000e6))
+	assert.Nil(t, err)
+	assert.Equal(t, entry.Reason, EntryTransfer)
+	assert.Equal(t, entry.Reference, "transfer:1")
+	_, err = userService.Transfer(master, beta.Address, "USD", big.NewInt(150_000e6))
+	assert.ErrorContains(t, err, "insufficient USD balance for transfer")
+	_, err = userService.Transfer(master, beta.Address, "USD", big.NewInt(50_000e6))
+	assert.Nil(t, err)
+
+	// alpha buys one BTC at 100,000 and the price moves to 110,000
+	topup(users[1], big.NewInt(2e8), "BTC")
+	_, err = userService.PlaceOrder(limitOrder(1, SellOrder, 1e8, 100_000e6), false)
+	assert.Nil(t, err)
+	buy := limitOrder(0, BuyOrder, 1e8, 100_000e6)
+	buy.User = alpha.Address
+	_, err = userService.PlaceOrder(buy, true)
+	assert.Nil(t, err)
+	_, err = userService.PlaceOrder(limitOrder(1, SellOrder, 2e7, 110_000e6), false)
+	assert.Nil(t, err)
+	topup(users[2], big.NewInt(11_000e6), "USD")
+	_, err = userService.PlaceOrder(limitOrder(2, BuyOrder, 1e7, 110_000e6), true)
+	assert.Nil(t, err)
+
+	// beta's resting order is its own, not alpha's or the master's
+	sell := limitOrder(0, SellOrder, 1e7, 120_000e6)
+	sell.User = beta.Address
+	_, err = userService.PlaceOrder(sell, false)
+	assert.ErrorContains(t, err, "insufficient BTC balance")
+	_, err = userService.Transfer(alpha.Address, beta.Address, "BTC", big.NewInt(1e7))
+	assert.Nil(t, err)
+	_, err = userService.PlaceOrder(sell, false)
+	assert.Nil(t, err)
+	assert.Equal(t, orderService.GetOpenOrderCount(marketTicker, beta.Address), 1)
+	assert.Equal(t, orderService.GetOpenOrderCount(marketTicker, alpha.Address), 0)
+	assert.ErrorContains(t, userService.CancelOrder(alpha.Address, marketTicker, sell.ID), "does not belong")
+
+	assert.Equal(t, userService.GetAssetAmount(master, "USD"), big.NewInt(50_000e6))
+	assert.Equal(t, userService.GetAssetAmount(alpha.Address, "BTC"), big.NewInt(9e7))
+	assert.Equal(t, userService.GetAssetAmountLocked(beta.Address, "BTC"), big.NewInt(1e7))
+	balances, locked := userService.GetAggregatedBalances(master)
+	assert.Equal(t, balances["USD"], big.NewInt(100_000e6))
+	assert.Equal(t, balances["BTC"], big.NewInt(1e8))
+	assert.Equal(t, locked["BTC"], big.NewInt(1e7))
+
+	pnl, err := userService.GetPnL(alpha.Address, "USD")
+	assert.Nil(t, err)
+	assert.Equal(t, pnl.Flows["BTC"], big.NewInt(1e8))
+	assert.Equal(t, pnl.Flows["USD"], big.NewInt(-100_000e6))
+	assert.Equal(t, pnl.Value, big.NewInt(10_000e6))
+	pnl, err = userService.GetPnL(beta.Address, "USD")
+	assert.Nil(t, err)
+	assert.Equal(t, len(pnl.Flows), 0)
+	pnl, err = userService.GetAggregatedPnL(master, "USD")
+	assert.Nil(t, err)
+	assert.Equal(t, len(pnl.Accounts), 3)
+	assert.Equal(t, pnl.Value, big.NewInt(10_000e6))
+	assert.Nil(t, userService.VerifyBalances())
+
+	// freezing the master freezes its sub-accounts
+	assert.Nil(t, userService.FreezeUser(master))
+	_, err = userService.Transfer(alpha.Address, beta.Address, "BTC", big.NewInt(1e7))
+	assert.ErrorContains(t, err, "is frozen")
+}
+
+func TestSubAccountOrdersSignedByMaster(t *testing.T) {
+	setup()
+	userService.SetOrderDomain(testOrderDomain)
+	master, masterKey := newSigningUser(t)
+	alpha, err := userService.CreateSubAccount(master, "alpha")
+	assert.Nil(t, err)
+	topup(alpha.Address, big.NewInt(200_000e6), "USD")
+
+	// a sub-account address has no key, its master signs for it
+	_, err = userService.PlaceOrder(signedBuyOrder(t, alpha.Address, masterKey, 1), false)
+	assert.Nil(t, err)
+	assert.Equal(t, orderService.GetOpenOrderCount(marketTicker, alpha.Address), 1)
+
+	_, otherKey := newSigningUser(t)
+	_, err = userService.PlaceOrder(signedBuyOrder(t, alpha.Address, otherKey, 2), false)
+	assert.ErrorContains(t, err, "not by "+master.Hex())
+	assert.Equal(t, orderService.GetOpenOrderCount(marketTicker, alpha.Address), 1)
+}
@@ -0,0 +1,161 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+const (
+	minReconnectBackoff = time.Second
+	maxReconnectBackoff = time.Minute
+)
+
+// SubscriptionClient pushes new heads and logs, e.g. over a WebSocket RPC.
+type SubscriptionClient interface {
+	SubscribeNewHead(ctx context.Context, ch chan<- *types.Header) (ethereum.Subscription, error)
+	SubscribeFilterLogs(ctx context.Context, query ethereum.FilterQuery, ch chan<- types.Log) (ethereum.Subscription, error)
+}
+
+// SetWebSocketURL switches the service to subscription mode: new heads and
+// Transfer logs are pushed over the WebSocket endpoint instead of being polled.
+func (service *BlockchainService) SetWebSocketURL(wsURL string) {
+	service.SetSubscriptionDialer(func(ctx context.Context) (SubscriptionClient, error) {
+		return ethclient.DialContext(ctx, wsURL)
+	})
+}
+
+// SetSubscriptionDialer sets how subscription clients are (re)connected. A
+// client with a Close method is closed when its subscriptions end.
+func (service *BlockchainService) SetSubscriptionDialer(dial func(ctx context.Context) (SubscriptionClient, error)) {
+	service.dialSubscriber = dial
+}
+
+// SetReconnectBackoff bounds the delay between subscription reconnects.
+func (service *BlockchainService) SetReconnectBackoff(minBackoff time.Duration, maxBackoff time.Duration) {
+	service.minReconnectBackoff = minBackoff
+	service.maxReconnectBackoff = max(minBackoff, maxBackoff)
+}
+
+// subscriptionLoop follows the chain through subscriptions. Whenever they
+// cannot be established or drop, it polls until the next reconnect attempt
+// and backs off exponentially between attempts. Both modes index from
+// lastProcessedBlock, so blocks produced while switching are never skipped.
+func (service *BlockchainService) subscriptionLoop() {
+	backoff := service.minReconnectBackoff
+	for {
+		subscribed, err := service.followSubscriptions()
+		if service.ctx.Err() != nil {
+			log.Println("Blockchain service subscriptions stopped")
+			return
+		}
+		if subscribed {
+			backoff = service.minReconnectBackoff
+		}
+		log.Printf("Subscription failed, polling for %s before reconnecting: %v", backoff, err)
+		service.pollFor(backoff)
+		backoff = min(backoff*2, service.maxReconnectBackoff)
+	}
+}
+
+// followSubscriptions runs until a subscription fails or the service stops.
+// It reports whether the subscriptions were established.
+func (service *BlockchainService) followSubscriptions() (bool, error) {
+	ctx, cancel := context.WithCancel(service.ctx)
+	defer cancel()
+
+	subscriber, err := service.dialSubscriber(ctx)
+	if err != nil {
+		return false, err
+	}
+	if closer, ok := subscriber.(interface{ Close() }); ok {
+		defer closer.Close()
+	}
+
+	heads := make(chan *types.Header, 16)
+	headSubscription, err := subscriber.SubscribeNewHead(ctx, heads)
+	if err != nil {
+		return false, err
+	}
+	defer headSubscription.Unsubscribe()
+
+	logs := make(chan types.Log, 256)
+	logSubscription, err := subscriber.SubscribeFilterLogs(ctx, ethereum.FilterQuery{
+		Addresses: service.contractAddresses,
+		Topics:    [][]common.Hash{{transferEventSigHash}},
+	}, logs)
+	if err != nil {
+		return false, err
+	}
+	defer logSubscription.Unsubscribe()
+
+	// catch up on blocks produced while no subscription was active
+	if err := service.processNewBlocks(); err != nil {
+		log.Printf("Error processing blocks: %v", err)
+	}
+
+	for {
+		select {
+		case <-service.ctx.Done():
+			return true, service.ctx.Err()
+		case err := <-headSubscription.Err():
+			return true, errors.Join(errors.New("head subscription dropped"), err)
+		case err := <-logSubscription.Err():
+			return true, errors.Join(errors.New("log subscription dropped"), err)
+		case vLog := <-logs:
+			service.processPushedLog(vLog)
+		case <-heads:
+			if err := service.processNewBlocks(); err != nil {
+				log.Printf("Error processing blocks: %v", err)
+			}
+		}
+	}
+}
+
+// processPushedLog records a deposit as soon as its log is pushed. The ranged
+// query run for every new head sees the same log again, which is a no-op, and
+// verifies its block hash before the deposit can be credited.
+func (service *BlockchainService) processPushedLog(vLog types.Log) {
+	if vLog.Removed {
+		// reorgs are handled by the ranged query on the next head
+		return
+	}
+	transferEvent, err := service.parseTransferLog(vLog)
+	if err != nil {
+		log.Printf("Error parsing transfer event: %v", err)
+		return
+	}
+
+	service.indexMu.Lock()
+	defer service.indexMu.Unlock()
+	if err := service.updateUserBalance(transferEvent); err != nil {
+		log.Printf("Error updating user balance: %v", err)
+	}
+}
+
+// pollFor polls for new blocks until duration has elapsed.
+func (service *BlockchainService) pollFor(duration time.Duration) {
+	deadline := time.NewTimer(duration)
+	defer deadline.Stop()
+	ticker := time.NewTicker(min(service.pollInterval, duration))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-service.ctx.Done():
+			return
+		case <-deadline.C:
+			return
+		case <-ticker.C:
+			if err := service.processNewBlocks(); err != nil {
+				log.Printf("Error processing blocks: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"x-swap/internal/utils"
+)
+
+// subscriptionOnly hides the Close method of the shared simulated client.
+type subscriptionOnly struct {
+	SubscriptionClient
+}
+
+func TestSubscriptionModeFallsBackToPolling(t *testing.T) {
+	chain, _, token := setupWithdrawals(t)
+	blockchainService := NewBlockchainService("", token.Address)
+	blockchainService.SetServiceRegistry(serviceRegistry)
+	blockchainService.SetConfirmations(2)
+	blockchainService.SetPollInterval(10 * time.Millisecond)
+	blockchainService.SetReconnectBackoff(100*time.Millisecond, 200*time.Millisecond)
+	assert.Nil(t, blockchainService.SetClient(chain.client))
+
+	var dials atomic.Int32
+	blockchainService.SetSubscriptionDialer(func(ctx context.Context) (SubscriptionClient, error) {
+		if dials.Add(1) == 1 {
+			return nil, errors.New("connection refused")
+		}
+		return subscriptionOnly{chain.client}, nil
+	})
+
+	depositAddress := utils.GenerateRandomAddress()
+	assert.Nil(t, userService.SetDepositAddress(users[0], depositAddress))
+	go blockchainService.Start()
+	defer blockchainService.Stop()
+
+	// the first deposit is indexed by polling while the subscription is down
+	chain.mint(t, token.Address, depositAddress, big.NewInt(100e6))
+	chain.backend.Commit()
+	assert.Eventually(t, func() bool {
+		return len(blockchainService.GetDeposits()) == 1 &&
+			blockchainService.GetDeposits()[0].Status == DepositCredited
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// the second one arrives once the subscription is established
+	assert.Eventually(t, func() bool { return dials.Load() >= 2 }, 2*time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	chain.mint(t, token.Address, depositAddress, big.NewInt(50e6))
+	chain.backend.Commit()
+	assert.Eventually(t, func() bool {
+		deposits := blockchainService.GetDeposits()
+		return len(deposits) == 2 && deposits[1].Status == DepositCredited
+	}, 2*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,235 @@
+package service
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/eth/ethconfig"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+	"github.com/ethereum/go-ethereum/node"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/stretchr/testify/assert"
+)
+
+// assembler builds EVM bytecode with forward jump labels, so the test token
+// can be deployed without a Solidity compiler.
+type assembler struct {
+	code   []byte
+	labels map[string]int
+	refs   map[int]string
+}
+
+func newAssembler() *assembler {
+	return &assembler{labels: map[string]int{}, refs: map[int]string{}}
+}
+
+func (asm *assembler) op(ops ...vm.OpCode) *assembler {
+	for _, op := range ops {
+		asm.code = append(asm.code, byte(op))
+	}
+	return asm
+}
+
+func (asm *assembler) push(value []byte) *assembler {
+	if len(value) == 0 {
+		value = []byte{0}
+	}
+	asm.code = append(asm.code, byte(vm.PUSH1)+byte(len(value)-1))
+	asm.code = append(asm.code, value...)
+	return asm
+}
+
+func (asm *assembler) pushInt(value uint64) *assembler {
+	return asm.push(new(big.Int).SetUint64(value).Bytes())
+}
+
+func (asm *assembler) pushLabel(name string) *assembler {
+	asm.refs[len(asm.code)+1] = name
+	return asm.push([]byte{0, 0})
+}
+
+func (asm *assembler) label(name string) *assembler {
+	asm.labels[name] = len(asm.code)
+	return asm.op(vm.JUMPDEST)
+}
+
+func (asm *assembler) bytes() []byte {
+	for offset, name := range asm.refs {
+		asm.code[offset] = byte(asm.labels[name] >> 8)
+		asm.code[offset+1] = byte(asm.labels[name])
+	}
+	return asm.code
+}
+
+// testTokenCode returns the creation code of a minimal ERC-20 token with
+// decimals, balanceOf, transfer and an unrestricted mint. Balances are stored
+// in the slot named by the holder address.
+func testTokenCode(decimals uint8) []byte {
+	transferTopic := transferEventSigHash.Bytes()
+	selector := func(method string) []byte { return erc20TestABI.Methods[method].ID }
+
+	runtime := newAssembler()
+	runtime.pushInt(0).op(vm.CALLDATALOAD).pushInt(224).op(vm.SHR)
+	for _, method := range []string{"transfer", "balanceOf", "decimals", "mint"} {
+		runtime.op(vm.DUP1).push(selector(method)).op(vm.EQ).pushLabel(method).op(vm.JUMPI)
+	}
+	runtime.label("revert").pushInt(0).op(vm.DUP1, vm.REVERT)
+
+	runtime.label("decimals").pushInt(uint64(decimals)).pushInt(0).op(vm.MSTORE).
+		pushInt(32).pushInt(0).op(vm.RETURN)
+
+	runtime.label("balanceOf").pushInt(4).op(vm.CALLDATALOAD, vm.SLOAD).pushInt(0).op(vm.MSTORE).
+		pushInt(32).pushInt(0).op(vm.RETURN)
+
+	// balance[to] += amount, emit Transfer(0, to, amount)
+	runtime.label("mint").pushInt(36).op(vm.CALLDATALOAD).
+		pushInt(4).op(vm.CALLDATALOAD, vm.DUP1, vm.SLOAD, vm.DUP3, vm.ADD, vm.SWAP1, vm.SSTORE).
+		pushInt(0).op(vm.MSTORE).
+		pushInt(4).op(vm.CALLDATALOAD).pushInt(0).push(transferTopic).pushInt(32).pushInt(0).op(vm.LOG3, vm.STOP)
+
+	// require(balance[caller] >= amount), move amount from caller to to,
+	// emit Transfer(caller, to, amount), return true
+	runtime.label("transfer").pushInt(36).op(vm.CALLDATALOAD, vm.CALLER, vm.SLOAD, vm.DUP2, vm.DUP2, vm.LT).
+		pushLabel("revert").op(vm.JUMPI).
+		op(vm.DUP2, vm.SWAP1, vm.SUB, vm.CALLER, vm.SSTORE).
+		pushInt(4).op(vm.CALLDATALOAD, vm.DUP1, vm.SLOAD, vm.DUP3, vm.ADD, vm.SWAP1, vm.SSTORE).
+		pushInt(0).op(vm.MSTORE).
+		pushInt(4).op(vm.CALLDATALOAD, vm.CALLER).push(transferTopic).pushInt(32).pushInt(0).op(vm.LOG3).
+		pushInt(1).pushInt(0).op(vm.MSTORE).pushInt(32).pushInt(0).op(vm.RETURN)
+	return creationCode(runtime.bytes())
+}
+
+// creationCode prepends a constructor that deploys runtimeCode.
+func creationCode(runtimeCode []byte) []byte {
+	const constructorLength = 13
+	constructor := newAssembler().
+		push([]byte{byte(len(runtimeCode) >> 8), byte(len(runtimeCode))}).op(vm.DUP1).
+		push([]byte{0, constructorLength}).pushInt(0).op(vm.CODECOPY).
+		pushInt(0).op(vm.RETURN).bytes()
+	return append(constructor, runtimeCode...)
+}
+
+var erc20TestABI = mustParseABI(`[
+	{"type":"function","name":"transfer","inputs":[{"name":"to","type":"address"},{"name":"amount","type":"uint256"}],"outputs":[{"name":"","type":"bool"}]},
+	{"type":"function","name":"balanceOf","inputs":[{"name":"owner","type":"address"}],"outputs":[{"name":"","type":"uint256"}]},
+	{"type":"function","name":"decimals","inputs":[],"outputs":[{"name":"","type":"uint8"}]},
+	{"type":"function","name":"mint","inputs":[{"name":"to","type":"address"},{"name":"amount","type":"uint256"}],"outputs":[]}
+]`)
+
+// testChain is a simulated chain with a funded account.
+type testChain struct {
+	backend *simulated.Backend
+	client  simulated.Client
+	key     *ecdsa.PrivateKey
+	address common.Address
+}
+
+func newTestChain(t *testing.T, funded ...common.Address) *testChain {
+	return newTestChainWithID(t, 0, funded...)
+}
+
+// newTestChainWithID starts a simulated chain with the given chain ID, or the
+// simulated backend's default one when chainID is zero.
+func newTestChainWithID(t *testing.T, chainID uint64, funded ...common.Address) *testChain {
+	key, err := crypto.GenerateKey()
+	assert.Nil(t, err)
+	address := crypto.PubkeyToAddress(key.PublicKey)
+	balance := new(big.Int).Mul(big.NewInt(1000), big.NewInt(params.Ether))
+	alloc := types.GenesisAlloc{address: {Balance: balance}}
+	for _, account := range funded {
+		alloc[account] = types.Account{Balance: balance}
+	}
+	backend := simulated.NewBackend(alloc, func(nodeConf *node.Config, ethConf *ethconfig.Config) {
+		if chainID != 0 {
+			chainConfig := *ethConf.Genesis.Config
+			chainConfig.ChainID = new(big.Int).SetUint64(chainID)
+			ethConf.Genesis.Config = &chainConfig
+			ethConf.NetworkId = chainID
+		}
+	})
+	t.Cleanup(func() { backend.Close() })
+	return &testChain{backend: backend, client: backend.Client(), key: key, address: address}
+}
+
+// send signs a transaction from the funded account, mines it and returns the
+// receipt.
+func (chain *testChain) send(t *testing.T, to *common.Address, data []byte) *types.Receipt {
+	return chain.sendValue(t, to, big.NewInt(0), data)
+}
+
+func (chain *testChain) sendValue(t *testing.T, to *common.Address, value *big.Int, data []byte) *types.Receipt {
+	ctx := context.Background()
+	chainID, err := chain.client.ChainID(ctx)
+	assert.Nil(t, err)
+	nonce, err := chain.client.PendingNonceAt(ctx, chain.address)
+	assert.Nil(t, err)
+	head, err := chain.client.HeaderByNumber(ctx, nil)
+	assert.Nil(t, err)
+
+	tx, err := types.SignNewTx(chain.key, types.LatestSignerForChainID(chainID), &types.DynamicFeeTx{
+		ChainID:   chainID,
+		Nonce:     nonce,
+		GasTipCap: big.NewInt(params.GWei),
+		GasFeeCap: new(big.Int).Add(new(big.Int).Mul(head.BaseFee, big.NewInt(2)), big.NewInt(params.GWei)),
+		Gas:       1_000_000,
+		To:        to,
+		Value:     value,
+		Data:      data,
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, chain.client.SendTransaction(ctx, tx))
+	chain.backend.Commit()
+
+	receipt, err := chain.client.TransactionReceipt(ctx, tx.Hash())
+	assert.Nil(t, err)
+	return receipt
+}
+
+func (chain *testChain) deployToken(t *testing.T, decimals uint8) common.Address {
+	receipt := chain.send(t, nil, testTokenCode(decimals))
+	assert.Equal(t, receipt.Status, types.ReceiptStatusSuccessful)
+	return receipt.ContractAddress
+}
+
+func (chain *testChain) mint(t *testing.T, token common.Address, to common.Address, amount *big.Int) {
+	data, err := erc20TestABI.Pack("mint", to, amount)
+	assert.Nil(t, err)
+	receipt := chain.send(t, &token, data)
+	assert.Equal(t, receipt.Status, types.ReceiptStatusSuccessful)
+}
+
+func (chain *testChain) tokenBalance(t *testing.T, token common.Address, owner common.Address) *big.Int {
+	balance, err := ReadTokenBalance(context.Background(), chain.client, token, owner, nil)
+	assert.Nil(t, err)
+	return balance
+}
+
+func TestTestToken(t *testing.T) {
+	chain := newTestChain(t)
+	token := chain.deployToken(t, 6)
+
+	decimals, err := ReadTokenDecimals(context.Background(), chain.client, token)
+	assert.Nil(t, err)
+	assert.Equal(t, decimals, 6)
+
+	chain.mint(t, token, chain.address, big.NewInt(100e6))
+	recipient := common.HexToAddress("0x1234")
+	data, err := erc20TestABI.Pack("transfer", recipient, big.NewInt(30e6))
+	assert.Nil(t, err)
+	receipt := chain.send(t, &token, data)
+	assert.Equal(t, receipt.Status, types.ReceiptStatusSuccessful)
+	assert.Equal(t, len(receipt.Logs), 1)
+	assert.Equal(t, chain.tokenBalance(t, token, chain.address), big.NewInt(70e6))
+	assert.Equal(t, chain.tokenBalance(t, token, recipient), big.NewInt(30e6))
+
+	data, err = erc20TestABI.Pack("transfer", recipient, big.NewInt(71e6))
+	assert.Nil(t, err)
+	receipt = chain.send(t, &token, data)
+	assert.Equal(t, receipt.Status, types.ReceiptStatusFailed)
+}
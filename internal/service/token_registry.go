@@ -0,0 +1,177 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Token links an asset symbol used by markets and balances to its contract on
+// one chain. The same asset may be deployed on several chains, balances are
+// kept per asset regardless of the chain it was deposited on.
+type Token struct {
+	Symbol   string
+	ChainID  uint64
+	Address  common.Address
+	Decimals int
+}
+
+type tokenContract struct {
+	chainID uint64
+	address common.Address
+}
+
+type tokenDeployment struct {
+	symbol  string
+	chainID uint64
+}
+
+type TokenRegistry struct {
+	// Tokens holds the first registered deployment of every asset, its
+	// decimals are the asset's decimals used by markets and balances.
+	Tokens         map[string]Token
+	TokenSymbols   []string
+	deployments    map[tokenDeployment]Token
+	deploymentKeys []tokenDeployment
+	contracts      map[tokenContract]string
+}
+
+func NewTokenRegistry() *TokenRegistry {
+	return &TokenRegistry{
+		Tokens:         make(map[string]Token),
+		TokenSymbols:   []string{},
+		deployments:    make(map[tokenDeployment]Token),
+		deploymentKeys: []tokenDeployment{},
+		contracts:      make(map[tokenContract]string),
+	}
+}
+
+func (registry *TokenRegistry) RegisterToken(
+	symbol string,
+	chainID uint64,
+	address common.Address,
+	decimals int,
+) (Token, error) {
+	if symbol == "" {
+		return Token{}, errors.New("token symbol is empty")
+	}
+	if decimals < 0 || decimals > 77 {
+		return Token{}, fmt.Errorf("invalid decimals %d for token %s", decimals, symbol)
+	}
+	deployment := tokenDeployment{symbol: symbol, chainID: chainID}
+	if _, ok := registry.deployments[deployment]; ok {
+		return Token{}, fmt.Errorf("token %s already registered on chain %d", symbol, chainID)
+	}
+	contract := tokenContract{chainID: chainID, address: address}
+	if existing, ok := registry.contracts[contract]; ok {
+		return Token{}, fmt.Errorf(
+			"contract %s on chain %d already registered as %s",
+			address.Hex(), chainID, existing,
+		)
+	}
+
+	token := Token{
+		Symbol:   symbol,
+		ChainID:  chainID,
+		Address:  address,
+		Decimals: decimals,
+	}
+	if _, ok := registry.Tokens[symbol]; !ok {
+		registry.Tokens[symbol] = token
+		registry.TokenSymbols = append(registry.TokenSymbols, symbol)
+	}
+	registry.deployments[deployment] = token
+	registry.deploymentKeys = append(registry.deploymentKeys, deployment)
+	registry.contracts[contract] = symbol
+	return token, nil
+}
+
+// RegisterTokenFromChain registers a token, reading its decimals from the
+// ERC-20 decimals() function.
+func (registry *TokenRegistry) RegisterTokenFromChain(
+	ctx context.Context,
+	caller ethereum.ContractCaller,
+	symbol string,
+	chainID uint64,
+	address common.Address,
+) (Token, error) {
+	decimals, err := ReadTokenDecimals(ctx, caller, address)
+	if err != nil {
+		return Token{}, err
+	}
+	return registry.RegisterToken(symbol, chainID, address, decimals)
+}
+
+func (registry *TokenRegistry) GetToken(symbol string) (Token, error) {
+	token, ok := registry.Tokens[symbol]
+	if !ok {
+		return Token{}, fmt.Errorf("token %s not registered", symbol)
+	}
+	return token, nil
+}
+
+func (registry *TokenRegistry) GetTokenByContract(chainID uint64, address common.Address) (Token, error) {
+	symbol, ok := registry.contracts[tokenContract{chainID: chainID, address: address}]
+	if !ok {
+		return Token{}, fmt.Errorf("contract %s on chain %d not registered", address.Hex(), chainID)
+	}
+	return registry.deployments[tokenDeployment{symbol: symbol, chainID: chainID}], nil
+}
+
+// GetTokenOnChain returns the deployment of an asset on a chain.
+func (registry *TokenRegistry) GetTokenOnChain(symbol string, chainID uint64) (Token, error) {
+	token, ok := registry.deployments[tokenDeployment{symbol: symbol, chainID: chainID}]
+	if !ok {
+		return Token{}, fmt.Errorf("token %s not registered on chain %d", symbol, chainID)
+	}
+	return token, nil
+}
+
+// GetTokensByChain returns the tokens deployed on a chain.
+func (registry *TokenRegistry) GetTokensByChain(chainID uint64) []Token {
+	tokens := []Token{}
+	for _, deployment := range registry.deploymentKeys {
+		if deployment.chainID == chainID {
+			tokens = append(tokens, registry.deployments[deployment])
+		}
+	}
+	return tokens
+}
+
+// GetChains returns the chains an asset is deployed on.
+func (registry *TokenRegistry) GetChains(symbol string) []uint64 {
+	chains := []uint64{}
+	for _, deployment := range registry.deploymentKeys {
+		if deployment.symbol == symbol {
+			chains = append(chains, deployment.chainID)
+		}
+	}
+	return chains
+}
+
+// ToAssetAmount converts an on-chain amount of a deployment to the asset's
+// decimals. Digits below the asset's precision are truncated.
+func (registry *TokenRegistry) ToAssetAmount(token Token, amount *big.Int) *big.Int {
+	return scaleDecimals(amount, token.Decimals, registry.Tokens[token.Symbol].Decimals)
+}
+
+// ToChainAmount converts an asset amount to the decimals of a deployment.
+func (registry *TokenRegistry) ToChainAmount(token Token, amount *big.Int) *big.Int {
+	return scaleDecimals(amount, registry.Tokens[token.Symbol].Decimals, token.Decimals)
+}
+
+func scaleDecimals(amount *big.Int, fromDecimals int, toDecimals int) *big.Int {
+	if fromDecimals == toDecimals {
+		return new(big.Int).Set(amount)
+	}
+	if toDecimals > fromDecimals {
+		scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(toDecimals-fromDecimals)), nil)
+		return scale.Mul(scale, amount)
+	}
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(fromDecimals-toDecimals)), nil)
+	return scale.Quo(amount, scale)
+}
@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"x-swap/internal/utils"
+)
+
+func TestTokenRegistryResolvesMarketsAndBalances(t *testing.T) {
+	setup()
+	tokenRegistry := NewTokenRegistry()
+	serviceRegistry.SetTokenRegistry(tokenRegistry)
+
+	wethAddress := utils.GenerateRandomAddress()
+	usdcAddress := utils.GenerateRandomAddress()
+	_, err := tokenRegistry.RegisterToken("WETH", 1, wethAddress, 18)
+	assert.Nil(t, err)
+	_, err = tokenRegistry.RegisterToken("USDC", 1, usdcAddress, 6)
+	assert.Nil(t, err)
+
+	_, err = tokenRegistry.RegisterToken("WETH", 1, utils.GenerateRandomAddress(), 18)
+	assert.ErrorContains(t, err, "already registered")
+	_, err = tokenRegistry.RegisterToken("USDC.e", 1, usdcAddress, 6)
+	assert.ErrorContains(t, err, "already registered as USDC")
+
+	wethMarket, err := marketService.CreateMarket("WETH", "USDC")
+	assert.Nil(t, err)
+	assert.Equal(t, wethMarket.BaseTokenDecimals, 18)
+	assert.Equal(t, wethMarket.QuoteTokenDecimals, 6)
+	_, err = marketService.CreateMarket("WETH", "USDC")
+	assert.ErrorContains(t, err, "market WETH/USDC already exists")
+	_, err = marketService.CreateMarket("WBTC", "USDC")
+	assert.ErrorContains(t, err, "token WBTC not registered")
+
+	token, err := tokenRegistry.GetTokenByContract(1, usdcAddress)
+	assert.Nil(t, err)
+	assert.Equal(t, token.Symbol, "USDC")
+	_, err = tokenRegistry.GetTokenByContract(10, usdcAddress)
+	assert.ErrorContains(t, err, "not registered")
+}
+
+func TestRegisterTokenFromChain(t *testing.T) {
+	chain := newTestChain(t)
+	token := chain.deployToken(t, 8)
+	tokenRegistry := NewTokenRegistry()
+
+	registered, err := tokenRegistry.RegisterTokenFromChain(context.Background(), chain.client, "WBTC", 1337, token)
+	assert.Nil(t, err)
+	assert.Equal(t, registered.Decimals, 8)
+	asset, err := tokenRegistry.GetToken("WBTC")
+	assert.Nil(t, err)
+	assert.Equal(t, asset, registered)
+
+	// an address without a contract has no decimals to read
+	_, err = tokenRegistry.RegisterTokenFromChain(context.Background(), chain.client, "USDC", 1337, utils.GenerateRandomAddress())
+	assert.NotNil(t, err)
+	_, err = tokenRegistry.GetToken("USDC")
+	assert.ErrorContains(t, err, "not registered")
+}
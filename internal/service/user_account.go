@@ -0,0 +1,201 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+type UserStatus string
+
+const (
+	UserActive UserStatus = "ACTIVE"
+	// UserFrozen accounts keep their funds but cannot place orders or
+	// withdraw until they are unfrozen.
+	UserFrozen UserStatus = "FROZEN"
+	// UserClosed accounts are emptied and cannot be reopened.
+	UserClosed UserStatus = "CLOSED"
+)
+
+// DefaultUserTier is the tier of newly registered users.
+const DefaultUserTier = "standard"
+
+// CheckActive returns an error unless the account may trade and withdraw.
+func (user User) CheckActive() error {
+	switch user.Status {
+	case UserFrozen:
+		return fmt.Errorf("account %s is frozen", user.Address.Hex())
+	case UserClosed:
+		return fmt.Errorf("account %s is closed", user.Address.Hex())
+	}
+	return nil
+}
+
+// clone returns a copy of the user whose balances can be handed out.
+func (user User) clone() User {
+	balance := make(map[string]*big.Int, len(user.Balance))
+	for asset, amount := range user.Balance {
+		balance[asset] = new(big.Int).Set(amount)
+	}
+	locked := make(map[string]*big.Int, len(user.BalanceLocked))
+	for asset, amount := range user.BalanceLocked {
+		locked[asset] = new(big.Int).Set(amount)
+	}
+	user.Balance = balance
+	user.BalanceLocked = locked
+	return user
+}
+
+// RegisterUser creates an active account in the default tier.
+func (service *UserService) RegisterUser(address common.Address) (User, error) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	if _, ok := service.Users[address]; ok {
+		return User{}, fmt.Errorf("user %s already registered", address.Hex())
+	}
+	return service.ensureUser(address).clone(), nil
+}
+
+// ensureUser returns the account of an address, registering it first if it
+// is unknown and initializing missing balance maps.
+func (service *UserService) ensureUser(address common.Address) User {
+	user, ok := service.Users[address]
+	if !ok {
+		user = User{
+			Address:   address,
+			Status:    UserActive,
+			Tier:      DefaultUserTier,
+			CreatedAt: time.Now(),
+		}
+		service.UserList = append(service.UserList, address)
+	}
+	if user.Balance == nil {
+		user.Balance = make(map[string]*big.Int)
+	}
+	if user.BalanceLocked == nil {
+		user.BalanceLocked = make(map[string]*big.Int)
+	}
+	service.Users[address] = user
+	return user
+}
+
+// GetUser returns a copy of the account of an address.
+func (service *UserService) GetUser(address common.Address) (User, error) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	user, ok := service.Users[address]
+	if !ok {
+		return User{}, fmt.Errorf("user %s not found", address.Hex())
+	}
+	return user.clone(), nil
+}
+
+// ListUsers returns up to limit accounts starting at offset, in registration
+// order, and the total number of accounts.
+func (service *UserService) ListUsers(offset int, limit int) ([]User, int, error) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	if offset < 0 {
+		return nil, 0, errors.New("offset must not be negative")
+	}
+	if limit <= 0 {
+		return nil, 0, errors.New("limit must be positive")
+	}
+	total := len(service.UserList)
+	users := []User{}
+	for i := offset; i < total && len(users) < limit; i++ {
+		users = append(users, service.Users[service.UserList[i]].clone())
+	}
+	return users, total, nil
+}
+
+// SetUserTier changes the tier of an account.
+func (service *UserService) SetUserTier(address common.Address, tier string) error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	user, ok := service.Users[address]
+	if !ok {
+		return fmt.Errorf("user %s not found", address.Hex())
+	}
+	if tier == "" {
+		return errors.New("tier must not be empty")
+	}
+	user.Tier = tier
+	service.Users[address] = user
+	return nil
+}
+
+// FreezeUser stops an active account from placing orders and withdrawing.
+func (service *UserService) FreezeUser(address common.Address) error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	return service.setUserStatus(address, UserActive, UserFrozen)
+}
+
+// UnfreezeUser makes a frozen account active again.
+func (service *UserService) UnfreezeUser(address common.Address) error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	return service.setUserStatus(address, UserFrozen, UserActive)
+}
+
+// CloseUser closes an active or frozen account. The account must not hold
+// any balance.
+func (service *UserService) CloseUser(address common.Address) error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	user, ok := service.Users[address]
+	if !ok {
+		return fmt.Errorf("user %s not found", address.Hex())
+	}
+	if user.Status == UserClosed {
+		return fmt.Errorf("account %s is closed", address.Hex())
+	}
+	for asset, balance := range user.Balance {
+		if balance.Sign() != 0 {
+			return fmt.Errorf("account %s still holds %s %s", address.Hex(), balance, asset)
+		}
+	}
+	user.Status = UserClosed
+	service.Users[address] = user
+	return nil
+}
+
+func (service *UserService) setUserStatus(address common.Address, from UserStatus, to UserStatus) error {
+	user, ok := service.Users[address]
+	if !ok {
+		return fmt.Errorf("user %s not found", address.Hex())
+	}
+	if user.Status != from {
+		return fmt.Errorf("account %s is %s, not %s", address.Hex(), user.Status, from)
+	}
+	user.Status = to
+	service.Users[address] = user
+	return nil
+}
+
+// CheckUserActive returns an error unless the account of an address may trade
+// and withdraw.
+func (service *UserService) CheckUserActive(address common.Address) error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	return service.checkUserActive(address)
+}
+
+func (service *UserService) checkUserActive(address common.Address) error {
+	user, ok := service.Users[address]
+	if !ok {
+		return fmt.Errorf("user %s not found", address.Hex())
+	}
+	if err := user.CheckActive(); err != nil {
+		return err
+	}
+	if user.Master != (common.Address{}) {
+		// sub-accounts share the status of their master
+		return service.checkUserActive(user.Master)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package service
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"x-swap/internal/utils"
+)
+
+func TestRegisterAndListUsers(t *testing.T) {
+	setup()
+	_, err := userService.RegisterUser(users[0])
+	assert.ErrorContains(t, err, "already registered")
+
+	user, err := userService.GetUser(users[3])
+	assert.Nil(t, err)
+	assert.Equal(t, user.Address, users[3])
+	assert.Equal(t, user.Status, UserActive)
+	assert.Equal(t, user.Tier, DefaultUserTier)
+	assert.False(t, user.CreatedAt.IsZero())
+
+	page, total, err := userService.ListUsers(8, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, total, 10)
+	assert.Equal(t, len(page), 2)
+	assert.Equal(t, page[0].Address, users[8])
+	assert.Equal(t, page[1].Address, users[9])
+	_, _, err = userService.ListUsers(0, 0)
+	assert.ErrorContains(t, err, "limit must be positive")
+
+	// crediting an unknown address registers it
+	unknown := utils.GenerateRandomAddress()
+	userService.AddBalance(unknown, "USD", big.NewInt(1e6))
+	user, err = userService.GetUser(unknown)
+	assert.Nil(t, err)
+	assert.Equal(t, user.Balance["USD"], big.NewInt(1e6))
+	_, total, _ = userService.ListUsers(0, 100)
+	assert.Equal(t, total, 11)
+
+	// the returned account does not alias the balances
+	user.Balance["USD"].SetInt64(0)
+	assert.Equal(t, userService.GetAssetAmount(unknown, "USD"), big.NewInt(1e6))
+
+	assert.Nil(t, userService.SetUserTier(unknown, "vip"))
+	user, _ = userService.GetUser(unknown)
+	assert.Equal(t, user.Tier, "vip")
+	_, err = userService.GetUser(utils.GenerateRandomAddress())
+	assert.ErrorContains(t, err, "not found")
+}
+
+func TestFrozenUserCannotTradeOrWithdraw(t *testing.T) {
+	_, withdrawalService, _ := setupWithdrawals(t)
+	topup(users[0], big.NewInt(200e6), "USDC")
+	topup(users[0], big.NewInt(1e8), "BTC")
+
+	assert.Nil(t, userService.FreezeUser(users[0]))
+	assert.ErrorContains(t, userService.FreezeUser(users[0]), "is FROZEN, not ACTIVE")
+	_, err := userService.PlaceOrder(limitOrder(0, SellOrder, 1e8, 100_000e6), false)
+	assert.ErrorContains(t, err, "order rejected: account "+users[0].Hex()+" is frozen")
+	_, err = withdrawalService.RequestWithdrawal(users[0], "USDC", utils.GenerateRandomAddress(), big.NewInt(100e6))
+	assert.ErrorContains(t, err, "withdrawal rejected")
+
+	assert.Nil(t, userService.UnfreezeUser(users[0]))
+	_, err = userService.PlaceOrder(limitOrder(0, SellOrder, 1e8, 100_000e6), false)
+	assert.Nil(t, err)
+
+	assert.ErrorContains(t, userService.CloseUser(users[0]), "still holds")
+	assert.Nil(t, userService.CloseUser(users[1]))
+	_, err = userService.PlaceOrder(limitOrder(1, SellOrder, 1e8, 100_000e6), false)
+	assert.ErrorContains(t, err, "is closed")
+	assert.ErrorContains(t, userService.UnfreezeUser(users[1]), "is CLOSED")
+}
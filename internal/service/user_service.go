@@ -2,26 +2,73 @@ package service
 
 import (
 	"errors"
+	"fmt"
+	"log"
 	"math/big"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 )
 
 type User struct {
+	Address common.Address
+	// Master is the account a sub-account belongs to, zero for master
+	// accounts. Name tells the sub-accounts of a master apart.
+	Master        common.Address
+	Name          string
+	Status        UserStatus
+	Tier          string
+	CreatedAt     time.Time
 	Balance       map[string]*big.Int
 	BalanceLocked map[string]*big.Int
 }
 
 type UserService struct {
-	Users           map[common.Address]User
-	UserList        []common.Address
-	serviceRegistry *ServiceRegistry
+	// mu guards the accounts, balances, journal postings, order locks and
+	// deposit addresses, which chain watchers and the withdrawal service
+	// change from their own goroutines. Methods called from outside the
+	// service take it. The unexported helpers, which the order service calls
+	// back while a user service method holds it, expect it to be held.
+	mu       sync.Mutex
+	Users    map[common.Address]User
+	UserList []common.Address
+	// DepositAddresses maps an exchange deposit address to the user it belongs to.
+	DepositAddresses map[common.Address]common.Address
+	// DepositIndexes records the HD derivation index of derived deposit
+	// addresses, needed later to sweep their funds.
+	DepositIndexes map[common.Address]uint32
+	// ChainBalances records per user and asset the net amount moved in
+	// through each chain.
+	ChainBalances        map[common.Address]map[string]map[uint64]*big.Int
+	userDepositAddresses map[common.Address]common.Address
+	depositAssignments   []DepositAssignment
+	depositAddressStore  DepositAddressStore
+	depositWallet        *HDWallet
+	orderDomain          *OrderDomain
+	usedOrderNonces      map[common.Address]map[uint64]bool
+	minOrderNonces       map[common.Address]uint64
+	journal              *Journal
+	orderLocks           map[string]*orderLock
+	subAccounts          map[common.Address][]common.Address
+	transferID           int64
+	serviceRegistry      *ServiceRegistry
 }
 
 func NewUserService() *UserService {
 	return &UserService{
-		Users:    make(map[common.Address]User),
-		UserList: []common.Address{},
+		Users:                make(map[common.Address]User),
+		UserList:             []common.Address{},
+		DepositAddresses:     make(map[common.Address]common.Address),
+		DepositIndexes:       make(map[common.Address]uint32),
+		ChainBalances:        make(map[common.Address]map[string]map[uint64]*big.Int),
+		userDepositAddresses: make(map[common.Address]common.Address),
+		usedOrderNonces:      make(map[common.Address]map[uint64]bool),
+		minOrderNonces:       make(map[common.Address]uint64),
+		journal:              NewJournal(),
+		orderLocks:           make(map[string]*orderLock),
+		subAccounts:          make(map[common.Address][]common.Address),
 	}
 }
 
@@ -36,7 +83,18 @@ func (service *UserService) GetServiceRegistry() (*ServiceRegistry, error) {
 	return service.serviceRegistry, nil
 }
 
-func (service *UserService) PlaceOrder(order Order, fill bool) {
+// PlaceOrder validates an order against the market rules and the user's
+// balance, then either fills it immediately or rests it on the order book.
+func (service *UserService) PlaceOrder(order Order, fill bool) (FillReport, error) {
+	return service.placeOrder(order, fill, true)
+}
+
+// placeOrder places an order. Orders of callers that authenticated the user
+// otherwise, like with an API key, need no signature.
+func (service *UserService) placeOrder(order Order, fill bool, requireSignature bool) (FillReport, error) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
 	// check if order is at the market price, fill it
 	// else put it in the order book
 
@@ -49,11 +107,43 @@ func (service *UserService) PlaceOrder(order Order, fill bool) {
 		panic(err)
 	}
 
-	market := marketService.GetMarket(order.Market.MarketTicker)
+	if err := service.checkUserActive(order.User); err != nil {
+		return FillReport{}, fmt.Errorf("order rejected: %w", err)
+	}
+	marketService.refreshStatus(order.Market.MarketTicker, time.Now())
+	market, ok := marketService.LookupMarket(order.Market.MarketTicker)
+	if !ok {
+		return FillReport{}, fmt.Errorf("market %s not found", order.Market.MarketTicker)
+	}
+	if err := market.CheckAcceptsOrder(fill); err != nil {
+		return FillReport{}, fmt.Errorf("order rejected: %w", err)
+	}
+	if err := service.verifyOrder(order, time.Now(), requireSignature); err != nil {
+		return FillReport{}, fmt.Errorf("order rejected: %w", err)
+	}
 	baseMultiplier := new(
 		big.Int,
 	).Exp(big.NewInt(10), big.NewInt(int64(market.BaseTokenDecimals)), nil)
 
+	if err := market.Rules.CheckOrder(order, baseMultiplier); err != nil {
+		return FillReport{}, fmt.Errorf("order rejected: %w", err)
+	}
+
+	orderService, err := serviceRegistry.GetOrderService()
+	if err != nil {
+		panic(err)
+	}
+	// expired orders release their locks and leave the book before the
+	// reference price, balance and open order checks
+	if err := orderService.CancelExpiredOrders(market.MarketTicker, time.Now()); err != nil {
+		return FillReport{}, err
+	}
+
+	referencePrice := orderService.GetReferencePrice(market.MarketTicker, market.Protection.Reference)
+	if err := market.Protection.CheckPriceBand(order.Price, referencePrice); err != nil {
+		return FillReport{}, fmt.Errorf("order rejected: %w", err)
+	}
+
 	var asset string
 	var amount *big.Int
 	if order.OrderType == BuyOrder {
@@ -65,57 +155,365 @@ func (service *UserService) PlaceOrder(order Order, fill bool) {
 		amount = new(big.Int).Set(order.Size)
 	}
 
-	assetBalance := service.Users[order.User].Balance[asset]
+	assetBalance := service.assetAmountAvailable(order.User, asset)
 	if assetBalance.Cmp(amount) < 0 {
-		panic("Insufficient balance")
+		return FillReport{}, fmt.Errorf(
+			"order rejected: insufficient %s balance: have %s, need %s",
+			asset, assetBalance, amount,
+		)
 	}
 
+	if fill {
+		service.useOrderNonce(order)
+		return orderService.FillOrder(order, order.Market.MarketTicker), nil
+	}
+
+	maxOpenOrders := market.Rules.MaxOpenOrders
+	if maxOpenOrders > 0 &&
+		orderService.GetOpenOrderCount(order.Market.MarketTicker, order.User) >= maxOpenOrders {
+		return FillReport{}, fmt.Errorf(
+			"order rejected: user already has the maximum of %d open orders",
+			maxOpenOrders,
+		)
+	}
+
+	if err := service.lockBalance(order.User, asset, amount, orderReference(order.Market.MarketTicker, order.ID)); err != nil {
+		return FillReport{}, fmt.Errorf("order rejected: %w", err)
+	}
+	service.useOrderNonce(order)
+	orderService.CreateOrder(order, order.Market.MarketTicker)
+	return NewFillReport(), nil
+}
+
+// AddLiquidity moves base and quote tokens from the user's available balance
+// into the market's pool and returns the LP shares minted.
+func (service *UserService) AddLiquidity(
+	user common.Address,
+	marketTicker string,
+	baseAmount *big.Int,
+	quoteAmount *big.Int,
+) (*big.Int, error) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	serviceRegistry, err := service.GetServiceRegistry()
+	if err != nil {
+		return nil, err
+	}
+	marketService, err := serviceRegistry.GetMarketService()
+	if err != nil {
+		return nil, err
+	}
+	market := marketService.GetMarket(marketTicker)
+	pool, err := marketService.GetPool(marketTicker)
+	if err != nil {
+		return nil, err
+	}
+
+	if service.assetAmountAvailable(user, market.BaseToken).Cmp(baseAmount) < 0 {
+		return nil, fmt.Errorf("insufficient %s balance", market.BaseToken)
+	}
+	if service.assetAmountAvailable(user, market.QuoteToken).Cmp(quoteAmount) < 0 {
+		return nil, fmt.Errorf("insufficient %s balance", market.QuoteToken)
+	}
+
+	shares, baseUsed, quoteUsed, err := pool.Deposit(user, baseAmount, quoteAmount)
+	if err != nil {
+		return nil, err
+	}
+	postings := transfer(availableAccount(user), poolAccount(marketTicker), market.BaseToken, baseUsed)
+	postings = append(postings, transfer(availableAccount(user), poolAccount(marketTicker), market.QuoteToken, quoteUsed)...)
+	service.post(EntryAddLiquidity, marketTicker, postings...)
+	return shares, nil
+}
+
+// RemoveLiquidity burns LP shares and credits the pro-rata reserves back to
+// the user's balance.
+func (service *UserService) RemoveLiquidity(
+	user common.Address,
+	marketTicker string,
+	shares *big.Int,
+) (*big.Int, *big.Int, error) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	serviceRegistry, err := service.GetServiceRegistry()
+	if err != nil {
+		return nil, nil, err
+	}
+	marketService, err := serviceRegistry.GetMarketService()
+	if err != nil {
+		return nil, nil, err
+	}
+	market := marketService.GetMarket(marketTicker)
+	pool, err := marketService.GetPool(marketTicker)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	baseAmount, quoteAmount, err := pool.Withdraw(user, shares)
+	if err != nil {
+		return nil, nil, err
+	}
+	postings := transfer(poolAccount(marketTicker), availableAccount(user), market.BaseToken, baseAmount)
+	postings = append(postings, transfer(poolAccount(marketTicker), availableAccount(user), market.QuoteToken, quoteAmount)...)
+	service.post(EntryRemoveLiquidity, marketTicker, postings...)
+	return baseAmount, quoteAmount, nil
+}
+
+// CancelOrder cancels a resting order owned by user.
+func (service *UserService) CancelOrder(user common.Address, marketTicker string, orderID int64) error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	serviceRegistry, err := service.GetServiceRegistry()
+	if err != nil {
+		return err
+	}
 	orderService, err := serviceRegistry.GetOrderService()
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	if fill {
-		orderService.FillOrder(order, order.Market.MarketTicker)
-	} else {
-		if service.Users[order.User].BalanceLocked[asset] == nil {
-			service.Users[order.User].BalanceLocked[asset] = amount
-		} else {
-			service.Users[order.User].BalanceLocked[asset].Add(service.Users[order.User].BalanceLocked[asset], amount)
+	order, ok := orderService.GetOrder(marketTicker, orderID)
+	if !ok {
+		return fmt.Errorf("order %d not found in market %s", orderID, marketTicker)
+	}
+	if order.User != user {
+		return fmt.Errorf("order %d does not belong to %s", orderID, user.Hex())
+	}
+	return orderService.CancelOrder(marketTicker, orderID)
+}
+
+// CancelExpiredOrders cancels the expired resting orders of every market.
+func (service *UserService) CancelExpiredOrders() error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	serviceRegistry, err := service.GetServiceRegistry()
+	if err != nil {
+		return err
+	}
+	marketService, err := serviceRegistry.GetMarketService()
+	if err != nil {
+		return err
+	}
+	orderService, err := serviceRegistry.GetOrderService()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, market := range marketService.GetMarkets() {
+		if err := orderService.CancelExpiredOrders(market.MarketTicker, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SweepExpiredOrders cancels the expired orders every interval, so their
+// locks are released in markets nobody trades in.
+func (service *UserService) SweepExpiredOrders(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := service.CancelExpiredOrders(); err != nil {
+			log.Printf("Error cancelling expired orders: %v", err)
 		}
-		orderService.CreateOrder(order, order.Market.MarketTicker)
 	}
 }
 
+// AddBalance credits a user with a manual adjustment against the exchange's
+// equity account.
 func (service *UserService) AddBalance(user common.Address, asset string, amount *big.Int) {
-	if service.Users[user].Balance[asset] == nil {
-		service.Users[user].Balance[asset] = amount
-	} else {
-		service.Users[user].Balance[asset].Add(service.Users[user].Balance[asset], amount)
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	service.post(EntryAdjustment, "", transfer(equityAccount(), availableAccount(user), asset, amount)...)
+}
+
+// SetDepositAddress assigns an on-chain deposit address to a user.
+func (service *UserService) SetDepositAddress(user common.Address, depositAddress common.Address) error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	return service.addDepositAssignment(DepositAssignment{User: user, Address: depositAddress})
+}
+
+// SetDepositWallet sets the HD wallet deposit addresses are derived from.
+func (service *UserService) SetDepositWallet(wallet *HDWallet) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	service.depositWallet = wallet
+}
+
+// SetDepositAddressStore restores the deposit addresses saved in the store and
+// saves every address handed out from then on. The deposit wallet must be set
+// first, derived addresses are checked against it.
+func (service *UserService) SetDepositAddressStore(store DepositAddressStore) error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	saved, err := store.LoadDepositAddresses()
+	if err != nil {
+		return err
+	}
+	if saved != nil {
+		for _, assignment := range saved.Assignments {
+			if assignment.Index != nil {
+				if service.depositWallet == nil {
+					return errors.New("deposit wallet not set")
+				}
+				address, err := service.depositWallet.DeriveAddress(*assignment.Index)
+				if err != nil {
+					return err
+				}
+				if address != assignment.Address {
+					return fmt.Errorf(
+						"deposit address %s is not derived at index %d of the deposit wallet",
+						assignment.Address.Hex(), *assignment.Index,
+					)
+				}
+			}
+			if owner, ok := service.DepositAddresses[assignment.Address]; ok && owner != assignment.User {
+				return fmt.Errorf("deposit address %s already belongs to %s", assignment.Address.Hex(), owner.Hex())
+			}
+			service.applyDepositAssignment(assignment)
+			service.depositAssignments = append(service.depositAssignments, assignment)
+		}
+		if service.depositWallet != nil && saved.NextIndex > service.depositWallet.nextIndex {
+			service.depositWallet.nextIndex = saved.NextIndex
+		}
+	}
+	service.depositAddressStore = store
+	return nil
+}
+
+// AssignDepositAddress derives a unique deposit address for the user from the
+// deposit wallet. A user that already has a deposit address keeps it.
+func (service *UserService) AssignDepositAddress(user common.Address) (common.Address, error) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	if depositAddress, ok := service.userDepositAddresses[user]; ok {
+		return depositAddress, nil
+	}
+	if service.depositWallet == nil {
+		return common.Address{}, errors.New("deposit wallet not set")
 	}
+	depositAddress, index, err := service.depositWallet.NextAddress()
+	if err != nil {
+		return common.Address{}, err
+	}
+	if err := service.addDepositAssignment(DepositAssignment{User: user, Address: depositAddress, Index: &index}); err != nil {
+		return common.Address{}, err
+	}
+	return depositAddress, nil
 }
 
-func (service *UserService) SubBalance(user common.Address, asset string, amount *big.Int) {
-	service.Users[user].Balance[asset].Sub(service.Users[user].Balance[asset], amount)
+// addDepositAssignment saves the assignment before applying it, so an address
+// is never handed out without being persisted.
+func (service *UserService) addDepositAssignment(assignment DepositAssignment) error {
+	if owner, ok := service.DepositAddresses[assignment.Address]; ok && owner != assignment.User {
+		return fmt.Errorf("deposit address %s already belongs to %s", assignment.Address.Hex(), owner.Hex())
+	}
+	assignments := append(slices.Clip(service.depositAssignments), assignment)
+	if service.depositAddressStore != nil {
+		depositAddresses := DepositAddresses{Assignments: assignments}
+		if service.depositWallet != nil {
+			depositAddresses.NextIndex = service.depositWallet.NextIndex()
+		}
+		if err := service.depositAddressStore.SaveDepositAddresses(depositAddresses); err != nil {
+			return fmt.Errorf("saving deposit address %s: %w", assignment.Address.Hex(), err)
+		}
+	}
+	service.applyDepositAssignment(assignment)
+	service.depositAssignments = assignments
+	return nil
+}
+
+func (service *UserService) applyDepositAssignment(assignment DepositAssignment) {
+	service.DepositAddresses[assignment.Address] = assignment.User
+	service.userDepositAddresses[assignment.User] = assignment.Address
+	if assignment.Index != nil {
+		service.DepositIndexes[assignment.Address] = *assignment.Index
+	}
+}
+
+func (service *UserService) GetDepositAddress(user common.Address) (common.Address, bool) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	depositAddress, ok := service.userDepositAddresses[user]
+	return depositAddress, ok
+}
+
+func (service *UserService) GetUserByDepositAddress(depositAddress common.Address) (common.Address, bool) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	user, ok := service.DepositAddresses[depositAddress]
+	return user, ok
+}
+
+// SubBalance debits a user with a manual adjustment against the exchange's
+// equity account. Locked funds cannot be debited.
+func (service *UserService) SubBalance(user common.Address, asset string, amount *big.Int) error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	if available := service.assetAmountAvailable(user, asset); available.Cmp(amount) < 0 {
+		return fmt.Errorf("insufficient %s balance: have %s, need %s", asset, available, amount)
+	}
+	service.post(EntryAdjustment, "", transfer(availableAccount(user), equityAccount(), asset, amount)...)
+	return nil
+}
+
+// GetDepositAddresses returns all deposit addresses handed out.
+func (service *UserService) GetDepositAddresses() []common.Address {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	depositAddresses := make([]common.Address, 0, len(service.DepositAddresses))
+	for depositAddress := range service.DepositAddresses {
+		depositAddresses = append(depositAddresses, depositAddress)
+	}
+	return depositAddresses
 }
 
 func (service *UserService) GetAssetAmount(user common.Address, asset string) *big.Int {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	return service.assetAmount(user, asset)
+}
+
+func (service *UserService) GetAssetAmountLocked(user common.Address, asset string) *big.Int {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	return service.assetAmountLocked(user, asset)
+}
+
+func (service *UserService) GetAssetAmountAvailable(user common.Address, asset string) *big.Int {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	return service.assetAmountAvailable(user, asset)
+}
+
+func (service *UserService) assetAmount(user common.Address, asset string) *big.Int {
 	if service.Users[user].Balance[asset] == nil {
 		return big.NewInt(0)
 	}
-	return service.Users[user].Balance[asset]
+	return new(big.Int).Set(service.Users[user].Balance[asset])
 }
 
-func (service *UserService) GetAssetAmountLocked(user common.Address, asset string) *big.Int {
+func (service *UserService) assetAmountLocked(user common.Address, asset string) *big.Int {
 	if service.Users[user].BalanceLocked[asset] == nil {
 		return big.NewInt(0)
 	}
-	return service.Users[user].BalanceLocked[asset]
+	return new(big.Int).Set(service.Users[user].BalanceLocked[asset])
 }
 
-func (service *UserService) GetAssetAmountAvailable(user common.Address, asset string) *big.Int {
-	return new(big.Int).Sub(
-		service.GetAssetAmount(user, asset),
-		service.GetAssetAmountLocked(user, asset),
-	)
+func (service *UserService) assetAmountAvailable(user common.Address, asset string) *big.Int {
+	return new(big.Int).Sub(service.assetAmount(user, asset), service.assetAmountLocked(user, asset))
+}
+
+// orderReference is the journal reference of the entries of an order.
+func orderReference(marketTicker string, orderID int64) string {
+	return fmt.Sprintf("order:%s:%d", marketTicker, orderID)
 }
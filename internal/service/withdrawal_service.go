@@ -0,0 +1,553 @@
+package service
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+type WithdrawalStatus string
+
+// defaultReplaceAfter is the number of blocks a withdrawal transaction may
+// wait in the mempool before it is replaced with higher fees.
+const defaultReplaceAfter = 10
+
+const (
+	WithdrawalPending   WithdrawalStatus = "PENDING"
+	WithdrawalBroadcast WithdrawalStatus = "BROADCAST"
+	WithdrawalConfirmed WithdrawalStatus = "CONFIRMED"
+	WithdrawalFailed    WithdrawalStatus = "FAILED"
+)
+
+// WithdrawalClient adds to EthereumClient what is needed to build and sign
+// transactions.
+type WithdrawalClient interface {
+	EthereumClient
+	PendingNonceAt(ctx context.Context, account common.Address) (uint64, error)
+	NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error)
+	SuggestGasTipCap(ctx context.Context) (*big.Int, error)
+	EstimateGas(ctx context.Context, call ethereum.CallMsg) (uint64, error)
+}
+
+type Withdrawal struct {
+	ID       uint64
+	User     common.Address
+	Token    string
+	ChainID  uint64
+	Contract common.Address
+	To       common.Address
+	// Amount is debited in the asset's decimals, ChainAmount is transferred in
+	// the token's decimals on the withdrawal chain.
+	Amount      *big.Int
+	ChainAmount *big.Int
+	Nonce       uint64
+	// TxHash is the transaction last sent for the withdrawal, or the one that
+	// got mined. TxHashes holds every transaction sent, replacements included.
+	TxHash    common.Hash
+	TxHashes  []common.Hash
+	Block     uint64
+	Status    WithdrawalStatus
+	Error     string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// tx is the transaction last sent and broadcastBlock the chain head when
+	// it was sent.
+	tx             *types.Transaction
+	broadcastBlock uint64
+}
+
+// WithdrawalService pays out user withdrawals as ETH or ERC-20 transfers
+// signed by the hot wallet. Balances are debited when a withdrawal is
+// requested and refunded only when its transaction reverted or can no longer
+// be mined.
+type WithdrawalService struct {
+	client           WithdrawalClient
+	hotWallet        *ecdsa.PrivateKey
+	hotWalletAddress common.Address
+	// chainID and signer are loaded on first use under chainMu, as requests
+	// and the processing loop may both be first.
+	chainID         *big.Int
+	signer          types.Signer
+	chainMu         sync.Mutex
+	serviceRegistry *ServiceRegistry
+	ctx             context.Context
+	cancel          context.CancelFunc
+	pollInterval    time.Duration
+	confirmations   uint64
+	replaceAfter    uint64
+	nonce           uint64
+	nonceLoaded     bool
+	withdrawals     map[uint64]*Withdrawal
+	withdrawalIDs   []uint64
+	nextID          uint64
+	mu              sync.Mutex
+}
+
+func NewWithdrawalService(client WithdrawalClient, hotWallet *ecdsa.PrivateKey) *WithdrawalService {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &WithdrawalService{
+		client:           client,
+		hotWallet:        hotWallet,
+		hotWalletAddress: crypto.PubkeyToAddress(hotWallet.PublicKey),
+		ctx:              ctx,
+		cancel:           cancel,
+		pollInterval:     5 * time.Second,
+		confirmations:    12,
+		replaceAfter:     defaultReplaceAfter,
+		withdrawals:      make(map[uint64]*Withdrawal),
+		withdrawalIDs:    []uint64{},
+		nextID:           1,
+	}
+}
+
+func (service *WithdrawalService) SetServiceRegistry(serviceRegistry *ServiceRegistry) {
+	service.serviceRegistry = serviceRegistry
+}
+
+func (service *WithdrawalService) GetServiceRegistry() (*ServiceRegistry, error) {
+	if service.serviceRegistry == nil {
+		return nil, errors.New("service registry not set")
+	}
+	return service.serviceRegistry, nil
+}
+
+// SetConfirmations sets how many blocks a withdrawal transaction needs before
+// it is considered final.
+func (service *WithdrawalService) SetConfirmations(confirmations uint64) {
+	service.confirmations = max(confirmations, 1)
+}
+
+// SetReplaceAfter sets how many blocks a withdrawal transaction may wait
+// before it is replaced by one paying higher fees.
+func (service *WithdrawalService) SetReplaceAfter(blocks uint64) {
+	service.replaceAfter = max(blocks, 1)
+}
+
+func (service *WithdrawalService) SetPollInterval(pollInterval time.Duration) {
+	service.pollInterval = pollInterval
+}
+
+func (service *WithdrawalService) HotWalletAddress() common.Address {
+	return service.hotWalletAddress
+}
+
+// RequestWithdrawal debits the user balance and queues an on-chain transfer of
+// amount tokens to the given address.
+func (service *WithdrawalService) RequestWithdrawal(
+	user common.Address,
+	tokenSymbol string,
+	to common.Address,
+	amount *big.Int,
+) (*Withdrawal, error) {
+	if amount == nil || amount.Sign() <= 0 {
+		return nil, errors.New("withdrawal amount must be positive")
+	}
+	if to == (common.Address{}) {
+		return nil, errors.New("withdrawal destination must not be the zero address")
+	}
+
+	serviceRegistry, err := service.GetServiceRegistry()
+	if err != nil {
+		return nil, err
+	}
+	userService, err := serviceRegistry.GetUserService()
+	if err != nil {
+		return nil, err
+	}
+	if err := userService.CheckUserActive(user); err != nil {
+		return nil, fmt.Errorf("withdrawal rejected: %w", err)
+	}
+	tokenRegistry, err := serviceRegistry.GetTokenRegistry()
+	if err != nil {
+		return nil, err
+	}
+	if err := service.loadChainID(); err != nil {
+		return nil, err
+	}
+	token, err := tokenRegistry.GetTokenOnChain(tokenSymbol, service.chainID.Uint64())
+	if err != nil {
+		return nil, err
+	}
+	chainAmount := tokenRegistry.ToChainAmount(token, amount)
+	if tokenRegistry.ToAssetAmount(token, chainAmount).Cmp(amount) != 0 {
+		return nil, fmt.Errorf("withdrawal amount exceeds the precision of %s on chain %d", token.Symbol, token.ChainID)
+	}
+
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	if err := userService.SubBalanceToChain(
+		user, token.ChainID, token.Symbol, amount, EntryWithdrawal, withdrawalReference(service.nextID),
+	); err != nil {
+		return nil, fmt.Errorf("withdrawal rejected: %w", err)
+	}
+
+	now := time.Now()
+	withdrawal := &Withdrawal{
+		ID:          service.nextID,
+		User:        user,
+		Token:       token.Symbol,
+		ChainID:     token.ChainID,
+		Contract:    token.Address,
+		To:          to,
+		Amount:      new(big.Int).Set(amount),
+		ChainAmount: chainAmount,
+		Status:      WithdrawalPending,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	service.nextID++
+	service.withdrawals[withdrawal.ID] = withdrawal
+	service.withdrawalIDs = append(service.withdrawalIDs, withdrawal.ID)
+
+	copied := *withdrawal
+	return &copied, nil
+}
+
+func (service *WithdrawalService) GetWithdrawal(id uint64) (Withdrawal, error) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	withdrawal, ok := service.withdrawals[id]
+	if !ok {
+		return Withdrawal{}, fmt.Errorf("withdrawal %d not found", id)
+	}
+	return *withdrawal, nil
+}
+
+// GetWithdrawals returns the withdrawals of a user in request order.
+func (service *WithdrawalService) GetWithdrawals(user common.Address) []Withdrawal {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	withdrawals := []Withdrawal{}
+	for _, id := range service.withdrawalIDs {
+		if withdrawal := service.withdrawals[id]; withdrawal.User == user {
+			withdrawals = append(withdrawals, *withdrawal)
+		}
+	}
+	return withdrawals
+}
+
+// GetAllWithdrawals returns the withdrawals of all users in request order.
+func (service *WithdrawalService) GetAllWithdrawals() []Withdrawal {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	withdrawals := make([]Withdrawal, 0, len(service.withdrawalIDs))
+	for _, id := range service.withdrawalIDs {
+		withdrawals = append(withdrawals, *service.withdrawals[id])
+	}
+	return withdrawals
+}
+
+func (service *WithdrawalService) Start() {
+	log.Println("Starting withdrawal service...")
+	ticker := time.NewTicker(service.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-service.ctx.Done():
+			log.Println("Withdrawal service stopped")
+			return
+		case <-ticker.C:
+			if err := service.ProcessWithdrawals(); err != nil {
+				log.Printf("Error processing withdrawals: %v", err)
+			}
+		}
+	}
+}
+
+func (service *WithdrawalService) Stop() {
+	service.cancel()
+}
+
+// ProcessWithdrawals broadcasts pending withdrawals and settles broadcast ones
+// whose transaction has enough confirmations.
+func (service *WithdrawalService) ProcessWithdrawals() error {
+	if err := service.loadChainID(); err != nil {
+		return err
+	}
+
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	latestBlock, err := service.client.BlockNumber(service.ctx)
+	if err != nil {
+		return err
+	}
+	for _, id := range service.withdrawalIDs {
+		withdrawal := service.withdrawals[id]
+		if withdrawal.Status != WithdrawalPending {
+			continue
+		}
+		if err := service.broadcast(withdrawal, latestBlock); err != nil {
+			return err
+		}
+	}
+
+	for _, id := range service.withdrawalIDs {
+		withdrawal := service.withdrawals[id]
+		if withdrawal.Status != WithdrawalBroadcast {
+			continue
+		}
+		if err := service.checkBroadcast(withdrawal, latestBlock); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// broadcast signs the transfer of a pending withdrawal with the next hot
+// wallet nonce and sends it. A gas estimate rejected by the node fails and
+// refunds the withdrawal, connectivity errors are returned so the withdrawal
+// is retried. Once signed, the withdrawal is broadcast even if sending reports
+// an error, as the transaction may have reached the network anyway.
+func (service *WithdrawalService) broadcast(withdrawal *Withdrawal, latestBlock uint64) error {
+	if !service.nonceLoaded {
+		nonce, err := service.client.PendingNonceAt(service.ctx, service.hotWalletAddress)
+		if err != nil {
+			return err
+		}
+		service.nonce = nonce
+		service.nonceLoaded = true
+	}
+
+	to, value, data, err := withdrawalCall(withdrawal)
+	if err != nil {
+		return err
+	}
+	gasLimit, err := service.client.EstimateGas(service.ctx, ethereum.CallMsg{
+		From:  service.hotWalletAddress,
+		To:    &to,
+		Value: value,
+		Data:  data,
+	})
+	if err != nil {
+		var rpcErr rpc.Error
+		if errors.As(err, &rpcErr) {
+			// the transfer would revert, e.g. the hot wallet is short of tokens
+			return service.fail(withdrawal, fmt.Errorf("estimating gas: %w", err))
+		}
+		return fmt.Errorf("estimating gas for withdrawal %d: %w", withdrawal.ID, err)
+	}
+	gasTipCap, gasFeeCap, err := service.suggestFees()
+	if err != nil {
+		return err
+	}
+
+	tx, err := types.SignNewTx(service.hotWallet, service.signer, &types.DynamicFeeTx{
+		ChainID:   service.chainID,
+		Nonce:     service.nonce,
+		GasTipCap: gasTipCap,
+		GasFeeCap: gasFeeCap,
+		Gas:       gasLimit,
+		To:        &to,
+		Value:     value,
+		Data:      data,
+	})
+	if err != nil {
+		return err
+	}
+	// the nonce belongs to the withdrawal from now on, it is never handed to
+	// another one even if this transaction does not make it
+	withdrawal.Nonce = service.nonce
+	service.nonce++
+	service.send(withdrawal, tx, latestBlock)
+	return nil
+}
+
+// send records tx as the latest transaction of the withdrawal and sends it.
+func (service *WithdrawalService) send(withdrawal *Withdrawal, tx *types.Transaction, latestBlock uint64) {
+	withdrawal.tx = tx
+	withdrawal.TxHash = tx.Hash()
+	withdrawal.TxHashes = append(withdrawal.TxHashes, tx.Hash())
+	withdrawal.Status = WithdrawalBroadcast
+	withdrawal.broadcastBlock = latestBlock
+	withdrawal.UpdatedAt = time.Now()
+	if err := sendTransaction(service.ctx, service.client, tx); err != nil {
+		log.Printf("Sending withdrawal %d transaction %s: %v", withdrawal.ID, tx.Hash().Hex(), err)
+	}
+}
+
+// checkBroadcast settles a broadcast withdrawal from the receipt of one of its
+// transactions. Without a receipt, the hot wallet nonce tells whether one can
+// still be mined. If the nonce was used by another transaction, the transfer
+// never happens and the withdrawal is refunded. Otherwise the transaction is
+// sent again, with higher fees once it has waited replaceAfter blocks.
+func (service *WithdrawalService) checkBroadcast(withdrawal *Withdrawal, latestBlock uint64) error {
+	for _, txHash := range withdrawal.TxHashes {
+		receipt, err := service.client.TransactionReceipt(service.ctx, txHash)
+		if errors.Is(err, ethereum.NotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		block := receipt.BlockNumber.Uint64()
+		withdrawal.TxHash = txHash
+		withdrawal.Block = block
+		if latestBlock+1 < block+service.confirmations {
+			return nil
+		}
+		if receipt.Status != types.ReceiptStatusSuccessful {
+			return service.fail(withdrawal, fmt.Errorf("transaction %s reverted", txHash.Hex()))
+		}
+		withdrawal.Status = WithdrawalConfirmed
+		withdrawal.UpdatedAt = time.Now()
+		return nil
+	}
+	withdrawal.Block = 0
+
+	if latestBlock+1 >= service.confirmations {
+		confirmedBlock := new(big.Int).SetUint64(latestBlock + 1 - service.confirmations)
+		usedNonce, err := service.client.NonceAt(service.ctx, service.hotWalletAddress, confirmedBlock)
+		if err != nil {
+			return err
+		}
+		if usedNonce > withdrawal.Nonce {
+			return service.fail(withdrawal, fmt.Errorf("nonce %d was used by another transaction", withdrawal.Nonce))
+		}
+	}
+
+	if latestBlock >= withdrawal.broadcastBlock+service.replaceAfter {
+		return service.replace(withdrawal, latestBlock)
+	}
+	// the node may have dropped it, sending it again is harmless
+	if err := sendTransaction(service.ctx, service.client, withdrawal.tx); err != nil {
+		log.Printf("Resending withdrawal %d transaction %s: %v", withdrawal.ID, withdrawal.TxHash.Hex(), err)
+	}
+	return nil
+}
+
+// replace sends the transaction of a stuck withdrawal again with the same
+// nonce and higher fees. Nodes only accept a replacement that raises both the
+// tip and the fee cap by at least 10%.
+func (service *WithdrawalService) replace(withdrawal *Withdrawal, latestBlock uint64) error {
+	gasTipCap, gasFeeCap, err := service.suggestFees()
+	if err != nil {
+		return err
+	}
+	gasTipCap = maxBigInt(gasTipCap, bumpFee(withdrawal.tx.GasTipCap()))
+	gasFeeCap = maxBigInt(gasFeeCap, bumpFee(withdrawal.tx.GasFeeCap()))
+	tx, err := types.SignNewTx(service.hotWallet, service.signer, &types.DynamicFeeTx{
+		ChainID:   service.chainID,
+		Nonce:     withdrawal.Nonce,
+		GasTipCap: gasTipCap,
+		GasFeeCap: gasFeeCap,
+		Gas:       withdrawal.tx.Gas(),
+		To:        withdrawal.tx.To(),
+		Value:     withdrawal.tx.Value(),
+		Data:      withdrawal.tx.Data(),
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Replacing withdrawal %d transaction %s with %s", withdrawal.ID, withdrawal.TxHash.Hex(), tx.Hash().Hex())
+	service.send(withdrawal, tx, latestBlock)
+	return nil
+}
+
+// withdrawalCall returns the destination, value and calldata of the
+// transaction paying out a withdrawal. Native ETH is sent as a plain value
+// transfer, tokens with an ERC-20 transfer call.
+func withdrawalCall(withdrawal *Withdrawal) (common.Address, *big.Int, []byte, error) {
+	if withdrawal.Contract == NativeTokenAddress {
+		return withdrawal.To, new(big.Int).Set(withdrawal.ChainAmount), nil, nil
+	}
+	data, err := erc20ABI.Pack("transfer", withdrawal.To, withdrawal.ChainAmount)
+	if err != nil {
+		return common.Address{}, nil, nil, err
+	}
+	return withdrawal.Contract, big.NewInt(0), data, nil
+}
+
+func bumpFee(fee *big.Int) *big.Int {
+	bumped := new(big.Int).Mul(fee, big.NewInt(110))
+	bumped.Quo(bumped, big.NewInt(100))
+	return bumped.Add(bumped, big.NewInt(1))
+}
+
+func maxBigInt(a *big.Int, b *big.Int) *big.Int {
+	if a.Cmp(b) >= 0 {
+		return a
+	}
+	return b
+}
+
+// suggestFees returns EIP-1559 fees: the suggested tip and a fee cap that
+// covers the tip plus twice the current base fee, so the transaction stays
+// includable through several full blocks.
+func (service *WithdrawalService) suggestFees() (*big.Int, *big.Int, error) {
+	gasTipCap, err := service.client.SuggestGasTipCap(service.ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	head, err := service.client.HeaderByNumber(service.ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if head.BaseFee == nil {
+		return nil, nil, errors.New("chain does not support EIP-1559 fees")
+	}
+	gasFeeCap := new(big.Int).Mul(head.BaseFee, big.NewInt(2))
+	gasFeeCap.Add(gasFeeCap, gasTipCap)
+	return gasTipCap, gasFeeCap, nil
+}
+
+// fail marks the withdrawal as failed and refunds the user.
+func (service *WithdrawalService) fail(withdrawal *Withdrawal, reason error) error {
+	serviceRegistry, err := service.GetServiceRegistry()
+	if err != nil {
+		return err
+	}
+	userService, err := serviceRegistry.GetUserService()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Withdrawal %d failed: %v", withdrawal.ID, reason)
+	userService.AddBalanceFromChain(
+		withdrawal.User, withdrawal.ChainID, withdrawal.Token, withdrawal.Amount,
+		EntryWithdrawalRefund, withdrawalReference(withdrawal.ID),
+	)
+	withdrawal.Status = WithdrawalFailed
+	withdrawal.Error = reason.Error()
+	withdrawal.UpdatedAt = time.Now()
+	return nil
+}
+
+// withdrawalReference is the journal reference of the entries of a
+// withdrawal.
+func withdrawalReference(id uint64) string {
+	return fmt.Sprintf("withdrawal:%d", id)
+}
+
+func (service *WithdrawalService) loadChainID() error {
+	service.chainMu.Lock()
+	defer service.chainMu.Unlock()
+	if service.chainID != nil {
+		return nil
+	}
+	chainID, err := service.client.ChainID(service.ctx)
+	if err != nil {
+		return err
+	}
+	service.chainID = chainID
+	service.signer = types.LatestSignerForChainID(chainID)
+	return nil
+}
@@ -0,0 +1,302 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/stretchr/testify/assert"
+
+	"x-swap/internal/utils"
+)
+
+func setupWithdrawals(t *testing.T) (*testChain, *WithdrawalService, Token) {
+	setup()
+	hotWallet, err := crypto.GenerateKey()
+	assert.Nil(t, err)
+	chain := newTestChain(t, crypto.PubkeyToAddress(hotWallet.PublicKey))
+	tokenAddress := chain.deployToken(t, 6)
+
+	chainID, err := chain.client.ChainID(context.Background())
+	assert.Nil(t, err)
+	tokenRegistry := NewTokenRegistry()
+	serviceRegistry.SetTokenRegistry(tokenRegistry)
+	token, err := tokenRegistry.RegisterToken("USDC", chainID.Uint64(), tokenAddress, 6)
+	assert.Nil(t, err)
+
+	withdrawalService := NewWithdrawalService(chain.client, hotWallet)
+	withdrawalService.SetServiceRegistry(serviceRegistry)
+	withdrawalService.SetConfirmations(2)
+	serviceRegistry.SetWithdrawalService(withdrawalService)
+	chain.mint(t, tokenAddress, withdrawalService.HotWalletAddress(), big.NewInt(1_000e6))
+	return chain, withdrawalService, token
+}
+
+func TestWithdrawalConfirmed(t *testing.T) {
+	chain, withdrawalService, token := setupWithdrawals(t)
+	topup(users[0], big.NewInt(500e6), "USDC")
+	recipients := []common.Address{utils.GenerateRandomAddress(), utils.GenerateRandomAddress()}
+
+	_, err := withdrawalService.RequestWithdrawal(users[0], "USDC", recipients[0], big.NewInt(600e6))
+	assert.ErrorContains(t, err, "insufficient USDC balance")
+
+	first, err := withdrawalService.RequestWithdrawal(users[0], "USDC", recipients[0], big.NewInt(300e6))
+	assert.Nil(t, err)
+	second, err := withdrawalService.RequestWithdrawal(users[0], "USDC", recipients[1], big.NewInt(200e6))
+	assert.Nil(t, err)
+	assert.Equal(t, first.Status, WithdrawalPending)
+	assert.Equal(t, userService.GetAssetAmount(users[0], "USDC").String(), "0")
+
+	assert.Nil(t, withdrawalService.ProcessWithdrawals())
+	withdrawals := withdrawalService.GetWithdrawals(users[0])
+	assert.Equal(t, withdrawals[0].Status, WithdrawalBroadcast)
+	assert.Equal(t, withdrawals[0].Nonce, uint64(0))
+	assert.Equal(t, withdrawals[1].Nonce, uint64(1))
+
+	chain.backend.Commit()
+	assert.Nil(t, withdrawalService.ProcessWithdrawals())
+	withdrawal, err := withdrawalService.GetWithdrawal(second.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, withdrawal.Status, WithdrawalBroadcast)
+
+	chain.backend.Commit()
+	assert.Nil(t, withdrawalService.ProcessWithdrawals())
+	for _, withdrawal := range withdrawalService.GetWithdrawals(users[0]) {
+		assert.Equal(t, withdrawal.Status, WithdrawalConfirmed)
+	}
+	assert.Equal(t, chain.tokenBalance(t, token.Address, recipients[0]), big.NewInt(300e6))
+	assert.Equal(t, chain.tokenBalance(t, token.Address, recipients[1]), big.NewInt(200e6))
+	assert.Equal(t, userService.GetAssetAmount(users[0], "USDC").String(), "0")
+}
+
+func TestWithdrawalChainIDLoadedOnce(t *testing.T) {
+	_, withdrawalService, _ := setupWithdrawals(t)
+	topup(users[0], big.NewInt(500e6), "USDC")
+	// requests and the processing loop both load the chain ID on first use
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Nil(t, withdrawalService.ProcessWithdrawals())
+	}()
+	_, err := withdrawalService.RequestWithdrawal(users[0], "USDC", utils.GenerateRandomAddress(), big.NewInt(100e6))
+	assert.Nil(t, err)
+	wg.Wait()
+}
+
+func TestWithdrawalFailureIsRefunded(t *testing.T) {
+	chain, withdrawalService, _ := setupWithdrawals(t)
+	topup(users[0], big.NewInt(5_000e6), "USDC")
+
+	// the hot wallet only holds 1,000 USDC, so the transfer would revert
+	withdrawal, err := withdrawalService.RequestWithdrawal(users[0], "USDC", utils.GenerateRandomAddress(), big.NewInt(2_000e6))
+	assert.Nil(t, err)
+	assert.Equal(t, userService.GetAssetAmount(users[0], "USDC"), big.NewInt(3_000e6))
+
+	assert.Nil(t, withdrawalService.ProcessWithdrawals())
+	failed, err := withdrawalService.GetWithdrawal(withdrawal.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, failed.Status, WithdrawalFailed)
+	assert.Equal(t, userService.GetAssetAmount(users[0], "USDC"), big.NewInt(5_000e6))
+
+	// the failed withdrawal did not consume a nonce
+	next, err := withdrawalService.RequestWithdrawal(users[0], "USDC", utils.GenerateRandomAddress(), big.NewInt(100e6))
+	assert.Nil(t, err)
+	assert.Nil(t, withdrawalService.ProcessWithdrawals())
+	chain.backend.Commit()
+	chain.backend.Commit()
+	assert.Nil(t, withdrawalService.ProcessWithdrawals())
+	confirmed, err := withdrawalService.GetWithdrawal(next.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, confirmed.Nonce, uint64(0))
+	assert.Equal(t, confirmed.Status, WithdrawalConfirmed)
+}
+
+// unreliableClient loses some calls on their way to the chain. Gas estimates
+// and sends fail with connectivity errors, and dropped transactions are
+// reported as sent without ever reaching the chain.
+type unreliableClient struct {
+	WithdrawalClient
+	estimateErrors int
+	sendErrors     int
+	dropNext       bool
+	dropped        map[common.Hash]bool
+}
+
+func newUnreliableClient(client WithdrawalClient) *unreliableClient {
+	return &unreliableClient{WithdrawalClient: client, dropped: make(map[common.Hash]bool)}
+}
+
+func (client *unreliableClient) EstimateGas(ctx context.Context, call ethereum.CallMsg) (uint64, error) {
+	if client.estimateErrors > 0 {
+		client.estimateErrors--
+		return 0, errors.New("connection refused")
+	}
+	return client.WithdrawalClient.EstimateGas(ctx, call)
+}
+
+func (client *unreliableClient) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	if client.dropNext {
+		client.dropNext = false
+		client.dropped[tx.Hash()] = true
+	}
+	if client.dropped[tx.Hash()] {
+		return nil
+	}
+	if client.sendErrors > 0 {
+		client.sendErrors--
+		return errors.New("i/o timeout")
+	}
+	return client.WithdrawalClient.SendTransaction(ctx, tx)
+}
+
+func TestWithdrawalSendErrorsAreNotRefunded(t *testing.T) {
+	chain, withdrawalService, token := setupWithdrawals(t)
+	client := newUnreliableClient(chain.client)
+	client.estimateErrors = 1
+	client.sendErrors = 1
+	withdrawalService.client = client
+	topup(users[0], big.NewInt(500e6), "USDC")
+	recipient := utils.GenerateRandomAddress()
+	withdrawal, err := withdrawalService.RequestWithdrawal(users[0], "USDC", recipient, big.NewInt(100e6))
+	assert.Nil(t, err)
+
+	// a gas estimate lost on the way is retried
+	assert.ErrorContains(t, withdrawalService.ProcessWithdrawals(), "connection refused")
+	pending, err := withdrawalService.GetWithdrawal(withdrawal.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, pending.Status, WithdrawalPending)
+
+	// the transaction may have reached the network, so it is not refunded
+	assert.Nil(t, withdrawalService.ProcessWithdrawals())
+	broadcast, err := withdrawalService.GetWithdrawal(withdrawal.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, broadcast.Status, WithdrawalBroadcast)
+	assert.Equal(t, userService.GetAssetAmount(users[0], "USDC"), big.NewInt(400e6))
+
+	// it is sent again until it is mined
+	assert.Nil(t, withdrawalService.ProcessWithdrawals())
+	chain.backend.Commit()
+	chain.backend.Commit()
+	assert.Nil(t, withdrawalService.ProcessWithdrawals())
+	confirmed, err := withdrawalService.GetWithdrawal(withdrawal.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, confirmed.Status, WithdrawalConfirmed)
+	assert.Equal(t, confirmed.TxHash, broadcast.TxHash)
+	assert.Equal(t, chain.tokenBalance(t, token.Address, recipient), big.NewInt(100e6))
+	assert.Equal(t, userService.GetAssetAmount(users[0], "USDC"), big.NewInt(400e6))
+}
+
+func TestStuckWithdrawalIsReplaced(t *testing.T) {
+	chain, withdrawalService, token := setupWithdrawals(t)
+	client := newUnreliableClient(chain.client)
+	client.dropNext = true
+	withdrawalService.client = client
+	withdrawalService.SetReplaceAfter(2)
+	topup(users[0], big.NewInt(500e6), "USDC")
+	recipient := utils.GenerateRandomAddress()
+	withdrawal, err := withdrawalService.RequestWithdrawal(users[0], "USDC", recipient, big.NewInt(100e6))
+	assert.Nil(t, err)
+
+	assert.Nil(t, withdrawalService.ProcessWithdrawals())
+	stuck, err := withdrawalService.GetWithdrawal(withdrawal.ID)
+	assert.Nil(t, err)
+	chain.backend.Commit()
+	assert.Nil(t, withdrawalService.ProcessWithdrawals())
+	chain.backend.Commit()
+	assert.Nil(t, withdrawalService.ProcessWithdrawals())
+	replaced, err := withdrawalService.GetWithdrawal(withdrawal.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, replaced.Status, WithdrawalBroadcast)
+	assert.Equal(t, replaced.Nonce, stuck.Nonce)
+	assert.Equal(t, replaced.TxHashes, []common.Hash{stuck.TxHash, replaced.TxHash})
+	assert.Equal(t, replaced.tx.GasTipCap().Cmp(stuck.tx.GasTipCap()), 1)
+
+	chain.backend.Commit()
+	chain.backend.Commit()
+	assert.Nil(t, withdrawalService.ProcessWithdrawals())
+	confirmed, err := withdrawalService.GetWithdrawal(withdrawal.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, confirmed.Status, WithdrawalConfirmed)
+	assert.Equal(t, confirmed.TxHash, replaced.TxHash)
+	assert.Equal(t, chain.tokenBalance(t, token.Address, recipient), big.NewInt(100e6))
+}
+
+func TestWithdrawalRefundedWhenNonceUsedElsewhere(t *testing.T) {
+	chain, withdrawalService, token := setupWithdrawals(t)
+	client := newUnreliableClient(chain.client)
+	client.dropNext = true
+	withdrawalService.client = client
+	topup(users[0], big.NewInt(500e6), "USDC")
+	recipient := utils.GenerateRandomAddress()
+	withdrawal, err := withdrawalService.RequestWithdrawal(users[0], "USDC", recipient, big.NewInt(100e6))
+	assert.Nil(t, err)
+	assert.Nil(t, withdrawalService.ProcessWithdrawals())
+	broadcast, err := withdrawalService.GetWithdrawal(withdrawal.ID)
+	assert.Nil(t, err)
+
+	// another transaction of the hot wallet takes the withdrawal's nonce
+	ctx := context.Background()
+	chainID, err := chain.client.ChainID(ctx)
+	assert.Nil(t, err)
+	head, err := chain.client.HeaderByNumber(ctx, nil)
+	assert.Nil(t, err)
+	tx, err := types.SignNewTx(withdrawalService.hotWallet, types.LatestSignerForChainID(chainID), &types.DynamicFeeTx{
+		ChainID:   chainID,
+		Nonce:     broadcast.Nonce,
+		GasTipCap: big.NewInt(params.GWei),
+		GasFeeCap: new(big.Int).Add(new(big.Int).Mul(head.BaseFee, big.NewInt(2)), big.NewInt(params.GWei)),
+		Gas:       21_000,
+		To:        &recipient,
+		Value:     big.NewInt(0),
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, chain.client.SendTransaction(ctx, tx))
+	chain.backend.Commit()
+	chain.backend.Commit()
+
+	assert.Nil(t, withdrawalService.ProcessWithdrawals())
+	failed, err := withdrawalService.GetWithdrawal(withdrawal.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, failed.Status, WithdrawalFailed)
+	assert.Equal(t, userService.GetAssetAmount(users[0], "USDC"), big.NewInt(500e6))
+	assert.Equal(t, chain.tokenBalance(t, token.Address, recipient).String(), "0")
+}
+
+func TestNativeWithdrawalIsValueTransfer(t *testing.T) {
+	chain, withdrawalService, _ := setupWithdrawals(t)
+	chainID, err := chain.client.ChainID(context.Background())
+	assert.Nil(t, err)
+	tokenRegistry, err := serviceRegistry.GetTokenRegistry()
+	assert.Nil(t, err)
+	_, err = tokenRegistry.RegisterToken("ETH", chainID.Uint64(), NativeTokenAddress, 18)
+	assert.Nil(t, err)
+	topup(users[0], big.NewInt(2*params.Ether), "ETH")
+
+	recipient := utils.GenerateRandomAddress()
+	withdrawal, err := withdrawalService.RequestWithdrawal(users[0], "ETH", recipient, big.NewInt(params.Ether))
+	assert.Nil(t, err)
+	assert.Nil(t, withdrawalService.ProcessWithdrawals())
+	chain.backend.Commit()
+	chain.backend.Commit()
+	assert.Nil(t, withdrawalService.ProcessWithdrawals())
+
+	confirmed, err := withdrawalService.GetWithdrawal(withdrawal.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, confirmed.Status, WithdrawalConfirmed)
+	tx, _, err := chain.client.TransactionByHash(context.Background(), confirmed.TxHash)
+	assert.Nil(t, err)
+	assert.Equal(t, *tx.To(), recipient)
+	assert.Equal(t, len(tx.Data()), 0)
+	balance, err := chain.client.BalanceAt(context.Background(), recipient, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, balance, big.NewInt(params.Ether))
+	assert.Equal(t, userService.GetAssetAmount(users[0], "ETH"), big.NewInt(params.Ether))
+}